@@ -0,0 +1,353 @@
+// Package bench measures the storage level operations of unistore on an in-process cluster, so the options of the
+// engine, the regions and the batches can be compared. Every run starts a new cluster with sequentially allocated
+// ts and deterministic keys, the results of the same options are reproducible on the same machine.
+package bench
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/ngaut/faketikv/testutil"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"golang.org/x/net/context"
+)
+
+// Options is the configuration of a run.
+type Options struct {
+	// Name is the name of the options in the report.
+	Name string
+	// Regions is the number of regions the table key space is split into. The latches are per region, so it also
+	// decides how the latches are shared.
+	Regions int
+	// Keys is the number of keys loaded before PointGet and Scan.
+	Keys int
+	// ValueSize is the size of the values written.
+	ValueSize int
+	// BatchSize is the number of keys written by a BatchWrite transaction, deleted by a DeleteRange and loaded by a
+	// transaction of the preparation.
+	BatchSize int
+	// ScanLimit is the limit of a Scan.
+	ScanLimit int
+	// HotKeys is the number of keys ContendedCommit writes to.
+	HotKeys int
+	// Concurrency is the number of goroutines running the operations.
+	Concurrency int
+	// SyncWrites makes badger sync every write to disk.
+	SyncWrites bool
+	// ValueThreshold is the size of the values badger stores in the value log, 0 means the default of badger.
+	ValueThreshold int
+	// LogicalDeleteRange makes DeleteRange write a range tombstone.
+	LogicalDeleteRange bool
+}
+
+// DefaultOptions is the baseline of the comparisons.
+var DefaultOptions = Options{
+	Name:        "default",
+	Regions:     4,
+	Keys:        10000,
+	ValueSize:   128,
+	BatchSize:   16,
+	ScanLimit:   100,
+	HotKeys:     8,
+	Concurrency: 8,
+}
+
+// Matrix returns DefaultOptions and its variations of one option each.
+func Matrix() []Options {
+	variant := func(name string, change func(o *Options)) Options {
+		o := DefaultOptions
+		o.Name = name
+		change(&o)
+		return o
+	}
+	return []Options{
+		DefaultOptions,
+		variant("1-region", func(o *Options) { o.Regions = 1 }),
+		variant("16-regions", func(o *Options) { o.Regions = 16 }),
+		variant("batch-1", func(o *Options) { o.BatchSize = 1 }),
+		variant("batch-256", func(o *Options) { o.BatchSize = 256 }),
+		variant("sync-writes", func(o *Options) { o.SyncWrites = true }),
+		variant("value-threshold-32", func(o *Options) { o.ValueThreshold = 32 }),
+		variant("logical-delete-range", func(o *Options) { o.LogicalDeleteRange = true }),
+	}
+}
+
+// Workload is a kind of operation to measure.
+type Workload struct {
+	Name    string
+	prepare func(e *env) error
+	// run runs the i-th operation and returns the time of the measured part.
+	run func(e *env, i int) (time.Duration, error)
+	// conflicts are counted instead of failing the run.
+	conflicts bool
+}
+
+// The workloads.
+var (
+	PointGet        = Workload{Name: "point-get", prepare: loadKeys, run: runPointGet}
+	BatchWrite      = Workload{Name: "batch-write", run: runBatchWrite}
+	Scan            = Workload{Name: "scan", prepare: loadKeys, run: runScan}
+	ContendedCommit = Workload{Name: "contended-commit", run: runContendedCommit, conflicts: true}
+	DeleteRange     = Workload{Name: "delete-range", run: runDeleteRange}
+)
+
+// Workloads are all the workloads.
+var Workloads = []Workload{PointGet, BatchWrite, Scan, ContendedCommit, DeleteRange}
+
+// Result is the measurement of a run.
+type Result struct {
+	Options  string
+	Workload string
+	Ops      int
+	// Conflicts is the number of ContendedCommit transactions failed by the write conflicts.
+	Conflicts int64
+	// Elapsed is the wall time of the operations.
+	Elapsed    time.Duration
+	OpsPerSec  float64
+	AvgLatency time.Duration
+	P99Latency time.Duration
+}
+
+type env struct {
+	opts Options
+	c    *testutil.Cluster
+	val  []byte
+}
+
+// Run starts a cluster of the options, prepares the data of the workload and runs ops operations of it.
+func Run(opts Options, w Workload, ops int) (Result, error) {
+	for _, n := range []*int{&opts.Regions, &opts.Keys, &opts.BatchSize, &opts.HotKeys, &opts.Concurrency} {
+		if *n <= 0 {
+			*n = 1
+		}
+	}
+	c, err := testutil.NewCluster(testutil.Options{
+		SplitKeys:      tableSplitKeys(opts.Regions),
+		SyncWrites:     opts.SyncWrites,
+		ValueThreshold: opts.ValueThreshold,
+	})
+	if err != nil {
+		return Result{}, err
+	}
+	defer c.Close()
+	c.Store.LogicalDeleteRange = opts.LogicalDeleteRange
+	e := &env{opts: opts, c: c, val: make([]byte, opts.ValueSize)}
+	if w.prepare != nil {
+		if err = w.prepare(e); err != nil {
+			return Result{}, errors.Annotatef(err, "prepare %s", w.Name)
+		}
+	}
+	var (
+		next      int64 = -1
+		conflicts int64
+		mu        sync.Mutex
+		firstErr  error
+		latencies = make([]time.Duration, 0, ops)
+		wg        sync.WaitGroup
+	)
+	start := time.Now()
+	for g := 0; g < opts.Concurrency; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var local []time.Duration
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= ops {
+					break
+				}
+				d, err := w.run(e, i)
+				if err != nil && w.conflicts {
+					atomic.AddInt64(&conflicts, 1)
+				} else if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = errors.Annotatef(err, "%s op %d", w.Name, i)
+					}
+					mu.Unlock()
+					return
+				}
+				local = append(local, d)
+			}
+			mu.Lock()
+			latencies = append(latencies, local...)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	if firstErr != nil {
+		return Result{}, firstErr
+	}
+	res := Result{Options: opts.Name, Workload: w.Name, Ops: ops, Conflicts: conflicts, Elapsed: elapsed}
+	if elapsed > 0 {
+		res.OpsPerSec = float64(ops) / elapsed.Seconds()
+	}
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		var total time.Duration
+		for _, d := range latencies {
+			total += d
+		}
+		res.AvgLatency = total / time.Duration(len(latencies))
+		res.P99Latency = latencies[(len(latencies)-1)*99/100]
+	}
+	return res, nil
+}
+
+// WriteReport writes the results grouped by workload, the throughput of each options is compared to the first
+// options of the workload.
+func WriteReport(w io.Writer, results []Result) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "workload\toptions\tops\tops/s\tvs base\tavg\tp99\tconflicts\t")
+	base := make(map[string]float64)
+	for _, r := range results {
+		if _, ok := base[r.Workload]; !ok {
+			base[r.Workload] = r.OpsPerSec
+		}
+		ratio := math.NaN()
+		if b := base[r.Workload]; b > 0 {
+			ratio = r.OpsPerSec / b
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%.0f\t%.2fx\t%s\t%s\t%d\t\n", r.Workload, r.Options, r.Ops, r.OpsPerSec, ratio,
+			r.AvgLatency, r.P99Latency, r.Conflicts)
+	}
+	return tw.Flush()
+}
+
+// tableSplitKeys splits the table key space ['t', 'u') evenly into n regions, the keys out of it are in the regions
+// that are not MVCC regions.
+func tableSplitKeys(n int) [][]byte {
+	keys := [][]byte{{'t'}}
+	for _, k := range testutil.EvenSplitKeys(n) {
+		keys = append(keys, append([]byte{'t'}, k...))
+	}
+	return append(keys, []byte{'u'})
+}
+
+// tableKey returns the n-th of total keys spread evenly over the table key space, with the optional suffixes.
+func tableKey(n, total int, suffixes ...uint64) []byte {
+	key := make([]byte, 9+8*len(suffixes))
+	key[0] = 't'
+	binary.BigEndian.PutUint64(key[1:], uint64(n)*(math.MaxUint64/uint64(total)))
+	for i, s := range suffixes {
+		binary.BigEndian.PutUint64(key[9+8*i:], s)
+	}
+	return key
+}
+
+func loadKeys(e *env) error {
+	batch := e.opts.BatchSize
+	for i := 0; i < e.opts.Keys; i += batch {
+		txn := e.c.Begin()
+		for j := i; j < i+batch && j < e.opts.Keys; j++ {
+			txn.Set(tableKey(j, e.opts.Keys), e.val)
+		}
+		if _, err := txn.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runPointGet(e *env, i int) (time.Duration, error) {
+	key := tableKey(i%e.opts.Keys, e.opts.Keys)
+	ts := e.c.AllocTS()
+	start := time.Now()
+	val, err := e.c.Get(key, ts)
+	d := time.Since(start)
+	if err == nil && len(val) != e.opts.ValueSize {
+		err = errors.Errorf("key %q not found", key)
+	}
+	return d, err
+}
+
+func runBatchWrite(e *env, i int) (time.Duration, error) {
+	start := time.Now()
+	txn := e.c.Begin()
+	for j := 0; j < e.opts.BatchSize; j++ {
+		txn.Set(tableKey(j, e.opts.BatchSize, uint64(i)), e.val)
+	}
+	_, err := txn.Commit()
+	return time.Since(start), err
+}
+
+func runScan(e *env, i int) (time.Duration, error) {
+	startKey := tableKey(i%e.opts.Keys, e.opts.Keys)
+	ctx, err := e.c.Context(startKey)
+	if err != nil {
+		return 0, err
+	}
+	ts := e.c.AllocTS()
+	start := time.Now()
+	resp, err := e.c.Server.KvScan(context.Background(), &kvrpcpb.ScanRequest{
+		Context:  ctx,
+		StartKey: startKey,
+		Limit:    uint32(e.opts.ScanLimit),
+		Version:  ts,
+	})
+	d := time.Since(start)
+	if err != nil {
+		return d, errors.Trace(err)
+	}
+	if resp.RegionError != nil {
+		return d, errors.Errorf("region error: %s", resp.RegionError)
+	}
+	return d, nil
+}
+
+func runContendedCommit(e *env, i int) (time.Duration, error) {
+	start := time.Now()
+	txn := e.c.Begin()
+	txn.Set(tableKey(i%e.opts.HotKeys, e.opts.HotKeys), e.val)
+	txn.Set(tableKey((i+1)%e.opts.HotKeys, e.opts.HotKeys), e.val)
+	if err := txn.Prewrite(); err != nil {
+		txn.Rollback()
+		return time.Since(start), err
+	}
+	err := txn.CommitAt(e.c.AllocTS())
+	return time.Since(start), err
+}
+
+// runDeleteRange writes BatchSize keys in a range of a region and deletes the range, only the delete is measured.
+func runDeleteRange(e *env, i int) (time.Duration, error) {
+	regions := e.opts.Regions
+	startKey := tableKey(i%regions, regions, uint64(i))
+	endKey := tableKey(i%regions, regions, uint64(i)+1)
+	txn := e.c.Begin()
+	for j := 0; j < e.opts.BatchSize; j++ {
+		txn.Set(tableKey(i%regions, regions, uint64(i), uint64(j)), e.val)
+	}
+	if _, err := txn.Commit(); err != nil {
+		return 0, err
+	}
+	ctx, err := e.c.Context(startKey)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	resp, err := e.c.Server.KvDeleteRange(context.Background(), &kvrpcpb.DeleteRangeRequest{
+		Context:  ctx,
+		StartKey: startKey,
+		EndKey:   endKey,
+	})
+	d := time.Since(start)
+	if err != nil {
+		return d, errors.Trace(err)
+	}
+	if resp.RegionError != nil {
+		return d, errors.Errorf("region error: %s", resp.RegionError)
+	}
+	if resp.Error != "" {
+		return d, errors.New(resp.Error)
+	}
+	return d, nil
+}
@@ -0,0 +1,34 @@
+package bench_test
+
+import (
+	"testing"
+
+	"github.com/ngaut/faketikv/bench"
+)
+
+func runBenchmark(b *testing.B, w bench.Workload) {
+	for _, opts := range bench.Matrix() {
+		b.Run(opts.Name, func(b *testing.B) {
+			res, err := bench.Run(opts, w, b.N)
+			if err != nil {
+				b.Fatal(err)
+			}
+			// The setup of the cluster is excluded from the metrics.
+			b.ReportMetric(float64(res.Elapsed.Nanoseconds())/float64(b.N), "wall-ns/op")
+			b.ReportMetric(float64(res.P99Latency.Nanoseconds()), "p99-ns")
+			if res.Conflicts > 0 {
+				b.ReportMetric(float64(res.Conflicts)/float64(b.N), "conflicts/op")
+			}
+		})
+	}
+}
+
+func BenchmarkPointGet(b *testing.B) { runBenchmark(b, bench.PointGet) }
+
+func BenchmarkBatchWrite(b *testing.B) { runBenchmark(b, bench.BatchWrite) }
+
+func BenchmarkScan(b *testing.B) { runBenchmark(b, bench.Scan) }
+
+func BenchmarkContendedCommit(b *testing.B) { runBenchmark(b, bench.ContendedCommit) }
+
+func BenchmarkDeleteRange(b *testing.B) { runBenchmark(b, bench.DeleteRange) }
@@ -0,0 +1,88 @@
+// The bench command runs the workloads of package bench on the options matrix or the options of the flags, and
+// writes the comparison report.
+package main
+
+import (
+	"flag"
+	"os"
+	"strings"
+
+	"github.com/ngaut/faketikv/bench"
+	"github.com/ngaut/faketikv/logutil"
+)
+
+var (
+	workloads   = flag.String("workloads", "", "Comma separated workloads to run, all the workloads if it's empty.")
+	ops         = flag.Int("ops", 10000, "Number of operations of a run.")
+	matrix      = flag.Bool("matrix", true, "Compare the options matrix, the options of the flags are run if it's false.")
+	regions     = flag.Int("regions", bench.DefaultOptions.Regions, "Number of regions.")
+	keys        = flag.Int("keys", bench.DefaultOptions.Keys, "Number of keys loaded for point-get and scan.")
+	valueSize   = flag.Int("value-size", bench.DefaultOptions.ValueSize, "Size of the values.")
+	batchSize   = flag.Int("batch-size", bench.DefaultOptions.BatchSize, "Keys of a batch write or a delete range.")
+	scanLimit   = flag.Int("scan-limit", bench.DefaultOptions.ScanLimit, "Limit of a scan.")
+	hotKeys     = flag.Int("hot-keys", bench.DefaultOptions.HotKeys, "Number of keys written by contended-commit.")
+	concurrency = flag.Int("concurrency", bench.DefaultOptions.Concurrency, "Number of concurrent operations.")
+	syncWrites  = flag.Bool("sync-writes", false, "Sync every badger write.")
+	valueThres  = flag.Int("value-threshold", 0, "Badger value threshold, 0 means the default.")
+	logicalDel  = flag.Bool("logical-delete-range", false, "Delete ranges by range tombstones.")
+	logLevel    = flag.String("L", "warn", "Log level: info, debug, warn, error, fatal.")
+)
+
+var log = logutil.Module("bench")
+
+func main() {
+	flag.Parse()
+	if err := logutil.Init(logutil.Config{Level: *logLevel}); err != nil {
+		log.Fatal(err)
+	}
+	options := bench.Matrix()
+	if !*matrix {
+		options = []bench.Options{{
+			Name:               "flags",
+			Regions:            *regions,
+			Keys:               *keys,
+			ValueSize:          *valueSize,
+			BatchSize:          *batchSize,
+			ScanLimit:          *scanLimit,
+			HotKeys:            *hotKeys,
+			Concurrency:        *concurrency,
+			SyncWrites:         *syncWrites,
+			ValueThreshold:     *valueThres,
+			LogicalDeleteRange: *logicalDel,
+		}}
+	}
+	var results []bench.Result
+	for _, w := range selectWorkloads() {
+		for _, opts := range options {
+			res, err := bench.Run(opts, w, *ops)
+			if err != nil {
+				log.Fatalf("%s %s: %v", w.Name, opts.Name, err)
+			}
+			log.Infof("%s %s: %.0f ops/s", w.Name, opts.Name, res.OpsPerSec)
+			results = append(results, res)
+		}
+	}
+	if err := bench.WriteReport(os.Stdout, results); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func selectWorkloads() []bench.Workload {
+	if *workloads == "" {
+		return bench.Workloads
+	}
+	var selected []bench.Workload
+	for _, name := range strings.Split(*workloads, ",") {
+		var found bool
+		for _, w := range bench.Workloads {
+			if w.Name == strings.TrimSpace(name) {
+				selected = append(selected, w)
+				found = true
+			}
+		}
+		if !found {
+			log.Fatalf("unknown workload %q", name)
+		}
+	}
+	return selected
+}
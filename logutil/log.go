@@ -0,0 +1,261 @@
+// Package logutil is the logging backend of unistore. It writes text or structured JSON logs to stderr or a rotated
+// file, with levels configurable per module. A module is a package or a file of a package, like "tikv" or "tikv/gc".
+package logutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// Level is the severity of a log.
+type Level int32
+
+// The log levels.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+	LevelFatal
+)
+
+var levelNames = []string{"debug", "info", "warn", "error", "fatal"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelFatal {
+		return fmt.Sprintf("level(%d)", l)
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses the level name, "warning" is accepted for warn.
+func ParseLevel(name string) (Level, error) {
+	name = strings.ToLower(name)
+	if name == "warning" {
+		return LevelWarn, nil
+	}
+	for i, n := range levelNames {
+		if n == name {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, errors.Errorf("unknown log level %q", name)
+}
+
+// Logger is the logging interface used by the packages of unistore.
+type Logger interface {
+	Debug(args ...interface{})
+	Debugf(format string, args ...interface{})
+	Info(args ...interface{})
+	Infof(format string, args ...interface{})
+	Warn(args ...interface{})
+	Warnf(format string, args ...interface{})
+	Error(args ...interface{})
+	Errorf(format string, args ...interface{})
+	// Fatal and Fatalf exit the process after writing the log.
+	Fatal(args ...interface{})
+	Fatalf(format string, args ...interface{})
+}
+
+// Format is the output format of the logs.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Config is the configuration of the logging backend.
+type Config struct {
+	// Level is the default level, info if it's empty.
+	Level string
+	// ModuleLevels overrides the level of the modules, a file module takes precedence over its package.
+	ModuleLevels map[string]string
+	// Format is FormatText or FormatJSON, FormatText if it's empty.
+	Format string
+	// File is the path of the log file, the logs are written to stderr if it's empty.
+	File string
+	// MaxSize is the size in bytes to rotate the log file at, 0 means no limit.
+	MaxSize int64
+	// MaxAge is the time to rotate the log file after, 0 means no limit.
+	MaxAge time.Duration
+	// MaxBackups is the number of rotated files to keep, 0 means keeping all of them.
+	MaxBackups int
+}
+
+// ParseModuleLevels parses the module levels in the form of "tikv/gc=debug,tikv=warn".
+func ParseModuleLevels(s string) (map[string]string, error) {
+	levels := make(map[string]string)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, errors.Errorf("invalid module level %q", item)
+		}
+		levels[kv[0]] = kv[1]
+	}
+	return levels, nil
+}
+
+type backend struct {
+	mu           sync.Mutex
+	out          io.Writer
+	closer       io.Closer
+	json         bool
+	level        Level
+	moduleLevels map[string]Level
+}
+
+var current atomic.Value
+
+func init() {
+	current.Store(&backend{out: os.Stderr, level: LevelInfo})
+}
+
+// Init replaces the logging backend by the configured one, the previous log file is closed.
+func Init(cfg Config) error {
+	b := &backend{out: os.Stderr, level: LevelInfo, moduleLevels: make(map[string]Level)}
+	var err error
+	if cfg.Level != "" {
+		if b.level, err = ParseLevel(cfg.Level); err != nil {
+			return err
+		}
+	}
+	for module, name := range cfg.ModuleLevels {
+		if b.moduleLevels[module], err = ParseLevel(name); err != nil {
+			return err
+		}
+	}
+	switch cfg.Format {
+	case "", FormatText:
+	case FormatJSON:
+		b.json = true
+	default:
+		return errors.Errorf("unknown log format %q", cfg.Format)
+	}
+	if cfg.File != "" {
+		f, err := newRotatingFile(cfg.File, cfg.MaxSize, cfg.MaxAge, cfg.MaxBackups)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		b.out, b.closer = f, f
+	}
+	old := current.Load().(*backend)
+	current.Store(b)
+	if old.closer != nil {
+		old.mu.Lock()
+		old.closer.Close()
+		old.mu.Unlock()
+	}
+	return nil
+}
+
+// SetLevel sets the default level.
+func SetLevel(level Level) {
+	b := current.Load().(*backend)
+	atomic.StoreInt32((*int32)(&b.level), int32(level))
+}
+
+type moduleLogger struct {
+	pkg string
+}
+
+// Module returns the Logger of the package, each log is attributed to the file module of its caller.
+func Module(pkg string) Logger {
+	return moduleLogger{pkg: pkg}
+}
+
+// callerDepth is the depth of the caller of a Logger method from output.
+const callerDepth = 2
+
+func (l moduleLogger) output(level Level, msg string) {
+	b := current.Load().(*backend)
+	_, file, line, ok := runtime.Caller(callerDepth)
+	fileName := "???"
+	module := l.pkg
+	if ok {
+		fileName = filepath.Base(file)
+		module = l.pkg + "/" + strings.TrimSuffix(fileName, ".go")
+	}
+	if level < b.levelOf(l.pkg, module) {
+		return
+	}
+	now := time.Now()
+	var data []byte
+	if b.json {
+		data, _ = json.Marshal(struct {
+			Time   string `json:"time"`
+			Level  string `json:"level"`
+			Module string `json:"module"`
+			Caller string `json:"caller"`
+			Msg    string `json:"msg"`
+		}{
+			Time:   now.Format(time.RFC3339Nano),
+			Level:  level.String(),
+			Module: module,
+			Caller: fmt.Sprintf("%s:%d", fileName, line),
+			Msg:    msg,
+		})
+		data = append(data, '\n')
+	} else {
+		data = []byte(fmt.Sprintf("%s %s:%d: [%s] %s\n", now.Format("2006/01/02 15:04:05.000000"), fileName, line,
+			level, strings.TrimSuffix(msg, "\n")))
+	}
+	b.mu.Lock()
+	b.out.Write(data)
+	b.mu.Unlock()
+	if level == LevelFatal {
+		os.Exit(1)
+	}
+}
+
+func (b *backend) levelOf(pkg, module string) Level {
+	if level, ok := b.moduleLevels[module]; ok {
+		return level
+	}
+	if level, ok := b.moduleLevels[pkg]; ok {
+		return level
+	}
+	return Level(atomic.LoadInt32((*int32)(&b.level)))
+}
+
+func (l moduleLogger) Debug(args ...interface{}) { l.output(LevelDebug, fmt.Sprint(args...)) }
+
+func (l moduleLogger) Debugf(format string, args ...interface{}) {
+	l.output(LevelDebug, fmt.Sprintf(format, args...))
+}
+
+func (l moduleLogger) Info(args ...interface{}) { l.output(LevelInfo, fmt.Sprint(args...)) }
+
+func (l moduleLogger) Infof(format string, args ...interface{}) {
+	l.output(LevelInfo, fmt.Sprintf(format, args...))
+}
+
+func (l moduleLogger) Warn(args ...interface{}) { l.output(LevelWarn, fmt.Sprint(args...)) }
+
+func (l moduleLogger) Warnf(format string, args ...interface{}) {
+	l.output(LevelWarn, fmt.Sprintf(format, args...))
+}
+
+func (l moduleLogger) Error(args ...interface{}) { l.output(LevelError, fmt.Sprint(args...)) }
+
+func (l moduleLogger) Errorf(format string, args ...interface{}) {
+	l.output(LevelError, fmt.Sprintf(format, args...))
+}
+
+func (l moduleLogger) Fatal(args ...interface{}) { l.output(LevelFatal, fmt.Sprint(args...)) }
+
+func (l moduleLogger) Fatalf(format string, args ...interface{}) {
+	l.output(LevelFatal, fmt.Sprintf(format, args...))
+}
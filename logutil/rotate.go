@@ -0,0 +1,116 @@
+package logutil
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// backupTimeFormat is the suffix of the rotated files, it sorts in time order.
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// rotatingFile is a log file renamed with the rotation time suffix and reopened when it's larger than maxSize or
+// older than maxAge. It's not safe for concurrent use, the backend serializes the writes.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	f       *os.File
+	size    int64
+	created time.Time
+}
+
+func newRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*rotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, errors.Trace(err)
+	}
+	r := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Trace(err)
+	}
+	r.f, r.size, r.created = f, info.Size(), time.Now()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	if r.shouldRotate(len(p)) {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) shouldRotate(n int) bool {
+	if r.size == 0 {
+		return false
+	}
+	if r.maxSize > 0 && r.size+int64(n) > r.maxSize {
+		return true
+	}
+	return r.maxAge > 0 && time.Since(r.created) >= r.maxAge
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return errors.Trace(err)
+	}
+	backup := r.path + "." + time.Now().Format(backupTimeFormat)
+	if err := os.Rename(r.path, backup); err != nil {
+		return errors.Trace(err)
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	r.removeOldBackups()
+	return nil
+}
+
+// removeOldBackups keeps the latest maxBackups rotated files.
+func (r *rotatingFile) removeOldBackups() {
+	if r.maxBackups <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(r.path + ".*")
+	if err != nil {
+		return
+	}
+	var names []string
+	for _, name := range backups {
+		if _, err := time.Parse(backupTimeFormat, strings.TrimPrefix(name, r.path+".")); err == nil {
+			names = append(names, name)
+		}
+	}
+	if len(names) <= r.maxBackups {
+		return
+	}
+	sort.Strings(names)
+	for _, name := range names[:len(names)-r.maxBackups] {
+		os.Remove(name)
+	}
+}
+
+func (r *rotatingFile) Close() error {
+	return r.f.Close()
+}
@@ -8,11 +8,15 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/coocood/badger"
 	"github.com/coocood/badger/options"
+	"github.com/ngaut/faketikv/logutil"
 	"github.com/ngaut/faketikv/tikv"
-	"github.com/ngaut/log"
+	deadlockpb "github.com/pingcap/kvproto/pkg/deadlock"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	recoverdatapb "github.com/pingcap/kvproto/pkg/recoverdatapb"
 	"github.com/pingcap/kvproto/pkg/tikvpb"
 	"google.golang.org/grpc"
 )
@@ -25,24 +29,81 @@ var (
 	vlogPath         = flag.String("vlog-path", "", "Directory to store the value log in. can be the same as db-path.")
 	valThreshold     = flag.Int("value-threshold", 20, "If value size >= this threshold, only store value offsets in tree.")
 	regionSize       = flag.Int64("region-size", 96*1024*1024, "Average region size.")
+	regionWriteRate  = flag.Int64("region-write-rate", 0, "Write bytes per second allowed for a region, exceeding requests get ServerIsBusy. 0 means no limit.")
+	regionWriteBurst = flag.Int64("region-write-burst", 0, "Max write bytes a region can take at once, defaults to region-write-rate.")
 	logLevel         = flag.String("L", "info", "log level")
+	logModuleLevels  = flag.String("log-module-levels", "", "Levels of the modules overriding -L, like tikv/gc=debug,tikv=warn.")
+	logFormat        = flag.String("log-format", "text", "Format of the logs, text or json.")
+	logFile          = flag.String("log-file", "", "Path of the log file, the logs are written to stderr if it's empty.")
+	logMaxSize       = flag.Int64("log-max-size", 300<<20, "Rotate the log file when it's larger than this in bytes, 0 means no limit.")
+	logMaxAge        = flag.Duration("log-max-age", 24*time.Hour, "Rotate the log file when it's older than this, 0 means no limit.")
+	logMaxBackups    = flag.Int("log-max-backups", 0, "Number of rotated log files to keep, 0 means keeping all of them.")
 	tableLoadingMode = flag.String("table-loading-mode", "memory-map", "How should LSM tree be accessed. (memory-map/load-to-ram)")
 	maxTableSize     = flag.Int64("max-table-size", 64<<20, "Each table (or file) is at most this size.")
 	numMemTables     = flag.Int("num-mem-tables", 3, "Maximum number of tables to keep in memory, before stalling.")
 	numL0Table       = flag.Int("num-level-zero-tables", 3, "Maximum number of Level 0 tables before we start compacting.")
 	syncWrites       = flag.Bool("sync-write", true, "Sync all writes to disk. Setting this to true would slow down data loading significantly.")
 	logTrace         = flag.Uint("log-trace", 300, "Prints trace log if the request duration is greater than this value in milliseconds.")
+	asyncCommit      = flag.Bool("async-commit-secondaries", false, "Acknowledge Commit after the primary key is committed, and commit the secondary keys asynchronously.")
+	readOnly         = flag.Bool("read-only", false, "Serve the data in db-path read-only, e.g. a backup checkpoint, all the write requests are rejected.")
+	snapshotTS       = flag.Uint64("snapshot-ts", 0, "The ts to serve reads at in read-only mode, 0 means the latest.")
+	pipelinedLock    = flag.Bool("pipelined-pessimistic-lock", false, "Respond to pessimistic lock requests before the locks are applied.")
+	snapshotMaxAge   = flag.Duration("snapshot-max-age", 0, "Snapshots older than this are deleted when a new snapshot is created, 0 means no limit.")
+	snapshotMaxCount = flag.Int("snapshot-max-count", 0, "Max number of snapshots to keep, 0 means no limit.")
+	rollbackRetain   = flag.Duration("rollback-retention", tikv.DefaultRollbackRetention, "Time to keep the rollback records.")
+	protectedRetain  = flag.Duration("protected-rollback-retention", tikv.DefaultProtectedRollbackRetention, "Time to keep the protected rollback records.")
+	gcBatchSize      = flag.Int("gc-batch-size", tikv.DefaultGCBatchSize, "Number of deletes written in a batch by GC.")
+	gcDeleteRate     = flag.Int("gc-deletes-per-second", 0, "Max deletes per second of GC, 0 means no limit.")
+	gcConcurrency    = flag.Int("gc-concurrency", 0, "Max number of regions collected by GC concurrently, 0 means no limit.")
+	maxKeyVersions   = flag.Int("max-key-versions", 0, "Number of old versions written for a key to prune its versions invisible at the GC safe point, 0 means disabled.")
+	logicalDelRange  = flag.Bool("logical-delete-range", false, "Write range tombstones for DeleteRange and leave the deletion to GC, the requests with notify_only are always logical.")
+	recoverLocks     = flag.Bool("recover-orphan-locks", true, "Resolve the secondary locks of the committed or rolled back transactions at startup.")
+	asyncDelRange    = flag.Bool("async-delete-range", false, "Respond to DeleteRange after starting the deletion in background, the progress is reported by /admin/delete_range.")
+	rollbackMemLimit = flag.Int64("rollback-mem-limit", 0, "Max bytes of the rollback records in memory, the oldest ones are spilled to disk when exceeded. 0 means no limit.")
+	shadowAddr       = flag.String("shadow-addr", "", "If not empty, a sample of the write requests is mirrored to the unistore at this address.")
+	shadowPDAddr     = flag.String("shadow-pd-addr", "", "The pd address of the shadow unistore.")
+	shadowRate       = flag.Float64("shadow-sample-rate", 0.01, "The fraction of transactions mirrored to the shadow unistore.")
+	shadowToken      = flag.String("shadow-auth-token", "", "The auth token of the shadow unistore, defaults to -auth-token.")
+	admissionLimit   = flag.Int64("admission-limit", 0, "Max estimated cost of the cheap requests being handled, 0 disables the admission control.")
+	admissionHeavy   = flag.Int64("admission-heavy-limit", 4096, "Max estimated cost of the heavy requests being handled.")
+	heavyCost        = flag.Int64("admission-heavy-cost", 64, "Requests costing more than this, in keys, are admitted as heavy requests.")
+	stallDist        = flag.String("write-stall-distribution", "fixed", "The distribution of the write stall delays, fixed, uniform or exponential.")
+	stallWrite       = flag.Duration("write-stall-delay", 0, "Delay the badger writes to simulate a slow disk, 0 disables it.")
+	stallSync        = flag.Duration("write-stall-sync-delay", 0, "Delay after the badger writes and before the lock store syncs to simulate slow fsyncs, 0 disables it.")
+	stallProb        = flag.Float64("write-stall-probability", 1, "The chance a write is delayed by the write stall, 1 delays every write.")
+	scanMaxBytes     = flag.Int64("scan-max-response-bytes", 0, "Max bytes of the pairs of a KvScan response, 0 means no limit. Only applies to the requests with the unistore-scan-resume metadata, whose clients resume from the last key until a scan returns no pairs.")
+	requestMemLimit  = flag.Int64("request-mem-limit", 0, "Max bytes of the scan results, locks and coprocessor data held by a request, 0 means no limit.")
+	copMemQuota      = flag.Int64("cop-mem-quota", 0, "Max bytes held by a coprocessor request, its statement fails with the memory quota error of TiDB. 0 means the request memory limit applies.")
+	httpGateway      = flag.Bool("http-gateway", false, "Serve the HTTP/JSON gateway of the KV requests with hex keys on the http address, under /kv/.")
+	apiVersion       = flag.Int("api-version", 1, "The api version of the requests served, 1 or 2. The keys of API V2 have the mode and keyspace prefixes.")
+	authToken        = flag.String("auth-token", "", "If not empty, every gRPC request and every admin HTTP request other than GET must carry this token in the authorization metadata or header.")
 )
 
 var (
 	gitHash = "None"
 )
 
+var log = logutil.Module("node")
+
 func main() {
 	flag.Parse()
+	moduleLevels, err := logutil.ParseModuleLevels(*logModuleLevels)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = logutil.Init(logutil.Config{
+		Level:        *logLevel,
+		ModuleLevels: moduleLevels,
+		Format:       *logFormat,
+		File:         *logFile,
+		MaxSize:      *logMaxSize,
+		MaxAge:       *logMaxAge,
+		MaxBackups:   *logMaxBackups,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
 	log.Info("gitHash:", gitHash)
-	log.SetLevelByString(*logLevel)
-	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.Lshortfile)
 	tikv.LogTraceMS = *logTrace
 	go http.ListenAndServe(*httpAddr, nil)
 
@@ -63,21 +124,112 @@ func main() {
 	opts.NumLevelZeroTables = *numL0Table
 	opts.NumLevelZeroTablesStall = opts.NumLevelZeroTables + 5
 	opts.SyncWrites = *syncWrites
+	opts.ReadOnly = *readOnly
 	db, err := badger.Open(opts)
 	if err != nil {
 		log.Fatal(err)
 	}
+	apiVer := kvrpcpb.APIVersion_V1
+	if *apiVersion == 2 {
+		apiVer = kvrpcpb.APIVersion_V2
+	}
 	regionOpts := tikv.RegionOptions{
 		StoreAddr:  *storeAddr,
 		PDAddr:     *pdAddr,
 		RegionSize: *regionSize,
+
+		WriteRateLimit: *regionWriteRate,
+		WriteBurst:     *regionWriteBurst,
+		APIVersion:     apiVer,
+		ReadOnly:       *readOnly,
 	}
 	rm := tikv.NewRegionManager(db, regionOpts)
-	store := tikv.NewMVCCStore(db, opts.Dir)
+	var store *tikv.MVCCStore
+	if *readOnly {
+		store = tikv.NewReadOnlyMVCCStore(db, opts.Dir)
+	} else {
+		store = tikv.NewMVCCStore(db, opts.Dir)
+	}
+	store.AsyncCommitSecondaries = *asyncCommit
+	store.PipelinedPessimisticLock = *pipelinedLock
+	store.RollbackRetention = *rollbackRetain
+	store.ProtectedRollbackRetention = *protectedRetain
+	store.RollbackMemLimit = *rollbackMemLimit
+	store.LogicalDeleteRange = *logicalDelRange
+	store.AsyncDeleteRange = *asyncDelRange
+	store.RequestMemLimit = *requestMemLimit
+	store.CopMemQuota = *copMemQuota
+	store.ScanMaxResponseBytes = *scanMaxBytes
+	store.GCBatchSize = *gcBatchSize
+	store.GCDeletesPerSecond = *gcDeleteRate
+	store.GCConcurrency = *gcConcurrency
+	store.MaxKeyVersions = *maxKeyVersions
+	store.SnapshotRetention = tikv.SnapshotRetention{MaxAge: *snapshotMaxAge, MaxCount: *snapshotMaxCount}
+	err = store.SetWriteStall(tikv.WriteStall{
+		Distribution: *stallDist,
+		WriteDelay:   *stallWrite,
+		SyncDelay:    *stallSync,
+		Probability:  *stallProb,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	// The recovery writes the locks and the data, it can't run on a read-only store.
+	if *recoverLocks && !*readOnly {
+		if _, _, err = store.RecoverOrphanLocks(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if !*readOnly {
+		rm.SyncGCSafePoint(store)
+	}
 	tikvServer := tikv.NewServer(rm, store)
+	if *readOnly {
+		tikvServer.SetReadOnly(*snapshotTS)
+	}
+	tikvServer.SetAPIVersion(apiVer)
+	tikvServer.RegisterHTTPHandlers(http.DefaultServeMux, *authToken)
 
-	grpcServer := grpc.NewServer()
+	var grpcOpts []grpc.ServerOption
+	var unaryInterceptors []grpc.UnaryServerInterceptor
+	if *authToken != "" {
+		unary, stream := tikv.TokenAuthInterceptors(*authToken)
+		unaryInterceptors = append(unaryInterceptors, unary)
+		grpcOpts = append(grpcOpts, grpc.StreamInterceptor(stream))
+	}
+	if apiVer == kvrpcpb.APIVersion_V2 {
+		unaryInterceptors = append(unaryInterceptors, tikvServer.KeyspaceInterceptor())
+	}
+	if *shadowAddr != "" {
+		token := *shadowToken
+		if token == "" {
+			token = *authToken
+		}
+		shadow, err := tikv.NewShadow(*shadowAddr, *shadowPDAddr, *shadowRate, token)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer shadow.Close()
+		unaryInterceptors = append(unaryInterceptors, shadow.UnaryInterceptor())
+	}
+	if *admissionLimit > 0 {
+		admission := tikv.NewAdmission(*admissionLimit, *admissionHeavy, *heavyCost)
+		unaryInterceptors = append(unaryInterceptors, admission.UnaryInterceptor())
+		tikvServer.SetAdmission(admission)
+	}
+	var unaryInterceptor grpc.UnaryServerInterceptor
+	if len(unaryInterceptors) > 0 {
+		unaryInterceptor = tikv.ChainUnaryInterceptors(unaryInterceptors...)
+		grpcOpts = append(grpcOpts, grpc.UnaryInterceptor(unaryInterceptor))
+	}
+	if *httpGateway {
+		// The gateway requests pass the same interceptors as the gRPC requests.
+		tikvServer.RegisterGatewayHandlers(http.DefaultServeMux, unaryInterceptor)
+	}
+	grpcServer := grpc.NewServer(grpcOpts...)
 	tikvpb.RegisterTikvServer(grpcServer, tikvServer)
+	deadlockpb.RegisterDeadlockServer(grpcServer, tikvServer)
+	recoverdatapb.RegisterRecoverDataServer(grpcServer, tikvServer)
 	l, err := net.Listen("tcp", *storeAddr)
 	if err != nil {
 		log.Fatal(err)
@@ -0,0 +1,352 @@
+// Package testutil runs an in-process unistore with an in-memory PD for the storage level integration tests.
+package testutil
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+
+	"github.com/coocood/badger"
+	"github.com/juju/errors"
+	"github.com/ngaut/faketikv/tikv"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/tidb/util/codec"
+	"golang.org/x/net/context"
+)
+
+// Options is the configuration of a Cluster.
+type Options struct {
+	// Dir is the directory of the data, a temporary directory removed on Close is used if it is empty.
+	Dir string
+	// SplitKeys are the raw keys the store is pre-split at, Regions is ignored if SplitKeys is not empty.
+	SplitKeys [][]byte
+	// Regions is the number of regions pre-split evenly by the first byte of the keys, 0 or 1 means no split.
+	Regions int
+	// StartTS is the first ts allocated by the TSO.
+	StartTS uint64
+	// SyncWrites makes badger sync every write to disk.
+	SyncWrites bool
+	// ValueThreshold is the size of the values badger stores in the value log instead of the LSM tree, 0 means the
+	// default of badger.
+	ValueThreshold int
+}
+
+// Cluster is an in-process unistore with an in-memory PD and a deterministic TSO.
+type Cluster struct {
+	Store         *tikv.MVCCStore
+	RegionManager *tikv.RegionManager
+	Server        *tikv.Server
+	PD            *tikv.MockPDClient
+
+	db      *badger.DB
+	dir     string
+	tempDir bool
+	ts      uint64
+}
+
+// NewCluster starts a Cluster.
+func NewCluster(opts Options) (*Cluster, error) {
+	c := &Cluster{dir: opts.Dir, ts: opts.StartTS}
+	if c.dir == "" {
+		dir, err := ioutil.TempDir("", "unistore")
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		c.dir = dir
+		c.tempDir = true
+	}
+	dbOpts := badger.DefaultOptions
+	dbOpts.Dir = c.dir
+	dbOpts.ValueDir = c.dir
+	dbOpts.SyncWrites = opts.SyncWrites
+	if opts.ValueThreshold > 0 {
+		dbOpts.ValueThreshold = opts.ValueThreshold
+	}
+	db, err := badger.Open(dbOpts)
+	if err != nil {
+		c.removeDir()
+		return nil, errors.Trace(err)
+	}
+	c.db = db
+	splitKeys := opts.SplitKeys
+	if len(splitKeys) == 0 {
+		splitKeys = EvenSplitKeys(opts.Regions)
+	}
+	c.PD = tikv.NewMockPDClient(1)
+	c.RegionManager = tikv.NewRegionManager(db, tikv.RegionOptions{
+		StoreAddr:  "127.0.0.1:0",
+		RegionSize: 96 << 20,
+		PDClient:   c.PD,
+		SplitKeys:  splitKeys,
+	})
+	c.Store = tikv.NewMVCCStore(db, c.dir)
+	c.Server = tikv.NewServer(c.RegionManager, c.Store)
+	return c, nil
+}
+
+// EvenSplitKeys returns the single byte split keys for n regions.
+func EvenSplitKeys(n int) [][]byte {
+	if n <= 1 {
+		return [][]byte{}
+	}
+	if n > 256 {
+		n = 256
+	}
+	keys := make([][]byte, 0, n-1)
+	for i := 1; i < n; i++ {
+		keys = append(keys, []byte{byte(i * 256 / n)})
+	}
+	return keys
+}
+
+// Close stops the Cluster and removes the temporary directory.
+func (c *Cluster) Close() error {
+	c.Server.Stop()
+	err := c.Store.Close()
+	if err1 := c.RegionManager.Close(); err == nil {
+		err = err1
+	}
+	if err1 := c.db.Close(); err == nil {
+		err = err1
+	}
+	c.removeDir()
+	return errors.Trace(err)
+}
+
+func (c *Cluster) removeDir() {
+	if c.tempDir {
+		os.RemoveAll(c.dir)
+	}
+}
+
+// AllocTS returns the next ts, the ts are allocated sequentially so the tests are deterministic.
+func (c *Cluster) AllocTS() uint64 {
+	return atomic.AddUint64(&c.ts, 1)
+}
+
+// Context returns the request context of the region containing the key.
+func (c *Cluster) Context(key []byte) (*kvrpcpb.Context, error) {
+	region, leader, err := c.PD.GetRegion(context.Background(), codec.EncodeBytes(nil, key))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if region == nil {
+		return nil, errors.Errorf("region of key %q not found", key)
+	}
+	return &kvrpcpb.Context{
+		RegionId:    region.Id,
+		RegionEpoch: region.RegionEpoch,
+		Peer:        leader,
+	}, nil
+}
+
+// Regions returns the regions of the Cluster sorted by the start key.
+func (c *Cluster) Regions() []*metapb.Region {
+	return c.PD.Regions()
+}
+
+// Get reads the key at ts.
+func (c *Cluster) Get(key []byte, ts uint64) ([]byte, error) {
+	reqCtx, err := c.Context(key)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.Server.KvGet(context.Background(), &kvrpcpb.GetRequest{Context: reqCtx, Key: key, Version: ts})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if resp.RegionError != nil {
+		return nil, errors.Errorf("region error: %s", resp.RegionError)
+	}
+	if resp.Error != nil {
+		return nil, keyError(resp.Error)
+	}
+	return resp.Value, nil
+}
+
+// Put writes the key in a transaction and returns the commit ts.
+func (c *Cluster) Put(key, value []byte) (uint64, error) {
+	txn := c.Begin()
+	txn.Set(key, value)
+	return txn.Commit()
+}
+
+// Txn is a transaction committed by 2PC, the mutations are buffered until Commit.
+type Txn struct {
+	c         *Cluster
+	startTS   uint64
+	mutations []*kvrpcpb.Mutation
+	index     map[string]int
+}
+
+// Begin starts a transaction with a new start ts.
+func (c *Cluster) Begin() *Txn {
+	return &Txn{c: c, startTS: c.AllocTS(), index: make(map[string]int)}
+}
+
+// StartTS returns the start ts of the transaction.
+func (txn *Txn) StartTS() uint64 {
+	return txn.startTS
+}
+
+// Set buffers a put of the key.
+func (txn *Txn) Set(key, value []byte) {
+	txn.mutate(&kvrpcpb.Mutation{Op: kvrpcpb.Op_Put, Key: key, Value: value})
+}
+
+// Delete buffers a delete of the key.
+func (txn *Txn) Delete(key []byte) {
+	txn.mutate(&kvrpcpb.Mutation{Op: kvrpcpb.Op_Del, Key: key})
+}
+
+func (txn *Txn) mutate(m *kvrpcpb.Mutation) {
+	if i, ok := txn.index[string(m.Key)]; ok {
+		txn.mutations[i] = m
+		return
+	}
+	txn.index[string(m.Key)] = len(txn.mutations)
+	txn.mutations = append(txn.mutations, m)
+}
+
+// Get reads the key at the start ts, the buffered mutations are not visible.
+func (txn *Txn) Get(key []byte) ([]byte, error) {
+	return txn.c.Get(key, txn.startTS)
+}
+
+// Commit prewrites all the mutations with the first key as the primary, and commits the primary region before the
+// others. The commit ts is returned.
+func (txn *Txn) Commit() (uint64, error) {
+	if len(txn.mutations) == 0 {
+		return 0, nil
+	}
+	if err := txn.Prewrite(); err != nil {
+		return 0, err
+	}
+	commitTS := txn.c.AllocTS()
+	return commitTS, txn.CommitAt(commitTS)
+}
+
+// Prewrite prewrites the mutations region by region, it is exposed to test the transactions left uncommitted.
+func (txn *Txn) Prewrite() error {
+	primary := txn.mutations[0].Key
+	groups, err := txn.c.groupByRegion(txn.keys())
+	if err != nil {
+		return err
+	}
+	for _, g := range groups {
+		mutations := make([]*kvrpcpb.Mutation, 0, len(g.keys))
+		for _, key := range g.keys {
+			mutations = append(mutations, txn.mutations[txn.index[string(key)]])
+		}
+		resp, err := txn.c.Server.KvPrewrite(context.Background(), &kvrpcpb.PrewriteRequest{
+			Context:      g.ctx,
+			Mutations:    mutations,
+			PrimaryLock:  primary,
+			StartVersion: txn.startTS,
+			LockTtl:      3000,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if resp.RegionError != nil {
+			return errors.Errorf("region error: %s", resp.RegionError)
+		}
+		if len(resp.Errors) > 0 {
+			return keyError(resp.Errors[0])
+		}
+	}
+	return nil
+}
+
+// CommitAt commits the prewritten mutations at commitTS, the region of the primary key is committed first.
+func (txn *Txn) CommitAt(commitTS uint64) error {
+	groups, err := txn.c.groupByRegion(txn.keys())
+	if err != nil {
+		return err
+	}
+	for _, g := range groups {
+		resp, err := txn.c.Server.KvCommit(context.Background(), &kvrpcpb.CommitRequest{
+			Context:       g.ctx,
+			Keys:          g.keys,
+			StartVersion:  txn.startTS,
+			CommitVersion: commitTS,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if resp.RegionError != nil {
+			return errors.Errorf("region error: %s", resp.RegionError)
+		}
+		if resp.Error != nil {
+			return keyError(resp.Error)
+		}
+	}
+	return nil
+}
+
+// Rollback rolls back the prewritten mutations.
+func (txn *Txn) Rollback() error {
+	groups, err := txn.c.groupByRegion(txn.keys())
+	if err != nil {
+		return err
+	}
+	for _, g := range groups {
+		resp, err := txn.c.Server.KvBatchRollback(context.Background(), &kvrpcpb.BatchRollbackRequest{
+			Context:      g.ctx,
+			Keys:         g.keys,
+			StartVersion: txn.startTS,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if resp.RegionError != nil {
+			return errors.Errorf("region error: %s", resp.RegionError)
+		}
+		if resp.Error != nil {
+			return keyError(resp.Error)
+		}
+	}
+	return nil
+}
+
+func (txn *Txn) keys() [][]byte {
+	keys := make([][]byte, 0, len(txn.mutations))
+	for _, m := range txn.mutations {
+		keys = append(keys, m.Key)
+	}
+	return keys
+}
+
+type regionKeys struct {
+	ctx  *kvrpcpb.Context
+	keys [][]byte
+}
+
+// groupByRegion groups the keys by the regions in the order of their first keys.
+func (c *Cluster) groupByRegion(keys [][]byte) ([]*regionKeys, error) {
+	var groups []*regionKeys
+	byID := make(map[uint64]*regionKeys)
+	for _, key := range keys {
+		reqCtx, err := c.Context(key)
+		if err != nil {
+			return nil, err
+		}
+		g := byID[reqCtx.RegionId]
+		if g == nil {
+			g = &regionKeys{ctx: reqCtx}
+			byID[reqCtx.RegionId] = g
+			groups = append(groups, g)
+		}
+		g.keys = append(g.keys, key)
+	}
+	return groups, nil
+}
+
+func keyError(err *kvrpcpb.KeyError) error {
+	if err.Locked != nil {
+		return errors.Errorf("key %q is locked by %d", err.Locked.Key, err.Locked.LockVersion)
+	}
+	return errors.New(fmt.Sprint(err))
+}
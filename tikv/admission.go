@@ -0,0 +1,209 @@
+package tikv
+
+import (
+	"sync"
+
+	"github.com/pingcap/kvproto/pkg/coprocessor"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/tidb/kv"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// rangeScanCost is the estimated cost of scanning a range whose size is unknown.
+	rangeScanCost = scanLimit
+	// keyCostBytes is the size of the written keys and values that costs as much as a key.
+	keyCostBytes = 1024
+)
+
+// Admission admits the requests by their estimated costs, the cheap and the heavy requests are queued in separate
+// classes so the heavy ones don't delay the cheap ones.
+type Admission struct {
+	heavyCost int64
+	cheap     *admissionClass
+	heavy     *admissionClass
+}
+
+// NewAdmission creates an Admission, the requests costing more than heavyCost are admitted by the heavy class.
+// cheapLimit and heavyLimit are the max total costs of the requests being handled in each class.
+func NewAdmission(cheapLimit, heavyLimit, heavyCost int64) *Admission {
+	return &Admission{
+		heavyCost: heavyCost,
+		cheap:     newAdmissionClass(cheapLimit),
+		heavy:     newAdmissionClass(heavyLimit),
+	}
+}
+
+type admissionClass struct {
+	mu       sync.Mutex
+	limit    int64
+	inflight int64
+	// The waiters are admitted in FIFO order, so a heavy request isn't starved by the cheaper ones of its class.
+	waiters []*admissionWaiter
+}
+
+type admissionWaiter struct {
+	cost  int64
+	ready chan struct{}
+}
+
+func newAdmissionClass(limit int64) *admissionClass {
+	return &admissionClass{limit: limit}
+}
+
+// acquire blocks until the cost fits in the limit or ctx is done, a request costing more than the limit is
+// admitted alone.
+func (c *admissionClass) acquire(ctx context.Context, cost int64) error {
+	c.mu.Lock()
+	if len(c.waiters) == 0 && c.fits(cost) {
+		c.inflight += cost
+		c.mu.Unlock()
+		return nil
+	}
+	w := &admissionWaiter{cost: cost, ready: make(chan struct{})}
+	c.waiters = append(c.waiters, w)
+	c.mu.Unlock()
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-w.ready:
+		// Admitted while the context is done.
+		return nil
+	default:
+	}
+	for i, waiter := range c.waiters {
+		if waiter == w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			break
+		}
+	}
+	// The waiters behind w may fit now.
+	c.admitWaiters()
+	if ctx.Err() == context.DeadlineExceeded {
+		return status.Error(codes.DeadlineExceeded, ctx.Err().Error())
+	}
+	return status.Error(codes.Canceled, ctx.Err().Error())
+}
+
+func (c *admissionClass) release(cost int64) {
+	c.mu.Lock()
+	c.inflight -= cost
+	c.admitWaiters()
+	c.mu.Unlock()
+}
+
+func (c *admissionClass) fits(cost int64) bool {
+	return c.inflight == 0 || c.inflight+cost <= c.limit
+}
+
+// admitWaiters must be called with mu held.
+func (c *admissionClass) admitWaiters() {
+	for len(c.waiters) > 0 && c.fits(c.waiters[0].cost) {
+		w := c.waiters[0]
+		c.waiters = c.waiters[1:]
+		c.inflight += w.cost
+		close(w.ready)
+	}
+}
+
+// SetAdmission makes the server admit the BatchCoprocessor requests by a, which the unary interceptor of a doesn't
+// see. It must be called before serving.
+func (svr *Server) SetAdmission(a *Admission) {
+	svr.admission = a
+}
+
+// UnaryInterceptor returns the interceptor that admits the requests before they are handled.
+func (a *Admission) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		release, err := a.admit(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		return handler(ctx, req)
+	}
+}
+
+// admit blocks until the request is admitted or ctx is done, release is called after the request is handled.
+func (a *Admission) admit(ctx context.Context, req interface{}) (release func(), err error) {
+	cost := requestCost(req)
+	class := a.cheap
+	if cost > a.heavyCost {
+		class = a.heavy
+	}
+	if err = class.acquire(ctx, cost); err != nil {
+		return nil, err
+	}
+	return func() { class.release(cost) }, nil
+}
+
+// requestCost estimates the cost of a request by the number of keys it reads or writes, and the size of the keys
+// and values it writes.
+func requestCost(req interface{}) int64 {
+	var cost int
+	switch r := req.(type) {
+	case *kvrpcpb.BatchGetRequest:
+		cost = len(r.Keys)
+	case *kvrpcpb.ScanRequest:
+		cost = int(r.Limit)
+	case *kvrpcpb.PrewriteRequest:
+		cost = mutationsCost(r.Mutations)
+	case *kvrpcpb.CommitRequest:
+		cost = len(r.Keys)
+	case *kvrpcpb.PessimisticLockRequest:
+		cost = mutationsCost(r.Mutations)
+	case *kvrpcpb.BatchRollbackRequest:
+		cost = len(r.Keys)
+	case *kvrpcpb.RawBatchGetRequest:
+		cost = len(r.Keys)
+	case *kvrpcpb.RawBatchPutRequest:
+		var size int
+		for _, pair := range r.Pairs {
+			size += len(pair.Key) + len(pair.Value)
+		}
+		cost = len(r.Pairs) + size/keyCostBytes
+	case *kvrpcpb.RawBatchDeleteRequest:
+		cost = len(r.Keys)
+	case *kvrpcpb.RawScanRequest:
+		cost = int(r.Limit)
+	case *kvrpcpb.RawBatchScanRequest:
+		cost = len(r.Ranges) * int(r.EachLimit)
+	case *coprocessor.Request:
+		cost = copRangesCost(r.Ranges)
+	case *coprocessor.BatchRequest:
+		for _, ri := range r.Regions {
+			cost += copRangesCost(ri.Ranges)
+		}
+	}
+	if cost < 1 {
+		cost = 1
+	}
+	return int64(cost)
+}
+
+func mutationsCost(mutations []*kvrpcpb.Mutation) int {
+	var size int
+	for _, m := range mutations {
+		size += len(m.Key) + len(m.Value)
+	}
+	return len(mutations) + size/keyCostBytes
+}
+
+func copRangesCost(ranges []*coprocessor.KeyRange) (cost int) {
+	for _, ran := range ranges {
+		if (kv.KeyRange{StartKey: ran.Start, EndKey: ran.End}).IsPoint() {
+			cost++
+		} else {
+			cost += rangeScanCost
+		}
+	}
+	return cost
+}
@@ -0,0 +1,40 @@
+package tikv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAdmission(t *testing.T) {
+	twoKeys := &kvrpcpb.BatchGetRequest{Keys: make([][]byte, 2)}
+	require.Equal(t, codes.OK, admitAfter(t, twoKeys, twoKeys))
+	require.Equal(t, codes.DeadlineExceeded, admitAfter(t, &kvrpcpb.BatchGetRequest{Keys: make([][]byte, 4)}, twoKeys))
+	// The size of the values counts in the cost.
+	bigMutation := &kvrpcpb.PrewriteRequest{Mutations: []*kvrpcpb.Mutation{{Value: make([]byte, 4*keyCostBytes)}}}
+	require.Equal(t, codes.DeadlineExceeded, admitAfter(t, twoKeys, bigMutation))
+}
+
+// admitAfter admits req while inflight is being handled, and returns the code of the error when the context of req is
+// done before it's admitted.
+func admitAfter(t *testing.T, inflight, req interface{}) codes.Code {
+	a := NewAdmission(4, 4, 64)
+	releaseInflight, err := a.admit(context.Background(), inflight)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	release, err := a.admit(ctx, req)
+	if err == nil {
+		release()
+	}
+	releaseInflight()
+	// The class is empty after the timed out waiter is removed.
+	require.Zero(t, a.cheap.inflight)
+	require.Empty(t, a.cheap.waiters)
+	return status.Code(err)
+}
@@ -17,10 +17,12 @@ var (
 )
 
 type hashAggExec struct {
+	reqCtx            *requestCtx
 	evalCtx           *evalContext
 	aggExprs          []aggregation.Aggregation
 	aggCtxsMap        aggCtxsMapper
 	groupByExprs      []expression.Expression
+	groupByCollators  []collator
 	relatedColOffsets []int
 	row               types.DatumRow
 	groups            map[string]struct{}
@@ -113,9 +115,9 @@ func (e *hashAggExec) getGroupKey() ([]byte, [][]byte, error) {
 	if length == 0 {
 		return nil, nil, nil
 	}
-	bufLen := 0
+	var buf []byte
 	row := make([][]byte, 0, length)
-	for _, item := range e.groupByExprs {
+	for i, item := range e.groupByExprs {
 		v, err := item.Eval(e.row)
 		if err != nil {
 			return nil, nil, errors.Trace(err)
@@ -124,12 +126,15 @@ func (e *hashAggExec) getGroupKey() ([]byte, [][]byte, error) {
 		if err != nil {
 			return nil, nil, errors.Trace(err)
 		}
-		bufLen += len(b)
 		row = append(row, b)
-	}
-	buf := make([]byte, 0, bufLen)
-	for _, col := range row {
-		buf = append(buf, col...)
+		if c := e.groupByCollators[i]; c != nil {
+			buf, err = codec.EncodeValue(e.evalCtx.sc, buf, collateDatum(c, v))
+			if err != nil {
+				return nil, nil, errors.Trace(err)
+			}
+		} else {
+			buf = append(buf, b...)
+		}
 	}
 	return buf, row, nil
 }
@@ -146,6 +151,11 @@ func (e *hashAggExec) aggregate(value [][]byte) error {
 		return errors.Trace(err)
 	}
 	if _, ok := e.groups[string(gk)]; !ok {
+		// The group key is held by the groups, the group keys and the contexts map, the group by values by the group
+		// key rows.
+		if err = e.reqCtx.consumeMem(3*len(gk) + rowSize(gbyKeyRow) + len(e.aggExprs)*aggCtxMemSize); err != nil {
+			return err
+		}
 		e.groups[string(gk)] = struct{}{}
 		e.groupKeys = append(e.groupKeys, gk)
 		e.groupKeyRows = append(e.groupKeyRows, gbyKeyRow)
@@ -161,6 +171,17 @@ func (e *hashAggExec) aggregate(value [][]byte) error {
 	return nil
 }
 
+// aggCtxMemSize is the estimated size of an AggEvaluateContext, the distinct values are not counted.
+const aggCtxMemSize = 128
+
+func rowSize(row [][]byte) int {
+	var size int
+	for _, col := range row {
+		size += len(col)
+	}
+	return size
+}
+
 func (e *hashAggExec) getContexts(groupKey []byte) []*aggregation.AggEvaluateContext {
 	groupKeyString := string(groupKey)
 	aggCtxs, ok := e.aggCtxsMap[groupKeyString]
@@ -179,6 +200,7 @@ type streamAggExec struct {
 	aggExprs          []aggregation.Aggregation
 	aggCtxs           []*aggregation.AggEvaluateContext
 	groupByExprs      []expression.Expression
+	groupByCollators  []collator
 	relatedColOffsets []int
 	row               types.DatumRow
 	tmpGroupByRow     types.DatumRow
@@ -250,7 +272,8 @@ func (e *streamAggExec) meetNewGroup(row [][]byte) (bool, error) {
 			return false, errors.Trace(err)
 		}
 		if matched {
-			c, err := d.CompareDatum(e.evalCtx.sc, &e.nextGroupByRow[i])
+			next := collateDatum(e.groupByCollators[i], e.nextGroupByRow[i])
+			c, err := collateDatum(e.groupByCollators[i], d).CompareDatum(e.evalCtx.sc, &next)
 			if err != nil {
 				return false, errors.Trace(err)
 			}
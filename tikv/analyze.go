@@ -33,6 +33,11 @@ func (svr *Server) handleCopAnalyzeRequest(reqCtx *requestCtx, req *coprocessor.
 		resp.OtherError = err.Error()
 		return resp
 	}
+	analyzeReq.StartTs = svr.readTS(analyzeReq.StartTs)
+	if err = svr.checkCopGCSafePoint(req.Ranges, analyzeReq.StartTs); err != nil {
+		resp.OtherError = err.Error()
+		return resp
+	}
 	ranges, err := svr.extractKVRanges(reqCtx.regCtx, req.Ranges, false)
 	if err != nil {
 		resp.OtherError = err.Error()
@@ -78,14 +83,16 @@ func (svr *Server) handleAnalyzeIndexReq(reqCtx *requestCtx, ranges []kv.KeyRang
 		var value []byte
 		for _, val := range values {
 			value = append(value, val...)
+			// Every column prefix of a multi-column index is counted, so the equal conditions on the prefix
+			// columns are estimated by the CMSketch too.
+			if cms != nil {
+				cms.InsertBytes(value)
+			}
 		}
 		err = statsBuilder.Iterate(types.NewBytesDatum(value))
 		if err != nil {
 			return nil, errors.Trace(err)
 		}
-		if cms != nil {
-			cms.InsertBytes(value)
-		}
 	}
 	hg := statistics.HistogramToProto(statsBuilder.Hist())
 	var cm *tipb.CMSketch
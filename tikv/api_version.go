@@ -0,0 +1,261 @@
+package tikv
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/kvproto/pkg/coprocessor"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The keys of API V2 start with the mode prefix and the 3 bytes keyspace id.
+const (
+	apiV2TxnMode      = 'x'
+	apiV2RawMode      = 'r'
+	keyspacePrefixLen = 4
+)
+
+// apiV2SplitKeys adds the boundaries of the txn keys of API V2 to defaultSplitKeys, so the txn keys are in an MVCC
+// region.
+var apiV2SplitKeys = [][]byte{{'m'}, {'n'}, {'t'}, {'u'}, {apiV2TxnMode}, {apiV2TxnMode + 1}}
+
+// ErrAPIVersionNotMatched is returned when the api version of a request differs from the store's.
+type ErrAPIVersionNotMatched struct {
+	CmdVersion   kvrpcpb.APIVersion
+	StoreVersion kvrpcpb.APIVersion
+}
+
+func (e *ErrAPIVersionNotMatched) Error() string {
+	return fmt.Sprintf("api version not matched, cmd %s, store %s", e.CmdVersion, e.StoreVersion)
+}
+
+// SetAPIVersion sets the api version of the requests served, V1 and V1TTL requests are compatible with each other.
+// It must be called before serving.
+func (svr *Server) SetAPIVersion(version kvrpcpb.APIVersion) {
+	svr.apiVersion = version
+}
+
+func (svr *Server) checkAPIVersion(ctx *kvrpcpb.Context) error {
+	cmdVersion := ctx.GetApiVersion()
+	if (cmdVersion == kvrpcpb.APIVersion_V2) != (svr.apiVersion == kvrpcpb.APIVersion_V2) {
+		return &ErrAPIVersionNotMatched{CmdVersion: cmdVersion, StoreVersion: svr.apiVersion}
+	}
+	return nil
+}
+
+// keyspaceEndKey returns the end key of the keyspace of the API V2 key.
+func keyspaceEndKey(key []byte) []byte {
+	end := safeCopy(key[:keyspacePrefixLen])
+	for i := len(end) - 1; i >= 0; i-- {
+		end[i]++
+		if end[i] != 0 {
+			break
+		}
+	}
+	return end
+}
+
+// KeyspaceInterceptor returns the interceptor that rejects the API V2 requests with keys out of the mode of the
+// request, or in different keyspaces. The requests of other api versions are passed through.
+func (svr *Server) KeyspaceInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		mode, reqCtx, keys, ranges := keyspaceKeys(req)
+		if reqCtx.GetApiVersion() == kvrpcpb.APIVersion_V2 {
+			if err := checkKeyspace(mode, reqCtx, keys, ranges); err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
+			clampKeyspaceEnd(req)
+		}
+		return handler(ctx, req)
+	}
+}
+
+// checkKeyspace checks the keys and range start keys have the mode and the same keyspace prefix, and the range end
+// keys don't exceed the keyspace.
+func checkKeyspace(mode byte, reqCtx *kvrpcpb.Context, keys [][]byte, ranges []KeyRange) error {
+	var prefix []byte
+	check := func(key []byte) error {
+		if len(key) < keyspacePrefixLen || key[0] != mode {
+			return errors.Errorf("key %q is not in the %c mode of api v2", key, mode)
+		}
+		if prefix == nil {
+			prefix = key[:keyspacePrefixLen]
+		} else if !bytes.HasPrefix(key, prefix) {
+			return errors.Errorf("key %q is not in the keyspace %q", key, prefix[1:])
+		}
+		return nil
+	}
+	for _, key := range keys {
+		if err := check(key); err != nil {
+			return err
+		}
+	}
+	for _, r := range ranges {
+		if err := check(r.StartKey); err != nil {
+			return err
+		}
+		if len(r.EndKey) > 0 && bytes.Compare(r.EndKey, keyspaceEndKey(r.StartKey)) > 0 {
+			return errors.Errorf("range end key %q exceeds the keyspace %q", r.EndKey, prefix[1:])
+		}
+	}
+	if prefix != nil && reqCtx.GetKeyspaceId() != 0 {
+		id := uint32(prefix[1])<<16 | uint32(prefix[2])<<8 | uint32(prefix[3])
+		if id != reqCtx.GetKeyspaceId() {
+			return errors.Errorf("keys of keyspace %d are not in the keyspace %d of the request", id, reqCtx.GetKeyspaceId())
+		}
+	}
+	return nil
+}
+
+// clampKeyspaceEnd sets the empty end keys of the range requests to the end of the keyspace, so the requests don't
+// read or delete the keys of the next keyspace.
+func clampKeyspaceEnd(req interface{}) {
+	switch r := req.(type) {
+	case *kvrpcpb.ScanRequest:
+		if r.Reverse {
+			if len(r.StartKey) == 0 {
+				r.StartKey = keyspaceEndKey(r.EndKey)
+			}
+		} else if len(r.EndKey) == 0 {
+			r.EndKey = keyspaceEndKey(r.StartKey)
+		}
+	case *kvrpcpb.DeleteRangeRequest:
+		if len(r.EndKey) == 0 {
+			r.EndKey = keyspaceEndKey(r.StartKey)
+		}
+	case *kvrpcpb.ScanLockRequest:
+		if len(r.EndKey) == 0 {
+			r.EndKey = keyspaceEndKey(r.StartKey)
+		}
+	case *kvrpcpb.RawScanRequest:
+		if r.Reverse {
+			if len(r.StartKey) == 0 {
+				r.StartKey = keyspaceEndKey(r.EndKey)
+			}
+		} else if len(r.EndKey) == 0 {
+			r.EndKey = keyspaceEndKey(r.StartKey)
+		}
+	case *kvrpcpb.RawBatchScanRequest:
+		for _, ran := range r.Ranges {
+			if r.Reverse {
+				if len(ran.StartKey) == 0 {
+					ran.StartKey = keyspaceEndKey(ran.EndKey)
+				}
+			} else if len(ran.EndKey) == 0 {
+				ran.EndKey = keyspaceEndKey(ran.StartKey)
+			}
+		}
+	case *kvrpcpb.RawDeleteRangeRequest:
+		if len(r.EndKey) == 0 {
+			r.EndKey = keyspaceEndKey(r.StartKey)
+		}
+	}
+}
+
+// keyspaceKeys returns the mode, the context, the keys and the ranges of the request to check.
+func keyspaceKeys(req interface{}) (mode byte, ctx *kvrpcpb.Context, keys [][]byte, ranges []KeyRange) {
+	switch r := req.(type) {
+	case *kvrpcpb.GetRequest:
+		return apiV2TxnMode, r.Context, [][]byte{r.Key}, nil
+	case *kvrpcpb.BatchGetRequest:
+		return apiV2TxnMode, r.Context, r.Keys, nil
+	case *kvrpcpb.ScanRequest:
+		if r.Reverse {
+			// The reverse scan range is [EndKey, StartKey).
+			return apiV2TxnMode, r.Context, nil, []KeyRange{{StartKey: r.EndKey, EndKey: r.StartKey}}
+		}
+		return apiV2TxnMode, r.Context, nil, []KeyRange{{StartKey: r.StartKey, EndKey: r.EndKey}}
+	case *kvrpcpb.PrewriteRequest:
+		keys = append(keys, r.PrimaryLock)
+		for _, m := range r.Mutations {
+			keys = append(keys, m.Key)
+		}
+		return apiV2TxnMode, r.Context, keys, nil
+	case *kvrpcpb.PessimisticLockRequest:
+		keys = append(keys, r.PrimaryLock)
+		for _, m := range r.Mutations {
+			keys = append(keys, m.Key)
+		}
+		return apiV2TxnMode, r.Context, keys, nil
+	case *kvrpcpb.CommitRequest:
+		return apiV2TxnMode, r.Context, r.Keys, nil
+	case *kvrpcpb.PessimisticRollbackRequest:
+		return apiV2TxnMode, r.Context, r.Keys, nil
+	case *kvrpcpb.BatchRollbackRequest:
+		return apiV2TxnMode, r.Context, r.Keys, nil
+	case *kvrpcpb.CleanupRequest:
+		return apiV2TxnMode, r.Context, [][]byte{r.Key}, nil
+	case *kvrpcpb.DeleteRangeRequest:
+		return apiV2TxnMode, r.Context, nil, []KeyRange{{StartKey: r.StartKey, EndKey: r.EndKey}}
+	case *kvrpcpb.CheckTxnStatusRequest:
+		return apiV2TxnMode, r.Context, [][]byte{r.PrimaryKey}, nil
+	case *kvrpcpb.TxnHeartBeatRequest:
+		return apiV2TxnMode, r.Context, [][]byte{r.PrimaryLock}, nil
+	case *kvrpcpb.CheckSecondaryLocksRequest:
+		return apiV2TxnMode, r.Context, r.Keys, nil
+	case *kvrpcpb.ResolveLockRequest:
+		return apiV2TxnMode, r.Context, r.Keys, nil
+	case *kvrpcpb.ScanLockRequest:
+		return apiV2TxnMode, r.Context, nil, []KeyRange{{StartKey: r.StartKey, EndKey: r.EndKey}}
+	case *kvrpcpb.PhysicalScanLockRequest:
+		// The scan has no end key, only its start key is checked.
+		return apiV2TxnMode, r.Context, [][]byte{r.StartKey}, nil
+	case *coprocessor.Request:
+		for _, ran := range r.Ranges {
+			ranges = append(ranges, KeyRange{StartKey: ran.Start, EndKey: ran.End})
+		}
+		return apiV2TxnMode, r.Context, nil, ranges
+	case *coprocessor.BatchRequest:
+		for _, ri := range r.Regions {
+			for _, ran := range ri.Ranges {
+				ranges = append(ranges, KeyRange{StartKey: ran.Start, EndKey: ran.End})
+			}
+		}
+		return apiV2TxnMode, r.Context, nil, ranges
+	case *kvrpcpb.RawGetRequest:
+		return apiV2RawMode, r.Context, [][]byte{r.Key}, nil
+	case *kvrpcpb.RawBatchGetRequest:
+		return apiV2RawMode, r.Context, r.Keys, nil
+	case *kvrpcpb.RawPutRequest:
+		return apiV2RawMode, r.Context, [][]byte{r.Key}, nil
+	case *kvrpcpb.RawBatchPutRequest:
+		for _, pair := range r.Pairs {
+			keys = append(keys, pair.Key)
+		}
+		return apiV2RawMode, r.Context, keys, nil
+	case *kvrpcpb.RawDeleteRequest:
+		return apiV2RawMode, r.Context, [][]byte{r.Key}, nil
+	case *kvrpcpb.RawBatchDeleteRequest:
+		return apiV2RawMode, r.Context, r.Keys, nil
+	case *kvrpcpb.RawCASRequest:
+		return apiV2RawMode, r.Context, [][]byte{r.Key}, nil
+	case *kvrpcpb.RawScanRequest:
+		if r.Reverse {
+			// The reverse scan range is [EndKey, StartKey).
+			return apiV2RawMode, r.Context, nil, []KeyRange{{StartKey: r.EndKey, EndKey: r.StartKey}}
+		}
+		return apiV2RawMode, r.Context, nil, []KeyRange{{StartKey: r.StartKey, EndKey: r.EndKey}}
+	case *kvrpcpb.RawBatchScanRequest:
+		for _, ran := range r.Ranges {
+			if r.Reverse {
+				ranges = append(ranges, KeyRange{StartKey: ran.EndKey, EndKey: ran.StartKey})
+			} else {
+				ranges = append(ranges, KeyRange{StartKey: ran.StartKey, EndKey: ran.EndKey})
+			}
+		}
+		return apiV2RawMode, r.Context, nil, ranges
+	case *kvrpcpb.RawDeleteRangeRequest:
+		return apiV2RawMode, r.Context, nil, []KeyRange{{StartKey: r.StartKey, EndKey: r.EndKey}}
+	case *kvrpcpb.RawChecksumRequest:
+		for _, ran := range r.Ranges {
+			ranges = append(ranges, KeyRange{StartKey: ran.StartKey, EndKey: ran.EndKey})
+		}
+		return apiV2RawMode, r.Context, nil, ranges
+	}
+	return 0, nil, nil, nil
+}
@@ -0,0 +1,89 @@
+package tikv
+
+import (
+	"testing"
+
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckAPIVersion(t *testing.T) {
+	svr := new(Server)
+	svr.SetAPIVersion(kvrpcpb.APIVersion_V1TTL)
+	// V1 and V1TTL are compatible with each other.
+	require.NoError(t, svr.checkAPIVersion(&kvrpcpb.Context{ApiVersion: kvrpcpb.APIVersion_V1}))
+	require.Error(t, svr.checkAPIVersion(&kvrpcpb.Context{ApiVersion: kvrpcpb.APIVersion_V2}))
+	svr.SetAPIVersion(kvrpcpb.APIVersion_V2)
+	require.NoError(t, svr.checkAPIVersion(&kvrpcpb.Context{ApiVersion: kvrpcpb.APIVersion_V2}))
+	require.Error(t, svr.checkAPIVersion(&kvrpcpb.Context{ApiVersion: kvrpcpb.APIVersion_V1}))
+}
+
+func TestCheckKeyspace(t *testing.T) {
+	ctx := &kvrpcpb.Context{ApiVersion: kvrpcpb.APIVersion_V2, KeyspaceId: 1}
+	require.NoError(t, checkKeyspaceOf(&kvrpcpb.BatchGetRequest{
+		Context: ctx,
+		Keys:    [][]byte{[]byte("x\x00\x00\x01a"), []byte("x\x00\x00\x01b")},
+	}))
+	err := checkKeyspaceOf(&kvrpcpb.GetRequest{Context: ctx, Key: []byte("r\x00\x00\x01a")})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "mode")
+	err = checkKeyspaceOf(&kvrpcpb.BatchGetRequest{
+		Context: ctx,
+		Keys:    [][]byte{[]byte("x\x00\x00\x01a"), []byte("x\x00\x00\x02a")},
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not in the keyspace")
+	err = checkKeyspaceOf(&kvrpcpb.GetRequest{Context: ctx, Key: []byte("x\x00\x00\x02a")})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "of the request")
+
+	// The end key of a range may be the end of the keyspace, but not beyond it.
+	require.NoError(t, checkKeyspaceOf(&kvrpcpb.RawScanRequest{
+		Context:  ctx,
+		StartKey: []byte("r\x00\x00\x01a"),
+		EndKey:   []byte("r\x00\x00\x02"),
+	}))
+	err = checkKeyspaceOf(&kvrpcpb.RawScanRequest{
+		Context:  ctx,
+		StartKey: []byte("r\x00\x00\x01a"),
+		EndKey:   []byte("r\x00\x00\x02a"),
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "exceeds the keyspace")
+}
+
+func checkKeyspaceOf(req interface{}) error {
+	mode, reqCtx, keys, ranges := keyspaceKeys(req)
+	return checkKeyspace(mode, reqCtx, keys, ranges)
+}
+
+func TestCheckKeyspaceOfLockRequests(t *testing.T) {
+	ctx := &kvrpcpb.Context{ApiVersion: kvrpcpb.APIVersion_V2, KeyspaceId: 1}
+	lockRequests := func(key []byte) []interface{} {
+		return []interface{}{
+			&kvrpcpb.CheckTxnStatusRequest{Context: ctx, PrimaryKey: key},
+			&kvrpcpb.TxnHeartBeatRequest{Context: ctx, PrimaryLock: key},
+			&kvrpcpb.CheckSecondaryLocksRequest{Context: ctx, Keys: [][]byte{key}},
+			&kvrpcpb.ResolveLockRequest{Context: ctx, Keys: [][]byte{key}},
+			&kvrpcpb.ScanLockRequest{Context: ctx, StartKey: key},
+			&kvrpcpb.PhysicalScanLockRequest{Context: ctx, StartKey: key},
+		}
+	}
+	for _, req := range lockRequests([]byte("x\x00\x00\x01k")) {
+		require.NoError(t, checkKeyspaceOf(req), "%T", req)
+	}
+	for _, req := range lockRequests([]byte("x\x00\x00\x02k")) {
+		require.Error(t, checkKeyspaceOf(req), "%T", req)
+	}
+}
+
+func TestClampKeyspaceEnd(t *testing.T) {
+	req := &kvrpcpb.ScanRequest{StartKey: []byte("x\x00\x00\x01a")}
+	clampKeyspaceEnd(req)
+	require.Equal(t, []byte("x\x00\x00\x02"), req.EndKey)
+	lockReq := &kvrpcpb.ScanLockRequest{StartKey: []byte("x\x00\x00\x01a")}
+	clampKeyspaceEnd(lockReq)
+	require.Equal(t, []byte("x\x00\x00\x02"), lockReq.EndKey)
+	// The keyspace end carries into the mode byte.
+	require.Equal(t, []byte("y\x00\x00\x00"), keyspaceEndKey([]byte("x\xff\xff\xffa")))
+}
@@ -0,0 +1,81 @@
+package tikv
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// AuthTokenHeader is the gRPC metadata key that carries the shared secret token.
+const AuthTokenHeader = "authorization"
+
+// TokenAuthInterceptors returns the interceptors that reject the requests without the shared secret token in the
+// metadata, the value can be either the token or "Bearer <token>".
+func TokenAuthInterceptors(token string) (grpc.UnaryServerInterceptor, grpc.StreamServerInterceptor) {
+	unary := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := checkAuthToken(ctx, token); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+	stream := func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := checkAuthToken(ss.Context(), token); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+	return unary, stream
+}
+
+// ChainUnaryInterceptors chains the interceptors into one, the first one is the outermost.
+func ChainUnaryInterceptors(interceptors ...grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		chained := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, next := interceptors[i], chained
+			chained = func(ctx context.Context, req interface{}) (interface{}, error) {
+				return interceptor(ctx, req, info, next)
+			}
+		}
+		return chained(ctx, req)
+	}
+}
+
+func checkAuthToken(ctx context.Context, token string) error {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return status.Error(codes.Unauthenticated, "missing auth token")
+	}
+	for _, val := range md[AuthTokenHeader] {
+		if validToken(val, token) {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "invalid auth token")
+}
+
+func validToken(val, token string) bool {
+	val = strings.TrimPrefix(val, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(val), []byte(token)) == 1
+}
+
+// requireToken rejects the HTTP requests other than GET without the token in the Authorization header, nothing is
+// checked if the token is empty.
+func requireToken(token string, handler http.HandlerFunc) http.HandlerFunc {
+	if token == "" {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && !validToken(r.Header.Get("Authorization"), token) {
+			http.Error(w, "invalid auth token", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
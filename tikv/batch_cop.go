@@ -0,0 +1,83 @@
+package tikv
+
+import (
+	"github.com/pingcap/kvproto/pkg/coprocessor"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/kvproto/pkg/tikvpb"
+	"github.com/pingcap/tidb/kv"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// BatchCoprocessor handles the DAG request on every region of the request and streams a response per region, so
+// the client pays one RPC for the regions of a store. The regions with a region error are returned in RetryRegions
+// for the client to retry with the normal Coprocessor RPC.
+// The unary interceptors don't see the stream, so the keyspace is checked and the request is admitted here.
+func (svr *Server) BatchCoprocessor(req *coprocessor.BatchRequest, stream tikvpb.Tikv_BatchCoprocessorServer) error {
+	if req.Tp != kv.ReqTypeDAG {
+		return errUnimplemented("BatchCoprocessor: request type %d is not supported", req.Tp)
+	}
+	var reqCtx kvrpcpb.Context
+	if req.GetContext() != nil {
+		reqCtx = *req.GetContext()
+	}
+	if reqCtx.GetApiVersion() == kvrpcpb.APIVersion_V2 {
+		mode, _, _, ranges := keyspaceKeys(req)
+		if err := checkKeyspace(mode, &reqCtx, nil, ranges); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	if svr.admission != nil {
+		release, err := svr.admission.admit(stream.Context(), req)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+	var retryRegions []*metapb.Region
+	for _, ri := range req.Regions {
+		ctx := reqCtx
+		ctx.RegionId = ri.RegionId
+		ctx.RegionEpoch = ri.RegionEpoch
+		resp, retry := svr.handleBatchCopRegion(&ctx, req, ri)
+		if retry {
+			retryRegions = append(retryRegions, &metapb.Region{Id: ri.RegionId, RegionEpoch: ri.RegionEpoch})
+			continue
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+		if resp.OtherError != "" {
+			// The client fails the whole request on the error, the other regions are not read.
+			return nil
+		}
+	}
+	if len(retryRegions) > 0 {
+		return stream.Send(&coprocessor.BatchResponse{RetryRegions: retryRegions})
+	}
+	return nil
+}
+
+// handleBatchCopRegion handles the request on a region, retry is true if the region is not served as requested.
+func (svr *Server) handleBatchCopRegion(ctx *kvrpcpb.Context, req *coprocessor.BatchRequest, ri *coprocessor.RegionInfo) (resp *coprocessor.BatchResponse, retry bool) {
+	reqCtx, err := newRequestCtx(svr, ctx, "BatchCoprocessor")
+	if err != nil {
+		return &coprocessor.BatchResponse{OtherError: convertToKeyError(err).String()}, false
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return nil, true
+	}
+	copResp := svr.handleCopDAGRequest(reqCtx, &coprocessor.Request{
+		Context: ctx,
+		Tp:      req.Tp,
+		Data:    req.Data,
+		Ranges:  ri.Ranges,
+	})
+	// BatchResponse has no lock info, the client resolves the lock when it retries the region.
+	if copResp.RegionError != nil || copResp.Locked != nil {
+		return nil, true
+	}
+	return &coprocessor.BatchResponse{Data: copResp.Data, OtherError: copResp.OtherError, ExecDetails: copResp.ExecDetails}, false
+}
@@ -0,0 +1,87 @@
+package tikv_test
+
+import (
+	"testing"
+
+	"github.com/ngaut/faketikv/testutil"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestBatchGetOldVersions(t *testing.T) {
+	c := newTestCluster(t)
+	keys := [][]byte{[]byte("t1"), []byte("t2"), []byte("t3"), []byte("t4")}
+	// The versions of the keys are interleaved, so the old versions of a key are between the ones of other keys.
+	var versionTSs []uint64
+	for v := 0; v < 3; v++ {
+		for _, key := range keys {
+			_, err := c.Put(key, versionValue(key, v))
+			require.NoError(t, err)
+		}
+		versionTSs = append(versionTSs, c.AllocTS())
+	}
+	checkBatchGet(t, c, keys, versionTSs[0], 0)
+	checkBatchGet(t, c, keys, versionTSs[1], 1)
+	// The keys behind the position of the old iterator are sought.
+	checkBatchGet(t, c, [][]byte{keys[3], keys[2], keys[1], keys[0]}, versionTSs[0], 0)
+	checkBatchGet(t, c, [][]byte{keys[1], keys[1], keys[2]}, versionTSs[1], 1)
+}
+
+func versionValue(key []byte, v int) []byte {
+	return append(append([]byte(nil), key...), byte('0'+v))
+}
+
+// checkBatchGet checks every key is read at the version v.
+func checkBatchGet(t *testing.T, c *testutil.Cluster, keys [][]byte, ts uint64, v int) {
+	pairs := batchGet(t, c, keys, ts)
+	require.Len(t, pairs, len(keys))
+	for i, pair := range pairs {
+		require.Nil(t, pair.Error)
+		require.Equal(t, keys[i], pair.Key)
+		require.Equal(t, versionValue(keys[i], v), pair.Value)
+	}
+}
+
+func TestBatchGetLockedKeys(t *testing.T) {
+	c := newTestCluster(t)
+	k1, k2, k3 := []byte("t1"), []byte("t2"), []byte("t3")
+	for _, key := range [][]byte{k1, k2, k3} {
+		_, err := c.Put(key, key)
+		require.NoError(t, err)
+	}
+	require.Empty(t, lockedKeys(t, batchGet(t, c, [][]byte{k1, k2, k3}, c.AllocTS())))
+
+	// Only the locked keys have errors, the other keys are read.
+	startTS := c.AllocTS()
+	prewrite(t, c, startTS, primaryKey, k2)
+	require.Equal(t, [][]byte{k2}, lockedKeys(t, batchGet(t, c, [][]byte{k1, k2, k3}, c.AllocTS())))
+	prewrite(t, c, startTS, primaryKey, k1, k3)
+	require.Len(t, lockedKeys(t, batchGet(t, c, [][]byte{k1, k2, k3}, c.AllocTS())), 3)
+}
+
+// lockedKeys returns the keys of the pairs with lock errors, and checks the value of each other key is the key.
+func lockedKeys(t *testing.T, pairs []*kvrpcpb.KvPair) [][]byte {
+	var locked [][]byte
+	for _, pair := range pairs {
+		if pair.Error != nil {
+			require.NotNil(t, pair.Error.Locked)
+			require.Equal(t, pair.Key, pair.Error.Locked.Key)
+			locked = append(locked, pair.Key)
+			continue
+		}
+		require.Equal(t, pair.Key, pair.Value)
+	}
+	return locked
+}
+
+func batchGet(t *testing.T, c *testutil.Cluster, keys [][]byte, ts uint64) []*kvrpcpb.KvPair {
+	resp, err := c.Server.KvBatchGet(context.Background(), &kvrpcpb.BatchGetRequest{
+		Context: regionCtx(t, c, keys[0]),
+		Keys:    keys,
+		Version: ts,
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp.RegionError)
+	return resp.Pairs
+}
@@ -0,0 +1,81 @@
+package tikv
+
+import (
+	"hash/crc64"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/juju/errors"
+	"github.com/pingcap/kvproto/pkg/coprocessor"
+	"github.com/pingcap/tidb/kv"
+	tipb "github.com/pingcap/tipb/go-tipb"
+)
+
+// handleCopChecksumRequest returns the Crc64_Xor checksum of the pairs visible at the start ts in the ranges, the
+// checksum of a pair is the crc64 of its key and value like RawChecksum.
+func (svr *Server) handleCopChecksumRequest(reqCtx *requestCtx, req *coprocessor.Request) *coprocessor.Response {
+	resp := &coprocessor.Response{}
+	checksumReq := new(tipb.ChecksumRequest)
+	err := proto.Unmarshal(req.Data, checksumReq)
+	if err != nil {
+		resp.OtherError = err.Error()
+		return resp
+	}
+	if checksumReq.Algorithm != tipb.ChecksumAlgorithm_Crc64_Xor {
+		resp.OtherError = errors.Errorf("unsupported checksum algorithm %s", checksumReq.Algorithm).Error()
+		return resp
+	}
+	startTS := svr.readTS(checksumReq.StartTs)
+	ranges, err := svr.extractKVRanges(reqCtx.regCtx, req.Ranges, false)
+	if err != nil {
+		resp.OtherError = err.Error()
+		return resp
+	}
+	checksumResp, err := svr.mvccStore.checksum(reqCtx, ranges, startTS)
+	if err != nil {
+		if locked, ok := errors.Cause(err).(*ErrLocked); ok {
+			resp.Locked = locked.lockInfo()
+		} else {
+			resp.OtherError = err.Error()
+		}
+		return resp
+	}
+	data, err := proto.Marshal(checksumResp)
+	if err != nil {
+		resp.OtherError = err.Error()
+		return resp
+	}
+	resp.Data = data
+	return resp
+}
+
+func (store *MVCCStore) checksum(reqCtx *requestCtx, ranges []kv.KeyRange, startTS uint64) (*tipb.ChecksumResponse, error) {
+	for _, ran := range ranges {
+		if err := store.CheckRangeLock(startTS, ran.StartKey, ran.EndKey); err != nil {
+			return nil, err
+		}
+	}
+	resp := new(tipb.ChecksumResponse)
+	reader := reqCtx.getDBReader()
+	for _, ran := range ranges {
+		seekKey := ran.StartKey
+		for {
+			pairs := reader.Scan(seekKey, ran.EndKey, scanLimit, startTS, false, 0, 0)
+			for _, pair := range pairs {
+				if pair.Err != nil {
+					return nil, pair.Err
+				}
+				digest := crc64.New(rawChecksumTable)
+				digest.Write(pair.Key)
+				digest.Write(pair.Value)
+				resp.Checksum ^= digest.Sum64()
+				resp.TotalKvs++
+				resp.TotalBytes += uint64(len(pair.Key) + len(pair.Value))
+			}
+			if len(pairs) < scanLimit {
+				break
+			}
+			seekKey = []byte(kv.Key(pairs[len(pairs)-1].Key).PrefixNext())
+		}
+	}
+	return resp, nil
+}
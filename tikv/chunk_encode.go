@@ -0,0 +1,83 @@
+package tikv
+
+import (
+	"github.com/juju/errors"
+	"github.com/pingcap/tidb/tablecodec"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/util/chunk"
+	tipb "github.com/pingcap/tipb/go-tipb"
+)
+
+// useChunkEncoding returns true if the response of the DAG can be encoded in the chunk format. The output types of
+// the aggregations are not known here, so their responses are encoded by datums, TiDB decodes the response by its
+// encode type.
+func useChunkEncoding(dagReq *tipb.DAGRequest) bool {
+	if dagReq.EncodeType != tipb.EncodeType_TypeChunk {
+		return false
+	}
+	for _, exec := range dagReq.Executors {
+		switch exec.Tp {
+		case tipb.ExecType_TypeAggregation, tipb.ExecType_TypeStreamAgg:
+			return false
+		}
+	}
+	return true
+}
+
+// chunkEncoder encodes the output columns of the rows into the chunks of TiDB, a tipb.Chunk holds an encoded chunk
+// of rowsPerChunk rows.
+type chunkEncoder struct {
+	evalCtx  *evalContext
+	offsets  []uint32
+	fieldTps []*types.FieldType
+	codec    *chunk.Codec
+	chk      *chunk.Chunk
+	chunks   []tipb.Chunk
+}
+
+func newChunkEncoder(evalCtx *evalContext, offsets []uint32) *chunkEncoder {
+	fieldTps := make([]*types.FieldType, 0, len(offsets))
+	for _, offset := range offsets {
+		fieldTps = append(fieldTps, evalCtx.fieldTps[offset])
+	}
+	return &chunkEncoder{
+		evalCtx:  evalCtx,
+		offsets:  offsets,
+		fieldTps: fieldTps,
+		codec:    chunk.NewCodec(fieldTps),
+		chk:      chunk.NewChunkWithCapacity(fieldTps, rowsPerChunk),
+	}
+}
+
+func (e *chunkEncoder) appendRow(reqCtx *requestCtx, row [][]byte) error {
+	var size int
+	for _, offset := range e.offsets {
+		size += len(row[offset])
+	}
+	if err := reqCtx.consumeMem(size); err != nil {
+		return err
+	}
+	for i, offset := range e.offsets {
+		d, err := tablecodec.DecodeColumnValue(row[offset], e.fieldTps[i], e.evalCtx.sc.TimeZone)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		e.chk.AppendDatum(i, &d)
+	}
+	if e.chk.NumRows() == rowsPerChunk {
+		e.flush()
+	}
+	return nil
+}
+
+func (e *chunkEncoder) flush() {
+	e.chunks = append(e.chunks, tipb.Chunk{RowsData: e.codec.Encode(e.chk)})
+	e.chk.Reset()
+}
+
+func (e *chunkEncoder) finish() []tipb.Chunk {
+	if e.chk.NumRows() > 0 {
+		e.flush()
+	}
+	return e.chunks
+}
@@ -15,7 +15,6 @@ package tikv
 
 import (
 	"context"
-	"github.com/ngaut/log"
 	"strings"
 	"sync"
 	"time"
@@ -35,6 +34,8 @@ type Client interface {
 	PutStore(ctx context.Context, store *metapb.Store) error
 	ReportRegion(regInfo *regionCtx)
 	StoreHeartbeat(ctx context.Context, stats *pdpb.StoreStats) error
+	GetGCSafePoint(ctx context.Context) (uint64, error)
+	GetRegion(ctx context.Context, key []byte) (*metapb.Region, *metapb.Peer, error)
 	Close()
 }
 
@@ -284,6 +285,34 @@ func (c *client) StoreHeartbeat(ctx context.Context, stats *pdpb.StoreStats) err
 	return nil
 }
 
+func (c *client) GetGCSafePoint(ctx context.Context) (uint64, error) {
+	ctx, cancel := context.WithTimeout(ctx, pdTimeout)
+	resp, err := c.pdClient().GetGCSafePoint(ctx, &pdpb.GetGCSafePointRequest{
+		Header: c.requestHeader(),
+	})
+	cancel()
+	if err != nil {
+		return 0, err
+	}
+	return resp.GetSafePoint(), nil
+}
+
+func (c *client) GetRegion(ctx context.Context, key []byte) (*metapb.Region, *metapb.Peer, error) {
+	ctx, cancel := context.WithTimeout(ctx, pdTimeout)
+	resp, err := c.pdClient().GetRegion(ctx, &pdpb.GetRegionRequest{
+		Header:    c.requestHeader(),
+		RegionKey: key,
+	})
+	cancel()
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.Header.GetError() != nil {
+		return nil, nil, errors.New(resp.Header.GetError().String())
+	}
+	return resp.GetRegion(), resp.GetLeader(), nil
+}
+
 func (c *client) ReportRegion(regInfo *regionCtx) {
 	c.regionCh <- regInfo
 }
@@ -0,0 +1,144 @@
+package tikv
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of the wall clock time used by the time-dependent behaviors: deadlock entry expiry,
+// lock wait timeouts, rollback GC intervals, write throttling and keyviz slices.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	// NewTimer is used instead of After when the wait may end before d, so the timer can be stopped.
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a timer of a Clock.
+type Timer interface {
+	C() <-chan time.Time
+	// Stop prevents the timer from firing, it returns false if the timer has already fired or been stopped.
+	Stop() bool
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func (systemClock) NewTimer(d time.Duration) Timer { return systemTimer{time.NewTimer(d)} }
+
+type systemTimer struct {
+	*time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time { return t.Timer.C }
+
+// replaceableClock lets SetClock race with the workers reading the clock.
+type replaceableClock struct {
+	mu sync.RWMutex
+	c  Clock
+}
+
+func (r *replaceableClock) get() Clock {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.c
+}
+
+func (r *replaceableClock) Now() time.Time { return r.get().Now() }
+
+func (r *replaceableClock) After(d time.Duration) <-chan time.Time { return r.get().After(d) }
+
+func (r *replaceableClock) NewTimer(d time.Duration) Timer { return r.get().NewTimer(d) }
+
+var clock = &replaceableClock{c: systemClock{}}
+
+// SetClock replaces the clock, the waits already started on the old clock are not affected.
+func SetClock(c Clock) {
+	clock.mu.Lock()
+	clock.c = c
+	clock.mu.Unlock()
+}
+
+// MockClock is a Clock that only moves forward by Advance, it lets tests trigger time-dependent behaviors
+// without sleeping.
+type MockClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []mockWaiter
+}
+
+type mockWaiter struct {
+	deadline time.Time
+	ch       chan time.Time
+}
+
+type mockTimer struct {
+	clock *MockClock
+	ch    chan time.Time
+}
+
+// NewMockClock creates a MockClock starting at now.
+func NewMockClock(now time.Time) *MockClock {
+	return &MockClock{now: now}
+}
+
+// Now implements the Clock interface.
+func (c *MockClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// After implements the Clock interface, the channel fires when the clock is advanced past the deadline.
+func (c *MockClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+// NewTimer implements the Clock interface.
+func (c *MockClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &mockTimer{clock: c, ch: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.ch <- c.now
+		return t
+	}
+	c.waiters = append(c.waiters, mockWaiter{deadline: c.now.Add(d), ch: t.ch})
+	return t
+}
+
+func (t *mockTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *mockTimer) Stop() bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, w := range c.waiters {
+		if w.ch == t.ch {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Advance moves the clock forward by d and fires the expired After channels.
+func (c *MockClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if !w.deadline.After(c.now) {
+			w.ch <- c.now
+			continue
+		}
+		waiters = append(waiters, w)
+	}
+	c.waiters = waiters
+}
@@ -0,0 +1,80 @@
+package tikv
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMockClock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	c := NewMockClock(start)
+	timer := c.NewTimer(time.Second)
+	c.Advance(time.Second - 1)
+	require.False(t, timerFired(t, c, timer))
+	c.Advance(1)
+	require.Equal(t, start.Add(time.Second), c.Now())
+	require.True(t, timerFired(t, c, timer))
+	require.False(t, timer.Stop())
+	require.True(t, timerFired(t, c, c.NewTimer(0)))
+
+	// A stopped timer never fires and is removed from the clock.
+	timer = c.NewTimer(time.Second)
+	require.True(t, timer.Stop())
+	require.Empty(t, c.waiters)
+	c.Advance(time.Second)
+	require.False(t, timerFired(t, c, timer))
+}
+
+func timerFired(t *testing.T, c *MockClock, timer Timer) bool {
+	select {
+	case now := <-timer.C():
+		require.Equal(t, c.Now(), now)
+		return true
+	default:
+		return false
+	}
+}
+
+func TestLockWaiterTimeout(t *testing.T) {
+	c := NewMockClock(time.Unix(1000, 0))
+	SetClock(c)
+	defer SetClock(systemClock{})
+	require.True(t, waitLock(c, true))
+	// The timer of the wait is stopped either way.
+	require.Empty(t, c.waiters)
+	require.False(t, waitLock(c, false))
+	require.Empty(t, c.waiters)
+}
+
+// waitLock waits for a lock for a second, which is woken up or times out by advancing the clock, and returns whether
+// it's woken up.
+func waitLock(c *MockClock, wakeUp bool) (wokenUp bool) {
+	m := newLockWaiterManager()
+	w := m.newWaiter(2, 1, 1, nil)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		wokenUp = m.wait(w, time.Second)
+	}()
+	if wakeUp {
+		m.wakeUp([]uint64{1})
+	} else {
+		// Advance after the wait starts its timer.
+		for {
+			c.mu.Lock()
+			n := len(c.waiters)
+			c.mu.Unlock()
+			if n > 0 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		c.Advance(time.Second)
+	}
+	wg.Wait()
+	return wokenUp
+}
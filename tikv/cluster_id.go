@@ -0,0 +1,71 @@
+package tikv
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/coocood/badger"
+	"github.com/juju/errors"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+)
+
+// InternalClusterIDKey stores the id of the cluster the data dir is bootstrapped in.
+var InternalClusterIDKey = append(InternalKeyPrefix, "cluster_id"...)
+
+// ErrClusterIDMismatch is returned when the data dir or a request belongs to another cluster.
+type ErrClusterIDMismatch struct {
+	Expected uint64
+	Actual   uint64
+}
+
+func (e *ErrClusterIDMismatch) Error() string {
+	return fmt.Sprintf("cluster id mismatch, expected %d, actual %d", e.Expected, e.Actual)
+}
+
+// fenceClusterID checks the cluster id stored in the data dir is the id of PD, so the data dir is not served in
+// another cluster. The id is stored if the data dir has none, which is a new or an upgraded data dir, unless the db
+// is read-only.
+func (rm *RegionManager) fenceClusterID() error {
+	var stored uint64
+	err := rm.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(InternalClusterIDKey)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return errors.Trace(err)
+		}
+		val, err := item.Value()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		stored = binary.LittleEndian.Uint64(val)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if stored != 0 {
+		if stored != rm.clusterID {
+			return &ErrClusterIDMismatch{Expected: stored, Actual: rm.clusterID}
+		}
+		return nil
+	}
+	if rm.readOnly {
+		return nil
+	}
+	val := make([]byte, 8)
+	binary.LittleEndian.PutUint64(val, rm.clusterID)
+	return rm.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(InternalClusterIDKey, val)
+	})
+}
+
+// checkClusterID rejects the requests sent to another cluster, the requests without a cluster id are accepted.
+func (svr *Server) checkClusterID(ctx *kvrpcpb.Context) error {
+	clusterID := svr.regionManager.clusterID
+	if id := ctx.GetClusterId(); id != 0 && id != clusterID {
+		return &ErrClusterIDMismatch{Expected: clusterID, Actual: id}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package tikv_test
+
+import (
+	"testing"
+
+	"github.com/ngaut/faketikv/testutil"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// newTestCluster starts a cluster of two regions split at 0x80, which is closed when the test ends.
+func newTestCluster(t *testing.T) *testutil.Cluster {
+	c, err := testutil.NewCluster(testutil.Options{Regions: 2})
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// newTableCluster starts a cluster with the region [t, u) of the table keys, which is closed when the test ends. The
+// scans are only served by the regions of the table and the meta keys.
+func newTableCluster(t *testing.T) *testutil.Cluster {
+	c, err := testutil.NewCluster(testutil.Options{SplitKeys: [][]byte{{'t'}, {'u'}}})
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func regionCtx(t *testing.T, c *testutil.Cluster, key []byte) *kvrpcpb.Context {
+	ctx, err := c.Context(key)
+	require.NoError(t, err)
+	return ctx
+}
+
+// prewrite prewrites the puts of the keys with min commit ts, each key in its own request.
+func prewrite(t *testing.T, c *testutil.Cluster, startTS uint64, primary []byte, keys ...[]byte) {
+	for _, key := range keys {
+		require.Empty(t, tryPrewrite(t, c, startTS, primary, key))
+	}
+}
+
+func tryPrewrite(t *testing.T, c *testutil.Cluster, startTS uint64, primary, key []byte) []*kvrpcpb.KeyError {
+	resp, err := c.Server.KvPrewrite(context.Background(), &kvrpcpb.PrewriteRequest{
+		Context:      regionCtx(t, c, key),
+		Mutations:    []*kvrpcpb.Mutation{{Op: kvrpcpb.Op_Put, Key: key, Value: key}},
+		PrimaryLock:  primary,
+		StartVersion: startTS,
+		LockTtl:      3000,
+		MinCommitTs:  startTS + 1,
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp.RegionError)
+	return resp.Errors
+}
@@ -0,0 +1,313 @@
+package tikv
+
+import (
+	"bytes"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/tidb/expression"
+	"github.com/pingcap/tidb/mysql"
+	"github.com/pingcap/tidb/sessionctx/stmtctx"
+	"github.com/pingcap/tidb/types"
+	tipb "github.com/pingcap/tipb/go-tipb"
+)
+
+// collationName returns the name of the collation id, the new collation framework of TiDB sends the negative ids.
+func collationName(id int32) string {
+	if id < 0 {
+		id = -id
+	}
+	return mysql.Collations[uint8(id)]
+}
+
+// collator maps a string to the key compared instead of it, nil compares the strings in binary.
+type collator func(s []byte) []byte
+
+// collatorOf returns the collator of the collation id, the positive ids are the old collations that compare in
+// binary.
+func collatorOf(id int32) (collator, error) {
+	if id >= 0 {
+		return nil, nil
+	}
+	switch -id {
+	case 63: // binary
+		return nil, nil
+	case 46, 83, 65, 47: // utf8mb4_bin, utf8_bin, ascii_bin, latin1_bin
+		return trimPadding, nil
+	case 45, 33: // utf8mb4_general_ci, utf8_general_ci
+		return generalCIKey, nil
+	case 224, 192: // utf8mb4_unicode_ci, utf8_unicode_ci
+		// The weights of UCA 4.0.0 are not implemented, comparing by a close collation would return wrong rows.
+		return nil, errors.Errorf("collation %s is not supported, the UCA weights are not implemented", collationName(id))
+	}
+	return nil, errors.Errorf("collation %s is not supported", collationName(id))
+}
+
+// collatorOfExpr returns the collator of the field type of the expression.
+func collatorOfExpr(expr *tipb.Expr) (collator, error) {
+	return collatorOf(expr.GetFieldType().GetCollate())
+}
+
+// collateDatum returns the datum compared instead of d.
+func collateDatum(c collator, d types.Datum) types.Datum {
+	if c == nil {
+		return d
+	}
+	switch d.Kind() {
+	case types.KindString, types.KindBytes:
+		return types.NewBytesDatum(c(d.GetBytes()))
+	}
+	return d
+}
+
+// trimPadding trims the trailing spaces, the new collations are PAD SPACE.
+func trimPadding(s []byte) []byte {
+	return bytes.TrimRight(s, " ")
+}
+
+// generalCIKey returns the weights of the runes like utf8mb4_general_ci, the weight of a Latin-1 letter is its
+// upper case letter without the accent and the weights of the other runes are their upper case runes. The runes out
+// of the BMP have the same weight.
+func generalCIKey(s []byte) []byte {
+	s = trimPadding(s)
+	key := make([]byte, 0, 2*len(s))
+	for len(s) > 0 {
+		r, size := utf8.DecodeRune(s)
+		s = s[size:]
+		switch {
+		case r > 0xFFFF:
+			r = 0xFFFD
+		case r >= 0xC0 && r <= 0xFF:
+			r = latin1Weights[r-0xC0]
+		default:
+			r = unicode.ToUpper(r)
+		}
+		key = append(key, byte(r>>8), byte(r))
+	}
+	return key
+}
+
+// latin1Weights are the weights of U+00C0 to U+00FF in utf8mb4_general_ci.
+var latin1Weights = [64]rune{
+	'A', 'A', 'A', 'A', 'A', 'A', 0xC6, 'C', 'E', 'E', 'E', 'E', 'I', 'I', 'I', 'I',
+	0xD0, 'N', 'O', 'O', 'O', 'O', 'O', 0xD7, 0xD8, 'U', 'U', 'U', 'U', 'Y', 0xDE, 'S',
+	'A', 'A', 'A', 'A', 'A', 'A', 0xC6, 'C', 'E', 'E', 'E', 'E', 'I', 'I', 'I', 'I',
+	0xD0, 'N', 'O', 'O', 'O', 'O', 'O', 0xF7, 0xD8, 'U', 'U', 'U', 'U', 'Y', 0xDE, 'Y',
+}
+
+// condition is a condition of the selection.
+type condition interface {
+	Eval(row types.DatumRow) (types.Datum, error)
+}
+
+// collatedCompare is a string comparison evaluated by the collation keys of its arguments, the builtin functions
+// of TiDB compare the strings in binary.
+type collatedCompare struct {
+	sig  tipb.ScalarFuncSig
+	args []expression.Expression
+	key  collator
+}
+
+func (c *collatedCompare) Eval(row types.DatumRow) (types.Datum, error) {
+	a, err := c.args[0].Eval(row)
+	if err != nil {
+		return types.Datum{}, errors.Trace(err)
+	}
+	b, err := c.args[1].Eval(row)
+	if err != nil {
+		return types.Datum{}, errors.Trace(err)
+	}
+	if a.IsNull() || b.IsNull() {
+		if c.sig == tipb.ScalarFuncSig_NullEQString {
+			return types.NewIntDatum(boolToInt64(a.IsNull() && b.IsNull())), nil
+		}
+		return types.Datum{}, nil
+	}
+	sa, err := a.ToString()
+	if err != nil {
+		return types.Datum{}, errors.Trace(err)
+	}
+	sb, err := b.ToString()
+	if err != nil {
+		return types.Datum{}, errors.Trace(err)
+	}
+	cmp := bytes.Compare(c.key([]byte(sa)), c.key([]byte(sb)))
+	var res bool
+	switch c.sig {
+	case tipb.ScalarFuncSig_LTString:
+		res = cmp < 0
+	case tipb.ScalarFuncSig_LEString:
+		res = cmp <= 0
+	case tipb.ScalarFuncSig_GTString:
+		res = cmp > 0
+	case tipb.ScalarFuncSig_GEString:
+		res = cmp >= 0
+	case tipb.ScalarFuncSig_NEString:
+		res = cmp != 0
+	default:
+		res = cmp == 0
+	}
+	return types.NewIntDatum(boolToInt64(res)), nil
+}
+
+// collatedIn is IN of strings evaluated by the collation keys of its arguments.
+type collatedIn struct {
+	args []expression.Expression
+	key  collator
+}
+
+func (c *collatedIn) Eval(row types.DatumRow) (types.Datum, error) {
+	a, err := c.args[0].Eval(row)
+	if err != nil {
+		return types.Datum{}, errors.Trace(err)
+	}
+	if a.IsNull() {
+		return types.Datum{}, nil
+	}
+	sa, err := a.ToString()
+	if err != nil {
+		return types.Datum{}, errors.Trace(err)
+	}
+	ka := c.key([]byte(sa))
+	hasNull := false
+	for _, arg := range c.args[1:] {
+		b, err := arg.Eval(row)
+		if err != nil {
+			return types.Datum{}, errors.Trace(err)
+		}
+		if b.IsNull() {
+			hasNull = true
+			continue
+		}
+		sb, err := b.ToString()
+		if err != nil {
+			return types.Datum{}, errors.Trace(err)
+		}
+		if bytes.Equal(ka, c.key([]byte(sb))) {
+			return types.NewIntDatum(1), nil
+		}
+	}
+	if hasNull {
+		return types.Datum{}, nil
+	}
+	return types.NewIntDatum(0), nil
+}
+
+func boolToInt64(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func isStringCompare(expr *tipb.Expr) bool {
+	if expr.GetTp() != tipb.ExprType_ScalarFunc {
+		return false
+	}
+	switch expr.Sig {
+	case tipb.ScalarFuncSig_LTString, tipb.ScalarFuncSig_LEString, tipb.ScalarFuncSig_GTString,
+		tipb.ScalarFuncSig_GEString, tipb.ScalarFuncSig_EQString, tipb.ScalarFuncSig_NEString,
+		tipb.ScalarFuncSig_NullEQString:
+		return true
+	}
+	return false
+}
+
+// isCollatedFunc returns whether the result of the string function depends on the collation, like the comparisons,
+// IN, LIKE and STRCMP.
+func isCollatedFunc(expr *tipb.Expr) bool {
+	if isStringCompare(expr) {
+		return true
+	}
+	if expr.GetTp() != tipb.ExprType_ScalarFunc {
+		return false
+	}
+	switch expr.Sig {
+	case tipb.ScalarFuncSig_InString, tipb.ScalarFuncSig_LikeSig, tipb.ScalarFuncSig_Strcmp:
+		return true
+	}
+	return false
+}
+
+// convertToConditions converts the conditions of a selection. The string comparisons of a collation are evaluated
+// by collatedCompare and IN of strings by collatedIn, they are supported at the top of a condition only, which is
+// where TiDB puts the comparisons of the CNF conditions. MEMBER OF is evaluated by jsonMemberOf, at the top or under
+// NOT, AND and OR. LIKE and STRCMP of a collation are not supported.
+func convertToConditions(sc *stmtctx.StatementContext, fieldTps []*types.FieldType, pbConds []*tipb.Expr) ([]condition, error) {
+	conds := make([]condition, 0, len(pbConds))
+	for _, pbCond := range pbConds {
+		if hasJSONMemberOf(pbCond) {
+			cond, err := convertMemberOfCondition(sc, fieldTps, pbCond)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			conds = append(conds, cond)
+			continue
+		}
+		if isStringCompare(pbCond) || pbCond.GetSig() == tipb.ScalarFuncSig_InString {
+			key, err := collatorOfExpr(pbCond)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			if key != nil {
+				if err = checkNoCollatedCompare(pbCond.Children); err != nil {
+					return nil, errors.Trace(err)
+				}
+				args, err := convertToExprs(sc, fieldTps, pbCond.Children)
+				if err != nil {
+					return nil, errors.Trace(err)
+				}
+				if pbCond.Sig == tipb.ScalarFuncSig_InString {
+					conds = append(conds, &collatedIn{args: args, key: key})
+				} else {
+					conds = append(conds, &collatedCompare{sig: pbCond.Sig, args: args, key: key})
+				}
+				continue
+			}
+		}
+		if err := checkNoCollatedCompare([]*tipb.Expr{pbCond}); err != nil {
+			return nil, errors.Trace(err)
+		}
+		cond, err := expression.PBToExpr(pbCond, fieldTps, sc)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		conds = append(conds, cond)
+	}
+	return conds, nil
+}
+
+// checkNoCollatedCompare returns an error if the expressions have a string comparison, IN, LIKE or STRCMP of a
+// collation, which would be evaluated in binary and return results different from TiDB.
+func checkNoCollatedCompare(exprs []*tipb.Expr) error {
+	for _, expr := range exprs {
+		if isCollatedFunc(expr) {
+			key, err := collatorOfExpr(expr)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if key != nil {
+				return errors.Errorf("%s of collation %s is not supported here", expr.Sig,
+					collationName(expr.GetFieldType().GetCollate()))
+			}
+		}
+		if err := checkNoCollatedCompare(expr.Children); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collatorsOfExprs returns the collators of the group by or order by expressions.
+func collatorsOfExprs(exprs []*tipb.Expr) ([]collator, error) {
+	collators := make([]collator, 0, len(exprs))
+	for _, expr := range exprs {
+		c, err := collatorOfExpr(expr)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		collators = append(collators, c)
+	}
+	return collators, nil
+}
@@ -0,0 +1,95 @@
+package tikv
+
+import (
+	"testing"
+
+	"github.com/pingcap/tidb/mysql"
+	"github.com/pingcap/tidb/sessionctx/stmtctx"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/util/codec"
+	tipb "github.com/pingcap/tipb/go-tipb"
+	"github.com/stretchr/testify/require"
+)
+
+const generalCI = -45
+
+func columnExpr(offset int64, collate int32) *tipb.Expr {
+	return &tipb.Expr{
+		Tp:        tipb.ExprType_ColumnRef,
+		Val:       codec.EncodeInt(nil, offset),
+		FieldType: &tipb.FieldType{Tp: int32(mysql.TypeVarString), Collate: collate},
+	}
+}
+
+func stringExpr(s string) *tipb.Expr {
+	return &tipb.Expr{Tp: tipb.ExprType_String, Val: []byte(s)}
+}
+
+func funcExpr(sig tipb.ScalarFuncSig, collate int32, children ...*tipb.Expr) *tipb.Expr {
+	return &tipb.Expr{
+		Tp:        tipb.ExprType_ScalarFunc,
+		Sig:       sig,
+		FieldType: &tipb.FieldType{Tp: int32(mysql.TypeLonglong), Collate: collate},
+		Children:  children,
+	}
+}
+
+func TestCollatedConditions(t *testing.T) {
+	col := columnExpr(0, generalCI)
+	require.Equal(t, int64(1), evalCollatedCond(t, funcExpr(tipb.ScalarFuncSig_EQString, generalCI, col, stringExpr("àbc")), "ABC  "))
+	require.Equal(t, int64(0), evalCollatedCond(t, funcExpr(tipb.ScalarFuncSig_EQString, 0, columnExpr(0, 0), stringExpr("abc")), "ABC"))
+	require.Equal(t, int64(1), evalCollatedCond(t, funcExpr(tipb.ScalarFuncSig_LTString, generalCI, col, stringExpr("B")), "a"))
+	in := funcExpr(tipb.ScalarFuncSig_InString, generalCI, col, stringExpr("x"), stringExpr("Abc"))
+	require.Equal(t, int64(1), evalCollatedCond(t, in, "aBC"))
+	require.Equal(t, int64(0), evalCollatedCond(t, in, "abd"))
+
+	// LIKE and STRCMP under a collation and the unicode_ci collation are not supported.
+	escape := &tipb.Expr{Tp: tipb.ExprType_Int64, Val: codec.EncodeInt(nil, '\\')}
+	checkUnsupportedCond(t, funcExpr(tipb.ScalarFuncSig_LikeSig, generalCI, col, stringExpr("A%"), escape))
+	strcmp := funcExpr(tipb.ScalarFuncSig_Strcmp, generalCI, col, stringExpr("abc"))
+	checkUnsupportedCond(t, funcExpr(tipb.ScalarFuncSig_EQInt, 0, strcmp, &tipb.Expr{Tp: tipb.ExprType_Int64, Val: codec.EncodeInt(nil, 0)}))
+	checkUnsupportedCond(t, funcExpr(tipb.ScalarFuncSig_EQString, -224, columnExpr(0, -224), stringExpr("abc")))
+}
+
+var collationFieldTps = []*types.FieldType{types.NewFieldType(mysql.TypeVarString)}
+
+func evalCollatedCond(t *testing.T, cond *tipb.Expr, val string) int64 {
+	conds, err := convertToConditions(new(stmtctx.StatementContext), collationFieldTps, []*tipb.Expr{cond})
+	require.NoError(t, err)
+	d, err := conds[0].Eval(types.DatumRow{types.NewStringDatum(val)})
+	require.NoError(t, err)
+	return d.GetInt64()
+}
+
+func checkUnsupportedCond(t *testing.T, cond *tipb.Expr) {
+	_, err := convertToConditions(new(stmtctx.StatementContext), collationFieldTps, []*tipb.Expr{cond})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not supported")
+}
+
+func TestCollatedKeys(t *testing.T) {
+	// GROUP BY and TopN compare the collated datums.
+	require.Equal(t, 0, compareCollated(t, generalCI, "abc", "ÀBC "))
+	require.Equal(t, 1, compareCollated(t, 0, "abc", "ABC"))
+	require.Equal(t, 0, compareCollated(t, -46, "abc", "abc  "))
+	require.Equal(t, -1, compareCollated(t, generalCI, "a", "B"))
+	require.Equal(t, 1, compareCollated(t, 0, "a", "B"))
+}
+
+// compareCollated compares a and b under the collation, and checks the hash aggregation, which groups by the encoded
+// keys, agrees with the order.
+func compareCollated(t *testing.T, collate int32, a, b string) int {
+	sc := new(stmtctx.StatementContext)
+	collators, err := collatorsOfExprs([]*tipb.Expr{columnExpr(0, collate)})
+	require.NoError(t, err)
+	da := collateDatum(collators[0], types.NewStringDatum(a))
+	db := collateDatum(collators[0], types.NewStringDatum(b))
+	cmp, err := da.CompareDatum(sc, &db)
+	require.NoError(t, err)
+	ka, err := codec.EncodeValue(sc, nil, da)
+	require.NoError(t, err)
+	kb, err := codec.EncodeValue(sc, nil, db)
+	require.NoError(t, err)
+	require.Equal(t, cmp == 0, string(ka) == string(kb))
+	return cmp
+}
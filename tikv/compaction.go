@@ -0,0 +1,63 @@
+package tikv
+
+import (
+	"sync/atomic"
+)
+
+const (
+	// compactionKeysThreshold is the number of deleted keys that triggers a compaction over the range.
+	compactionKeysThreshold = 1024
+	vlogGCDiscardRatio      = 0.5
+)
+
+type compactionTask struct {
+	startKey []byte
+	endKey   []byte
+}
+
+// compactionWorker reclaims the space of large deleted ranges in background, so the space doesn't wait for
+// the badger compaction to be reclaimed. The table files in the range are not dropped, the writes after the
+// deletion may be in them, only the value log files are rewritten to drop the deleted values.
+type compactionWorker struct {
+	store  *MVCCStore
+	taskCh chan compactionTask
+}
+
+func (w *compactionWorker) run() {
+	store := w.store
+	defer store.wg.Done()
+	for {
+		var task compactionTask
+		select {
+		case <-store.closeCh:
+			return
+		case task = <-w.taskCh:
+		}
+		lsmBefore, vlogBefore := store.db.Size()
+		for store.db.RunValueLogGC(vlogGCDiscardRatio) == nil {
+		}
+		lsmAfter, vlogAfter := store.db.Size()
+		reclaimed := lsmBefore + vlogBefore - lsmAfter - vlogAfter
+		if reclaimed > 0 {
+			atomic.AddInt64(&store.reclaimedBytes, reclaimed)
+		}
+		log.Infof("compact range [%q, %q) reclaimed %d bytes", task.startKey, task.endKey, reclaimed)
+	}
+}
+
+// scheduleCompaction schedules a compaction after the keys in the range are deleted by DeleteRange or GC, the task is dropped if the worker is busy.
+func (store *MVCCStore) scheduleCompaction(startKey, endKey []byte, deletedKeys int) {
+	if deletedKeys < compactionKeysThreshold {
+		return
+	}
+	select {
+	case store.compactionWorker.taskCh <- compactionTask{startKey: safeCopy(startKey), endKey: safeCopy(endKey)}:
+	default:
+		log.Warnf("compaction worker is busy, skip compact range [%q, %q)", startKey, endKey)
+	}
+}
+
+// ReclaimedBytes returns the total bytes reclaimed by the compaction worker.
+func (store *MVCCStore) ReclaimedBytes() int64 {
+	return atomic.LoadInt64(&store.reclaimedBytes)
+}
@@ -0,0 +1,73 @@
+package tikv
+
+import (
+	"hash/crc64"
+
+	"github.com/coocood/badger"
+	"github.com/juju/errors"
+)
+
+var crcTable = crc64.MakeTable(crc64.ECMA)
+
+// ComputeRegionHash computes a checksum of the region's latest and old versions and locks, replicas holding the
+// same data produce the same hash.
+func (store *MVCCStore) ComputeRegionHash(regCtx *regionCtx) (uint64, error) {
+	h := crc64.New(crcTable)
+	ranges := [][2][]byte{{regCtx.startKey, regCtx.endKey}}
+	if len(regCtx.startKey) > 0 {
+		oldEnd := []byte(nil)
+		if len(regCtx.endKey) > 0 {
+			oldEnd = encodeOldKey(regCtx.endKey, maxSystemTS)
+		}
+		ranges = append(ranges, [2][]byte{encodeOldKey(regCtx.startKey, maxSystemTS), oldEnd})
+	}
+	err := store.db.View(func(txn *badger.Txn) error {
+		it := newIterator(txn, false)
+		defer it.Close()
+		for _, r := range ranges {
+			for it.Seek(r[0]); it.Valid(); it.Next() {
+				item := it.Item()
+				if exceedEndKey(item.Key(), r[1]) {
+					break
+				}
+				val, err := item.Value()
+				if err != nil {
+					return errors.Trace(err)
+				}
+				h.Write(item.Key())
+				h.Write(val)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	lockIt := store.lockStore.NewIterator()
+	for lockIt.Seek(regCtx.startKey); lockIt.Valid(); lockIt.Next() {
+		if exceedEndKey(lockIt.Key(), regCtx.endKey) {
+			break
+		}
+		h.Write(lockIt.Key())
+		h.Write(lockIt.Value())
+	}
+	return h.Sum64(), nil
+}
+
+// VerifyRegionHash computes the region hash and returns an error if it differs from the expected one.
+func (store *MVCCStore) VerifyRegionHash(regCtx *regionCtx, expected uint64) error {
+	hash, err := store.ComputeRegionHash(regCtx)
+	if err != nil {
+		return err
+	}
+	if hash != expected {
+		return errors.Errorf("region %d is inconsistent, hash %x, expected %x", regCtx.meta.Id, hash, expected)
+	}
+	return nil
+}
+
+func (rm *RegionManager) getRegionByID(id uint64) *regionCtx {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	return rm.regions[id]
+}
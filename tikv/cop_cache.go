@@ -0,0 +1,70 @@
+package tikv
+
+import (
+	"sync/atomic"
+
+	"github.com/pingcap/kvproto/pkg/coprocessor"
+)
+
+// bumpDataVersion is called after the data or the locks are written. The writes of a request invalidate the cached
+// coprocessor results of its region, the writes without a region, like GC, DeleteRange tasks and range tombstones,
+// invalidate all of them.
+func (store *MVCCStore) bumpDataVersion(reqCtx *requestCtx) {
+	if reqCtx != nil && reqCtx.regCtx != nil {
+		atomic.AddUint64(&reqCtx.regCtx.dataVersion, 1)
+		return
+	}
+	atomic.AddUint64(&store.dataVersion, 1)
+}
+
+// updateMaxCommitTS is called after the committed values are written and before the data version is bumped, so
+// the reader which sees the new version sees the new max commit ts.
+func (store *MVCCStore) updateMaxCommitTS(reqCtx *requestCtx, commitTS uint64) {
+	addr := &store.maxCommitTS
+	if reqCtx != nil && reqCtx.regCtx != nil {
+		addr = &reqCtx.regCtx.maxCommitTS
+	}
+	for {
+		old := atomic.LoadUint64(addr)
+		if commitTS <= old || atomic.CompareAndSwapUint64(addr, old, commitTS) {
+			return
+		}
+	}
+}
+
+// copMaxCommitTS returns the max commit ts of the data read by the coprocessor.
+func (svr *Server) copMaxCommitTS(regCtx *regionCtx) uint64 {
+	maxCommitTS := atomic.LoadUint64(&regCtx.maxCommitTS)
+	if storeTS := atomic.LoadUint64(&svr.mvccStore.maxCommitTS); storeTS > maxCommitTS {
+		maxCommitTS = storeTS
+	}
+	return maxCommitTS
+}
+
+// copDataVersion returns the version of the data of the region read by the coprocessor. Both versions only
+// increase, so their sum changes on every write.
+func (svr *Server) copDataVersion(regCtx *regionCtx) uint64 {
+	return atomic.LoadUint64(&regCtx.dataVersion) + atomic.LoadUint64(&svr.mvccStore.dataVersion)
+}
+
+// handleCopWithCache returns a cache hit without reading if the request enables the cache and the version in the
+// client's cache matches the region's, otherwise the request is handled and the result can be cached with the
+// version read before handling it, so a write during handling makes the cached result stale instead of wrong.
+// The result read before the max commit ts of the region is not the latest data and is not cached.
+func (svr *Server) handleCopWithCache(reqCtx *requestCtx, req *coprocessor.Request, handle func() (*coprocessor.Response, error)) *coprocessor.Response {
+	if !req.IsCacheEnabled {
+		resp, _ := handle()
+		return resp
+	}
+	version := svr.copDataVersion(reqCtx.regCtx)
+	if req.CacheIfMatchVersion == version {
+		return &coprocessor.Response{IsCacheHit: true, CacheLastVersion: version}
+	}
+	maxCommitTS := svr.copMaxCommitTS(reqCtx.regCtx)
+	resp, err := handle()
+	if err == nil && resp.RegionError == nil && reqCtx.readTS >= maxCommitTS {
+		resp.CanBeCached = true
+		resp.CacheLastVersion = version
+	}
+	return resp
+}
@@ -3,6 +3,7 @@ package tikv
 import (
 	"bytes"
 	"io"
+	"sync"
 	"time"
 
 	"github.com/golang/protobuf/proto"
@@ -38,20 +39,41 @@ type dagContext struct {
 }
 
 func (svr *Server) handleCopDAGRequest(reqCtx *requestCtx, req *coprocessor.Request) *coprocessor.Response {
+	resp, _ := svr.execDAGRequest(reqCtx, req)
+	return resp
+}
+
+// execDAGRequest returns the response of the DAG request and the error in it.
+func (svr *Server) execDAGRequest(reqCtx *requestCtx, req *coprocessor.Request) (*coprocessor.Response, error) {
 	startTime := time.Now()
 	resp := &coprocessor.Response{}
 	dagCtx, e, dagReq, err := svr.buildDAGExecutor(reqCtx, req)
 	if err != nil {
 		resp.OtherError = err.Error()
-		return resp
+		return resp, err
 	}
 
 	var (
 		chunks []tipb.Chunk
 		rowCnt int
+		enc    *chunkEncoder
 	)
+	encodeType := tipb.EncodeType_TypeDefault
+	if useChunkEncoding(dagReq) {
+		encodeType = tipb.EncodeType_TypeChunk
+		enc = newChunkEncoder(dagCtx.evalCtx, dagReq.OutputOffsets)
+	}
+	var pagingSize uint64
+	if isPageable(dagReq) {
+		pagingSize = req.PagingSize
+	}
+	paged := false
 	ctx := context.TODO()
 	for {
+		if pagingSize > 0 && uint64(rowCnt) >= pagingSize {
+			paged = true
+			break
+		}
 		var row [][]byte
 		row, err = e.Next(ctx)
 		if err != nil {
@@ -60,15 +82,32 @@ func (svr *Server) handleCopDAGRequest(reqCtx *requestCtx, req *coprocessor.Requ
 		if row == nil {
 			break
 		}
+		if enc != nil {
+			if err = enc.appendRow(reqCtx, row); err != nil {
+				break
+			}
+			rowCnt++
+			continue
+		}
 		data := dummySlice
 		for _, offset := range dagReq.OutputOffsets {
 			data = append(data, row[offset]...)
 		}
+		if err = reqCtx.consumeMem(len(data)); err != nil {
+			break
+		}
 		chunks = appendRow(chunks, data, rowCnt)
 		rowCnt++
 	}
+	if enc != nil {
+		chunks = enc.finish()
+	}
 	warnings := dagCtx.evalCtx.sc.GetWarnings()
-	return buildResp(chunks, e.Counts(), err, warnings, time.Since(startTime))
+	resp = buildResp(chunks, encodeType, e.Counts(), err, warnings, time.Since(startTime))
+	if req.PagingSize > 0 && err == nil {
+		resp.Range = scannedRange(req.Ranges, e, paged)
+	}
+	return resp, err
 }
 
 func (svr *Server) buildDAGExecutor(reqCtx *requestCtx, req *coprocessor.Request) (*dagContext, executor, *tipb.DAGRequest, error) {
@@ -84,8 +123,16 @@ func (svr *Server) buildDAGExecutor(reqCtx *requestCtx, req *coprocessor.Request
 	if err != nil {
 		return nil, nil, nil, errors.Trace(err)
 	}
+	dagReq.StartTs = svr.readTS(dagReq.StartTs)
+	if err = svr.checkCopGCSafePoint(req.Ranges, dagReq.StartTs); err != nil {
+		return nil, nil, nil, errors.Trace(err)
+	}
+	reqCtx.readTS = dagReq.StartTs
 	sc := flagsToStatementContext(dagReq.Flags)
-	sc.TimeZone = time.FixedZone("UTC", int(dagReq.TimeZoneOffset))
+	sc.TimeZone, err = timeZoneOfDAG(dagReq)
+	if err != nil {
+		return nil, nil, nil, errors.Trace(err)
+	}
 	ctx := &dagContext{
 		reqCtx:    reqCtx,
 		dagReq:    dagReq,
@@ -140,6 +187,9 @@ func (svr *Server) buildExec(ctx *dagContext, curr *tipb.Executor) (executor, er
 
 func (svr *Server) buildDAG(ctx *dagContext, executors []*tipb.Executor) (executor, error) {
 	var src executor
+	var tblScan *tableScanExec
+	var usedOffsets []int
+	aggregated := false
 	for i := 0; i < len(executors); i++ {
 		curr, err := svr.buildExec(ctx, executors[i])
 		if err != nil {
@@ -147,10 +197,57 @@ func (svr *Server) buildDAG(ctx *dagContext, executors []*tipb.Executor) (execut
 		}
 		curr.SetSrcExec(src)
 		src = curr
+		if aggregated {
+			// The offsets of the executors after the aggregation refer to its output.
+			continue
+		}
+		switch x := curr.(type) {
+		case *tableScanExec:
+			tblScan = x
+		case *selectionExec:
+			usedOffsets = append(usedOffsets, x.relatedColOffsets...)
+		case *topNExec:
+			usedOffsets = append(usedOffsets, x.relatedColOffsets...)
+		case *hashAggExec:
+			usedOffsets = append(usedOffsets, x.relatedColOffsets...)
+			aggregated = true
+		case *streamAggExec:
+			usedOffsets = append(usedOffsets, x.relatedColOffsets...)
+			aggregated = true
+		case *limitExec:
+			// The scan right below the Limit stops scanning at the limit.
+			switch scan := x.src.(type) {
+			case *tableScanExec:
+				scan.limit = x.limit
+			case *indexScanExec:
+				scan.limit = x.limit
+			}
+		}
+	}
+	if tblScan != nil {
+		if !aggregated {
+			for _, offset := range ctx.dagReq.OutputOffsets {
+				usedOffsets = append(usedOffsets, int(offset))
+			}
+		}
+		tblScan.colIDs = projectColIDs(ctx.evalCtx.columnInfos, ctx.evalCtx.colIDs, usedOffsets)
 	}
 	return src, nil
 }
 
+// projectColIDs returns the column IDs of the used offsets so the table scan only cuts the columns used by the DAG,
+// all the columns are returned if any offset is out of range.
+func projectColIDs(columns []*tipb.ColumnInfo, colIDs map[int64]int, usedOffsets []int) map[int64]int {
+	projected := make(map[int64]int, len(usedOffsets))
+	for _, offset := range usedOffsets {
+		if offset < 0 || offset >= len(columns) {
+			return colIDs
+		}
+		projected[columns[offset].GetColumnId()] = offset
+	}
+	return projected
+}
+
 func (svr *Server) buildTableScan(ctx *dagContext, executor *tipb.Executor) (*tableScanExec, error) {
 	columns := executor.TblScan.Columns
 	ctx.evalCtx.setColumnInfo(columns)
@@ -178,16 +275,29 @@ func (svr *Server) buildIndexScan(ctx *dagContext, executor *tipb.Executor) (*in
 	columns := executor.IdxScan.Columns
 	ctx.evalCtx.setColumnInfo(columns)
 	length := len(columns)
+	// The physical table id is the last column if it's requested.
+	physTblIDColumn := length > 0 && columns[length-1].ColumnId == extraPhysTblID
+	if physTblIDColumn {
+		columns = columns[:length-1]
+		length--
+	}
 	pkStatus := pkColNotExists
-	// The PKHandle column info has been collected in ctx.
-	if columns[length-1].GetPkHandle() {
+	// The columns of the common handle are at the end for a clustered index.
+	primaryColsLen := len(executor.IdxScan.PrimaryColumnIds)
+	if primaryColsLen > length {
+		return nil, errors.Errorf("index scan has %d columns, fewer than its %d primary columns", length, primaryColsLen)
+	}
+	if primaryColsLen > 0 {
+		columns = columns[:length-primaryColsLen]
+	} else if length > 0 && columns[length-1].GetPkHandle() {
+		// The PKHandle column info has been collected in ctx.
 		if mysql.HasUnsignedFlag(uint(columns[length-1].GetFlag())) {
 			pkStatus = pkColIsUnsigned
 		} else {
 			pkStatus = pkColIsSigned
 		}
 		columns = columns[:length-1]
-	} else if columns[length-1].ColumnId == model.ExtraHandleID {
+	} else if length > 0 && columns[length-1].ColumnId == model.ExtraHandleID {
 		pkStatus = pkColIsSigned
 		columns = columns[:length-1]
 	}
@@ -197,13 +307,15 @@ func (svr *Server) buildIndexScan(ctx *dagContext, executor *tipb.Executor) (*in
 	}
 
 	e := &indexScanExec{
-		IndexScan: executor.IdxScan,
-		kvRanges:  ranges,
-		colsLen:   len(columns),
-		startTS:   ctx.dagReq.GetStartTs(),
-		mvccStore: svr.mvccStore,
-		reqCtx:    ctx.reqCtx,
-		pkStatus:  pkStatus,
+		IndexScan:       executor.IdxScan,
+		kvRanges:        ranges,
+		colsLen:         len(columns),
+		primaryColsLen:  primaryColsLen,
+		startTS:         ctx.dagReq.GetStartTs(),
+		mvccStore:       svr.mvccStore,
+		reqCtx:          ctx.reqCtx,
+		pkStatus:        pkStatus,
+		physTblIDColumn: physTblIDColumn,
 	}
 	if ctx.dagReq.CollectRangeCounts != nil && *ctx.dagReq.CollectRangeCounts {
 		e.counts = make([]int64, len(ranges))
@@ -221,7 +333,7 @@ func (svr *Server) buildSelection(ctx *dagContext, executor *tipb.Executor) (*se
 			return nil, errors.Trace(err)
 		}
 	}
-	conds, err := convertToExprs(ctx.evalCtx.sc, ctx.evalCtx.fieldTps, pbConds)
+	conds, err := convertToConditions(ctx.evalCtx.sc, ctx.evalCtx.fieldTps, pbConds)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -270,11 +382,17 @@ func (svr *Server) buildHashAgg(ctx *dagContext, executor *tipb.Executor) (*hash
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
+	collators, err := collatorsOfExprs(executor.Aggregation.GetGroupBy())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
 
 	return &hashAggExec{
+		reqCtx:            ctx.reqCtx,
 		evalCtx:           ctx.evalCtx,
 		aggExprs:          aggs,
 		groupByExprs:      groupBys,
+		groupByCollators:  collators,
 		groups:            make(map[string]struct{}),
 		groupKeys:         make([][]byte, 0),
 		relatedColOffsets: relatedColOffsets,
@@ -287,6 +405,10 @@ func (svr *Server) buildStreamAgg(ctx *dagContext, executor *tipb.Executor) (*st
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
+	collators, err := collatorsOfExprs(executor.Aggregation.GetGroupBy())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
 	aggCtxs := make([]*aggregation.AggEvaluateContext, 0, len(aggs))
 	for _, agg := range aggs {
 		aggCtxs = append(aggCtxs, agg.CreateContext(ctx.evalCtx.sc))
@@ -297,6 +419,7 @@ func (svr *Server) buildStreamAgg(ctx *dagContext, executor *tipb.Executor) (*st
 		aggExprs:          aggs,
 		aggCtxs:           aggCtxs,
 		groupByExprs:      groupBys,
+		groupByCollators:  collators,
 		currGroupByValues: make([][]byte, 0),
 		relatedColOffsets: relatedColOffsets,
 		row:               make([]types.Datum, len(ctx.evalCtx.columnInfos)),
@@ -327,12 +450,18 @@ func (svr *Server) buildTopN(ctx *dagContext, executor *tipb.Executor) (*topNExe
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
+	collators, err := collatorsOfExprs(pbConds)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
 
 	return &topNExec{
+		reqCtx:            ctx.reqCtx,
 		heap:              heap,
 		evalCtx:           ctx.evalCtx,
 		relatedColOffsets: relatedColOffsets,
 		orderByExprs:      conds,
+		orderByCollators:  collators,
 		row:               make([]types.Datum, len(ctx.evalCtx.columnInfos)),
 	}, nil
 }
@@ -392,6 +521,27 @@ func flagsToStatementContext(flags uint64) *stmtctx.StatementContext {
 	return sc
 }
 
+// locations caches the locations loaded by name.
+var locations sync.Map
+
+// timeZoneOfDAG returns the time zone of the session. The name is preferred over the offset, which is not right
+// for the times on the other side of a DST change.
+func timeZoneOfDAG(dagReq *tipb.DAGRequest) (*time.Location, error) {
+	name := dagReq.TimeZoneName
+	if name == "" {
+		return time.FixedZone("UTC", int(dagReq.TimeZoneOffset)), nil
+	}
+	if loc, ok := locations.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, errors.Annotatef(err, "time zone %s", name)
+	}
+	locations.Store(name, loc)
+	return loc, nil
+}
+
 // MockGRPCClientStream is exported for testing purpose.
 func MockGRPCClientStream() grpc.ClientStream {
 	return mockClientStream{}
@@ -449,12 +599,7 @@ func (mock *mockCopStreamClient) Recv() (*coprocessor.Response, error) {
 	resp.Range = ran
 	if err != nil {
 		if locked, ok := errors.Cause(err).(*ErrLocked); ok {
-			resp.Locked = &kvrpcpb.LockInfo{
-				Key:         locked.Key,
-				PrimaryLock: locked.Primary,
-				LockVersion: locked.StartTS,
-				LockTtl:     locked.TTL,
-			}
+			resp.Locked = locked.lockInfo()
 		} else {
 			resp.OtherError = err.Error()
 		}
@@ -518,12 +663,13 @@ func (mock *mockCopStreamClient) readBlockFromExecutor() (tipb.Chunk, bool, *cop
 	return chunk, finish, &ran, mock.exec.Counts(), nil
 }
 
-func buildResp(chunks []tipb.Chunk, counts []int64, err error, warnings []stmtctx.SQLWarn, dur time.Duration) *coprocessor.Response {
+func buildResp(chunks []tipb.Chunk, encodeType tipb.EncodeType, counts []int64, err error, warnings []stmtctx.SQLWarn, dur time.Duration) *coprocessor.Response {
 	resp := &coprocessor.Response{}
 	selResp := &tipb.SelectResponse{
 		Error:        toPBError(err),
 		Chunks:       chunks,
 		OutputCounts: counts,
+		EncodeType:   encodeType,
 	}
 	if len(warnings) > 0 {
 		selResp.Warnings = make([]*tipb.Error, 0, len(warnings))
@@ -533,12 +679,11 @@ func buildResp(chunks []tipb.Chunk, counts []int64, err error, warnings []stmtct
 	}
 	if err != nil {
 		if locked, ok := errors.Cause(err).(*ErrLocked); ok {
-			resp.Locked = &kvrpcpb.LockInfo{
-				Key:         locked.Key,
-				PrimaryLock: locked.Primary,
-				LockVersion: locked.StartTS,
-				LockTtl:     locked.TTL,
-			}
+			resp.Locked = locked.lockInfo()
+		} else if memErr, ok := errors.Cause(err).(*ErrMemLimitExceeded); ok {
+			// The statement fails with the error like exceeding the memory quota of a query in TiDB, an other
+			// error would be retried by TiDB.
+			selResp.Error = &tipb.Error{Code: errCodeMemoryExceeded, Msg: memErr.Error()}
 		} else {
 			resp.OtherError = err.Error()
 		}
@@ -572,6 +717,16 @@ func toPBError(err error) *tipb.Error {
 	return perr
 }
 
+// checkCopGCSafePoint checks the read ts of the coprocessor request against the GC safe points of its ranges.
+func (svr *Server) checkCopGCSafePoint(keyRanges []*coprocessor.KeyRange, ts uint64) error {
+	for _, kran := range keyRanges {
+		if err := svr.mvccStore.checkRangeGCSafePoint(kran.GetStart(), kran.GetEnd(), ts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // extractKVRanges extracts kv.KeyRanges slice from a SelectRequest.
 func (svr *Server) extractKVRanges(regCtx *regionCtx, keyRanges []*coprocessor.KeyRange, descScan bool) (kvRanges []kv.KeyRange, err error) {
 	startKey := regCtx.rawStartKey()
@@ -676,6 +831,6 @@ func fieldTypeFromPBColumn(col *tipb.ColumnInfo) *types.FieldType {
 		Flen:    int(col.GetColumnLen()),
 		Decimal: int(col.GetDecimal()),
 		Elems:   col.Elems,
-		Collate: mysql.Collations[uint8(col.GetCollation())],
+		Collate: collationName(col.GetCollation()),
 	}
 }
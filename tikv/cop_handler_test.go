@@ -0,0 +1,35 @@
+package tikv
+
+import (
+	"testing"
+	"time"
+
+	tipb "github.com/pingcap/tipb/go-tipb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeZoneOfDAG(t *testing.T) {
+	loc, err := timeZoneOfDAG(&tipb.DAGRequest{TimeZoneOffset: 3600})
+	require.NoError(t, err)
+	checkZoneOffsets(t, loc, 3600, 3600)
+
+	// The name is preferred over the offset, the offset of the named zone changes with DST.
+	loc, err = timeZoneOfDAG(&tipb.DAGRequest{TimeZoneName: "Europe/Berlin", TimeZoneOffset: 3600})
+	require.NoError(t, err)
+	checkZoneOffsets(t, loc, 3600, 7200)
+	cached, err := timeZoneOfDAG(&tipb.DAGRequest{TimeZoneName: "Europe/Berlin"})
+	require.NoError(t, err)
+	require.True(t, loc == cached)
+
+	_, err = timeZoneOfDAG(&tipb.DAGRequest{TimeZoneName: "Mars/Olympus"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Mars/Olympus")
+}
+
+// checkZoneOffsets checks the offsets of the location in winter and in summer.
+func checkZoneOffsets(t *testing.T, loc *time.Location, winter, summer int) {
+	_, offset := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC).In(loc).Zone()
+	require.Equal(t, winter, offset)
+	_, offset = time.Date(2020, 7, 1, 12, 0, 0, 0, time.UTC).In(loc).Zone()
+	require.Equal(t, summer, offset)
+}
@@ -0,0 +1,41 @@
+package tikv_test
+
+import (
+	"testing"
+
+	"github.com/ngaut/faketikv/testutil"
+	"github.com/pingcap/kvproto/pkg/coprocessor"
+	"github.com/pingcap/tidb/kv"
+	tipb "github.com/pingcap/tipb/go-tipb"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestIndexScanColumns(t *testing.T) {
+	c := newTestCluster(t)
+	// The index scan of COUNT(*) reads no column.
+	require.Empty(t, indexScan(t, c, nil).OtherError)
+	require.Contains(t, indexScan(t, c, []int64{1}).OtherError, "primary columns")
+}
+
+// indexScan sends the DAG of an index scan without columns over the table keys.
+func indexScan(t *testing.T, c *testutil.Cluster, primaryIDs []int64) *coprocessor.Response {
+	dag := &tipb.DAGRequest{
+		StartTs: c.AllocTS(),
+		Executors: []*tipb.Executor{{
+			Tp:      tipb.ExecType_TypeIndexScan,
+			IdxScan: &tipb.IndexScan{TableId: 1, IndexId: 1, PrimaryColumnIds: primaryIDs},
+		}},
+	}
+	data, err := dag.Marshal()
+	require.NoError(t, err)
+	resp, err := c.Server.Coprocessor(context.Background(), &coprocessor.Request{
+		Context: regionCtx(t, c, []byte("t")),
+		Tp:      kv.ReqTypeDAG,
+		Data:    data,
+		Ranges:  []*coprocessor.KeyRange{{Start: []byte("t"), End: []byte("u")}},
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp.RegionError)
+	return resp
+}
@@ -11,6 +11,7 @@ func (store *MVCCStore) NewDBReader(reqCtx *requestCtx) *DBReader {
 	return &DBReader{
 		reqCtx: reqCtx,
 		txn:    store.db.NewTransaction(false),
+		store:  store,
 	}
 }
 
@@ -25,38 +26,47 @@ func newIterator(txn *badger.Txn, reverse bool) *badger.Iterator {
 type DBReader struct {
 	reqCtx  *requestCtx
 	txn     *badger.Txn
+	store   *MVCCStore
 	iter    *badger.Iterator
 	revIter *badger.Iterator
 	oldIter *badger.Iterator
 }
 
 func (r *DBReader) Get(key []byte, startTS uint64) ([]byte, error) {
+	val, _, _, err := r.GetVersion(key, startTS)
+	return val, err
+}
+
+// GetVersion is Get that also returns the start ts and commit ts of the version read, the ts are 0 if the key
+// doesn't exist at startTS.
+func (r *DBReader) GetVersion(key []byte, startTS uint64) (val []byte, verStartTS, commitTS uint64, err error) {
+	if err = r.store.checkGCSafePoint(key, startTS); err != nil {
+		return nil, 0, 0, err
+	}
 	item, err := r.txn.Get(key)
 	if err != nil && err != badger.ErrKeyNotFound {
-		return nil, errors.Trace(err)
+		return nil, 0, 0, errors.Trace(err)
 	}
 	if err == badger.ErrKeyNotFound {
-		return nil, nil
+		return nil, 0, 0, nil
 	}
 	mvVal, err := decodeValue(item)
 	if err != nil {
-		return nil, errors.Trace(err)
+		return nil, 0, 0, errors.Trace(err)
 	}
-	if mvVal.commitTS <= startTS {
-		return mvVal.value, nil
-	}
-	oldKey := encodeOldKey(key, startTS)
-	iter := r.getIter()
-	iter.Seek(oldKey)
-	if !iter.ValidForPrefix(oldKey[:len(oldKey)-8]) {
-		return nil, nil
+	if mvVal.commitTS > startTS {
+		mvVal, err = r.getOldValue(encodeOldKey(key, startTS))
+		if err == badger.ErrKeyNotFound {
+			return nil, 0, 0, nil
+		}
+		if err != nil {
+			return nil, 0, 0, errors.Trace(err)
+		}
 	}
-	item = iter.Item()
-	mvVal, err = decodeValue(item)
-	if err != nil {
-		return nil, errors.Trace(err)
+	if len(mvVal.value) == 0 || r.store.isRangeDeleted(key, mvVal.commitTS, startTS) {
+		return nil, 0, 0, nil
 	}
-	return mvVal.value, nil
+	return mvVal.value, mvVal.startTS, mvVal.commitTS, nil
 }
 
 func (r *DBReader) getIter() *badger.Iterator {
@@ -80,20 +90,56 @@ func (r *DBReader) getOldIter() *badger.Iterator {
 	return r.oldIter
 }
 
+// maxOldIterSteps is the max number of keys the old iterator steps over to reach a key instead of seeking.
+const maxOldIterSteps = 8
+
+// seekOldIter positions the old iterator at the first key not less than oldKey. The old keys of a multi-key request
+// are usually visited in ascending order, so the iterator steps forward if the key is close ahead of its position,
+// which is much cheaper than a seek.
+func (r *DBReader) seekOldIter(oldKey []byte) *badger.Iterator {
+	it := r.getOldIter()
+	if it.Valid() {
+		cmp := bytes.Compare(it.Item().Key(), oldKey)
+		if cmp == 0 {
+			return it
+		}
+		for i := 0; cmp < 0 && i < maxOldIterSteps; i++ {
+			it.Next()
+			if !it.Valid() || bytes.Compare(it.Item().Key(), oldKey) >= 0 {
+				// The previous key is less than oldKey, so this is the first key not less than it.
+				return it
+			}
+		}
+	}
+	it.Seek(oldKey)
+	return it
+}
+
 func (r *DBReader) BatchGet(keys [][]byte, startTS uint64) []Pair {
 	pairs := make([]Pair, 0, len(keys))
 	for _, key := range keys {
-		val, err := r.Get(key, startTS)
+		val, verStartTS, commitTS, err := r.GetVersion(key, startTS)
+		if err != nil {
+			pairs = append(pairs, Pair{Key: key, Err: err})
+			continue
+		}
 		if len(val) == 0 {
 			continue
 		}
-		pairs = append(pairs, Pair{Key: key, Value: val, Err: err})
+		pairs = append(pairs, Pair{Key: key, Value: val, StartTS: verStartTS, CommitTS: commitTS})
 	}
 	return pairs
 }
 
-func (r *DBReader) Scan(startKey, endKey []byte, limit int, startTS uint64) []Pair {
+// Scan returns at most limit pairs in [startKey, endKey), the values are not returned if keyOnly is true.
+// If sampleStep > 1, only the first of every sampleStep visible keys is returned. The scan stops once the pairs
+// reach maxBytes if it's positive.
+func (r *DBReader) Scan(startKey, endKey []byte, limit int, startTS uint64, keyOnly bool, sampleStep, maxBytes int) []Pair {
+	if err := r.store.checkRangeGCSafePoint(startKey, endKey, startTS); err != nil {
+		return []Pair{{Err: err}}
+	}
 	var pairs []Pair
+	var visible, size int
 	iter := r.getIter()
 	for iter.Seek(startKey); iter.Valid(); iter.Next() {
 		item := iter.Item()
@@ -111,11 +157,23 @@ func (r *DBReader) Scan(startKey, endKey []byte, limit int, startTS uint64) []Pa
 				continue
 			}
 		}
-		if len(mvVal.value) == 0 {
+		if len(mvVal.value) == 0 || r.store.isRangeDeleted(key, mvVal.commitTS, startTS) {
+			continue
+		}
+		visible++
+		if sampleStep > 1 && (visible-1)%sampleStep != 0 {
 			continue
 		}
-		pairs = append(pairs, Pair{Key: key, Value: mvVal.value})
-		if len(pairs) >= limit {
+		pair := Pair{Key: key}
+		if !keyOnly {
+			pair.Value = mvVal.value
+		}
+		if err = r.reqCtx.consumeMem(len(pair.Key) + len(pair.Value)); err != nil {
+			return []Pair{{Err: err}}
+		}
+		pairs = append(pairs, pair)
+		size += len(pair.Key) + len(pair.Value)
+		if len(pairs) >= limit || (maxBytes > 0 && size >= maxBytes) {
 			break
 		}
 	}
@@ -123,21 +181,29 @@ func (r *DBReader) Scan(startKey, endKey []byte, limit int, startTS uint64) []Pa
 }
 
 func (r *DBReader) getOldValue(oldKey []byte) (mvccValue, error) {
-	oldIter := r.getOldIter()
-	oldIter.Seek(oldKey)
+	oldIter := r.seekOldIter(oldKey)
 	if !oldIter.ValidForPrefix(oldKey[:len(oldKey)-8]) {
 		return mvccValue{}, badger.ErrKeyNotFound
 	}
 	return decodeValue(oldIter.Item())
 }
 
-// ReverseScan implements the MVCCStore interface. The search range is [startKey, endKey).
-func (r *DBReader) ReverseScan(startKey, endKey []byte, limit int, startTS uint64) []Pair {
+// ReverseScan implements the MVCCStore interface. The search range is [startKey, endKey), the values are not
+// returned if keyOnly is true, and the keys are sampled and the bytes are limited like Scan.
+func (r *DBReader) ReverseScan(startKey, endKey []byte, limit int, startTS uint64, keyOnly bool, sampleStep, maxBytes int) []Pair {
+	if err := r.store.checkRangeGCSafePoint(startKey, endKey, startTS); err != nil {
+		return []Pair{{Err: err}}
+	}
 	var pairs []Pair
+	var visible, size int
 	iter := r.getReverseIter()
 	for iter.Seek(endKey); iter.Valid(); iter.Next() {
 		item := iter.Item()
 		key := item.KeyCopy(nil)
+		if exceedEndKey(key, endKey) {
+			// The reverse seek lands on endKey if it exists.
+			continue
+		}
 		if bytes.Compare(key, startKey) < 0 {
 			break
 		}
@@ -151,11 +217,23 @@ func (r *DBReader) ReverseScan(startKey, endKey []byte, limit int, startTS uint6
 				continue
 			}
 		}
-		if len(mvVal.value) == 0 {
+		if len(mvVal.value) == 0 || r.store.isRangeDeleted(key, mvVal.commitTS, startTS) {
+			continue
+		}
+		visible++
+		if sampleStep > 1 && (visible-1)%sampleStep != 0 {
 			continue
 		}
-		pairs = append(pairs, Pair{Key: key, Value: mvVal.value})
-		if len(pairs) >= limit {
+		pair := Pair{Key: key}
+		if !keyOnly {
+			pair.Value = mvVal.value
+		}
+		if err = r.reqCtx.consumeMem(len(pair.Key) + len(pair.Value)); err != nil {
+			return []Pair{{Err: err}}
+		}
+		pairs = append(pairs, pair)
+		size += len(pair.Key) + len(pair.Value)
+		if len(pairs) >= limit || (maxBytes > 0 && size >= maxBytes) {
 			break
 		}
 	}
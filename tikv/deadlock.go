@@ -0,0 +1,185 @@
+package tikv
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	deadlockpb "github.com/pingcap/kvproto/pkg/deadlock"
+	"golang.org/x/net/context"
+)
+
+// DeadlockDetector detects deadlocks of pessimistic transactions with a wait-for graph keyed by the
+// start ts of transactions.
+type DeadlockDetector struct {
+	mu         sync.Mutex
+	waitForMap map[uint64]*txnWaitList
+	entryTTL   time.Duration
+}
+
+type txnWaitEntry struct {
+	txn     uint64
+	keyHash uint64
+	since   time.Time
+}
+
+type txnWaitList struct {
+	entries []txnWaitEntry
+}
+
+// NewDeadlockDetector creates a DeadlockDetector, an edge older than entryTTL is considered stale
+// and is removed during detection.
+func NewDeadlockDetector(entryTTL time.Duration) *DeadlockDetector {
+	return &DeadlockDetector{
+		waitForMap: make(map[uint64]*txnWaitList),
+		entryTTL:   entryTTL,
+	}
+}
+
+// Detect adds an edge sourceTxn -> waitForTxn on the key and returns an ErrDeadlock if the edge forms a cycle,
+// in which case the edge is not added.
+func (d *DeadlockDetector) Detect(sourceTxn, waitForTxn, keyHash uint64) *ErrDeadlock {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := clock.Now()
+	if deadlockKeyHash, ok := d.doDetect(now, sourceTxn, waitForTxn); ok {
+		return &ErrDeadlock{
+			LockTS:          waitForTxn,
+			LockKeyHash:     keyHash,
+			DeadlockKeyHash: deadlockKeyHash,
+		}
+	}
+	d.register(now, sourceTxn, waitForTxn, keyHash)
+	return nil
+}
+
+// doDetect returns the key hash of the edge pointing back to sourceTxn if waitForTxn reaches sourceTxn.
+func (d *DeadlockDetector) doDetect(now time.Time, sourceTxn, waitForTxn uint64) (uint64, bool) {
+	visited := map[uint64]struct{}{waitForTxn: {}}
+	stack := []uint64{waitForTxn}
+	for len(stack) > 0 {
+		txn := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		list, ok := d.waitForMap[txn]
+		if !ok {
+			continue
+		}
+		d.removeExpired(now, txn, list)
+		for _, entry := range list.entries {
+			if entry.txn == sourceTxn {
+				return entry.keyHash, true
+			}
+			if _, ok := visited[entry.txn]; !ok {
+				visited[entry.txn] = struct{}{}
+				stack = append(stack, entry.txn)
+			}
+		}
+	}
+	return 0, false
+}
+
+func (d *DeadlockDetector) removeExpired(now time.Time, txn uint64, list *txnWaitList) {
+	entries := list.entries[:0]
+	for _, entry := range list.entries {
+		if now.Sub(entry.since) < d.entryTTL {
+			entries = append(entries, entry)
+		}
+	}
+	list.entries = entries
+	if len(entries) == 0 {
+		delete(d.waitForMap, txn)
+	}
+}
+
+func (d *DeadlockDetector) register(now time.Time, sourceTxn, waitForTxn, keyHash uint64) {
+	list, ok := d.waitForMap[sourceTxn]
+	if !ok {
+		list = new(txnWaitList)
+		d.waitForMap[sourceTxn] = list
+	}
+	for i, entry := range list.entries {
+		if entry.txn == waitForTxn && entry.keyHash == keyHash {
+			list.entries[i].since = now
+			return
+		}
+	}
+	list.entries = append(list.entries, txnWaitEntry{txn: waitForTxn, keyHash: keyHash, since: now})
+}
+
+// CleanUpWaitFor removes the edge sourceTxn -> waitForTxn on the key, it's called when the waiter is woken up.
+func (d *DeadlockDetector) CleanUpWaitFor(sourceTxn, waitForTxn, keyHash uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	list, ok := d.waitForMap[sourceTxn]
+	if !ok {
+		return
+	}
+	for i, entry := range list.entries {
+		if entry.txn == waitForTxn && entry.keyHash == keyHash {
+			list.entries = append(list.entries[:i], list.entries[i+1:]...)
+			break
+		}
+	}
+	if len(list.entries) == 0 {
+		delete(d.waitForMap, sourceTxn)
+	}
+}
+
+// CleanUp removes all the edges from the transaction, it's called when the transaction is finished.
+func (d *DeadlockDetector) CleanUp(txn uint64) {
+	d.mu.Lock()
+	delete(d.waitForMap, txn)
+	d.mu.Unlock()
+}
+
+// WaitForEntries returns the edges of the wait-for graph.
+func (d *DeadlockDetector) WaitForEntries() []deadlockpb.WaitForEntry {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var entries []deadlockpb.WaitForEntry
+	for txn, list := range d.waitForMap {
+		for _, entry := range list.entries {
+			entries = append(entries, deadlockpb.WaitForEntry{Txn: txn, WaitForTxn: entry.txn, KeyHash: entry.keyHash})
+		}
+	}
+	return entries
+}
+
+var _ deadlockpb.DeadlockServer = new(Server)
+
+// GetWaitForEntries is the GetWaitForEntries of the deadlock service.
+func (svr *Server) GetWaitForEntries(ctx context.Context, req *deadlockpb.WaitForEntriesRequest) (*deadlockpb.WaitForEntriesResponse, error) {
+	return &deadlockpb.WaitForEntriesResponse{Entries: svr.mvccStore.DeadlockDetector.WaitForEntries()}, nil
+}
+
+// Detect is the Detect of the deadlock service, the store is its own deadlock detector leader. A response is sent
+// only for the detected deadlocks.
+func (svr *Server) Detect(stream deadlockpb.Deadlock_DetectServer) error {
+	detector := svr.mvccStore.DeadlockDetector
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Trace(err)
+		}
+		entry := req.GetEntry()
+		switch req.Tp {
+		case deadlockpb.DeadlockRequestType_Detect:
+			deadlock := detector.Detect(entry.Txn, entry.WaitForTxn, entry.KeyHash)
+			if deadlock == nil {
+				continue
+			}
+			err = stream.Send(&deadlockpb.DeadlockResponse{Entry: entry, DeadlockKeyHash: deadlock.DeadlockKeyHash})
+			if err != nil {
+				return errors.Trace(err)
+			}
+		case deadlockpb.DeadlockRequestType_CleanUpWaitFor:
+			detector.CleanUpWaitFor(entry.Txn, entry.WaitForTxn, entry.KeyHash)
+		case deadlockpb.DeadlockRequestType_CleanUp:
+			detector.CleanUp(entry.Txn)
+		}
+	}
+}
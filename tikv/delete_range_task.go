@@ -0,0 +1,213 @@
+package tikv
+
+import (
+	"encoding/hex"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coocood/badger"
+	"github.com/juju/errors"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+)
+
+// maxFinishedDeleteRangeTasks is the number of finished tasks kept for querying the result.
+const maxFinishedDeleteRangeTasks = 64
+
+var errDeleteRangeCanceled = errors.New("delete range is canceled")
+
+// DeleteRangeProgress is the state of a DeleteRange task.
+type DeleteRangeProgress struct {
+	ID           uint64    `json:"id"`
+	StartKey     string    `json:"start_key"`
+	EndKey       string    `json:"end_key"`
+	DeletedKeys  int64     `json:"deleted_keys"`
+	DeletedBytes int64     `json:"deleted_bytes"`
+	StartTime    time.Time `json:"start_time"`
+	Done         bool      `json:"done"`
+	Canceled     bool      `json:"canceled"`
+	Error        string    `json:"error,omitempty"`
+}
+
+type deleteRangeTask struct {
+	id        uint64
+	startKey  []byte
+	endKey    []byte
+	startTime time.Time
+
+	deletedKeys  int64
+	deletedBytes int64
+	canceled     int32
+
+	// done and err are protected by the mutex of deleteRangeTasks.
+	done bool
+	err  error
+}
+
+// deleteRangeTasks holds the running DeleteRange tasks and the latest finished ones.
+type deleteRangeTasks struct {
+	mu     sync.Mutex
+	lastID uint64
+	tasks  map[uint64]*deleteRangeTask
+}
+
+func (dt *deleteRangeTasks) add(startKey, endKey []byte) *deleteRangeTask {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	if dt.tasks == nil {
+		dt.tasks = make(map[uint64]*deleteRangeTask)
+	}
+	dt.lastID++
+	task := &deleteRangeTask{
+		id:        dt.lastID,
+		startKey:  safeCopy(startKey),
+		endKey:    safeCopy(endKey),
+		startTime: time.Now(),
+	}
+	dt.tasks[task.id] = task
+	return task
+}
+
+func (dt *deleteRangeTasks) finish(task *deleteRangeTask, err error) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	task.done = true
+	task.err = err
+	var finished []uint64
+	for id, t := range dt.tasks {
+		if t.done {
+			finished = append(finished, id)
+		}
+	}
+	if len(finished) <= maxFinishedDeleteRangeTasks {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i] < finished[j] })
+	for _, id := range finished[:len(finished)-maxFinishedDeleteRangeTasks] {
+		delete(dt.tasks, id)
+	}
+}
+
+func (task *deleteRangeTask) progress() DeleteRangeProgress {
+	p := DeleteRangeProgress{
+		ID:           task.id,
+		StartKey:     hex.EncodeToString(task.startKey),
+		EndKey:       hex.EncodeToString(task.endKey),
+		DeletedKeys:  atomic.LoadInt64(&task.deletedKeys),
+		DeletedBytes: atomic.LoadInt64(&task.deletedBytes),
+		StartTime:    task.startTime,
+		Done:         task.done,
+		Canceled:     atomic.LoadInt32(&task.canceled) > 0,
+	}
+	if task.err != nil {
+		p.Error = task.err.Error()
+	}
+	return p
+}
+
+// StartDeleteRange deletes all the versions in [startKey, endKey) in background and returns the task id. The
+// deletes don't take the latches, like UnsafeDestroyRange.
+func (store *MVCCStore) StartDeleteRange(startKey, endKey []byte) uint64 {
+	task := store.deleteRangeTasks.add(startKey, endKey)
+	store.wg.Add(1)
+	go func() {
+		defer store.wg.Done()
+		if err := store.runDeleteRangeTask(nil, kvrpcpb.CommandPri_Normal, task); err != nil {
+			log.Errorf("delete range task %d failed: %v", task.id, err)
+		}
+	}()
+	return task.id
+}
+
+// DeleteRangeTasks returns the progress of the running and the latest finished DeleteRange tasks sorted by id.
+func (store *MVCCStore) DeleteRangeTasks() []DeleteRangeProgress {
+	dt := &store.deleteRangeTasks
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	tasks := make([]DeleteRangeProgress, 0, len(dt.tasks))
+	for _, task := range dt.tasks {
+		tasks = append(tasks, task.progress())
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].ID < tasks[j].ID })
+	return tasks
+}
+
+// CancelDeleteRange stops the running DeleteRange task, the keys already deleted are not restored. It returns false
+// if the task is not found or finished.
+func (store *MVCCStore) CancelDeleteRange(id uint64) bool {
+	dt := &store.deleteRangeTasks
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	task := dt.tasks[id]
+	if task == nil || task.done {
+		return false
+	}
+	atomic.StoreInt32(&task.canceled, 1)
+	return true
+}
+
+// runDeleteRangeTask deletes the latest and old versions in the range batch by batch, the latches of the region
+// are taken for each batch if regCtx is not nil.
+func (store *MVCCStore) runDeleteRangeTask(regCtx *regionCtx, priority kvrpcpb.CommandPri, task *deleteRangeTask) (err error) {
+	defer func() {
+		store.deleteRangeTasks.finish(task, err)
+	}()
+	ranges := [][2][]byte{
+		{task.startKey, task.endKey},
+		{encodeOldKey(task.startKey, maxSystemTS), encodeOldKey(task.endKey, maxSystemTS)},
+	}
+	for _, r := range ranges {
+		startKey, endKey := r[0], r[1]
+		for {
+			if atomic.LoadInt32(&task.canceled) > 0 {
+				return errDeleteRangeCanceled
+			}
+			select {
+			case <-store.closeCh:
+				return errDeleteRangeCanceled
+			default:
+			}
+			keys, size, err := store.collectRangeKeys(startKey, endKey)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if len(keys) == 0 {
+				break
+			}
+			reqCtx := &requestCtx{regCtx: regCtx, priority: priority, startTime: time.Now()}
+			if err = store.deleteKeysInBatch(reqCtx, keys, delRangeBatchSize); err != nil {
+				return errors.Trace(err)
+			}
+			atomic.AddInt64(&task.deletedKeys, int64(len(keys)))
+			atomic.AddInt64(&task.deletedBytes, size)
+			if len(keys) < delRangeBatchSize {
+				break
+			}
+			startKey = append(safeCopy(keys[len(keys)-1]), 0)
+		}
+	}
+	store.scheduleCompaction(task.startKey, task.endKey, int(atomic.LoadInt64(&task.deletedKeys)))
+	return nil
+}
+
+// collectRangeKeys returns at most delRangeBatchSize keys in the range and their estimated size.
+func (store *MVCCStore) collectRangeKeys(startKey, endKey []byte) (keys [][]byte, size int64, err error) {
+	err = store.db.View(func(txn *badger.Txn) error {
+		it := newIterator(txn, false)
+		defer it.Close()
+		for it.Seek(startKey); it.Valid(); it.Next() {
+			item := it.Item()
+			if exceedEndKey(item.Key(), endKey) {
+				break
+			}
+			keys = append(keys, item.KeyCopy(nil))
+			size += item.EstimatedSize()
+			if len(keys) == delRangeBatchSize {
+				break
+			}
+		}
+		return nil
+	})
+	return keys, size, errors.Trace(err)
+}
@@ -0,0 +1,101 @@
+package tikv
+
+import (
+	"bytes"
+	"sync/atomic"
+
+	"github.com/coocood/badger"
+	"github.com/juju/errors"
+)
+
+// UnsafeDestroyRange deletes all the data and locks in [startKey, endKey) bypassing MVCC, it is used to reclaim
+// the space of dropped tables after the GC safe point passed the drop.
+// The keys are deleted in batches instead of dropping the table files in the range, the files may have the keys
+// written after the check of the range without latches.
+func (store *MVCCStore) UnsafeDestroyRange(startKey, endKey []byte) error {
+	if len(endKey) == 0 {
+		return errors.New("the end key of the range to destroy must not be empty")
+	}
+	oldStartKey := encodeOldKey(startKey, maxSystemTS)
+	oldEndKey := encodeOldKey(endKey, maxSystemTS)
+	if overlapInternalKeys(startKey, endKey) || overlapInternalKeys(oldStartKey, oldEndKey) {
+		return errors.Errorf("range [%q, %q) overlaps the internal keys", startKey, endKey)
+	}
+	lsmBefore, vlogBefore := store.db.Size()
+	if err := store.destroyLocks(startKey, endKey); err != nil {
+		return errors.Trace(err)
+	}
+	cnt, err := store.destroyKeys(startKey, endKey)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	oldCnt, err := store.destroyKeys(oldStartKey, oldEndKey)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for store.db.RunValueLogGC(vlogGCDiscardRatio) == nil {
+	}
+	lsmAfter, vlogAfter := store.db.Size()
+	reclaimed := lsmBefore + vlogBefore - lsmAfter - vlogAfter
+	if reclaimed > 0 {
+		atomic.AddInt64(&store.reclaimedBytes, reclaimed)
+	}
+	log.Infof("destroy range [%q, %q) deleted %d keys, reclaimed %d bytes", startKey, endKey,
+		cnt+oldCnt, reclaimed)
+	return nil
+}
+
+func overlapInternalKeys(startKey, endKey []byte) bool {
+	internalEnd := []byte{InternalKeyPrefix[0] + 1}
+	return bytes.Compare(startKey, internalEnd) < 0 && bytes.Compare(endKey, InternalKeyPrefix) > 0
+}
+
+func (store *MVCCStore) destroyLocks(startKey, endKey []byte) error {
+	lockBatch := newWriteLockBatch(new(requestCtx))
+	it := store.lockStore.NewIterator()
+	for it.Seek(startKey); it.Valid(); it.Next() {
+		if exceedEndKey(it.Key(), endKey) {
+			break
+		}
+		lockBatch.destroy(safeCopy(it.Key()))
+	}
+	return store.writeLocks(lockBatch)
+}
+
+// destroyKeys deletes the keys in the range in batches.
+func (store *MVCCStore) destroyKeys(startKey, endKey []byte) (int, error) {
+	var cnt int
+	for {
+		dbBatch := newWriteDBBatch(new(requestCtx))
+		err := store.db.View(func(txn *badger.Txn) error {
+			it := newIterator(txn, false)
+			defer it.Close()
+			for it.Seek(startKey); it.Valid(); it.Next() {
+				key := it.Item().KeyCopy(nil)
+				if exceedEndKey(key, endKey) {
+					break
+				}
+				dbBatch.delete(key)
+				if len(dbBatch.entries) == delRangeBatchSize {
+					break
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return cnt, errors.Trace(err)
+		}
+		if len(dbBatch.entries) == 0 {
+			return cnt, nil
+		}
+		if err = store.writeDB(dbBatch); err != nil {
+			return cnt, errors.Trace(err)
+		}
+		cnt += len(dbBatch.entries)
+		if len(dbBatch.entries) < delRangeBatchSize {
+			return cnt, nil
+		}
+		lastKey := dbBatch.entries[len(dbBatch.entries)-1].Key
+		startKey = append(lastKey, 0)
+	}
+}
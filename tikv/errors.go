@@ -2,15 +2,47 @@ package tikv
 
 import (
 	"fmt"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // ErrLocked is returned when trying to Read/Write on a locked key. Client should
 // backoff or cleanup the lock then retry.
 type ErrLocked struct {
-	Key     []byte
-	Primary []byte
-	StartTS uint64
-	TTL     uint64
+	Key         []byte
+	Primary     []byte
+	StartTS     uint64
+	TTL         uint64
+	LockType    kvrpcpb.Op
+	ForUpdateTS uint64
+	MinCommitTS uint64
+}
+
+func newErrLocked(key []byte, lock *mvccLock) *ErrLocked {
+	return &ErrLocked{
+		Key:         key,
+		Primary:     lock.primary,
+		StartTS:     lock.startTS,
+		TTL:         uint64(lock.ttl),
+		LockType:    kvrpcpb.Op(lock.op),
+		ForUpdateTS: lock.forUpdateTS,
+		MinCommitTS: lock.minCommitTS,
+	}
+}
+
+func (e *ErrLocked) lockInfo() *kvrpcpb.LockInfo {
+	return &kvrpcpb.LockInfo{
+		Key:             e.Key,
+		PrimaryLock:     e.Primary,
+		LockVersion:     e.StartTS,
+		LockTtl:         e.TTL,
+		LockType:        e.LockType,
+		LockForUpdateTs: e.ForUpdateTS,
+		MinCommitTs:     e.MinCommitTS,
+	}
 }
 
 // Error formats the lock to a string.
@@ -29,8 +61,18 @@ var (
 	ErrLockNotFound    = ErrRetryable("lock not found")
 	ErrAlreadyRollback = ErrRetryable("already rollback")
 	ErrReplaced        = ErrRetryable("replaced by another transaction")
+	ErrTxnTooOld       = ErrRetryable("txn is too old, rollback key may be collected")
+	ErrKeyRangeFrozen  = ErrRetryable("key range is frozen")
+	ErrGCPaused        = ErrRetryable("GC is paused")
 )
 
+// ErrReadOnly is returned for write requests when the server is in read-only mode.
+var ErrReadOnly = errors.New("store is read-only")
+
+// ErrPessimisticLockNotFound is returned when a pessimistic transaction prewrites a key that is not
+// pessimistic locked, the lock may be rolled back by others, so the transaction must abort.
+var ErrPessimisticLockNotFound = errors.New("pessimistic lock not found")
+
 // ErrAlreadyCommitted is returned specially when client tries to rollback a
 // committed lock.
 type ErrAlreadyCommitted uint64
@@ -38,3 +80,78 @@ type ErrAlreadyCommitted uint64
 func (e ErrAlreadyCommitted) Error() string {
 	return fmt.Sprint("txn already committed")
 }
+
+// ErrKeyAlreadyExist is returned when an Insert mutation finds a committed value of the key.
+type ErrKeyAlreadyExist struct {
+	Key []byte
+}
+
+func (e *ErrKeyAlreadyExist) Error() string {
+	return fmt.Sprintf("key already exist, key: %q", e.Key)
+}
+
+// ErrCommitExpire is returned when the commit ts is less than the min commit ts pushed by readers, the
+// client should commit with a new commit ts.
+type ErrCommitExpire struct {
+	Key         []byte
+	StartTS     uint64
+	CommitTS    uint64
+	MinCommitTS uint64
+}
+
+func (e *ErrCommitExpire) Error() string {
+	return fmt.Sprintf("commit ts %d is less than min commit ts %d, startTS: %d", e.CommitTS, e.MinCommitTS, e.StartTS)
+}
+
+// ErrTxnNotFound is returned by CheckTxnStatus when the primary key has neither the lock nor the commit or rollback
+// record of the transaction.
+type ErrTxnNotFound struct {
+	StartTS    uint64
+	PrimaryKey []byte
+}
+
+func (e *ErrTxnNotFound) Error() string {
+	return fmt.Sprintf("txn not found, startTS: %d, primary: %q", e.StartTS, e.PrimaryKey)
+}
+
+// ErrDeadlock is returned when a pessimistic lock wait forms a cycle in the wait-for graph.
+type ErrDeadlock struct {
+	LockKey         []byte
+	LockTS          uint64
+	LockKeyHash     uint64
+	DeadlockKeyHash uint64
+}
+
+func (e *ErrDeadlock) Error() string {
+	return fmt.Sprintf("deadlock, lockTS: %d, lockKeyHash: %d, deadlockKeyHash: %d", e.LockTS, e.LockKeyHash, e.DeadlockKeyHash)
+}
+
+// ErrGCSafePointExceeded is returned when reading at a ts older than the GC safe point, the versions to read may
+// have been collected.
+type ErrGCSafePointExceeded struct {
+	TS        uint64
+	SafePoint uint64
+}
+
+func (e *ErrGCSafePointExceeded) Error() string {
+	return fmt.Sprintf("GcSafePointExceeded: read ts %d is older than the GC safe point %d", e.TS, e.SafePoint)
+}
+
+// ErrMemLimitExceeded is returned when the memory used by a request exceeds MVCCStore.RequestMemLimit.
+type ErrMemLimitExceeded struct {
+	Method string
+	Limit  int64
+}
+
+func (e *ErrMemLimitExceeded) Error() string {
+	return fmt.Sprintf("%s uses more than the request memory limit %d bytes", e.Method, e.Limit)
+}
+
+// errCodeMemoryExceeded is the code of the error of TiDB for a query exceeding its memory quota.
+const errCodeMemoryExceeded = 8175
+
+// errUnimplemented is returned as the gRPC error for the requests or request fields unistore doesn't support, so
+// clients can fall back explicitly instead of getting a wrong result.
+func errUnimplemented(format string, args ...interface{}) error {
+	return status.Errorf(codes.Unimplemented, format, args...)
+}
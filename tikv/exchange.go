@@ -0,0 +1,185 @@
+package tikv
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/coocood/badger"
+	"github.com/juju/errors"
+	"github.com/pingcap/tidb/kv"
+)
+
+// maxExchangeKeys is the max number of the latest keys in the two ranges of ExchangeRanges, the exchange is
+// written in a single badger transaction, which fails if it's too big.
+const maxExchangeKeys = 10000
+
+// ExchangeRanges atomically exchanges the data of the keys with prefixA and the keys with prefixB by writing new
+// versions at a commit ts allocated by the store, e.g. the record prefixes of a partition and a table for EXCHANGE
+// PARTITION. The new prewrites in the ranges are frozen and the latches of the keys are held during the exchange.
+// It fails if any key in the ranges is locked or has a version newer than the commit ts, or the ranges have more than
+// maxExchangeKeys keys.
+func (svr *Server) ExchangeRanges(prefixA, prefixB []byte) (uint64, error) {
+	store := svr.mvccStore
+	if len(prefixA) == 0 || len(prefixB) == 0 || bytes.HasPrefix(prefixA, prefixB) || bytes.HasPrefix(prefixB, prefixA) {
+		return 0, errors.New("the ranges to exchange must not overlap")
+	}
+	prefixes := [][]byte{prefixA, prefixB}
+	for _, prefix := range prefixes {
+		id := store.FreezeRange(prefix, []byte(kv.Key(prefix).PrefixNext()), 0)
+		defer store.UnfreezeRange(id)
+	}
+	keys, err := store.exchangeKeys(prefixes)
+	if err != nil {
+		return 0, err
+	}
+	release := svr.acquireKeyLatches(keys)
+	defer release()
+	// Check the locks again, the prewrites may write the locks before the ranges are frozen.
+	if err = store.checkPrefixLocks(prefixes); err != nil {
+		return 0, err
+	}
+	commitTS := store.allocTS()
+	defer store.bumpDataVersion(nil)
+	defer store.updateMaxCommitTS(nil, commitTS)
+	err = store.db.Update(func(txn *badger.Txn) error {
+		valsA, err := collectLatestValues(txn, prefixA, commitTS)
+		if err != nil {
+			return err
+		}
+		valsB, err := collectLatestValues(txn, prefixB, commitTS)
+		if err != nil {
+			return err
+		}
+		if err = exchangeInto(txn, prefixB, valsA, valsB, commitTS); err != nil {
+			return err
+		}
+		return exchangeInto(txn, prefixA, valsB, valsA, commitTS)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return commitTS, nil
+}
+
+// checkPrefixLocks returns the first lock of the keys with the prefixes as the error.
+func (store *MVCCStore) checkPrefixLocks(prefixes [][]byte) error {
+	for _, prefix := range prefixes {
+		it := store.lockStore.NewIterator()
+		if it.Seek(prefix); it.Valid() && bytes.HasPrefix(it.Key(), prefix) {
+			lock := decodeLock(it.Value())
+			return newErrLocked(safeCopy(it.Key()), &lock)
+		}
+	}
+	return nil
+}
+
+// exchangeKeys returns the latest keys with the prefixes, the ranges must not be locked.
+func (store *MVCCStore) exchangeKeys(prefixes [][]byte) ([][]byte, error) {
+	if err := store.checkPrefixLocks(prefixes); err != nil {
+		return nil, err
+	}
+	var keys [][]byte
+	err := store.db.View(func(txn *badger.Txn) error {
+		it := newIterator(txn, false)
+		defer it.Close()
+		for _, prefix := range prefixes {
+			for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+				if len(keys) == maxExchangeKeys {
+					return errors.Errorf("the ranges to exchange have more than %d keys", maxExchangeKeys)
+				}
+				keys = append(keys, it.Item().KeyCopy(nil))
+			}
+		}
+		return nil
+	})
+	return keys, errors.Trace(err)
+}
+
+// acquireKeyLatches acquires the latches of the keys region by region in the order of the region ids, and returns
+// the function to release them.
+func (svr *Server) acquireKeyLatches(keys [][]byte) (release func()) {
+	byRegion := make(map[uint64][][]byte)
+	regions := make(map[uint64]*regionCtx)
+	for _, key := range keys {
+		regCtx := svr.regionManager.getRegionByKey(key)
+		if regCtx == nil {
+			continue
+		}
+		id := regCtx.meta.Id
+		regions[id] = regCtx
+		byRegion[id] = append(byRegion[id], key)
+	}
+	ids := make([]uint64, 0, len(regions))
+	for id := range regions {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	hashVals := make([][]uint64, len(ids))
+	for i, id := range ids {
+		hashVals[i] = keysToHashVals(byRegion[id]...)
+		regions[id].acquireLatches(hashVals[i], false)
+	}
+	return func() {
+		for i, id := range ids {
+			regions[id].releaseLatches(hashVals[i])
+		}
+	}
+}
+
+// collectLatestValues returns the latest values of the keys with the prefix, keyed by the key suffix.
+func collectLatestValues(txn *badger.Txn, prefix []byte, commitTS uint64) (map[string]mvccValue, error) {
+	vals := make(map[string]mvccValue)
+	it := newIterator(txn, false)
+	defer it.Close()
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		item := it.Item()
+		mvVal, err := decodeValue(item)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if mvVal.commitTS > commitTS {
+			return nil, ErrRetryable("write conflict")
+		}
+		vals[string(item.Key()[len(prefix):])] = mvVal
+	}
+	return vals, nil
+}
+
+// exchangeInto writes the src values into the keys with dstPrefix, the existing dst values that are not in src
+// are deleted, and the replaced latest values are moved to old versions.
+func exchangeInto(txn *badger.Txn, dstPrefix []byte, src, dst map[string]mvccValue, commitTS uint64) error {
+	put := func(suffix string, value []byte) error {
+		key := append(append([]byte{}, dstPrefix...), suffix...)
+		if old, ok := dst[suffix]; ok {
+			if err := txn.Set(encodeOldKey(key, old.commitTS), old.MarshalBinary()); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		newVal := mvccValue{
+			mvccValueHdr: mvccValueHdr{startTS: commitTS, commitTS: commitTS},
+			value:        value,
+		}
+		return errors.Trace(txn.Set(key, newVal.MarshalBinary()))
+	}
+	for suffix, val := range src {
+		if len(val.value) == 0 {
+			continue
+		}
+		if err := put(suffix, val.value); err != nil {
+			return err
+		}
+	}
+	for suffix, val := range dst {
+		if len(val.value) == 0 {
+			continue
+		}
+		if srcVal, ok := src[suffix]; ok && len(srcVal.value) > 0 {
+			continue
+		}
+		// Write a delete version.
+		if err := put(suffix, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package tikv_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExchangeRanges(t *testing.T) {
+	c := newTestCluster(t)
+	prefixA, prefixB := []byte{0x10, 'a'}, []byte{0xf0, 'b'}
+	keyA, keyB := append(prefixA, '1'), append(prefixB, '1')
+	onlyA := append(prefixA, '2')
+	for _, key := range [][]byte{keyA, keyB, onlyA} {
+		_, err := c.Put(key, key)
+		require.NoError(t, err)
+	}
+	_, err := c.Server.ExchangeRanges(prefixA, prefixA[:1])
+	require.Error(t, err)
+	// The locked ranges are not exchanged.
+	lockTS := c.AllocTS()
+	prewrite(t, c, lockTS, keyA, keyA)
+	_, err = c.Server.ExchangeRanges(prefixA, prefixB)
+	require.Error(t, err)
+	rollback(t, c, keyA, lockTS)
+
+	commitTS, err := c.Server.ExchangeRanges(prefixA, prefixB)
+	require.NoError(t, err)
+	// The commit ts is allocated after all the ts the store has seen.
+	require.Greater(t, commitTS, c.AllocTS())
+	require.Equal(t, keyB, get(t, c, keyA, commitTS).Value)
+	require.Equal(t, keyA, get(t, c, keyB, commitTS).Value)
+	require.Empty(t, get(t, c, onlyA, commitTS).Value)
+	require.Equal(t, onlyA, get(t, c, append(prefixB, '2'), commitTS).Value)
+	// The old versions are kept.
+	require.Equal(t, keyA, get(t, c, keyA, commitTS-1).Value)
+}
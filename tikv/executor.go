@@ -47,13 +47,21 @@ type tableScanExec struct {
 	reqCtx         *requestCtx
 	rangeCursor    int
 
-	rowCursor   int
-	rows        [][][]byte
+	rowCursor int
+	rows      [][][]byte
+	// rowKeys are the keys of the rows, lastKey is the key of the last row returned by Next, where a paged request
+	// stops.
+	rowKeys     [][]byte
+	lastKey     []byte
 	seekKey     []byte
 	start       int
 	counts      []int64
 	ignoreLock  bool
 	lockChecked bool
+	// limit is the limit of the Limit executor right above the scan, 0 means no limit. The rows beyond it are not
+	// scanned.
+	limit   uint64
+	scanned int
 
 	src executor
 }
@@ -109,12 +117,28 @@ func (e *tableScanExec) Cursor() ([]byte, bool) {
 func (e *tableScanExec) refill() error {
 	e.rowCursor = 0
 	e.rows = e.rows[:0]
-	return e.fillRows()
+	e.rowKeys = e.rowKeys[:0]
+	err := e.fillRows()
+	e.scanned += len(e.rows)
+	return err
+}
+
+// pageLimit returns the number of rows to scan in the next page.
+func (e *tableScanExec) pageLimit() int {
+	return pageLimit(e.limit, e.scanned+len(e.rows))
+}
+
+func pageLimit(limit uint64, scanned int) int {
+	if limit > 0 && int(limit)-scanned < scanLimit {
+		return int(limit) - scanned
+	}
+	return scanLimit
 }
 
 func (e *tableScanExec) getOneRow() [][]byte {
 	if e.rowCursor < len(e.rows) {
 		value := e.rows[e.rowCursor]
+		e.lastKey = e.rowKeys[e.rowCursor]
 		e.rowCursor++
 		return value
 	}
@@ -146,7 +170,7 @@ func (e *tableScanExec) Next(ctx context.Context) ([][]byte, error) {
 }
 
 func (e *tableScanExec) fillRows() error {
-	for e.rangeCursor < len(e.kvRanges) {
+	for e.rangeCursor < len(e.kvRanges) && e.pageLimit() > 0 {
 		ran := e.kvRanges[e.rangeCursor]
 		var err error
 		if ran.IsPoint() {
@@ -179,18 +203,62 @@ func (e *tableScanExec) fillRowsFromPoint(ran kv.KeyRange) error {
 	if len(val) == 0 {
 		return nil
 	}
-	handle, err := tablecodec.DecodeRowKey(ran.StartKey)
-	if err != nil {
-		return errors.Trace(err)
-	}
-	row, err := getRowData(e.Columns, e.colIDs, handle, val)
+	row, err := e.rowData(ran.StartKey, val)
 	if err != nil {
 		return errors.Trace(err)
 	}
 	e.rows = append(e.rows, row)
+	e.rowKeys = append(e.rowKeys, ran.StartKey)
 	return nil
 }
 
+// rowData returns the values of the columns of the row. The rows of a clustered table are keyed by the common
+// handle, the primary key columns missing in the value are cut from it. The physical table id is decoded from the
+// key if it's requested.
+func (e *tableScanExec) rowData(key, value []byte) ([][]byte, error) {
+	var (
+		handle    int64
+		extraCols map[int64][]byte
+		err       error
+	)
+	if len(e.PrimaryColumnIds) == 0 {
+		handle, err = tablecodec.DecodeRowKey(key)
+	} else {
+		extraCols, err = cutCommonHandle(key, e.PrimaryColumnIds)
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if _, ok := e.colIDs[extraPhysTblID]; ok {
+		if extraCols == nil {
+			extraCols = make(map[int64][]byte, 1)
+		}
+		if extraCols[extraPhysTblID], err = encodePhysTblID(key); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	return getRowData(e.Columns, e.colIDs, handle, extraCols, value)
+}
+
+// cutCommonHandle cuts the values of the primary key columns from the common handle of the row key.
+func cutCommonHandle(key []byte, primaryColIDs []int64) (map[int64][]byte, error) {
+	prefixLen := tablecodec.RecordRowKeyLen - 8
+	if len(key) <= prefixLen {
+		return nil, errors.Errorf("invalid common handle row key %q", key)
+	}
+	handle := key[prefixLen:]
+	pkCols := make(map[int64][]byte, len(primaryColIDs))
+	for _, id := range primaryColIDs {
+		col, remain, err := codec.CutOne(handle)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		pkCols[id] = col
+		handle = remain
+	}
+	return pkCols, nil
+}
+
 const scanLimit = 128
 
 func (e *tableScanExec) fillRowsFromRange(ran kv.KeyRange) error {
@@ -204,9 +272,9 @@ func (e *tableScanExec) fillRowsFromRange(ran kv.KeyRange) error {
 	var pairs []Pair
 	reader := e.reqCtx.getDBReader()
 	if e.Desc {
-		pairs = reader.ReverseScan(ran.StartKey, e.seekKey, scanLimit, e.startTS)
+		pairs = reader.ReverseScan(ran.StartKey, e.seekKey, e.pageLimit(), e.startTS, false, 0, 0)
 	} else {
-		pairs = reader.Scan(e.seekKey, ran.EndKey, scanLimit, e.startTS)
+		pairs = reader.Scan(e.seekKey, ran.EndKey, e.pageLimit(), e.startTS, false, 0, 0)
 	}
 	if len(pairs) == 0 {
 		return nil
@@ -215,19 +283,16 @@ func (e *tableScanExec) fillRowsFromRange(ran kv.KeyRange) error {
 		if pair.Err != nil {
 			return errors.Trace(pair.Err)
 		}
-		handle, err := tablecodec.DecodeRowKey(pair.Key)
-		if err != nil {
-			return errors.Trace(err)
-		}
-		row, err := getRowData(e.Columns, e.colIDs, handle, pair.Value)
+		row, err := e.rowData(pair.Key, pair.Value)
 		if err != nil {
 			return errors.Trace(err)
 		}
 		e.rows = append(e.rows, row)
+		e.rowKeys = append(e.rowKeys, pair.Key)
 	}
 	lastPair := pairs[len(pairs)-1]
 	if e.Desc {
-		e.seekKey = prefixPrev(lastPair.Key)
+		e.seekKey = lastPair.Key
 	} else {
 		e.seekKey = []byte(kv.Key(lastPair.Key).PrefixNext())
 	}
@@ -243,6 +308,7 @@ const (
 type indexScanExec struct {
 	*tipb.IndexScan
 	colsLen        int
+	primaryColsLen int
 	kvRanges       []kv.KeyRange
 	startTS        uint64
 	isolationLevel kvrpcpb.IsolationLevel
@@ -255,10 +321,18 @@ type indexScanExec struct {
 	counts         []int64
 	ignoreLock     bool
 	lockChecked    bool
+	// limit is the limit of the Limit executor right above the scan like tableScanExec.
+	limit   uint64
+	scanned int
+	// physTblIDColumn is true if the physical table id is requested after the handle.
+	physTblIDColumn bool
 
 	rowCursor int
 	rows      [][][]byte
-	src       executor
+	// rowKeys and lastKey are like tableScanExec.
+	rowKeys [][]byte
+	lastKey []byte
+	src     executor
 }
 
 func (e *indexScanExec) SetSrcExec(exec executor) {
@@ -323,12 +397,15 @@ func (e *indexScanExec) Next(ctx context.Context) (value [][]byte, err error) {
 	for {
 		if e.rowCursor < len(e.rows) {
 			value = e.rows[e.rowCursor]
+			e.lastKey = e.rowKeys[e.rowCursor]
 			e.rowCursor++
 			return value, nil
 		}
 		e.rowCursor = 0
 		e.rows = e.rows[:0]
+		e.rowKeys = e.rowKeys[:0]
 		err = e.fillRows()
+		e.scanned += len(e.rows)
 		if err != nil {
 			return nil, errors.Trace(err)
 		}
@@ -339,8 +416,13 @@ func (e *indexScanExec) Next(ctx context.Context) (value [][]byte, err error) {
 	return nil, nil
 }
 
+// pageLimit returns the number of rows to scan in the next page.
+func (e *indexScanExec) pageLimit() int {
+	return pageLimit(e.limit, e.scanned+len(e.rows))
+}
+
 func (e *indexScanExec) fillRows() error {
-	for e.ranCursor < len(e.kvRanges) {
+	for e.ranCursor < len(e.kvRanges) && e.pageLimit() > 0 {
 		ran := e.kvRanges[e.ranCursor]
 		var err error
 		if e.isUnique() && ran.IsPoint() {
@@ -378,14 +460,30 @@ func (e *indexScanExec) fillRowsFromPoint(ran kv.KeyRange) error {
 		return errors.Trace(err)
 	}
 	e.rows = append(e.rows, row)
+	e.rowKeys = append(e.rowKeys, ran.StartKey)
 	return nil
 }
 
 func (e *indexScanExec) decodeIndexKV(pair Pair) ([][]byte, error) {
+	values, err := e.decodeIndexColumns(pair)
+	if err != nil || !e.physTblIDColumn {
+		return values, err
+	}
+	b, err := encodePhysTblID(pair.Key)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return append(values, b), nil
+}
+
+func (e *indexScanExec) decodeIndexColumns(pair Pair) ([][]byte, error) {
 	values, b, err := tablecodec.CutIndexKeyNew(pair.Key, e.colsLen)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
+	if e.primaryColsLen > 0 {
+		return e.appendCommonHandle(values, b, pair.Value)
+	}
 	if len(b) > 0 {
 		if e.pkStatus != pkColNotExists {
 			values = append(values, b)
@@ -410,6 +508,43 @@ func (e *indexScanExec) decodeIndexKV(pair Pair) ([][]byte, error) {
 	return values, nil
 }
 
+// appendCommonHandle appends the primary key columns of a clustered index, the common handle is at the end of the
+// key unless the index is unique, then it's in the value.
+func (e *indexScanExec) appendCommonHandle(values [][]byte, tail, value []byte) ([][]byte, error) {
+	handle := tail
+	if len(handle) == 0 {
+		var err error
+		handle, err = decodeCommonHandleFromValue(value)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	for i := 0; i < e.primaryColsLen; i++ {
+		col, remain, err := codec.CutOne(handle)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		values = append(values, col)
+		handle = remain
+	}
+	return values, nil
+}
+
+const indexValueCommonHandleFlag = 127
+
+// decodeCommonHandleFromValue returns the common handle in the value of a unique index, the layout is
+// tailLen | commonHandleFlag | handleLen(2 bytes) | handle | ...
+func decodeCommonHandleFromValue(value []byte) ([]byte, error) {
+	if len(value) < 4 || value[1] != indexValueCommonHandleFlag {
+		return nil, errors.Errorf("invalid common handle index value %q", value)
+	}
+	handleLen := int(binary.BigEndian.Uint16(value[2:]))
+	if len(value) < 4+handleLen {
+		return nil, errors.Errorf("invalid common handle index value %q", value)
+	}
+	return value[4 : 4+handleLen], nil
+}
+
 func (e *indexScanExec) fillRowsFromRange(ran kv.KeyRange) error {
 	if e.seekKey == nil {
 		if e.Desc {
@@ -421,9 +556,9 @@ func (e *indexScanExec) fillRowsFromRange(ran kv.KeyRange) error {
 	var pairs []Pair
 	reader := e.reqCtx.getDBReader()
 	if e.Desc {
-		pairs = reader.ReverseScan(ran.StartKey, e.seekKey, scanLimit, e.startTS)
+		pairs = reader.ReverseScan(ran.StartKey, e.seekKey, e.pageLimit(), e.startTS, false, 0, 0)
 	} else {
-		pairs = reader.Scan(e.seekKey, ran.EndKey, scanLimit, e.startTS)
+		pairs = reader.Scan(e.seekKey, ran.EndKey, e.pageLimit(), e.startTS, false, 0, 0)
 	}
 	if len(pairs) == 0 {
 		return nil
@@ -438,35 +573,19 @@ func (e *indexScanExec) fillRowsFromRange(ran kv.KeyRange) error {
 			return errors.Trace(err)
 		}
 		e.rows = append(e.rows, row)
+		e.rowKeys = append(e.rowKeys, pair.Key)
 	}
 	lastPair := pairs[len(pairs)-1]
 	if e.Desc {
-		e.seekKey = prefixPrev(lastPair.Key)
+		e.seekKey = lastPair.Key
 	} else {
 		e.seekKey = []byte(kv.Key(lastPair.Key).PrefixNext())
 	}
 	return nil
 }
 
-// previous version of kv.PrefixNext.
-func prefixPrev(k []byte) []byte {
-	buf := make([]byte, len([]byte(k)))
-	copy(buf, []byte(k))
-	var i int
-	for i = len(k) - 1; i >= 0; i-- {
-		buf[i]--
-		if buf[i] != 255 {
-			break
-		}
-	}
-	if i == -1 {
-		return nil
-	}
-	return buf
-}
-
 type selectionExec struct {
-	conditions        []expression.Expression
+	conditions        []condition
 	relatedColOffsets []int
 	row               []types.Datum
 	evalCtx           *evalContext
@@ -490,7 +609,7 @@ func (e *selectionExec) Counts() []int64 {
 }
 
 // evalBool evaluates expression to a boolean value.
-func evalBool(exprs []expression.Expression, row types.DatumRow, ctx *stmtctx.StatementContext) (bool, error) {
+func evalBool(exprs []condition, row types.DatumRow, ctx *stmtctx.StatementContext) (bool, error) {
 	for _, expr := range exprs {
 		data, err := expr.Eval(row)
 		if err != nil {
@@ -540,10 +659,12 @@ func (e *selectionExec) Next(ctx context.Context) (value [][]byte, err error) {
 }
 
 type topNExec struct {
+	reqCtx            *requestCtx
 	heap              *topNHeap
 	evalCtx           *evalContext
 	relatedColOffsets []int
 	orderByExprs      []expression.Expression
+	orderByCollators  []collator
 	row               types.DatumRow
 	cursor            int
 	executed          bool
@@ -624,12 +745,20 @@ func (e *topNExec) evalTopN(value [][]byte) error {
 		if err != nil {
 			return errors.Trace(err)
 		}
+		newRow.key[i] = collateDatum(e.orderByCollators[i], newRow.key[i])
 	}
 
+	// A row replacing the top of a full heap frees the memory of the top, only the rows that grow the heap count.
+	growing := e.heap.heapSize < e.heap.totalCount
 	if e.heap.tryToAddRow(newRow) {
 		for _, val := range value {
 			newRow.data = append(newRow.data, val)
 		}
+		if growing {
+			if err = e.reqCtx.consumeMem(rowSize(value)); err != nil {
+				return err
+			}
+		}
 	}
 	return errors.Trace(e.heap.err)
 }
@@ -685,19 +814,27 @@ func hasColVal(data [][]byte, colIDs map[int64]int, id int64) bool {
 	return false
 }
 
-// getRowData decodes raw byte slice to row data.
-func getRowData(columns []*tipb.ColumnInfo, colIDs map[int64]int, handle int64, value []byte) ([][]byte, error) {
-	values, err := tablecodec.CutRowNew(value, colIDs)
+// getRowData cuts the values of the columns in colIDs from the raw row of the format v1 or v2, the values of the
+// other columns are left nil. The columns missing in the row are the handle, the columns in extraCols, the default
+// values or null.
+func getRowData(columns []*tipb.ColumnInfo, colIDs map[int64]int, handle int64, extraCols map[int64][]byte, value []byte) ([][]byte, error) {
+	var values [][]byte
+	var err error
+	if isRowV2(value) {
+		values, err = cutRowV2Columns(value, columns, colIDs)
+	} else {
+		values, err = cutRowColumns(value, colIDs, len(columns))
+	}
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
-	if values == nil {
-		values = make([][]byte, len(colIDs))
-	}
 	// Fill the handle and null columns.
 	for _, col := range columns {
 		id := col.GetColumnId()
-		offset := colIDs[id]
+		offset, ok := colIDs[id]
+		if !ok {
+			continue
+		}
 		if col.GetPkHandle() || id == model.ExtraHandleID {
 			var handleDatum types.Datum
 			if mysql.HasUnsignedFlag(uint(col.GetFlag())) {
@@ -716,6 +853,10 @@ func getRowData(columns []*tipb.ColumnInfo, colIDs map[int64]int, handle int64,
 		if hasColVal(values, colIDs, id) {
 			continue
 		}
+		if b, ok := extraCols[id]; ok {
+			values[offset] = b
+			continue
+		}
 		if len(col.DefaultVal) > 0 {
 			values[offset] = col.DefaultVal
 			continue
@@ -730,6 +871,35 @@ func getRowData(columns []*tipb.ColumnInfo, colIDs map[int64]int, handle int64,
 	return values, nil
 }
 
+// cutRowColumns cuts the values of the columns in colIDs without decoding them, the rest of the row is skipped once
+// all the columns are found.
+func cutRowColumns(data []byte, colIDs map[int64]int, numCols int) ([][]byte, error) {
+	row := make([][]byte, numCols)
+	if len(data) == 0 || (len(data) == 1 && data[0] == codec.NilFlag) {
+		return row, nil
+	}
+	var cnt int
+	for len(data) > 0 && cnt < len(colIDs) {
+		b, remain, err := codec.CutOne(data)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		_, cid, err := codec.DecodeOne(b)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		b, data, err = codec.CutOne(remain)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if offset, ok := colIDs[cid.GetInt64()]; ok {
+			row[offset] = b
+			cnt++
+		}
+	}
+	return row, nil
+}
+
 func convertToExprs(sc *stmtctx.StatementContext, fieldTps []*types.FieldType, pbExprs []*tipb.Expr) ([]expression.Expression, error) {
 	exprs := make([]expression.Expression, 0, len(pbExprs))
 	for _, expr := range pbExprs {
@@ -0,0 +1,14 @@
+package tikv
+
+// CollectRollbacks runs a round of the rollback GC.
+func (store *MVCCStore) CollectRollbacks() error {
+	return (&rollbackGCWorker{store: store}).collect()
+}
+
+// SplitRegion splits the region at the raw splitKey.
+func (rm *RegionManager) SplitRegion(regionID uint64, splitKey []byte) error {
+	rm.mu.RLock()
+	region := rm.regions[regionID]
+	rm.mu.RUnlock()
+	return rm.splitRegion(region, splitKey, 0, 0)
+}
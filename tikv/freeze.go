@@ -0,0 +1,70 @@
+package tikv
+
+import (
+	"bytes"
+	"sync"
+	"time"
+)
+
+// frozenRanges holds the key ranges that reject new prewrites.
+type frozenRanges struct {
+	mu     sync.RWMutex
+	nextID uint64
+	ranges map[uint64]frozenRange
+}
+
+type frozenRange struct {
+	startKey []byte
+	endKey   []byte
+	deadline time.Time
+}
+
+// FreezeRange makes the new prewrites and pessimistic locks in [startKey, endKey) fail with ErrKeyRangeFrozen until
+// UnfreezeRange is called with the returned id or the ttl expires, a zero ttl never expires. Reads, the prewrites
+// over the pessimistic locks of the same transaction and the commits and rollbacks of the existing locks are not
+// affected.
+func (store *MVCCStore) FreezeRange(startKey, endKey []byte, ttl time.Duration) uint64 {
+	r := frozenRange{startKey: safeCopy(startKey), endKey: safeCopy(endKey)}
+	if ttl > 0 {
+		r.deadline = clock.Now().Add(ttl)
+	}
+	fr := &store.frozenRanges
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	if fr.ranges == nil {
+		fr.ranges = make(map[uint64]frozenRange)
+	}
+	fr.nextID++
+	fr.ranges[fr.nextID] = r
+	return fr.nextID
+}
+
+// UnfreezeRange removes the frozen range by id, it returns false if the range doesn't exist or has expired.
+func (store *MVCCStore) UnfreezeRange(id uint64) bool {
+	fr := &store.frozenRanges
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	r, ok := fr.ranges[id]
+	delete(fr.ranges, id)
+	return ok && !r.expired(clock.Now())
+}
+
+func (r frozenRange) expired(now time.Time) bool {
+	return !r.deadline.IsZero() && now.After(r.deadline)
+}
+
+func (store *MVCCStore) isKeyFrozen(key []byte) bool {
+	fr := &store.frozenRanges
+	fr.mu.RLock()
+	defer fr.mu.RUnlock()
+	if len(fr.ranges) == 0 {
+		return false
+	}
+	now := clock.Now()
+	for _, r := range fr.ranges {
+		if bytes.Compare(key, r.startKey) >= 0 && !exceedEndKey(key, r.endKey) && !r.expired(now) {
+			return true
+		}
+	}
+	return false
+}
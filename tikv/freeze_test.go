@@ -0,0 +1,62 @@
+package tikv_test
+
+import (
+	"testing"
+
+	"github.com/ngaut/faketikv/testutil"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestFrozenRange(t *testing.T) {
+	c := newTestCluster(t)
+	ownerTS := c.AllocTS()
+	require.Empty(t, pessimisticLock(t, c, primaryKey, ownerTS))
+	c.Store.FreezeRange(primaryKey[:1], []byte{primaryKey[0] + 1}, 0)
+
+	startTS, frozenKey := c.AllocTS(), []byte{primaryKey[0], 'f'}
+	checkFrozen(t, tryPrewrite(t, c, startTS, frozenKey, frozenKey))
+	checkFrozen(t, pessimisticLock(t, c, frozenKey, startTS))
+	// The keys out of the range are not frozen.
+	require.Empty(t, tryPrewrite(t, c, startTS, secondaryKey, secondaryKey))
+
+	// The owner of the pessimistic lock finishes its transaction in the frozen range.
+	require.Empty(t, pessimisticPrewrite(t, c, primaryKey, ownerTS))
+	require.Nil(t, commit(t, c, primaryKey, ownerTS, c.AllocTS()))
+}
+
+func checkFrozen(t *testing.T, errs []*kvrpcpb.KeyError) {
+	require.Len(t, errs, 1)
+	require.Contains(t, errs[0].Retryable, "frozen")
+}
+
+func pessimisticLock(t *testing.T, c *testutil.Cluster, key []byte, startTS uint64) []*kvrpcpb.KeyError {
+	resp, err := c.Server.KvPessimisticLock(context.Background(), &kvrpcpb.PessimisticLockRequest{
+		Context:      regionCtx(t, c, key),
+		Mutations:    []*kvrpcpb.Mutation{{Op: kvrpcpb.Op_PessimisticLock, Key: key}},
+		PrimaryLock:  key,
+		StartVersion: startTS,
+		ForUpdateTs:  startTS,
+		LockTtl:      3000,
+		WaitTimeout:  -1,
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp.RegionError)
+	return resp.Errors
+}
+
+func pessimisticPrewrite(t *testing.T, c *testutil.Cluster, key []byte, startTS uint64) []*kvrpcpb.KeyError {
+	resp, err := c.Server.KvPrewrite(context.Background(), &kvrpcpb.PrewriteRequest{
+		Context:           regionCtx(t, c, key),
+		Mutations:         []*kvrpcpb.Mutation{{Op: kvrpcpb.Op_Put, Key: key, Value: key}},
+		PrimaryLock:       key,
+		StartVersion:      startTS,
+		LockTtl:           3000,
+		IsPessimisticLock: []bool{true},
+		ForUpdateTs:       startTS,
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp.RegionError)
+	return resp.Errors
+}
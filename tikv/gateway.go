@@ -0,0 +1,462 @@
+package tikv
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/kvproto/pkg/errorpb"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// defaultGatewayScanLimit is the limit of a gateway scan if it's not specified.
+const defaultGatewayScanLimit = 100
+
+// RegisterGatewayHandlers registers the HTTP/JSON gateway of the transactional KV requests on mux, the keys and
+// values are hex encoded. The requests are routed to the regions of the keys and served like the gRPC requests,
+// through the interceptor of the gRPC server if it's not nil, the Authorization header is passed as the auth token.
+func (svr *Server) RegisterGatewayHandlers(mux *http.ServeMux, interceptor grpc.UnaryServerInterceptor) {
+	svr.gatewayInterceptor = interceptor
+	mux.HandleFunc("/kv/get", svr.handleGatewayGet)
+	mux.HandleFunc("/kv/scan", svr.handleGatewayScan)
+	mux.HandleFunc("/kv/prewrite", svr.handleGatewayPrewrite)
+	mux.HandleFunc("/kv/commit", svr.handleGatewayCommit)
+	mux.HandleFunc("/kv/rollback", svr.handleGatewayRollback)
+}
+
+type gatewayLock struct {
+	Key         string `json:"key"`
+	Primary     string `json:"primary"`
+	LockVersion uint64 `json:"lock_version"`
+	LockTTL     uint64 `json:"lock_ttl"`
+}
+
+type gatewayError struct {
+	Locked  *gatewayLock `json:"locked,omitempty"`
+	Message string       `json:"message"`
+}
+
+type gatewayPair struct {
+	Key   string        `json:"key"`
+	Value string        `json:"value,omitempty"`
+	Error *gatewayError `json:"error,omitempty"`
+}
+
+type gatewayScanResult struct {
+	Pairs     []gatewayPair `json:"pairs"`
+	ResumeKey string        `json:"resume_key,omitempty"`
+}
+
+type gatewayMutation struct {
+	// Op is put, del or lock.
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type gatewayPrewriteRequest struct {
+	Mutations    []gatewayMutation `json:"mutations"`
+	Primary      string            `json:"primary"`
+	StartVersion uint64            `json:"start_version"`
+	LockTTL      uint64            `json:"lock_ttl"`
+}
+
+type gatewayCommitRequest struct {
+	Keys          []string `json:"keys"`
+	StartVersion  uint64   `json:"start_version"`
+	CommitVersion uint64   `json:"commit_version"`
+}
+
+type gatewayResponse struct {
+	Errors []*gatewayError `json:"errors,omitempty"`
+}
+
+func toGatewayError(keyErr *kvrpcpb.KeyError) *gatewayError {
+	if keyErr == nil {
+		return nil
+	}
+	gwErr := &gatewayError{Message: fmt.Sprint(keyErr)}
+	if keyErr.Locked != nil {
+		gwErr.Locked = &gatewayLock{
+			Key:         hex.EncodeToString(keyErr.Locked.Key),
+			Primary:     hex.EncodeToString(keyErr.Locked.PrimaryLock),
+			LockVersion: keyErr.Locked.LockVersion,
+			LockTTL:     keyErr.Locked.LockTtl,
+		}
+	}
+	return gwErr
+}
+
+// gatewayContext returns the request context of the region containing the key and the raw end key of the region.
+func (svr *Server) gatewayContext(key []byte) (*kvrpcpb.Context, []byte, error) {
+	regCtx := svr.regionManager.getRegionByKey(key)
+	if regCtx == nil {
+		return nil, nil, errors.Errorf("region of key %q not found", key)
+	}
+	return &kvrpcpb.Context{
+		RegionId:    regCtx.meta.Id,
+		RegionEpoch: regCtx.meta.RegionEpoch,
+		ApiVersion:  svr.apiVersion,
+	}, regCtx.endKey, nil
+}
+
+type gatewayGroup struct {
+	ctx  *kvrpcpb.Context
+	keys [][]byte
+}
+
+// groupKeysByRegion groups the keys by the regions in the order of their first keys.
+func (svr *Server) groupKeysByRegion(keys [][]byte) ([]*gatewayGroup, error) {
+	var groups []*gatewayGroup
+	byID := make(map[uint64]*gatewayGroup)
+	for _, key := range keys {
+		ctx, _, err := svr.gatewayContext(key)
+		if err != nil {
+			return nil, err
+		}
+		g := byID[ctx.RegionId]
+		if g == nil {
+			g = &gatewayGroup{ctx: ctx}
+			byID[ctx.RegionId] = g
+			groups = append(groups, g)
+		}
+		g.keys = append(g.keys, key)
+	}
+	return groups, nil
+}
+
+// gatewayInvoke calls the handler of the KV method through the gateway interceptor.
+func (svr *Server) gatewayInvoke(r *http.Request, method string, req interface{}, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx := context.Background()
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(AuthTokenHeader, auth))
+	}
+	if svr.gatewayInterceptor == nil {
+		return handler(ctx, req)
+	}
+	info := &grpc.UnaryServerInfo{Server: svr, FullMethod: "/tikvpb.Tikv/" + method}
+	return svr.gatewayInterceptor(ctx, req, info, handler)
+}
+
+// gatewayCallError writes the error returned by gatewayInvoke.
+func gatewayCallError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch status.Code(err) {
+	case codes.Unauthenticated:
+		code = http.StatusUnauthorized
+	case codes.PermissionDenied, codes.InvalidArgument:
+		code = http.StatusForbidden
+	case codes.ResourceExhausted, codes.Unavailable:
+		code = http.StatusServiceUnavailable
+	}
+	http.Error(w, err.Error(), code)
+}
+
+func gatewayRegionError(w http.ResponseWriter, regErr *errorpb.Error) {
+	http.Error(w, "region error: "+regErr.Message, http.StatusServiceUnavailable)
+}
+
+func decodeHexKeys(hexKeys []string) ([][]byte, error) {
+	keys := make([][]byte, 0, len(hexKeys))
+	for _, hexKey := range hexKeys {
+		key, err := hex.DecodeString(hexKey)
+		if err != nil || len(key) == 0 {
+			return nil, errors.Errorf("invalid key %q", hexKey)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func parseUintForm(r *http.Request, name string, def uint64) (uint64, error) {
+	v := r.FormValue(name)
+	if v == "" {
+		return def, nil
+	}
+	return strconv.ParseUint(v, 10, 64)
+}
+
+// handleGatewayGet reads the hex encoded key at the version, the latest version is read if it's not specified.
+func (svr *Server) handleGatewayGet(w http.ResponseWriter, r *http.Request) {
+	key, err := hex.DecodeString(r.FormValue("key"))
+	if err != nil || len(key) == 0 {
+		http.Error(w, "invalid key", http.StatusBadRequest)
+		return
+	}
+	version, err := parseUintForm(r, "version", maxSystemTS)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx, _, err := svr.gatewayContext(key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	res, err := svr.gatewayInvoke(r, "KvGet", &kvrpcpb.GetRequest{Context: ctx, Key: key, Version: version},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			return svr.KvGet(ctx, req.(*kvrpcpb.GetRequest))
+		})
+	if err != nil {
+		gatewayCallError(w, err)
+		return
+	}
+	resp := res.(*kvrpcpb.GetResponse)
+	if resp.RegionError != nil {
+		gatewayRegionError(w, resp.RegionError)
+		return
+	}
+	writeJSON(w, gatewayPair{
+		Key:   hex.EncodeToString(key),
+		Value: hex.EncodeToString(resp.Value),
+		Error: toGatewayError(resp.Error),
+	})
+}
+
+// handleGatewayScan scans [start, end) at the version across the regions, at most limit pairs and about max_bytes
+// bytes of pairs are returned. The values are not returned if key_only is true. If the scan stops at a limit, the
+// resume key is returned to be the start key of the next scan.
+func (svr *Server) handleGatewayScan(w http.ResponseWriter, r *http.Request) {
+	startKey, err := hex.DecodeString(r.FormValue("start"))
+	if err != nil {
+		http.Error(w, "invalid start key", http.StatusBadRequest)
+		return
+	}
+	endKey, err := hex.DecodeString(r.FormValue("end"))
+	if err != nil {
+		http.Error(w, "invalid end key", http.StatusBadRequest)
+		return
+	}
+	version, err := parseUintForm(r, "version", maxSystemTS)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, err := parseUintForm(r, "limit", defaultGatewayScanLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	maxBytes, err := parseUintForm(r, "max_bytes", uint64(svr.mvccStore.ScanMaxResponseBytes))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	keyOnly := r.FormValue("key_only") == "true"
+	result := gatewayScanResult{Pairs: make([]gatewayPair, 0)}
+	var size uint64
+	for uint64(len(result.Pairs)) < limit {
+		ctx, regionEnd, err := svr.gatewayContext(startKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		var regionMaxBytes int
+		if maxBytes > 0 {
+			regionMaxBytes = int(maxBytes - size)
+		}
+		var resumeKey []byte
+		res, err := svr.gatewayInvoke(r, "KvScan", &kvrpcpb.ScanRequest{
+			Context:  ctx,
+			StartKey: startKey,
+			EndKey:   endKey,
+			Limit:    uint32(limit) - uint32(len(result.Pairs)),
+			Version:  version,
+			KeyOnly:  keyOnly,
+		}, func(ctx context.Context, req interface{}) (interface{}, error) {
+			var resp *kvrpcpb.ScanResponse
+			resp, resumeKey = svr.scan(req.(*kvrpcpb.ScanRequest), regionMaxBytes)
+			return resp, nil
+		})
+		if err != nil {
+			gatewayCallError(w, err)
+			return
+		}
+		resp := res.(*kvrpcpb.ScanResponse)
+		if resp.RegionError != nil {
+			gatewayRegionError(w, resp.RegionError)
+			return
+		}
+		for _, pair := range resp.Pairs {
+			result.Pairs = append(result.Pairs, gatewayPair{
+				Key:   hex.EncodeToString(pair.Key),
+				Value: hex.EncodeToString(pair.Value),
+				Error: toGatewayError(pair.Error),
+			})
+			size += uint64(len(pair.Key) + len(pair.Value))
+		}
+		if resumeKey != nil {
+			result.ResumeKey = hex.EncodeToString(resumeKey)
+			break
+		}
+		if len(regionEnd) == 0 || exceedEndKey(regionEnd, endKey) {
+			break
+		}
+		startKey = regionEnd
+	}
+	writeJSON(w, result)
+}
+
+var gatewayOps = map[string]kvrpcpb.Op{
+	"put":  kvrpcpb.Op_Put,
+	"del":  kvrpcpb.Op_Del,
+	"lock": kvrpcpb.Op_Lock,
+}
+
+// handleGatewayPrewrite prewrites the JSON mutations region by region.
+func (svr *Server) handleGatewayPrewrite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req gatewayPrewriteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	primary, err := hex.DecodeString(req.Primary)
+	if err != nil || len(primary) == 0 {
+		http.Error(w, "invalid primary", http.StatusBadRequest)
+		return
+	}
+	mutations := make(map[string]*kvrpcpb.Mutation, len(req.Mutations))
+	keys := make([][]byte, 0, len(req.Mutations))
+	for _, m := range req.Mutations {
+		op, ok := gatewayOps[m.Op]
+		if !ok {
+			http.Error(w, fmt.Sprintf("invalid op %q", m.Op), http.StatusBadRequest)
+			return
+		}
+		key, err := hex.DecodeString(m.Key)
+		if err != nil || len(key) == 0 {
+			http.Error(w, fmt.Sprintf("invalid key %q", m.Key), http.StatusBadRequest)
+			return
+		}
+		value, err := hex.DecodeString(m.Value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid value %q", m.Value), http.StatusBadRequest)
+			return
+		}
+		mutations[string(key)] = &kvrpcpb.Mutation{Op: op, Key: key, Value: value}
+		keys = append(keys, key)
+	}
+	groups, err := svr.groupKeysByRegion(keys)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	var result gatewayResponse
+	for _, g := range groups {
+		pbMutations := make([]*kvrpcpb.Mutation, 0, len(g.keys))
+		for _, key := range g.keys {
+			pbMutations = append(pbMutations, mutations[string(key)])
+		}
+		res, err := svr.gatewayInvoke(r, "KvPrewrite", &kvrpcpb.PrewriteRequest{
+			Context:      g.ctx,
+			Mutations:    pbMutations,
+			PrimaryLock:  primary,
+			StartVersion: req.StartVersion,
+			LockTtl:      req.LockTTL,
+		}, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return svr.KvPrewrite(ctx, req.(*kvrpcpb.PrewriteRequest))
+		})
+		if err != nil {
+			gatewayCallError(w, err)
+			return
+		}
+		resp := res.(*kvrpcpb.PrewriteResponse)
+		if resp.RegionError != nil {
+			gatewayRegionError(w, resp.RegionError)
+			return
+		}
+		for _, keyErr := range resp.Errors {
+			result.Errors = append(result.Errors, toGatewayError(keyErr))
+		}
+	}
+	writeJSON(w, result)
+}
+
+// handleGatewayCommit commits the JSON keys region by region, the region of the first key is committed first.
+func (svr *Server) handleGatewayCommit(w http.ResponseWriter, r *http.Request) {
+	svr.handleGatewayCommitOrRollback(w, r, true)
+}
+
+// handleGatewayRollback rolls back the JSON keys.
+func (svr *Server) handleGatewayRollback(w http.ResponseWriter, r *http.Request) {
+	svr.handleGatewayCommitOrRollback(w, r, false)
+}
+
+func (svr *Server) handleGatewayCommitOrRollback(w http.ResponseWriter, r *http.Request, commit bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req gatewayCommitRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	keys, err := decodeHexKeys(req.Keys)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	groups, err := svr.groupKeysByRegion(keys)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	var result gatewayResponse
+	for _, g := range groups {
+		var regErr *errorpb.Error
+		var keyErr *kvrpcpb.KeyError
+		var res interface{}
+		if commit {
+			res, err = svr.gatewayInvoke(r, "KvCommit", &kvrpcpb.CommitRequest{
+				Context:       g.ctx,
+				Keys:          g.keys,
+				StartVersion:  req.StartVersion,
+				CommitVersion: req.CommitVersion,
+			}, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return svr.KvCommit(ctx, req.(*kvrpcpb.CommitRequest))
+			})
+			if err == nil {
+				resp := res.(*kvrpcpb.CommitResponse)
+				regErr, keyErr = resp.RegionError, resp.Error
+			}
+		} else {
+			res, err = svr.gatewayInvoke(r, "KvBatchRollback", &kvrpcpb.BatchRollbackRequest{
+				Context:      g.ctx,
+				Keys:         g.keys,
+				StartVersion: req.StartVersion,
+			}, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return svr.KvBatchRollback(ctx, req.(*kvrpcpb.BatchRollbackRequest))
+			})
+			if err == nil {
+				resp := res.(*kvrpcpb.BatchRollbackResponse)
+				regErr, keyErr = resp.RegionError, resp.Error
+			}
+		}
+		if err != nil {
+			gatewayCallError(w, err)
+			return
+		}
+		if regErr != nil {
+			gatewayRegionError(w, regErr)
+			return
+		}
+		if keyErr != nil {
+			result.Errors = append(result.Errors, toGatewayError(keyErr))
+			break
+		}
+	}
+	writeJSON(w, result)
+}
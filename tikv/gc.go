@@ -0,0 +1,406 @@
+package tikv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+
+	"github.com/coocood/badger"
+	"github.com/juju/errors"
+)
+
+// DefaultGCBatchSize is the default number of deletes written in a batch by GC.
+const DefaultGCBatchSize = 1024
+
+// GCStats is the progress of the MVCC GC.
+type GCStats struct {
+	// Running is the number of regions being collected.
+	Running int32 `json:"running"`
+	Paused  bool  `json:"paused"`
+	// SafePoint is the max safe point GC has been run with.
+	SafePoint         uint64 `json:"safe_point"`
+	ScannedKeys       int64  `json:"scanned_keys"`
+	DeletedVersions   int64  `json:"deleted_versions"`
+	DeletedTombstones int64  `json:"deleted_tombstones"`
+	CollectedRegions  int64  `json:"collected_regions"`
+}
+
+type gcTombstone struct {
+	key      []byte
+	commitTS uint64
+}
+
+// GC collects the versions of the region that are invisible at the safe point, for each key the newest version
+// not newer than the safe point is kept unless it is a delete.
+func (store *MVCCStore) GC(reqCtx *requestCtx, safePoint uint64) error {
+	if store.IsGCPaused() {
+		return ErrGCPaused
+	}
+	if release := store.acquireGCSlot(); release != nil {
+		defer release()
+	}
+	stats := &store.gcStats
+	atomic.AddInt32(&stats.Running, 1)
+	defer atomic.AddInt32(&stats.Running, -1)
+	for {
+		old := atomic.LoadUint64(&stats.SafePoint)
+		if safePoint <= old || atomic.CompareAndSwapUint64(&stats.SafePoint, old, safePoint) {
+			break
+		}
+	}
+	// The safe point must be persisted before any version is collected.
+	if err := store.UpdateGCSafePoint(safePoint); err != nil {
+		return errors.Trace(err)
+	}
+	regCtx := reqCtx.regCtx
+	begin := time.Now()
+	var scanned, deletedVersions, deletedTombstones int64
+	// The range tombstones written after the scan starts may hide the versions not in the snapshot.
+	rangeTombstoneSeq := store.lastRangeTombstoneSeq()
+	txn := store.db.NewTransaction(false)
+	defer txn.Discard()
+	it := newIterator(txn, false)
+	defer it.Close()
+	oldIt := newIterator(txn, false)
+	defer oldIt.Close()
+	dbBatch := newWriteDBBatch(reqCtx)
+	var tombstones []gcTombstone
+	flush := func() error {
+		if store.IsGCPaused() {
+			return ErrGCPaused
+		}
+		store.waitGCQuota(len(dbBatch.entries) + len(tombstones))
+		n, err := store.writeGCBatch(reqCtx, dbBatch, tombstones)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		deletedVersions += int64(len(dbBatch.entries) - n)
+		deletedTombstones += int64(n)
+		dbBatch = newWriteDBBatch(reqCtx)
+		tombstones = tombstones[:0]
+		return nil
+	}
+	for it.Seek(regCtx.startKey); it.Valid(); it.Next() {
+		item := it.Item()
+		if exceedEndKey(item.Key(), regCtx.endKey) {
+			break
+		}
+		if bytes.HasPrefix(item.Key(), InternalKeyPrefix) {
+			continue
+		}
+		key := item.KeyCopy(nil)
+		mvVal, err := decodeValue(item)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		scanned++
+		sp := store.gcSafePoint(key, safePoint)
+		// The versions hidden by the range tombstones before the safe point are invisible at any ts allowed to read.
+		deletedTS := store.rangeDeletedTS(key, safePoint)
+		if deletedTS > sp {
+			sp = deletedTS
+		}
+		if mvVal.commitTS <= sp && (len(mvVal.value) == 0 || mvVal.commitTS <= deletedTS) {
+			tombstones = append(tombstones, gcTombstone{key: key, commitTS: mvVal.commitTS})
+		}
+		if err = collectOldVersions(oldIt, key, mvVal.commitTS, sp, deletedTS, dbBatch); err != nil {
+			return errors.Trace(err)
+		}
+		if len(dbBatch.entries)+len(tombstones) >= store.GCBatchSize {
+			if err = flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	if err := store.trimRangeTombstones(regCtx.startKey, regCtx.endKey, rangeTombstoneSeq, safePoint); err != nil {
+		return errors.Trace(err)
+	}
+	atomic.AddInt64(&stats.ScannedKeys, scanned)
+	atomic.AddInt64(&stats.DeletedVersions, deletedVersions)
+	atomic.AddInt64(&stats.DeletedTombstones, deletedTombstones)
+	atomic.AddInt64(&stats.CollectedRegions, 1)
+	store.scheduleCompaction(regCtx.startKey, regCtx.endKey, int(deletedVersions+deletedTombstones))
+	log.Infof("GC region %d at safe point %d scanned %d keys, deleted %d versions and %d tombstones in %v",
+		regCtx.meta.Id, safePoint, scanned, deletedVersions, deletedTombstones, time.Since(begin))
+	return nil
+}
+
+// collectOldVersions adds the deletes of the old versions of the key that are invisible at the safe point or
+// committed not later than deletedTS to the batch, the latest version is not touched.
+func collectOldVersions(oldIt *badger.Iterator, key []byte, latestCommitTS, safePoint, deletedTS uint64, dbBatch *writeDBBatch) error {
+	// Once the visible version at the safe point is found, all the older versions are invisible.
+	visibleFound := latestCommitTS <= safePoint
+	seekKey := encodeOldKey(key, safePoint)
+	if visibleFound {
+		seekKey = encodeOldKey(key, maxSystemTS)
+	}
+	prefix := seekKey[:len(key)]
+	for oldIt.Seek(seekKey); oldIt.ValidForPrefix(prefix); oldIt.Next() {
+		oldItem := oldIt.Item()
+		if len(oldItem.Key()) != len(seekKey) {
+			// The old key of a longer key with the same prefix.
+			continue
+		}
+		if !visibleFound {
+			visibleFound = true
+			oldVal, err := decodeValue(oldItem)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if len(oldVal.value) > 0 && oldVal.commitTS > deletedTS {
+				continue
+			}
+		}
+		dbBatch.delete(oldItem.KeyCopy(nil))
+	}
+	return nil
+}
+
+// writeGCBatch writes the deletes of the old versions and the tombstones, the tombstones are deleted under
+// latches only if they are not overwritten by new commits, it returns the number of deleted tombstones.
+func (store *MVCCStore) writeGCBatch(reqCtx *requestCtx, dbBatch *writeDBBatch, tombstones []gcTombstone) (int, error) {
+	if len(tombstones) == 0 {
+		return 0, store.writeDB(dbBatch)
+	}
+	keys := make([][]byte, len(tombstones))
+	for i, t := range tombstones {
+		keys[i] = t.key
+	}
+	hashVals := keysToHashVals(keys...)
+	regCtx := reqCtx.regCtx
+	regCtx.acquireLatches(hashVals, reqCtx.isHighPriority())
+	defer regCtx.releaseLatches(hashVals)
+	var cnt int
+	err := store.db.View(func(txn *badger.Txn) error {
+		for _, t := range tombstones {
+			item, err := txn.Get(t.key)
+			if err == badger.ErrKeyNotFound {
+				continue
+			}
+			if err != nil {
+				return errors.Trace(err)
+			}
+			mvVal, err := decodeValue(item)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if mvVal.commitTS == t.commitTS {
+				dbBatch.delete(t.key)
+				cnt++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return cnt, store.writeDB(dbBatch)
+}
+
+// GCSafePoint returns the GC safe point, reads older than it are rejected.
+func (store *MVCCStore) GCSafePoint() uint64 {
+	return atomic.LoadUint64(&store.safePoint)
+}
+
+// UpdateGCSafePoint persists the safe point if it is newer than the current one.
+func (store *MVCCStore) UpdateGCSafePoint(safePoint uint64) error {
+	store.safePointMu.Lock()
+	defer store.safePointMu.Unlock()
+	if safePoint <= store.GCSafePoint() {
+		return nil
+	}
+	val := make([]byte, 8)
+	binary.LittleEndian.PutUint64(val, safePoint)
+	err := store.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(InternalGCSafePointKey, val)
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	atomic.StoreUint64(&store.safePoint, safePoint)
+	return nil
+}
+
+func (store *MVCCStore) loadGCSafePoint() error {
+	return store.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(InternalGCSafePointKey)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return errors.Trace(err)
+		}
+		val, err := item.Value()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		atomic.StoreUint64(&store.safePoint, binary.LittleEndian.Uint64(val))
+		return nil
+	})
+}
+
+// checkGCSafePoint returns ErrGCSafePointExceeded if the read ts of the key is older than the GC safe point of the
+// key, the GC policy of the key may keep its versions after the global safe point.
+func (store *MVCCStore) checkGCSafePoint(key []byte, ts uint64) error {
+	if safePoint := store.gcSafePoint(key, store.GCSafePoint()); ts < safePoint {
+		return &ErrGCSafePointExceeded{TS: ts, SafePoint: safePoint}
+	}
+	return nil
+}
+
+// checkRangeGCSafePoint is checkGCSafePoint of a range read in [startKey, endKey), the read ts is checked against the
+// lowest safe point of the keys in the range.
+func (store *MVCCStore) checkRangeGCSafePoint(startKey, endKey []byte, ts uint64) error {
+	if safePoint := store.rangeGCSafePoint(startKey, endKey, store.GCSafePoint()); ts < safePoint {
+		return &ErrGCSafePointExceeded{TS: ts, SafePoint: safePoint}
+	}
+	return nil
+}
+
+// PauseGC makes the GC requests fail with ErrGCPaused and stops the old version GC until ResumeGC is called, the
+// regions being collected stop at the next batch.
+func (store *MVCCStore) PauseGC() {
+	atomic.StoreInt32(&store.gcPaused, 1)
+}
+
+// ResumeGC resumes the GC paused by PauseGC.
+func (store *MVCCStore) ResumeGC() {
+	atomic.StoreInt32(&store.gcPaused, 0)
+}
+
+// IsGCPaused returns true if GC is paused.
+func (store *MVCCStore) IsGCPaused() bool {
+	return atomic.LoadInt32(&store.gcPaused) == 1
+}
+
+// acquireGCSlot blocks until the number of regions being collected is under GCConcurrency, and returns the function
+// to release the slot, nil is returned if there is no limit.
+func (store *MVCCStore) acquireGCSlot() func() {
+	store.gcSlotsOnce.Do(func() {
+		if store.GCConcurrency > 0 {
+			store.gcSlots = make(chan struct{}, store.GCConcurrency)
+		}
+	})
+	if store.gcSlots == nil {
+		return nil
+	}
+	store.gcSlots <- struct{}{}
+	return func() {
+		<-store.gcSlots
+	}
+}
+
+const gcQuotaWaitInterval = 10 * time.Millisecond
+
+// waitGCQuota blocks until GCDeletesPerSecond allows n more deletes.
+func (store *MVCCStore) waitGCQuota(n int) {
+	rate := store.GCDeletesPerSecond
+	if rate <= 0 || n == 0 {
+		return
+	}
+	if n > rate {
+		// More deletes than a second's quota can never be taken at once, let them drain the bucket instead.
+		n = rate
+	}
+	for !store.gcBucket.take(n, float64(rate), float64(rate), clock.Now()) {
+		timer := clock.NewTimer(gcQuotaWaitInterval)
+		select {
+		case <-store.closeCh:
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+	}
+}
+
+// GCStats returns the accumulated progress of the GC.
+func (store *MVCCStore) GCStats() GCStats {
+	stats := &store.gcStats
+	return GCStats{
+		Running:           atomic.LoadInt32(&stats.Running),
+		Paused:            store.IsGCPaused(),
+		SafePoint:         atomic.LoadUint64(&stats.SafePoint),
+		ScannedKeys:       atomic.LoadInt64(&stats.ScannedKeys),
+		DeletedVersions:   atomic.LoadInt64(&stats.DeletedVersions),
+		DeletedTombstones: atomic.LoadInt64(&stats.DeletedTombstones),
+		CollectedRegions:  atomic.LoadInt64(&stats.CollectedRegions),
+	}
+}
+
+const (
+	oldVersionGCInterval = 100 * time.Millisecond
+	// oldVersionGCStepKeys is the number of keys scanned by the oldVersionGCWorker in a step.
+	oldVersionGCStepKeys = 1024
+	// oldVersionGCIdleWrites is the max number of write batches during an interval for the store to be idle.
+	oldVersionGCIdleWrites = 16
+)
+
+// oldVersionGCWorker incrementally collects the old versions older than the GC safe point when the store is idle,
+// a step scans a small number of keys from where the last step stops and starts over after reaching the end.
+// The latest versions are left to the GC requests as deleting them requires the latches of the region.
+type oldVersionGCWorker struct {
+	store      *MVCCStore
+	cursor     []byte
+	lastWrites int64
+}
+
+// tick runs a step if the store has been idle since the last tick.
+func (w *oldVersionGCWorker) tick() error {
+	store := w.store
+	writes := atomic.LoadInt64(&store.writeDBWorker.batchCount)
+	idle := writes-w.lastWrites <= oldVersionGCIdleWrites
+	w.lastWrites = writes
+	safePoint := store.GCSafePoint()
+	if !idle || safePoint == 0 || store.IsGCPaused() {
+		return nil
+	}
+	return w.step(safePoint)
+}
+
+func (w *oldVersionGCWorker) step(safePoint uint64) error {
+	store := w.store
+	dbBatch := newWriteDBBatch(new(requestCtx))
+	var scanned int
+	err := store.db.View(func(txn *badger.Txn) error {
+		it := newIterator(txn, false)
+		defer it.Close()
+		oldIt := newIterator(txn, false)
+		defer oldIt.Close()
+		for it.Seek(w.cursor); it.Valid(); it.Next() {
+			item := it.Item()
+			if bytes.HasPrefix(item.Key(), InternalKeyPrefix) {
+				continue
+			}
+			if scanned == oldVersionGCStepKeys {
+				w.cursor = item.KeyCopy(w.cursor)
+				return nil
+			}
+			scanned++
+			key := item.KeyCopy(nil)
+			mvVal, err := decodeValue(item)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			err = collectOldVersions(oldIt, key, mvVal.commitTS, store.gcSafePoint(key, safePoint), 0, dbBatch)
+			if err != nil {
+				return errors.Trace(err)
+			}
+		}
+		w.cursor = w.cursor[:0]
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	store.waitGCQuota(len(dbBatch.entries))
+	if err = store.writeDB(dbBatch); err != nil {
+		return errors.Trace(err)
+	}
+	atomic.AddInt64(&store.gcStats.ScannedKeys, int64(scanned))
+	atomic.AddInt64(&store.gcStats.DeletedVersions, int64(len(dbBatch.entries)))
+	return nil
+}
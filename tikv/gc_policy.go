@@ -0,0 +1,153 @@
+package tikv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/coocood/badger"
+	"github.com/juju/errors"
+)
+
+// GCPolicy keeps the MVCC versions of the keys with Prefix for Retention longer than the global safe point.
+type GCPolicy struct {
+	Prefix    []byte
+	Retention time.Duration
+}
+
+// gcPolicies holds the persisted GC policies in memory, sorted by prefix.
+type gcPolicies struct {
+	sync.RWMutex
+	policies []GCPolicy
+}
+
+func (store *MVCCStore) loadGCPolicies() error {
+	return store.db.View(func(txn *badger.Txn) error {
+		it := newIterator(txn, false)
+		defer it.Close()
+		for it.Seek(InternalGCPolicyPrefix); it.ValidForPrefix(InternalGCPolicyPrefix); it.Next() {
+			item := it.Item()
+			val, err := item.Value()
+			if err != nil {
+				return errors.Trace(err)
+			}
+			store.gcPolicies.policies = append(store.gcPolicies.policies, GCPolicy{
+				Prefix:    safeCopy(item.Key()[len(InternalGCPolicyPrefix):]),
+				Retention: time.Duration(binary.LittleEndian.Uint64(val)),
+			})
+		}
+		return nil
+	})
+}
+
+// SetGCPolicy persists the retention of the key prefix, it replaces the old policy of the same prefix.
+func (store *MVCCStore) SetGCPolicy(prefix []byte, retention time.Duration) error {
+	val := make([]byte, 8)
+	binary.LittleEndian.PutUint64(val, uint64(retention))
+	err := store.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(gcPolicyKey(prefix), val)
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	p := &store.gcPolicies
+	p.Lock()
+	defer p.Unlock()
+	i := p.search(prefix)
+	if i < len(p.policies) && bytes.Equal(p.policies[i].Prefix, prefix) {
+		p.policies[i].Retention = retention
+		return nil
+	}
+	p.policies = append(p.policies, GCPolicy{})
+	copy(p.policies[i+1:], p.policies[i:])
+	p.policies[i] = GCPolicy{Prefix: safeCopy(prefix), Retention: retention}
+	return nil
+}
+
+// RemoveGCPolicy removes the policy of the key prefix.
+func (store *MVCCStore) RemoveGCPolicy(prefix []byte) error {
+	err := store.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(gcPolicyKey(prefix))
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	p := &store.gcPolicies
+	p.Lock()
+	defer p.Unlock()
+	i := p.search(prefix)
+	if i < len(p.policies) && bytes.Equal(p.policies[i].Prefix, prefix) {
+		p.policies = append(p.policies[:i], p.policies[i+1:]...)
+	}
+	return nil
+}
+
+// GCPolicies returns all the GC policies sorted by prefix.
+func (store *MVCCStore) GCPolicies() []GCPolicy {
+	p := &store.gcPolicies
+	p.RLock()
+	defer p.RUnlock()
+	return append([]GCPolicy{}, p.policies...)
+}
+
+// gcSafePoint returns the safe point for the key, the longest matched prefix policy takes effect.
+func (store *MVCCStore) gcSafePoint(key []byte, safePoint uint64) uint64 {
+	p := &store.gcPolicies
+	p.RLock()
+	defer p.RUnlock()
+	var matched *GCPolicy
+	for i := range p.policies {
+		policy := &p.policies[i]
+		if bytes.HasPrefix(key, policy.Prefix) && (matched == nil || len(policy.Prefix) > len(matched.Prefix)) {
+			matched = policy
+		}
+	}
+	if matched == nil {
+		return safePoint
+	}
+	holdBack := uint64(matched.Retention/time.Millisecond) << 18
+	if holdBack >= safePoint {
+		return 0
+	}
+	return safePoint - holdBack
+}
+
+// rangeGCSafePoint returns the lowest safe point of the keys in [startKey, endKey), an empty endKey means unbounded.
+func (store *MVCCStore) rangeGCSafePoint(startKey, endKey []byte, safePoint uint64) uint64 {
+	p := &store.gcPolicies
+	p.RLock()
+	defer p.RUnlock()
+	lowest := safePoint
+	for _, policy := range p.policies {
+		// The keys with the prefix are in [Prefix, PrefixNext), a start key after the prefix and not having it is
+		// after all of them.
+		if len(endKey) > 0 && bytes.Compare(policy.Prefix, endKey) >= 0 {
+			break
+		}
+		if bytes.Compare(policy.Prefix, startKey) < 0 && !bytes.HasPrefix(startKey, policy.Prefix) {
+			continue
+		}
+		holdBack := uint64(policy.Retention/time.Millisecond) << 18
+		if holdBack >= safePoint {
+			return 0
+		}
+		if sp := safePoint - holdBack; sp < lowest {
+			lowest = sp
+		}
+	}
+	return lowest
+}
+
+func (p *gcPolicies) search(prefix []byte) int {
+	return sort.Search(len(p.policies), func(i int) bool {
+		return bytes.Compare(p.policies[i].Prefix, prefix) >= 0
+	})
+}
+
+func gcPolicyKey(prefix []byte) []byte {
+	key := make([]byte, 0, len(InternalGCPolicyPrefix)+len(prefix))
+	key = append(key, InternalGCPolicyPrefix...)
+	return append(key, prefix...)
+}
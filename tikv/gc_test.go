@@ -0,0 +1,51 @@
+package tikv_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateGCSafePointConcurrently(t *testing.T) {
+	c := newTestCluster(t)
+	var wg sync.WaitGroup
+	for i := 1; i <= 64; i++ {
+		wg.Add(1)
+		go func(safePoint uint64) {
+			defer wg.Done()
+			require.NoError(t, c.Store.UpdateGCSafePoint(safePoint))
+		}(uint64(i))
+	}
+	wg.Wait()
+	require.Equal(t, uint64(64), c.Store.GCSafePoint())
+}
+
+func TestReadUnderGCPolicy(t *testing.T) {
+	c := newTableCluster(t)
+	for _, key := range [][]byte{[]byte("t1"), []byte("t2")} {
+		_, err := c.Put(key, key)
+		require.NoError(t, err)
+	}
+	readTS := c.AllocTS()
+	require.NoError(t, c.Store.SetGCPolicy([]byte("t1"), time.Hour))
+	require.NoError(t, c.Store.UpdateGCSafePoint(c.AllocTS()))
+
+	// The versions of t1 are kept by its policy for an hour before the safe point.
+	resp := get(t, c, []byte("t1"), readTS)
+	require.Nil(t, resp.Error)
+	require.Equal(t, []byte("t1"), resp.Value)
+	resp = get(t, c, []byte("t2"), readTS)
+	require.NotNil(t, resp.Error)
+	require.Contains(t, resp.Error.Abort, "GC safe point")
+
+	// A range read is checked against the lowest safe point of the keys in the range.
+	pairs := scan(t, c, &kvrpcpb.ScanRequest{StartKey: []byte("t1"), EndKey: []byte("t2"), Limit: 10, Version: readTS})
+	checkScanKeys(t, pairs, []byte("t1"))
+	pairs = scan(t, c, &kvrpcpb.ScanRequest{StartKey: []byte("t2"), Limit: 10, Version: readTS})
+	require.Len(t, pairs, 1)
+	require.NotNil(t, pairs[0].Error)
+	require.Contains(t, pairs[0].Error.Abort, "GC safe point")
+}
@@ -0,0 +1,384 @@
+package tikv
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RegisterHTTPHandlers registers the admin handlers of the server on mux, the handlers that change the store are
+// not registered in read-only mode, and require the token for the requests other than GET if it's not empty.
+func (svr *Server) RegisterHTTPHandlers(mux *http.ServeMux, token string) {
+	mux.HandleFunc("/gc/status", svr.handleGCStatus)
+	mux.HandleFunc("/rollback/stats", svr.handleRollbackStats)
+	mux.HandleFunc("/keyviz/heatmap", svr.handleHeatMap)
+	mux.HandleFunc("/admin/region/hash", svr.handleRegionHash)
+	mux.HandleFunc("/mvcc/version", svr.handleMvccVersion)
+	mux.HandleFunc("/jobs", svr.handleJobs)
+	if svr.readOnly {
+		return
+	}
+	mux.HandleFunc("/gc/policy", requireToken(token, svr.handleGCPolicy))
+	mux.HandleFunc("/gc/pause", requireToken(token, svr.handleGCPause))
+	mux.HandleFunc("/admin/exchange", requireToken(token, svr.handleExchangeRanges))
+	mux.HandleFunc("/admin/snapshots", requireToken(token, svr.handleSnapshots))
+	mux.HandleFunc("/admin/freeze", requireToken(token, svr.handleFreezeRange))
+	mux.HandleFunc("/admin/delete_range", requireToken(token, svr.handleDeleteRange))
+	mux.HandleFunc("/jobs/pause", requireToken(token, svr.handleJobPause))
+	mux.HandleFunc("/admin/write_stall", requireToken(token, svr.handleWriteStall))
+}
+
+// handleWriteStall returns the WriteStall and its stats on GET, and replaces the WriteStall on POST with the
+// distribution, the write_delay and sync_delay durations and the probability, which is 1 by default.
+func (svr *Server) handleWriteStall(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, svr.mvccStore.WriteStallStats())
+	case http.MethodPost:
+		stall := WriteStall{Distribution: r.FormValue("distribution"), Probability: 1}
+		var err error
+		if v := r.FormValue("write_delay"); v != "" {
+			if stall.WriteDelay, err = time.ParseDuration(v); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if v := r.FormValue("sync_delay"); v != "" {
+			if stall.SyncDelay, err = time.ParseDuration(v); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if v := r.FormValue("probability"); v != "" {
+			if stall.Probability, err = strconv.ParseFloat(v, 64); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if err = svr.mvccStore.SetWriteStall(stall); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleJobs returns the status of the background jobs.
+func (svr *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, svr.mvccStore.Jobs())
+}
+
+// handleJobPause pauses the job by name on POST and resumes it on DELETE.
+func (svr *Server) handleJobPause(w http.ResponseWriter, r *http.Request) {
+	name := r.FormValue("name")
+	var ok bool
+	switch r.Method {
+	case http.MethodPost:
+		ok = svr.mvccStore.PauseJob(name)
+	case http.MethodDelete:
+		ok = svr.mvccStore.ResumeJob(name)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !ok {
+		http.Error(w, "job not found", http.StatusNotFound)
+	}
+}
+
+// handleDeleteRange lists the DeleteRange tasks on GET, starts a task of the hex encoded [start, end) range on POST
+// and returns the id, and cancels the task by id on DELETE.
+func (svr *Server) handleDeleteRange(w http.ResponseWriter, r *http.Request) {
+	store := svr.mvccStore
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, store.DeleteRangeTasks())
+	case http.MethodPost:
+		if svr.readOnly {
+			http.Error(w, ErrReadOnly.Error(), http.StatusForbidden)
+			return
+		}
+		startKey, err1 := hex.DecodeString(r.FormValue("start"))
+		endKey, err2 := hex.DecodeString(r.FormValue("end"))
+		if err1 != nil || err2 != nil || len(endKey) == 0 {
+			http.Error(w, "invalid parameters", http.StatusBadRequest)
+			return
+		}
+		if overlapInternalKeys(startKey, endKey) {
+			http.Error(w, "the range overlaps the internal keys", http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, map[string]uint64{"id": store.StartDeleteRange(startKey, endKey)})
+	case http.MethodDelete:
+		id, err := strconv.ParseUint(r.FormValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !store.CancelDeleteRange(id) {
+			http.Error(w, "running delete range task not found", http.StatusNotFound)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleMvccVersion returns the hex encoded value of the hex encoded key visible at the optional ts with its start
+// ts and commit ts, the locks are ignored. The ts are 0 if the key doesn't exist.
+func (svr *Server) handleMvccVersion(w http.ResponseWriter, r *http.Request) {
+	key, err := hex.DecodeString(r.FormValue("key"))
+	if err != nil || len(key) == 0 {
+		http.Error(w, "invalid key", http.StatusBadRequest)
+		return
+	}
+	ts := maxSystemTS
+	if v := r.FormValue("ts"); v != "" {
+		if ts, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	reader := svr.mvccStore.NewDBReader(new(requestCtx))
+	defer reader.Close()
+	val, startTS, commitTS, err := reader.GetVersion(key, svr.readTS(ts))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"value":     hex.EncodeToString(val),
+		"start_ts":  startTS,
+		"commit_ts": commitTS,
+	})
+}
+
+// handleFreezeRange freezes the hex encoded [start, end) range for the optional ttl on POST and returns the id,
+// and unfreezes the range by id on DELETE.
+func (svr *Server) handleFreezeRange(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		startKey, err1 := hex.DecodeString(r.FormValue("start"))
+		endKey, err2 := hex.DecodeString(r.FormValue("end"))
+		if err1 != nil || err2 != nil {
+			http.Error(w, "invalid parameters", http.StatusBadRequest)
+			return
+		}
+		var ttl time.Duration
+		if v := r.FormValue("ttl"); v != "" {
+			var err error
+			if ttl, err = time.ParseDuration(v); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		writeJSON(w, map[string]uint64{"id": svr.mvccStore.FreezeRange(startKey, endKey, ttl)})
+	case http.MethodDelete:
+		id, err := strconv.ParseUint(r.FormValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !svr.mvccStore.UnfreezeRange(id) {
+			http.Error(w, "frozen range not found", http.StatusNotFound)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSnapshots lists the snapshots on GET, creates a snapshot of the hex encoded start and end keys on POST,
+// or restores the snapshot named by restore, and deletes the snapshot by name on DELETE.
+func (svr *Server) handleSnapshots(w http.ResponseWriter, r *http.Request) {
+	store := svr.mvccStore
+	switch r.Method {
+	case http.MethodGet:
+		metas, err := store.Snapshots()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, metas)
+	case http.MethodPost:
+		if name := r.FormValue("restore"); name != "" {
+			if err := store.RestoreSnapshot(name); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		startKey, err1 := hex.DecodeString(r.FormValue("start"))
+		endKey, err2 := hex.DecodeString(r.FormValue("end"))
+		if err1 != nil || err2 != nil {
+			http.Error(w, "invalid parameters", http.StatusBadRequest)
+			return
+		}
+		var ranges []KeyRange
+		if len(startKey) > 0 || len(endKey) > 0 {
+			ranges = append(ranges, KeyRange{StartKey: startKey, EndKey: endKey})
+		}
+		meta, err := store.CreateSnapshot(ranges)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, meta)
+	case http.MethodDelete:
+		if err := store.DeleteSnapshot(r.FormValue("name")); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleRegionHash returns the hash of the region, if the hash parameter is given, it is verified instead.
+func (svr *Server) handleRegionHash(w http.ResponseWriter, r *http.Request) {
+	regionID, err := strconv.ParseUint(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	regCtx := svr.regionManager.getRegionByID(regionID)
+	if regCtx == nil {
+		http.Error(w, "region not found", http.StatusNotFound)
+		return
+	}
+	if v := r.FormValue("hash"); v != "" {
+		expected, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err = svr.mvccStore.VerifyRegionHash(regCtx, expected); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+		}
+		return
+	}
+	hash, err := svr.mvccStore.ComputeRegionHash(regCtx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]uint64{"region_id": regionID, "hash": hash})
+}
+
+// handleExchangeRanges exchanges the data of the hex encoded key prefixes a and b, the commit ts of the exchange
+// is returned.
+func (svr *Server) handleExchangeRanges(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	prefixA, err1 := hex.DecodeString(r.FormValue("a"))
+	prefixB, err2 := hex.DecodeString(r.FormValue("b"))
+	if err1 != nil || err2 != nil {
+		http.Error(w, "invalid parameters", http.StatusBadRequest)
+		return
+	}
+	if svr.readOnly {
+		http.Error(w, ErrReadOnly.Error(), http.StatusForbidden)
+		return
+	}
+	commitTS, err := svr.ExchangeRanges(prefixA, prefixB)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]uint64{"commit_ts": commitTS})
+}
+
+// handleHeatMap returns the region heat matrix between the start and end unix seconds, the default
+// window is the last hour.
+func (svr *Server) handleHeatMap(w http.ResponseWriter, r *http.Request) {
+	end := clock.Now()
+	start := end.Add(-time.Hour)
+	if v := r.FormValue("end"); v != "" {
+		sec, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		end = time.Unix(sec, 0)
+	}
+	if v := r.FormValue("start"); v != "" {
+		sec, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		start = time.Unix(sec, 0)
+	}
+	writeJSON(w, svr.regionManager.HeatMatrix(start, end))
+}
+
+// handleGCStatus returns the progress of the MVCC GC.
+func (svr *Server) handleGCStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, svr.mvccStore.GCStats())
+}
+
+// handleGCPause pauses GC on POST and resumes it on DELETE.
+func (svr *Server) handleGCPause(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		svr.mvccStore.PauseGC()
+	case http.MethodDelete:
+		svr.mvccStore.ResumeGC()
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleRollbackStats returns the count and age of the rollback records.
+func (svr *Server) handleRollbackStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, svr.mvccStore.RollbackStats())
+}
+
+type gcPolicyJSON struct {
+	Prefix    string `json:"prefix"`
+	Retention string `json:"retention"`
+}
+
+// handleGCPolicy lists the GC policies on GET, sets a policy on POST with the hex encoded prefix and the
+// retention duration, and removes a policy on DELETE.
+func (svr *Server) handleGCPolicy(w http.ResponseWriter, r *http.Request) {
+	store := svr.mvccStore
+	if r.Method == http.MethodGet {
+		policies := store.GCPolicies()
+		result := make([]gcPolicyJSON, 0, len(policies))
+		for _, p := range policies {
+			result = append(result, gcPolicyJSON{Prefix: hex.EncodeToString(p.Prefix), Retention: p.Retention.String()})
+		}
+		writeJSON(w, result)
+		return
+	}
+	prefix, err := hex.DecodeString(r.FormValue("prefix"))
+	if err != nil || len(prefix) == 0 {
+		http.Error(w, "invalid prefix", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		retention, err := time.ParseDuration(r.FormValue("retention"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = store.SetGCPolicy(prefix, retention)
+	case http.MethodDelete:
+		err = store.RemoveGCPolicy(prefix)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,137 @@
+package tikv
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// JobStatus is the state of a background job of the store.
+type JobStatus struct {
+	Name       string    `json:"name"`
+	Interval   string    `json:"interval"`
+	Paused     bool      `json:"paused"`
+	Running    bool      `json:"running"`
+	Runs       int64     `json:"runs"`
+	Failures   int64     `json:"failures"`
+	LastRun    time.Time `json:"last_run"`
+	LastTimeMs int64     `json:"last_time_ms"`
+	LastError  string    `json:"last_error,omitempty"`
+	NextRun    time.Time `json:"next_run"`
+}
+
+// job is a background task run by the store periodically.
+type job struct {
+	name     string
+	interval time.Duration
+	run      func() error
+	paused   int32
+
+	mu     sync.Mutex
+	status JobStatus
+}
+
+// jobScheduler holds the background jobs, a job runs in its own goroutine after every interval unless paused.
+type jobScheduler struct {
+	mu   sync.RWMutex
+	jobs []*job
+}
+
+func (s *jobScheduler) get(name string) *job {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, j := range s.jobs {
+		if j.name == name {
+			return j
+		}
+	}
+	return nil
+}
+
+// addJob starts running the job, it stops when the store is closed.
+func (store *MVCCStore) addJob(name string, interval time.Duration, run func() error) {
+	j := &job{name: name, interval: interval, run: run}
+	j.status.Name = name
+	j.status.Interval = interval.String()
+	s := &store.jobScheduler
+	s.mu.Lock()
+	s.jobs = append(s.jobs, j)
+	s.mu.Unlock()
+	store.wg.Add(1)
+	go store.runJob(j)
+}
+
+func (store *MVCCStore) runJob(j *job) {
+	defer store.wg.Done()
+	for {
+		j.mu.Lock()
+		j.status.NextRun = clock.Now().Add(j.interval)
+		j.mu.Unlock()
+		timer := clock.NewTimer(j.interval)
+		select {
+		case <-store.closeCh:
+			timer.Stop()
+			return
+		case <-timer.C():
+		}
+		if atomic.LoadInt32(&j.paused) > 0 {
+			continue
+		}
+		start := clock.Now()
+		j.mu.Lock()
+		j.status.Running = true
+		j.status.LastRun = start
+		j.mu.Unlock()
+		err := j.run()
+		j.mu.Lock()
+		j.status.Running = false
+		j.status.Runs++
+		j.status.LastTimeMs = int64(clock.Now().Sub(start) / time.Millisecond)
+		j.status.LastError = ""
+		if err != nil {
+			j.status.Failures++
+			j.status.LastError = err.Error()
+		}
+		j.mu.Unlock()
+		if err != nil {
+			log.Errorf("job %s failed: %v", j.name, err)
+		}
+	}
+}
+
+// Jobs returns the status of the background jobs.
+func (store *MVCCStore) Jobs() []JobStatus {
+	s := &store.jobScheduler
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	jobs := make([]JobStatus, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		j.mu.Lock()
+		status := j.status
+		j.mu.Unlock()
+		status.Paused = atomic.LoadInt32(&j.paused) > 0
+		jobs = append(jobs, status)
+	}
+	return jobs
+}
+
+// PauseJob stops running the job until it is resumed, a running round is not interrupted. It returns false if the
+// job is not found.
+func (store *MVCCStore) PauseJob(name string) bool {
+	j := store.jobScheduler.get(name)
+	if j == nil {
+		return false
+	}
+	atomic.StoreInt32(&j.paused, 1)
+	return true
+}
+
+// ResumeJob resumes the paused job, it returns false if the job is not found.
+func (store *MVCCStore) ResumeJob(name string) bool {
+	j := store.jobScheduler.get(name)
+	if j == nil {
+		return false
+	}
+	atomic.StoreInt32(&j.paused, 0)
+	return true
+}
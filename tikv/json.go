@@ -0,0 +1,171 @@
+package tikv
+
+import (
+	"github.com/juju/errors"
+	"github.com/pingcap/tidb/expression"
+	"github.com/pingcap/tidb/sessionctx/stmtctx"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/types/json"
+	tipb "github.com/pingcap/tipb/go-tipb"
+)
+
+// jsonMemberOf evaluates `value MEMBER OF(json_array)`, which the builtin functions of TiDB don't have. The JSON
+// columns, json_extract and json_unquote are evaluated by the builtin functions.
+type jsonMemberOf struct {
+	args []expression.Expression
+}
+
+func (m *jsonMemberOf) Eval(row types.DatumRow) (types.Datum, error) {
+	value, err := m.args[0].Eval(row)
+	if err != nil {
+		return types.Datum{}, errors.Trace(err)
+	}
+	target, err := m.args[1].Eval(row)
+	if err != nil {
+		return types.Datum{}, errors.Trace(err)
+	}
+	if value.IsNull() || target.IsNull() {
+		return types.Datum{}, nil
+	}
+	bj, err := datumToJSON(value)
+	if err != nil {
+		return types.Datum{}, errors.Trace(err)
+	}
+	arr, err := targetToJSON(target)
+	if err != nil {
+		return types.Datum{}, errors.Trace(err)
+	}
+	if arr.TypeCode != json.TypeCodeArray {
+		// A scalar or an object is a member of itself only.
+		return types.NewIntDatum(boolToInt64(json.CompareBinary(bj, arr) == 0)), nil
+	}
+	for i := 0; i < arr.GetElemCount(); i++ {
+		if json.CompareBinary(bj, arr.ArrayGetElem(i)) == 0 {
+			return types.NewIntDatum(1), nil
+		}
+	}
+	return types.NewIntDatum(0), nil
+}
+
+// datumToJSON converts the value of MEMBER OF to JSON, the strings are JSON strings instead of parsed.
+func datumToJSON(d types.Datum) (json.BinaryJSON, error) {
+	switch d.Kind() {
+	case types.KindMysqlJSON:
+		return d.GetMysqlJSON(), nil
+	case types.KindInt64, types.KindUint64, types.KindFloat64, types.KindString:
+		return json.CreateBinary(d.GetValue()), nil
+	case types.KindBytes:
+		return json.CreateBinary(string(d.GetBytes())), nil
+	case types.KindFloat32:
+		return json.CreateBinary(d.GetFloat64()), nil
+	}
+	s, err := d.ToString()
+	if err != nil {
+		return json.BinaryJSON{}, errors.Trace(err)
+	}
+	return json.CreateBinary(s), nil
+}
+
+// targetToJSON converts the array of MEMBER OF to JSON, the strings are parsed as JSON documents like MySQL.
+func targetToJSON(d types.Datum) (json.BinaryJSON, error) {
+	switch d.Kind() {
+	case types.KindMysqlJSON:
+		return d.GetMysqlJSON(), nil
+	case types.KindString, types.KindBytes:
+		bj, err := json.ParseBinaryFromString(d.GetString())
+		return bj, errors.Trace(err)
+	}
+	return datumToJSON(d)
+}
+
+func isJSONMemberOf(expr *tipb.Expr) bool {
+	return expr.GetTp() == tipb.ExprType_ScalarFunc && expr.Sig == tipb.ScalarFuncSig_JsonMemberOfSig
+}
+
+func hasJSONMemberOf(expr *tipb.Expr) bool {
+	if isJSONMemberOf(expr) {
+		return true
+	}
+	for _, child := range expr.Children {
+		if hasJSONMemberOf(child) {
+			return true
+		}
+	}
+	return false
+}
+
+// logicalCondition is NOT, AND or OR of conditions, so MEMBER OF can be under them.
+type logicalCondition struct {
+	sc   *stmtctx.StatementContext
+	sig  tipb.ScalarFuncSig
+	args []condition
+}
+
+func (c *logicalCondition) Eval(row types.DatumRow) (types.Datum, error) {
+	var hasNull bool
+	for _, arg := range c.args {
+		d, err := arg.Eval(row)
+		if err != nil {
+			return types.Datum{}, errors.Trace(err)
+		}
+		if d.IsNull() {
+			hasNull = true
+			continue
+		}
+		b, err := d.ToBool(c.sc)
+		if err != nil {
+			return types.Datum{}, errors.Trace(err)
+		}
+		switch c.sig {
+		case tipb.ScalarFuncSig_UnaryNotInt:
+			return types.NewIntDatum(boolToInt64(b == 0)), nil
+		case tipb.ScalarFuncSig_LogicalAnd:
+			if b == 0 {
+				return types.NewIntDatum(0), nil
+			}
+		case tipb.ScalarFuncSig_LogicalOr:
+			if b != 0 {
+				return types.NewIntDatum(1), nil
+			}
+		}
+	}
+	if hasNull {
+		return types.Datum{}, nil
+	}
+	// All the arguments of AND are true, or all the arguments of OR are false.
+	return types.NewIntDatum(boolToInt64(c.sig == tipb.ScalarFuncSig_LogicalAnd)), nil
+}
+
+// convertMemberOfCondition converts the condition which has MEMBER OF, which can be under NOT, AND and OR.
+func convertMemberOfCondition(sc *stmtctx.StatementContext, fieldTps []*types.FieldType, expr *tipb.Expr) (condition, error) {
+	if isJSONMemberOf(expr) {
+		args, err := convertToExprs(sc, fieldTps, expr.Children)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return &jsonMemberOf{args: args}, nil
+	}
+	if expr.GetTp() != tipb.ExprType_ScalarFunc {
+		return nil, errors.Errorf("MEMBER OF under %s is not supported", expr.GetTp())
+	}
+	switch expr.Sig {
+	case tipb.ScalarFuncSig_UnaryNotInt, tipb.ScalarFuncSig_LogicalAnd, tipb.ScalarFuncSig_LogicalOr:
+	default:
+		return nil, errors.Errorf("MEMBER OF under %s is not supported", expr.Sig)
+	}
+	cond := &logicalCondition{sc: sc, sig: expr.Sig}
+	for _, child := range expr.Children {
+		var arg condition
+		var err error
+		if hasJSONMemberOf(child) {
+			arg, err = convertMemberOfCondition(sc, fieldTps, child)
+		} else if err = checkNoCollatedCompare([]*tipb.Expr{child}); err == nil {
+			arg, err = expression.PBToExpr(child, fieldTps, sc)
+		}
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		cond.args = append(cond.args, arg)
+	}
+	return cond, nil
+}
@@ -0,0 +1,64 @@
+package tikv
+
+import (
+	"testing"
+
+	"github.com/pingcap/tidb/mysql"
+	"github.com/pingcap/tidb/sessionctx/stmtctx"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/util/codec"
+	tipb "github.com/pingcap/tipb/go-tipb"
+	"github.com/stretchr/testify/require"
+)
+
+func intExpr(v int64) *tipb.Expr {
+	return &tipb.Expr{Tp: tipb.ExprType_Int64, Val: codec.EncodeInt(nil, v)}
+}
+
+func memberOfExpr(v int64) *tipb.Expr {
+	return funcExpr(tipb.ScalarFuncSig_JsonMemberOfSig, 0, intExpr(v), columnExpr(0, 0))
+}
+
+func TestJSONMemberOf(t *testing.T) {
+	// The string target is parsed as a JSON document.
+	checkMemberOf(t, memberOfExpr(1), "[1, 2]", 1)
+	checkMemberOf(t, memberOfExpr(3), "[1, 2]", 0)
+	checkMemberOf(t, memberOfExpr(1), "1", 1)
+	d, err := evalMemberOf(t, memberOfExpr(1), nil)
+	require.NoError(t, err)
+	require.True(t, d.IsNull())
+	_, err = evalMemberOf(t, memberOfExpr(1), "[1")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "JSON")
+}
+
+func TestJSONMemberOfUnderLogic(t *testing.T) {
+	checkMemberOf(t, funcExpr(tipb.ScalarFuncSig_UnaryNotInt, 0, memberOfExpr(1)), "[1, 2]", 0)
+	or := funcExpr(tipb.ScalarFuncSig_LogicalOr, 0, memberOfExpr(3), memberOfExpr(2))
+	checkMemberOf(t, or, "[1, 2]", 1)
+	checkMemberOf(t, funcExpr(tipb.ScalarFuncSig_LogicalAnd, 0, memberOfExpr(1), memberOfExpr(3)), "[1, 2]", 0)
+	d, err := evalMemberOf(t, or, nil)
+	require.NoError(t, err)
+	require.True(t, d.IsNull())
+
+	// MEMBER OF is only supported as a condition.
+	_, err = convertToConditions(new(stmtctx.StatementContext), memberOfFieldTps,
+		[]*tipb.Expr{funcExpr(tipb.ScalarFuncSig_EQInt, 0, memberOfExpr(1), intExpr(1))})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not supported")
+}
+
+var memberOfFieldTps = []*types.FieldType{types.NewFieldType(mysql.TypeVarString)}
+
+func checkMemberOf(t *testing.T, cond *tipb.Expr, target string, res int64) {
+	d, err := evalMemberOf(t, cond, target)
+	require.NoError(t, err)
+	require.Equal(t, res, d.GetInt64())
+}
+
+// evalMemberOf evaluates the condition on the row of the target, a nil target is NULL.
+func evalMemberOf(t *testing.T, cond *tipb.Expr, target interface{}) (types.Datum, error) {
+	conds, err := convertToConditions(new(stmtctx.StatementContext), memberOfFieldTps, []*tipb.Expr{cond})
+	require.NoError(t, err)
+	return conds[0].Eval(types.DatumRow{types.NewDatum(target)})
+}
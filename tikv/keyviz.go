@@ -0,0 +1,225 @@
+package tikv
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	keyVizInterval = time.Minute
+	// keyVizCapacity keeps one day of heat slices.
+	keyVizCapacity = 24 * 60
+)
+
+// Heat tags of the HeatMatrix, same as the tags of PD keyviz.
+const (
+	HeatReadBytes    = "read_bytes"
+	HeatReadKeys     = "read_keys"
+	HeatWrittenBytes = "written_bytes"
+	HeatWrittenKeys  = "written_keys"
+)
+
+// regionHeat counts the read and write traffic of a region since the last heat slice.
+type regionHeat struct {
+	readKeys     int64
+	readBytes    int64
+	writtenKeys  int64
+	writtenBytes int64
+}
+
+func (h *regionHeat) addRead(keys, bytes int) {
+	atomic.AddInt64(&h.readKeys, int64(keys))
+	atomic.AddInt64(&h.readBytes, int64(bytes))
+}
+
+func (h *regionHeat) addWrite(keys, bytes int) {
+	atomic.AddInt64(&h.writtenKeys, int64(keys))
+	atomic.AddInt64(&h.writtenBytes, int64(bytes))
+}
+
+func (h *regionHeat) reset() regionHeat {
+	return regionHeat{
+		readKeys:     atomic.SwapInt64(&h.readKeys, 0),
+		readBytes:    atomic.SwapInt64(&h.readBytes, 0),
+		writtenKeys:  atomic.SwapInt64(&h.writtenKeys, 0),
+		writtenBytes: atomic.SwapInt64(&h.writtenBytes, 0),
+	}
+}
+
+func (h regionHeat) value(tag string) int64 {
+	switch tag {
+	case HeatReadBytes:
+		return h.readBytes
+	case HeatReadKeys:
+		return h.readKeys
+	case HeatWrittenBytes:
+		return h.writtenBytes
+	default:
+		return h.writtenKeys
+	}
+}
+
+type regionHeatItem struct {
+	startKey []byte
+	endKey   []byte
+	heat     regionHeat
+}
+
+type heatSlice struct {
+	time    time.Time
+	regions []regionHeatItem
+}
+
+// heatRing is a fixed capacity ring buffer of heat slices.
+type heatRing struct {
+	mu     sync.RWMutex
+	slices []heatSlice
+	next   int
+	full   bool
+}
+
+func newHeatRing(capacity int) *heatRing {
+	return &heatRing{slices: make([]heatSlice, capacity)}
+}
+
+func (r *heatRing) push(slice heatSlice) {
+	r.mu.Lock()
+	r.slices[r.next] = slice
+	r.next++
+	if r.next == len(r.slices) {
+		r.next = 0
+		r.full = true
+	}
+	r.mu.Unlock()
+}
+
+// window returns the slices in [start, end) in time order.
+func (r *heatRing) window(start, end time.Time) []heatSlice {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var ordered []heatSlice
+	if r.full {
+		ordered = append(ordered, r.slices[r.next:]...)
+	}
+	ordered = append(ordered, r.slices[:r.next]...)
+	var result []heatSlice
+	for _, s := range ordered {
+		if !s.time.Before(start) && s.time.Before(end) {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+func (rm *RegionManager) keyVizLoop() {
+	defer rm.wg.Done()
+	for {
+		timer := clock.NewTimer(keyVizInterval)
+		select {
+		case <-rm.closeCh:
+			timer.Stop()
+			return
+		case <-timer.C():
+			rm.heatRing.push(rm.collectHeatSlice(clock.Now()))
+		}
+	}
+}
+
+func (rm *RegionManager) collectHeatSlice(now time.Time) heatSlice {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	slice := heatSlice{time: now, regions: make([]regionHeatItem, 0, len(rm.regions))}
+	for _, regCtx := range rm.regions {
+		slice.regions = append(slice.regions, regionHeatItem{
+			startKey: regCtx.startKey,
+			endKey:   regCtx.endKey,
+			heat:     regCtx.heat.reset(),
+		})
+	}
+	return slice
+}
+
+// HeatMatrix is the region heat over time, Data[tag][i][j] is the heat of the key range
+// [KeyAxis[j], KeyAxis[j+1]) at TimeAxis[i], an empty last key means the end of the key space.
+type HeatMatrix struct {
+	KeyAxis  [][]byte             `json:"keys"`
+	TimeAxis []int64              `json:"times"`
+	Data     map[string][][]int64 `json:"data"`
+}
+
+// HeatMatrix returns the heat matrix of the time window [start, end).
+func (rm *RegionManager) HeatMatrix(start, end time.Time) *HeatMatrix {
+	slices := rm.heatRing.window(start, end)
+	keyAxis := buildKeyAxis(slices)
+	tags := []string{HeatReadBytes, HeatReadKeys, HeatWrittenBytes, HeatWrittenKeys}
+	matrix := &HeatMatrix{
+		KeyAxis:  keyAxis,
+		TimeAxis: make([]int64, 0, len(slices)),
+		Data:     make(map[string][][]int64, len(tags)),
+	}
+	for _, s := range slices {
+		matrix.TimeAxis = append(matrix.TimeAxis, s.time.Unix())
+		rows := make(map[string][]int64, len(tags))
+		for _, tag := range tags {
+			rows[tag] = make([]int64, len(keyAxis)-1)
+		}
+		for _, item := range s.regions {
+			startIdx := searchKeyAxis(keyAxis, item.startKey)
+			endIdx := len(keyAxis) - 1
+			if len(item.endKey) > 0 {
+				endIdx = searchKeyAxis(keyAxis, item.endKey)
+			}
+			if endIdx <= startIdx {
+				continue
+			}
+			// Spread the heat evenly when the region covers multiple units of the axis.
+			n := int64(endIdx - startIdx)
+			for _, tag := range tags {
+				v := item.heat.value(tag) / n
+				for j := startIdx; j < endIdx; j++ {
+					rows[tag][j] += v
+				}
+			}
+		}
+		for _, tag := range tags {
+			matrix.Data[tag] = append(matrix.Data[tag], rows[tag])
+		}
+	}
+	return matrix
+}
+
+// buildKeyAxis returns the sorted distinct region boundaries of the slices, followed by an empty key as the end.
+func buildKeyAxis(slices []heatSlice) [][]byte {
+	var keys [][]byte
+	for _, s := range slices {
+		for _, item := range s.regions {
+			keys = append(keys, item.startKey)
+			if len(item.endKey) > 0 {
+				keys = append(keys, item.endKey)
+			}
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+	axis := make([][]byte, 0, len(keys)+1)
+	for _, key := range keys {
+		if len(axis) > 0 && bytes.Equal(axis[len(axis)-1], key) {
+			continue
+		}
+		axis = append(axis, key)
+	}
+	if len(axis) == 0 {
+		axis = append(axis, []byte{})
+	}
+	return append(axis, []byte{})
+}
+
+func searchKeyAxis(axis [][]byte, key []byte) int {
+	return sort.Search(len(axis)-1, func(i int) bool {
+		return bytes.Compare(axis[i], key) >= 0
+	})
+}
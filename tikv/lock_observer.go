@@ -0,0 +1,96 @@
+package tikv
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+)
+
+// lockObserverMaxLocks is the max number of locks collected by the lock observer, the observer becomes dirty if
+// more locks are written.
+const lockObserverMaxLocks = 32768
+
+// lockObserver collects the locks with start ts not greater than maxTS written after it is registered, so a GC
+// worker can resolve them without scanning the locks of every region after PhysicalScanLock.
+type lockObserver struct {
+	mu     sync.Mutex
+	active int32
+	maxTS  uint64
+	dirty  bool
+	locks  map[string]*kvrpcpb.LockInfo
+}
+
+// RegisterLockObserver starts observing the locks with start ts not greater than maxTS, the collected locks are
+// kept if an observer with the same maxTS is registered, and discarded if maxTS is greater.
+func (store *MVCCStore) RegisterLockObserver(maxTS uint64) error {
+	o := &store.lockObserver
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if maxTS < o.maxTS {
+		return errors.Errorf("lock observer max ts %d is less than the registered %d", maxTS, o.maxTS)
+	}
+	if maxTS > o.maxTS || atomic.LoadInt32(&o.active) == 0 {
+		o.maxTS = maxTS
+		o.dirty = false
+		o.locks = make(map[string]*kvrpcpb.LockInfo)
+		atomic.StoreInt32(&o.active, 1)
+	}
+	return nil
+}
+
+// CheckLockObserver returns the locks collected by the observer of maxTS, clean is false if some locks may be
+// missing in the result.
+func (store *MVCCStore) CheckLockObserver(maxTS uint64) (locks []*kvrpcpb.LockInfo, clean bool, err error) {
+	o := &store.lockObserver
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if atomic.LoadInt32(&o.active) == 0 || o.maxTS != maxTS {
+		return nil, false, errors.Errorf("lock observer of max ts %d is not registered", maxTS)
+	}
+	if o.dirty {
+		return nil, false, nil
+	}
+	locks = make([]*kvrpcpb.LockInfo, 0, len(o.locks))
+	for _, lock := range o.locks {
+		locks = append(locks, lock)
+	}
+	return locks, true, nil
+}
+
+// RemoveLockObserver stops the observer of maxTS and discards the collected locks.
+func (store *MVCCStore) RemoveLockObserver(maxTS uint64) error {
+	o := &store.lockObserver
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.maxTS != maxTS {
+		return errors.Errorf("lock observer of max ts %d is not registered", maxTS)
+	}
+	atomic.StoreInt32(&o.active, 0)
+	o.locks = nil
+	return nil
+}
+
+// observe is called by the writeLockWorker for every lock inserted, the pessimistic locks are ignored as they
+// don't block reads.
+func (o *lockObserver) observe(key, val []byte) {
+	if atomic.LoadInt32(&o.active) == 0 {
+		return
+	}
+	lock := decodeLock(val)
+	if lock.op == uint8(kvrpcpb.Op_PessimisticLock) {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if atomic.LoadInt32(&o.active) == 0 || o.dirty || lock.startTS > o.maxTS {
+		return
+	}
+	if _, ok := o.locks[string(key)]; !ok && len(o.locks) >= lockObserverMaxLocks {
+		o.dirty = true
+		o.locks = nil
+		return
+	}
+	o.locks[string(key)] = newLockInfo(key, &lock)
+}
@@ -0,0 +1,107 @@
+package tikv
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	defaultLockWaitTimeout = time.Second
+	maxLockWaitTimeout     = 10 * time.Second
+)
+
+// lockWaiterManager parks the pessimistic lock requests blocked by the locks of other transactions,
+// and wakes them up when the locks are released.
+type lockWaiterManager struct {
+	mu      sync.Mutex
+	waiters map[uint64][]*lockWaiter
+}
+
+type lockWaiter struct {
+	startTS uint64
+	lockTS  uint64
+	keyHash uint64
+	lockErr *ErrLocked
+	ch      chan struct{}
+}
+
+func newLockWaiterManager() *lockWaiterManager {
+	return &lockWaiterManager{waiters: make(map[uint64][]*lockWaiter)}
+}
+
+// newWaiter registers a waiter on the key hash, it must be called with the key's latch held so the
+// wake up of the lock release can not be missed.
+func (m *lockWaiterManager) newWaiter(startTS, lockTS, keyHash uint64, lockErr *ErrLocked) *lockWaiter {
+	w := &lockWaiter{
+		startTS: startTS,
+		lockTS:  lockTS,
+		keyHash: keyHash,
+		lockErr: lockErr,
+		ch:      make(chan struct{}, 1),
+	}
+	m.mu.Lock()
+	m.waiters[keyHash] = append(m.waiters[keyHash], w)
+	m.mu.Unlock()
+	return w
+}
+
+// wait blocks until the waiter is woken up or the timeout is reached, it returns false on timeout.
+func (m *lockWaiterManager) wait(w *lockWaiter, timeout time.Duration) bool {
+	timer := clock.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-w.ch:
+		return true
+	case <-timer.C():
+		m.removeWaiter(w)
+		return false
+	}
+}
+
+func (m *lockWaiterManager) removeWaiter(w *lockWaiter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	waiters := m.waiters[w.keyHash]
+	for i, waiter := range waiters {
+		if waiter == w {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(m.waiters, w.keyHash)
+	} else {
+		m.waiters[w.keyHash] = waiters
+	}
+}
+
+// wakeUp wakes up all the waiters of the released keys, they retry and the ones that lose the race wait again.
+func (m *lockWaiterManager) wakeUp(keyHashes []uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.waiters) == 0 {
+		return
+	}
+	for _, keyHash := range keyHashes {
+		for _, w := range m.waiters[keyHash] {
+			select {
+			case w.ch <- struct{}{}:
+			default:
+			}
+		}
+		delete(m.waiters, keyHash)
+	}
+}
+
+// lockWaitTimeout converts the wait_timeout in milliseconds of the request to a duration, 0 means the default
+// timeout.
+func lockWaitTimeout(waitTimeoutMs int64) time.Duration {
+	if waitTimeoutMs == 0 {
+		return defaultLockWaitTimeout
+	}
+	timeout := time.Duration(waitTimeoutMs) * time.Millisecond
+	if timeout > maxLockWaitTimeout {
+		return maxLockWaitTimeout
+	}
+	return timeout
+}
@@ -0,0 +1,5 @@
+package tikv
+
+import "github.com/ngaut/faketikv/logutil"
+
+var log = logutil.Module("tikv")
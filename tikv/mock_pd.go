@@ -0,0 +1,117 @@
+package tikv
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/kvproto/pkg/pdpb"
+)
+
+// MockPDClient is an in-memory PD for a single store, it keeps the regions reported by the RegionManager so the
+// regions can be located by keys without a PD server.
+type MockPDClient struct {
+	clusterID uint64
+
+	mu        sync.RWMutex
+	lastID    uint64
+	stores    map[uint64]*metapb.Store
+	regions   map[uint64]*metapb.Region
+	safePoint uint64
+}
+
+// NewMockPDClient creates an in-memory PD client for the tests.
+func NewMockPDClient(clusterID uint64) *MockPDClient {
+	return &MockPDClient{
+		clusterID: clusterID,
+		stores:    make(map[uint64]*metapb.Store),
+		regions:   make(map[uint64]*metapb.Region),
+	}
+}
+
+func (c *MockPDClient) GetClusterID(ctx context.Context) uint64 {
+	return c.clusterID
+}
+
+func (c *MockPDClient) AllocID(ctx context.Context) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastID++
+	return c.lastID, nil
+}
+
+func (c *MockPDClient) Bootstrap(ctx context.Context, store *metapb.Store, region *metapb.Region) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stores[store.Id] = proto.Clone(store).(*metapb.Store)
+	c.regions[region.Id] = proto.Clone(region).(*metapb.Region)
+	return nil
+}
+
+func (c *MockPDClient) PutStore(ctx context.Context, store *metapb.Store) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stores[store.Id] = proto.Clone(store).(*metapb.Store)
+	return nil
+}
+
+func (c *MockPDClient) ReportRegion(regInfo *regionCtx) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.regions[regInfo.meta.Id] = proto.Clone(regInfo.meta).(*metapb.Region)
+}
+
+func (c *MockPDClient) StoreHeartbeat(ctx context.Context, stats *pdpb.StoreStats) error {
+	return nil
+}
+
+func (c *MockPDClient) GetGCSafePoint(ctx context.Context) (uint64, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.safePoint, nil
+}
+
+// UpdateGCSafePoint sets the safe point returned by GetGCSafePoint.
+func (c *MockPDClient) UpdateGCSafePoint(safePoint uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if safePoint > c.safePoint {
+		c.safePoint = safePoint
+	}
+}
+
+// GetRegion returns the region containing the encoded key and its first peer as the leader.
+func (c *MockPDClient) GetRegion(ctx context.Context, key []byte) (*metapb.Region, *metapb.Peer, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, region := range c.regions {
+		if bytes.Compare(key, region.StartKey) >= 0 && (len(region.EndKey) == 0 || bytes.Compare(key, region.EndKey) < 0) {
+			region = proto.Clone(region).(*metapb.Region)
+			var leader *metapb.Peer
+			if len(region.Peers) > 0 {
+				leader = region.Peers[0]
+			}
+			return region, leader, nil
+		}
+	}
+	return nil, nil, nil
+}
+
+// Regions returns all the regions sorted by the start key.
+func (c *MockPDClient) Regions() []*metapb.Region {
+	c.mu.RLock()
+	regions := make([]*metapb.Region, 0, len(c.regions))
+	for _, region := range c.regions {
+		regions = append(regions, proto.Clone(region).(*metapb.Region))
+	}
+	c.mu.RUnlock()
+	sort.Slice(regions, func(i, j int) bool {
+		return bytes.Compare(regions[i].StartKey, regions[j].StartKey) < 0
+	})
+	return regions
+}
+
+func (c *MockPDClient) Close() {}
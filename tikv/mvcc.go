@@ -4,35 +4,127 @@ import (
 	"bytes"
 	"encoding/binary"
 	"math"
+	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/coocood/badger"
 	"github.com/cznic/mathutil"
 	"github.com/juju/errors"
 	"github.com/ngaut/faketikv/lockstore"
-	"github.com/ngaut/log"
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
 	"github.com/pingcap/tidb/util/codec"
 )
 
 // MVCCStore is a wrapper of badger.DB to provide MVCC functions.
 type MVCCStore struct {
-	dir             string
-	db              *badger.DB
-	writeDBWorker   *writeDBWorker
-	lockStore       *lockstore.MemStore
-	rollbackStore   *lockstore.MemStore
-	writeLockWorker *writeLockWorker
-	closeCh         chan struct{}
-	wg              sync.WaitGroup
+	dir              string
+	db               *badger.DB
+	writeDBWorker    *writeDBWorker
+	lockStore        *lockstore.MemStore
+	rollbackStore    *lockstore.MemStore
+	writeLockWorker  *writeLockWorker
+	compactionWorker *compactionWorker
+	// AsyncCommitSecondaries makes Commit return after the primary key is committed, and commit the
+	// secondary keys in the same request asynchronously.
+	AsyncCommitSecondaries bool
+	// PipelinedPessimisticLock makes PessimisticLock respond before the locks are applied by writeLockWorker.
+	PipelinedPessimisticLock bool
+	// RollbackRetention and ProtectedRollbackRetention are the time to keep the rollback records, a prewrite
+	// arriving after its rollback record is collected fails with ErrTxnTooOld.
+	RollbackRetention          time.Duration
+	ProtectedRollbackRetention time.Duration
+	// RollbackMemLimit is the max bytes of the rollback records in memory, the oldest records are spilled to
+	// badger when it's exceeded, 0 means no limit.
+	RollbackMemLimit int64
+	// GCBatchSize is the number of deletes written in a batch by GC.
+	GCBatchSize int
+	// GCDeletesPerSecond limits the deletes of GC, 0 means no limit.
+	GCDeletesPerSecond int
+	// GCConcurrency is the max number of regions collected concurrently, 0 means no limit.
+	GCConcurrency int
+	// MaxKeyVersions is the number of old versions written for a key to trigger pruning its versions invisible at
+	// the GC safe point, 0 means disabled.
+	MaxKeyVersions int
+	// LogicalDeleteRange makes DeleteRange write a range tombstone and leave the deletion to GC by default.
+	LogicalDeleteRange bool
+	// AsyncDeleteRange makes KvDeleteRange start a DeleteRange task and return without waiting for the deletion.
+	AsyncDeleteRange bool
+	// RequestMemLimit is the max bytes of the scan results, the locks and the coprocessor data held by a request,
+	// 0 means no limit.
+	RequestMemLimit int64
+	// CopMemQuota is the max bytes held by a coprocessor request instead of RequestMemLimit, 0 means RequestMemLimit
+	// applies.
+	CopMemQuota int64
+	// ScanMaxResponseBytes is the max bytes of the pairs of a KvScan response, 0 means no limit. A response cut by
+	// it has fewer pairs than the limit, so it only applies to the requests opting in by the ScanResumeHeader
+	// metadata, whose clients resume from the last key until a scan returns no pairs.
+	ScanMaxResponseBytes int64
+	// dataVersion is bumped by the writes without a region, see bumpDataVersion.
+	dataVersion uint64
+	// maxCommitTS is the max commit ts of the writes without a region, see updateMaxCommitTS.
+	maxCommitTS uint64
+	// SnapshotRetention limits the snapshots created by CreateSnapshot.
+	SnapshotRetention SnapshotRetention
+	// DeadlockDetector detects deadlocks among the pessimistic lock waiters.
+	DeadlockDetector  *DeadlockDetector
+	lockWaiterManager *lockWaiterManager
+	closeCh           chan struct{}
+	wg                sync.WaitGroup
 
 	// latestTS records the latest timestamp of requests, used to determine if it is safe to GC rollback key.
 	latestTS uint64
+	// rollbackGCTS is the persisted max start ts of the collected rollback keys, a request with
+	// start ts not greater than it may belong to a rolled back transaction whose rollback key is gone.
+	rollbackGCTS uint64
+	// safePoint is the persisted GC safe point, it's updated holding safePointMu so it never goes backwards.
+	safePoint   uint64
+	safePointMu sync.Mutex
+	// reclaimedBytes is the total bytes reclaimed by the compaction worker.
+	reclaimedBytes int64
+	gcPolicies     gcPolicies
+	gcStats        GCStats
+	// spilledRollbacks is the number of rollback records spilled to badger.
+	spilledRollbacks int64
+	rollbackStats    atomic.Value
+	subscriptions    subscriptions
+	frozenRanges     frozenRanges
+	rangeTombstones  rangeTombstones
+	lockObserver     lockObserver
+	gcPaused         int32
+	gcBucket         tokenBucket
+	gcSlotsOnce      sync.Once
+	gcSlots          chan struct{}
+	versionCounter   versionCounter
+	deleteRangeTasks deleteRangeTasks
+	// rawTTLUsed is 1 if there may be raw keys with ttl to purge.
+	rawTTLUsed   int32
+	jobScheduler jobScheduler
+	writeStall   writeStallState
+	readOnly     bool
 }
 
+// deadlockEntryTTL is the time a wait-for edge lives in the DeadlockDetector if it's not cleaned up. It outlives the
+// longest lock wait, so the edge of a waiter is there until it's woken up or times out.
+const deadlockEntryTTL = 3 * maxLockWaitTimeout
+
 // NewMVCCStore creates a new MVCCStore
 func NewMVCCStore(db *badger.DB, dataDir string) *MVCCStore {
+	store := newMVCCStore(db, dataDir)
+	store.startWorkers()
+	return store
+}
+
+// NewReadOnlyMVCCStore creates a MVCCStore on a read-only db, no background worker is started and the locks are
+// not dumped on Close.
+func NewReadOnlyMVCCStore(db *badger.DB, dataDir string) *MVCCStore {
+	store := newMVCCStore(db, dataDir)
+	store.readOnly = true
+	return store
+}
+
+func newMVCCStore(db *badger.DB, dataDir string) *MVCCStore {
 	ls := lockstore.NewMemStore(8 << 20)
 	rollbackStore := lockstore.NewMemStore(256 << 10)
 	closeCh := make(chan struct{})
@@ -49,31 +141,78 @@ func NewMVCCStore(db *badger.DB, dataDir string) *MVCCStore {
 			wakeUp:  make(chan struct{}, 1),
 			closeCh: closeCh,
 		},
-		closeCh: closeCh,
+		compactionWorker: &compactionWorker{
+			taskCh: make(chan compactionTask, 16),
+		},
+		DeadlockDetector:  NewDeadlockDetector(deadlockEntryTTL),
+		lockWaiterManager: newLockWaiterManager(),
+		closeCh:           closeCh,
+
+		RollbackRetention:          DefaultRollbackRetention,
+		ProtectedRollbackRetention: DefaultProtectedRollbackRetention,
+		GCBatchSize:                DefaultGCBatchSize,
 	}
+	store.rollbackStats.Store(RollbackStats{})
+	store.versionCounter.pruneCh = make(chan []byte, versionPruneQueueSize)
 	store.writeDBWorker.store = store
 	store.writeLockWorker.store = store
+	store.compactionWorker.store = store
+	store.subscriptions.ticketCond = sync.NewCond(&store.subscriptions.ticketMu)
 	err := store.loadLocks()
 	if err != nil {
 		log.Fatal(err)
 	}
+	err = store.loadRollbackGCTS()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = store.loadGCPolicies()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = store.loadGCSafePoint()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = store.loadSpilledRollbacks()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = store.loadRangeTombstones()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// The raw keys with ttl written before the restart are unknown.
+	store.rawTTLUsed = 1
+	return store
+}
 
+func (store *MVCCStore) startWorkers() {
 	// mark worker count
-	store.wg.Add(3)
+	store.wg.Add(4)
 	// run all the workers
 	go store.writeDBWorker.run()
 	go store.writeLockWorker.run()
+	go store.compactionWorker.run()
 	go func() {
-		rbGCWorker := rollbackGCWorker{store: store}
-		rbGCWorker.run()
+		pruner := versionPruner{store: store}
+		pruner.run()
 	}()
-
-	return store
+	// the periodic workers are run as jobs
+	ovGCWorker := &oldVersionGCWorker{store: store}
+	store.addJob("old_version_gc", oldVersionGCInterval, ovGCWorker.tick)
+	rbGCWorker := &rollbackGCWorker{store: store}
+	store.addJob("rollback_gc", rollbackGCInterval, rbGCWorker.collect)
+	purger := &rawTTLPurger{store: store}
+	store.addJob("raw_ttl_purge", rawTTLPurgeInterval, purger.tick)
 }
 
 func (store *MVCCStore) Close() error {
 	close(store.closeCh)
 	store.wg.Wait()
+	if store.readOnly {
+		return nil
+	}
 
 	err := store.dumpMemLocks()
 	if err != nil {
@@ -93,24 +232,94 @@ func (store *MVCCStore) updateLatestTS(ts uint64) {
 	}
 }
 
-func (store *MVCCStore) Prewrite(reqCtx *requestCtx, mutations []*kvrpcpb.Mutation, primary []byte, startTS uint64, ttl uint64) []error {
+// allocTS returns a ts greater than the latest ts of the requests and not less than the physical time now, for the
+// writes committed by the store itself.
+func (store *MVCCStore) allocTS() uint64 {
+	for {
+		latestTS := store.getLatestTS()
+		ts := uint64(clock.Now().UnixNano()/int64(time.Millisecond)) << 18
+		if ts <= latestTS {
+			ts = latestTS + 1
+		}
+		if atomic.CompareAndSwapUint64(&store.latestTS, latestTS, ts) {
+			return ts
+		}
+	}
+}
+
+func (store *MVCCStore) getRollbackGCTS() uint64 {
+	return atomic.LoadUint64(&store.rollbackGCTS)
+}
+
+func (store *MVCCStore) loadRollbackGCTS() error {
+	return store.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(InternalRollbackGCTSKey)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return errors.Trace(err)
+		}
+		val, err := item.Value()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		atomic.StoreUint64(&store.rollbackGCTS, binary.LittleEndian.Uint64(val))
+		return nil
+	})
+}
+
+// saveRollbackGCTS persists the watermark before the rollback keys are collected, so the protection
+// survives restart.
+func (store *MVCCStore) saveRollbackGCTS(ts uint64) error {
+	if ts <= store.getRollbackGCTS() {
+		return nil
+	}
+	val := make([]byte, 8)
+	binary.LittleEndian.PutUint64(val, ts)
+	err := store.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(InternalRollbackGCTSKey, val)
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	atomic.StoreUint64(&store.rollbackGCTS, ts)
+	return nil
+}
+
+func (store *MVCCStore) Prewrite(reqCtx *requestCtx, req *kvrpcpb.PrewriteRequest) []error {
+	mutations := req.Mutations
+	startTS := req.StartVersion
 	regCtx := reqCtx.regCtx
 	hashVals := mutationsToHashVals(mutations)
 	errs := make([]error, 0, len(mutations))
+	pessimisticLocks := make([]*mvccLock, len(mutations))
 	anyError := false
 
-	regCtx.acquireLatches(hashVals)
+	regCtx.acquireLatches(hashVals, reqCtx.isHighPriority())
 	reqCtx.trace(eventAcquireLatches)
 	defer regCtx.releaseLatches(hashVals)
 
 	// Must check the LockStore first.
-	for _, m := range mutations {
-		duplicate, err := store.checkPrewriteInLockStore(reqCtx, m, startTS)
+	for i, m := range mutations {
+		ownLock, err := store.checkPrewriteInLockStore(reqCtx, m, startTS)
 		if err != nil {
 			anyError = true
 		}
-		if duplicate {
-			return nil
+		if ownLock != nil {
+			if ownLock.op != uint8(kvrpcpb.Op_PessimisticLock) {
+				// Same ts, no need to overwrite.
+				return nil
+			}
+			pessimisticLocks[i] = ownLock
+		} else if err == nil && isPessimisticLockMutation(req, i) {
+			err = ErrPessimisticLockNotFound
+			anyError = true
+		}
+		// The owner of a pessimistic lock acquired before the freeze finishes its transaction.
+		if err == nil && ownLock == nil && store.isKeyFrozen(m.Key) {
+			err = ErrKeyRangeFrozen
+			anyError = true
 		}
 		errs = append(errs, err)
 	}
@@ -123,21 +332,52 @@ func (store *MVCCStore) Prewrite(reqCtx *requestCtx, mutations []*kvrpcpb.Mutati
 	// Check the DB.
 	txn := reqCtx.getDBReader().txn
 	for i, m := range mutations {
-		hasOldVer, err := store.checkPrewriteInDB(reqCtx, txn, m, startTS)
+		if m.Op == kvrpcpb.Op_CheckNotExists {
+			// Only check the constraint, no lock is written for the key.
+			val, err := reqCtx.getDBReader().Get(m.Key, startTS)
+			if err == nil && len(val) > 0 {
+				err = &ErrKeyAlreadyExist{Key: m.Key}
+			}
+			if err != nil {
+				anyError = true
+			}
+			errs[i] = err
+			continue
+		}
+		var hasOldVer bool
+		var err error
+		if pessimisticLocks[i] != nil {
+			// The write conflict is checked when the pessimistic lock is acquired, the pessimistic lock
+			// is replaced by the prewrite lock.
+			hasOldVer = pessimisticLocks[i].hasOldVer
+			if m.Op == kvrpcpb.Op_Insert {
+				err = store.checkKeyNotExist(txn, m.Key)
+			}
+			lockBatch.delete(m.Key)
+		} else {
+			hasOldVer, err = store.checkPrewriteInDB(reqCtx, txn, m, startTS)
+		}
 		if err != nil {
 			anyError = true
 		}
 		errs[i] = err
 		if !anyError {
+			op := m.Op
+			if op == kvrpcpb.Op_Insert {
+				// The constraint is checked, commit it as a Put.
+				op = kvrpcpb.Op_Put
+			}
 			lock := mvccLock{
 				mvccLockHdr: mvccLockHdr{
-					startTS:    startTS,
-					op:         uint8(m.Op),
-					hasOldVer:  hasOldVer,
-					ttl:        uint32(ttl),
-					primaryLen: uint16(len(primary)),
+					startTS:     startTS,
+					op:          uint8(op),
+					hasOldVer:   hasOldVer,
+					ttl:         uint32(req.LockTtl),
+					primaryLen:  uint16(len(req.PrimaryLock)),
+					forUpdateTS: req.ForUpdateTs,
+					minCommitTS: req.MinCommitTs,
 				},
-				primary: primary,
+				primary: req.PrimaryLock,
 				value:   m.Value,
 			}
 			lockBatch.set(m.Key, lock.MarshalBinary())
@@ -155,31 +395,38 @@ func (store *MVCCStore) Prewrite(reqCtx *requestCtx, mutations []*kvrpcpb.Mutati
 	return nil
 }
 
+func isPessimisticLockMutation(req *kvrpcpb.PrewriteRequest, i int) bool {
+	return i < len(req.IsPessimisticLock) && req.IsPessimisticLock[i]
+}
+
+// checkPrewriteInLockStore returns the lock if the key is already locked by the same transaction.
 func (store *MVCCStore) checkPrewriteInLockStore(
-	req *requestCtx, mutation *kvrpcpb.Mutation, startTS uint64) (duplicate bool, err error) {
+	req *requestCtx, mutation *kvrpcpb.Mutation, startTS uint64) (ownLock *mvccLock, err error) {
 	req.buf = encodeRollbackKey(req.buf, mutation.Key, startTS)
-	if len(store.rollbackStore.Get(req.buf, nil)) > 0 {
-		return false, ErrAlreadyRollback
+	if store.hasRollback(req.buf) {
+		return nil, ErrAlreadyRollback
 	}
 	req.buf = store.lockStore.Get(mutation.Key, req.buf)
 	if len(req.buf) == 0 {
-		return false, nil
+		if startTS <= store.getRollbackGCTS() {
+			// The rollback key may have been collected, we can not tell if the prewrite arrives after rollback.
+			return nil, ErrTxnTooOld
+		}
+		if store.newestRollbackTS(mutation.Key) > startTS {
+			// The rollback record of this transaction may have been collapsed by a newer one.
+			return nil, ErrRetryable("write conflict")
+		}
+		return nil, nil
 	}
 	lock := decodeLock(req.buf)
 	if lock.startTS == startTS {
-		// Same ts, no need to overwrite.
-		return true, nil
-	}
-	return false, &ErrLocked{
-		Key:     mutation.Key,
-		StartTS: lock.startTS,
-		Primary: lock.primary,
-		TTL:     uint64(lock.ttl),
+		return &lock, nil
 	}
+	return nil, newErrLocked(mutation.Key, &lock)
 }
 
 // checkPrewrietInDB checks that there is no committed version greater than startTS or return write conflict error.
-// And it returns a bool value indicates if there is an old version.
+// And it returns a bool value indicates if there is an old version. An Insert mutation also requires the key not exist.
 func (store *MVCCStore) checkPrewriteInDB(
 	req *requestCtx, txn *badger.Txn, mutation *kvrpcpb.Mutation, startTS uint64) (hasOldVer bool, err error) {
 	item, err := txn.Get(mutation.Key)
@@ -196,9 +443,195 @@ func (store *MVCCStore) checkPrewriteInDB(
 	if mvVal.commitTS > startTS {
 		return false, ErrRetryable("write conflict")
 	}
+	if mutation.Op == kvrpcpb.Op_Insert && len(mvVal.value) > 0 {
+		return false, &ErrKeyAlreadyExist{Key: mutation.Key}
+	}
 	return true, nil
 }
 
+// checkKeyNotExist returns ErrKeyAlreadyExist if the latest committed version of the key is not a delete.
+func (store *MVCCStore) checkKeyNotExist(txn *badger.Txn, key []byte) error {
+	item, err := txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+	mvVal, err := decodeValue(item)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(mvVal.value) > 0 {
+		return &ErrKeyAlreadyExist{Key: key}
+	}
+	return nil
+}
+
+// PessimisticLock acquires the pessimistic locks of the mutations' keys. If a key is locked by another transaction
+// and the request allows waiting, a lockWaiter is registered before the latches are released and returned with
+// the ErrLocked, the caller should wait on it and retry. If req.ReturnValues is set, the latest committed values
+// of the keys are read under the latches and set to resp.Values on success, if req.CheckExistence is set, only
+// resp.NotFounds is set.
+func (store *MVCCStore) PessimisticLock(reqCtx *requestCtx, req *kvrpcpb.PessimisticLockRequest,
+	resp *kvrpcpb.PessimisticLockResponse) (*lockWaiter, error) {
+	mutations := req.Mutations
+	startTS := req.StartVersion
+	forUpdateTS := req.ForUpdateTs
+	store.updateLatestTS(forUpdateTS)
+	regCtx := reqCtx.regCtx
+	hashVals := mutationsToHashVals(mutations)
+
+	regCtx.acquireLatches(hashVals, reqCtx.isHighPriority())
+	reqCtx.trace(eventAcquireLatches)
+	releaseLatches := true
+	defer func() {
+		if releaseLatches {
+			regCtx.releaseLatches(hashVals)
+		}
+	}()
+
+	locked := make([]bool, len(mutations))
+	for i, m := range mutations {
+		reqCtx.buf = encodeRollbackKey(reqCtx.buf, m.Key, startTS)
+		if store.hasRollback(reqCtx.buf) {
+			return nil, ErrAlreadyRollback
+		}
+		reqCtx.buf = store.lockStore.Get(m.Key, reqCtx.buf)
+		if len(reqCtx.buf) == 0 {
+			if store.isKeyFrozen(m.Key) {
+				return nil, ErrKeyRangeFrozen
+			}
+			continue
+		}
+		lock := decodeLock(reqCtx.buf)
+		if lock.startTS == startTS {
+			// Already locked by this transaction.
+			locked[i] = true
+			continue
+		}
+		lockErr := newErrLocked(m.Key, &lock)
+		if req.WaitTimeout < 0 {
+			return nil, lockErr
+		}
+		if deadlock := store.DeadlockDetector.Detect(startTS, lock.startTS, hashVals[i]); deadlock != nil {
+			deadlock.LockKey = m.Key
+			return nil, deadlock
+		}
+		return store.lockWaiterManager.newWaiter(startTS, lock.startTS, hashVals[i], lockErr), lockErr
+	}
+	reqCtx.trace(eventReadLock)
+
+	lockBatch := newWriteLockBatch(reqCtx)
+	txn := reqCtx.getDBReader().txn
+	var values [][]byte
+	var notFounds []bool
+	needRead := req.ReturnValues || req.CheckExistence
+	if req.ReturnValues {
+		values = make([][]byte, len(mutations))
+	}
+	if needRead {
+		notFounds = make([]bool, len(mutations))
+	}
+	for i, m := range mutations {
+		if locked[i] && !needRead {
+			continue
+		}
+		item, err := txn.Get(m.Key)
+		if err != nil && err != badger.ErrKeyNotFound {
+			return nil, errors.Trace(err)
+		}
+		var hasOldVer bool
+		if item != nil {
+			mvVal, err := decodeValue(item)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			if !locked[i] && mvVal.commitTS > forUpdateTS {
+				return nil, ErrRetryable("write conflict")
+			}
+			hasOldVer = true
+			if values != nil {
+				values[i] = mvVal.value
+			}
+			if notFounds != nil {
+				notFounds[i] = len(mvVal.value) == 0
+			}
+		} else if notFounds != nil {
+			notFounds[i] = true
+		}
+		if locked[i] {
+			continue
+		}
+		lock := mvccLock{
+			mvccLockHdr: mvccLockHdr{
+				startTS:     startTS,
+				op:          uint8(kvrpcpb.Op_PessimisticLock),
+				hasOldVer:   hasOldVer,
+				ttl:         uint32(req.LockTtl),
+				primaryLen:  uint16(len(req.PrimaryLock)),
+				forUpdateTS: forUpdateTS,
+			},
+			primary: req.PrimaryLock,
+		}
+		lockBatch.set(m.Key, lock.MarshalBinary())
+	}
+	reqCtx.trace(eventReadDB)
+	if store.PipelinedPessimisticLock && len(lockBatch.entries) > 0 {
+		// Respond before the locks are applied, the latches are held until then so the following requests
+		// on the keys see the locks. The region is held as well, the requests on the regions split from it
+		// wait for its latches to be released.
+		releaseLatches = false
+		regCtx.refCount.Add(1)
+		store.writeLocksAsync(lockBatch, func() {
+			regCtx.releaseLatches(hashVals)
+			regCtx.refCount.Done()
+		})
+	} else {
+		err := store.writeLocks(lockBatch)
+		reqCtx.trace(eventEndWriteLock)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	resp.Values = values
+	resp.NotFounds = notFounds
+	return nil, nil
+}
+
+// PessimisticRollback removes the pessimistic locks of the transaction whose for update ts is not greater than
+// forUpdateTS, the prewrite locks are not affected.
+func (store *MVCCStore) PessimisticRollback(reqCtx *requestCtx, keys [][]byte, startTS, forUpdateTS uint64) error {
+	regCtx := reqCtx.regCtx
+	hashVals := keysToHashVals(keys...)
+	lockBatch := newWriteLockBatch(reqCtx)
+
+	regCtx.acquireLatches(hashVals, reqCtx.isHighPriority())
+	reqCtx.trace(eventAcquireLatches)
+	defer regCtx.releaseLatches(hashVals)
+
+	var buf []byte
+	for _, key := range keys {
+		buf = store.lockStore.Get(key, buf)
+		if len(buf) == 0 {
+			continue
+		}
+		lock := decodeLock(buf)
+		if lock.startTS == startTS && lock.op == uint8(kvrpcpb.Op_PessimisticLock) && lock.forUpdateTS <= forUpdateTS {
+			lockBatch.delete(key)
+		}
+	}
+	reqCtx.trace(eventReadLock)
+	err := store.writeLocks(lockBatch)
+	reqCtx.trace(eventEndWriteLock)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	store.lockWaiterManager.wakeUp(hashVals)
+	store.DeadlockDetector.CleanUp(startTS)
+	return nil
+}
+
 const maxSystemTS uint64 = math.MaxUint64
 
 // Commit implements the MVCCStore interface.
@@ -208,12 +641,17 @@ func (store *MVCCStore) Commit(req *requestCtx, keys [][]byte, startTS, commitTS
 	hashVals := keysToHashVals(keys...)
 	dbBatch := newWriteDBBatch(req)
 
-	regCtx.acquireLatches(hashVals)
+	regCtx.acquireLatches(hashVals, req.isHighPriority())
 	req.trace(eventAcquireLatches)
-	defer regCtx.releaseLatches(hashVals)
+	var pub publication
+	defer func() {
+		regCtx.releaseLatches(hashVals)
+		pub.publish()
+	}()
 
 	var buf []byte
 	var tmpDiff int
+	var entries []CommittedEntry
 	needMove := make([]bool, len(keys))
 	for i, key := range keys {
 		buf = store.lockStore.Get(key, buf)
@@ -226,35 +664,44 @@ func (store *MVCCStore) Commit(req *requestCtx, keys [][]byte, startTS, commitTS
 		if lock.startTS != startTS {
 			return ErrReplaced
 		}
+		if commitTS < lock.minCommitTS {
+			return &ErrCommitExpire{
+				Key:         key,
+				StartTS:     startTS,
+				CommitTS:    commitTS,
+				MinCommitTS: lock.minCommitTS,
+			}
+		}
+		if lock.op == uint8(kvrpcpb.Op_PessimisticLock) {
+			// The pessimistic lock must be replaced by prewrite before commit.
+			return ErrLockNotFound
+		}
 		if lock.op == uint8(kvrpcpb.Op_Lock) {
 			continue
 		}
 		needMove[i] = lock.hasOldVer
 		val := lockToValue(lock, commitTS)
-		commitVal := val.MarshalBinary()
-		tmpDiff += len(key) + len(commitVal)
-		dbBatch.set(key, commitVal)
+		tmpDiff += len(key) + mvccValueHdrSize + len(val.value)
+		dbBatch.commit(key, val)
+		if store.hasSubscriptions() {
+			entries = append(entries, CommittedEntry{Key: key, Value: val.value, StartTS: startTS, CommitTS: commitTS})
+		}
 	}
 	req.trace(eventReadLock)
 	// Move current latest to old.
 	txn := req.getDBReader().txn
+	var movedKeys [][]byte
 	for i, key := range keys {
 		if !needMove[i] {
 			continue
 		}
-		item, err := txn.Get(key)
-		if err != nil && err != badger.ErrKeyNotFound {
-			return errors.Trace(err)
-		}
-		if item == nil {
-			continue
-		}
-		mvVal, err := decodeValue(item)
+		moved, err := moveLatestToOld(txn, key, dbBatch)
 		if err != nil {
-			return errors.Trace(err)
+			return err
+		}
+		if moved {
+			movedKeys = append(movedKeys, key)
 		}
-		oldKey := encodeOldKey(key, mvVal.commitTS)
-		dbBatch.set(oldKey, mvVal.MarshalBinary())
 	}
 	req.trace(eventReadDB)
 	atomic.AddInt64(&regCtx.diff, int64(tmpDiff))
@@ -262,6 +709,9 @@ func (store *MVCCStore) Commit(req *requestCtx, keys [][]byte, startTS, commitTS
 	if err != nil {
 		return errors.Trace(err)
 	}
+	regCtx.heat.addWrite(len(keys), tmpDiff)
+	pub = store.newPublication(entries)
+	store.countOldVersions(movedKeys)
 	// We must delete lock after commit succeed, or there will be inconsistency.
 	lockBatch := newWriteLockBatch(req)
 	for _, key := range keys {
@@ -269,7 +719,51 @@ func (store *MVCCStore) Commit(req *requestCtx, keys [][]byte, startTS, commitTS
 	}
 	err = store.writeLocks(lockBatch)
 	req.trace(eventEndWriteLock)
-	return errors.Trace(err)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	store.lockWaiterManager.wakeUp(hashVals)
+	store.DeadlockDetector.CleanUp(startTS)
+	return nil
+}
+
+// moveLatestToOld adds the move of the latest version of the key to its old key to the batch, it returns false if
+// the key has no latest version.
+func moveLatestToOld(txn *badger.Txn, key []byte, dbBatch *writeDBBatch) (bool, error) {
+	item, err := txn.Get(key)
+	if err != nil && err != badger.ErrKeyNotFound {
+		return false, errors.Trace(err)
+	}
+	if item == nil {
+		return false, nil
+	}
+	mvVal, err := decodeValue(item)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	dbBatch.set(encodeOldKey(key, mvVal.commitTS), mvVal.MarshalBinary())
+	return true, nil
+}
+
+// splitPrimary returns the primary key and the secondary keys if the primary key of the transaction is in keys.
+func (store *MVCCStore) splitPrimary(keys [][]byte, startTS uint64) (primary []byte, secondaries [][]byte) {
+	buf := store.lockStore.Get(keys[0], nil)
+	if len(buf) == 0 {
+		return nil, nil
+	}
+	lock := decodeLock(buf)
+	if lock.startTS != startTS {
+		return nil, nil
+	}
+	for i, key := range keys {
+		if bytes.Equal(key, lock.primary) {
+			secondaries = make([][]byte, 0, len(keys)-1)
+			secondaries = append(secondaries, keys[:i]...)
+			secondaries = append(secondaries, keys[i+1:]...)
+			return key, secondaries
+		}
+	}
+	return nil, nil
 }
 
 func (store *MVCCStore) handleLockNotFound(reqCtx *requestCtx, key []byte, startTS, commitTS uint64) error {
@@ -297,6 +791,9 @@ func (store *MVCCStore) handleLockNotFound(reqCtx *requestCtx, key []byte, start
 			return nil
 		}
 	}
+	if startTS <= store.getRollbackGCTS() {
+		return ErrAlreadyRollback
+	}
 	return ErrLockNotFound
 }
 
@@ -312,20 +809,23 @@ func (store *MVCCStore) Rollback(reqCtx *requestCtx, keys [][]byte, startTS uint
 	regCtx := reqCtx.regCtx
 	lockBatch := newWriteLockBatch(reqCtx)
 
-	regCtx.acquireLatches(hashVals)
+	regCtx.acquireLatches(hashVals, reqCtx.isHighPriority())
 	reqCtx.trace(eventAcquireLatches)
 	defer regCtx.releaseLatches(hashVals)
 
+	// Visit the keys in ascending order, so the old iterator moves forward instead of seeking for every key.
+	keys = append([][]byte(nil), keys...)
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
 	statuses := make([]int, len(keys))
 	for i, key := range keys {
-		statuses[i] = store.rollbackKeyReadLock(lockBatch, key, startTS)
+		statuses[i] = store.rollbackKeyReadLock(lockBatch, key, startTS, false)
 	}
 	reqCtx.trace(eventReadLock)
 	for i, key := range keys {
 		if statuses[i] == rollbackStatusDone {
 			continue
 		}
-		err := store.rollbackKeyReadDB(reqCtx, lockBatch, key, startTS, statuses[i] == rollbackStatusNewLock)
+		err := store.rollbackKeyReadDB(reqCtx, lockBatch, key, startTS, statuses[i] == rollbackStatusNewLock, false)
 		if err != nil {
 			return err
 		}
@@ -333,14 +833,18 @@ func (store *MVCCStore) Rollback(reqCtx *requestCtx, keys [][]byte, startTS uint
 	reqCtx.trace(eventReadDB)
 	err := store.writeLocks(lockBatch)
 	reqCtx.trace(eventEndWriteLock)
-	return errors.Trace(err)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	store.lockWaiterManager.wakeUp(hashVals)
+	store.DeadlockDetector.CleanUp(startTS)
+	return nil
 }
 
-func (store *MVCCStore) rollbackKeyReadLock(batch *writeLockBatch, key []byte, startTS uint64) (status int) {
+func (store *MVCCStore) rollbackKeyReadLock(batch *writeLockBatch, key []byte, startTS uint64, protected bool) (status int) {
 	batch.buf = encodeRollbackKey(batch.buf, key, startTS)
 	rollbackKey := safeCopy(batch.buf)
-	batch.buf = store.rollbackStore.Get(rollbackKey, batch.buf)
-	if len(batch.buf) != 0 {
+	if store.hasRollback(rollbackKey) {
 		// Already rollback.
 		return rollbackStatusDone
 	}
@@ -351,13 +855,13 @@ func (store *MVCCStore) rollbackKeyReadLock(batch *writeLockBatch, key []byte, s
 		if lock.startTS < startTS {
 			// The lock is old, means this is written by an old transaction, and the current transaction may not arrive.
 			// We should write a rollback lock.
-			batch.rollback(rollbackKey)
+			store.addRollback(batch, key, rollbackKey, protected)
 			return rollbackStatusDone
 		}
 		if lock.startTS == startTS {
 			// We can not simply delete the lock because the prewrite may be sent multiple times.
 			// To prevent that we update it a rollback lock.
-			batch.rollback(rollbackKey)
+			store.addRollback(batch, key, rollbackKey, protected)
 			batch.delete(key)
 			return rollbackStatusDone
 		}
@@ -367,7 +871,34 @@ func (store *MVCCStore) rollbackKeyReadLock(batch *writeLockBatch, key []byte, s
 	return rollbackStatusNoLock
 }
 
-func (store *MVCCStore) rollbackKeyReadDB(req *requestCtx, batch *writeLockBatch, key []byte, startTS uint64, hasLock bool) error {
+// addRollback writes the rollback record of the key and collapses the older unprotected rollback records of the
+// key, the prewrite of them is rejected by the newer rollback record.
+func (store *MVCCStore) addRollback(batch *writeLockBatch, key, rollbackKey []byte, protected bool) {
+	batch.rollback(rollbackKey, protected)
+	it := store.rollbackStore.NewIterator()
+	for it.Seek(rollbackKey); it.Valid() && bytes.HasPrefix(it.Key(), key); it.Next() {
+		if len(it.Key()) != len(rollbackKey) || bytes.Equal(it.Key(), rollbackKey) || isProtectedRollback(it.Value()) {
+			continue
+		}
+		batch.rollbackGC(safeCopy(it.Key()))
+	}
+}
+
+// newestRollbackTS returns the max start ts of the rollback records of the key.
+func (store *MVCCStore) newestRollbackTS(key []byte) uint64 {
+	seekKey := encodeRollbackKey(nil, key, math.MaxUint64)
+	it := store.rollbackStore.NewIterator()
+	for it.Seek(seekKey); it.Valid() && bytes.HasPrefix(it.Key(), key); it.Next() {
+		if len(it.Key()) == len(seekKey) {
+			return decodeRollbackTS(it.Key())
+		}
+	}
+	// The spilled records are older than the records in memory.
+	return store.newestSpilledRollbackTS(key)
+}
+
+func (store *MVCCStore) rollbackKeyReadDB(
+	req *requestCtx, batch *writeLockBatch, key []byte, startTS uint64, hasLock, protected bool) error {
 	batch.buf = encodeRollbackKey(batch.buf, key, startTS)
 	rollbackKey := safeCopy(batch.buf)
 	reader := req.getDBReader()
@@ -378,12 +909,13 @@ func (store *MVCCStore) rollbackKeyReadDB(req *requestCtx, batch *writeLockBatch
 	hasVal := item != nil
 	if !hasVal && !hasLock {
 		// The prewrite request is not arrived, we write a rollback lock to prevent the future prewrite.
-		batch.rollback(rollbackKey)
+		store.addRollback(batch, key, rollbackKey, protected)
 		return nil
 	}
 
 	if !hasVal {
-		// Not committed.
+		// Not committed, the newer lock doesn't prevent the late prewrite after it's rolled back.
+		store.addRollback(batch, key, rollbackKey, protected)
 		return nil
 	}
 	val, err := decodeValue(item)
@@ -395,52 +927,49 @@ func (store *MVCCStore) rollbackKeyReadDB(req *requestCtx, batch *writeLockBatch
 	}
 	if val.startTS < startTS && !hasLock {
 		// Prewrite and commit have not arrived.
-		batch.rollback(rollbackKey)
+		store.addRollback(batch, key, rollbackKey, protected)
 		return nil
 	}
 	// val.startTS > startTS, look for the key in the old version to check if the key is committed.
-	it := reader.getOldIter()
 	oldKey := encodeOldKey(key, val.commitTS)
+	it := reader.seekOldIter(oldKey)
 	// find greater commit version.
-	for it.Seek(oldKey); it.ValidForPrefix(oldKey[:len(oldKey)-8]); it.Next() {
+	for ; it.ValidForPrefix(oldKey[:len(oldKey)-8]); it.Next() {
 		item := it.Item()
 		foundKey := item.Key()
 		if isVisibleKey(foundKey, startTS) {
 			break
 		}
-		_, ts, err := codec.DecodeUintDesc(foundKey[len(foundKey)-8:])
+		mvVal, err := decodeValue(item)
 		if err != nil {
 			return errors.Trace(err)
 		}
-		mvVal, err := decodeValue(item)
 		if mvVal.startTS == startTS {
-			return ErrAlreadyCommitted(ts)
+			return ErrAlreadyCommitted(mvVal.commitTS)
 		}
 	}
+	// No committed version of the transaction.
+	store.addRollback(batch, key, rollbackKey, protected)
 	return nil
 }
 
 func isVisibleKey(key []byte, startTS uint64) bool {
-	ts := ^(binary.BigEndian.Uint64(key[len(key)-8:]))
-	return startTS >= ts
+	return startTS >= decodeKeyTS(key)
 }
 
 func checkLock(lock mvccLock, key []byte, startTS uint64) error {
 	lockVisible := lock.startTS < startTS
 	isWriteLock := lock.op == uint8(kvrpcpb.Op_Put) || lock.op == uint8(kvrpcpb.Op_Del)
 	isPrimaryGet := startTS == maxSystemTS && bytes.Equal(lock.primary, key)
-	if lockVisible && isWriteLock && !isPrimaryGet {
-		return &ErrLocked{
-			Key:     key,
-			StartTS: lock.startTS,
-			Primary: lock.primary,
-			TTL:     uint64(lock.ttl),
-		}
+	// The transaction must commit after startTS if the min commit ts has been pushed over it.
+	isPushed := lock.minCommitTS > startTS
+	if lockVisible && isWriteLock && !isPrimaryGet && !isPushed {
+		return newErrLocked(key, &lock)
 	}
 	return nil
 }
 
-func (store *MVCCStore) CheckKeysLock(startTS uint64, keys ...[]byte) error {
+func (store *MVCCStore) CheckKeysLock(reqCtx *requestCtx, startTS uint64, keys ...[]byte) error {
 	var buf []byte
 	for _, key := range keys {
 		buf = store.lockStore.Get(key, buf)
@@ -449,6 +978,9 @@ func (store *MVCCStore) CheckKeysLock(startTS uint64, keys ...[]byte) error {
 		}
 		lock := decodeLock(buf)
 		err := checkLock(lock, key, startTS)
+		if err != nil && store.canPushLock(lock, key, startTS) {
+			err = store.pushMinCommitTS(reqCtx, key, lock.startTS, startTS)
+		}
 		if err != nil {
 			return err
 		}
@@ -456,6 +988,66 @@ func (store *MVCCStore) CheckKeysLock(startTS uint64, keys ...[]byte) error {
 	return nil
 }
 
+// canPushLock returns true if the reader at startTS can push the lock's min commit ts instead of waiting for the
+// transaction to finish. Only the alive primary lock supporting min commit ts is pushed, the secondary locks are
+// committed at the commit ts of the primary, which may be decided already.
+func (store *MVCCStore) canPushLock(lock mvccLock, key []byte, startTS uint64) bool {
+	return !store.readOnly && lock.minCommitTS > 0 && startTS != maxSystemTS && bytes.Equal(lock.primary, key) &&
+		tsSub(startTS, lock.startTS) < time.Duration(lock.ttl)*time.Millisecond
+}
+
+// pushMinCommitTS pushes the min commit ts of the primary lock to startTS+1 under the latch of the key, so the
+// transaction can only commit after the reader and the reader skips the lock. It returns the lock error if the lock
+// is replaced by another transaction.
+func (store *MVCCStore) pushMinCommitTS(reqCtx *requestCtx, key []byte, lockTS, startTS uint64) error {
+	regCtx := reqCtx.regCtx
+	hashVals := keysToHashVals(key)
+	regCtx.acquireLatches(hashVals, reqCtx.isHighPriority())
+	reqCtx.trace(eventAcquireLatches)
+	defer regCtx.releaseLatches(hashVals)
+
+	buf := store.lockStore.Get(key, nil)
+	if len(buf) == 0 {
+		// The transaction is committed or rolled back, the read sees its result.
+		return nil
+	}
+	lock := decodeLock(buf)
+	if lock.startTS != lockTS {
+		return checkLock(lock, key, startTS)
+	}
+	if lock.minCommitTS > startTS {
+		return nil
+	}
+	lock.minCommitTS = startTS + 1
+	lockBatch := newWriteLockBatch(reqCtx)
+	lockBatch.delete(key)
+	lockBatch.set(key, lock.MarshalBinary())
+	err := store.writeLocks(lockBatch)
+	reqCtx.trace(eventEndWriteLock)
+	return errors.Trace(err)
+}
+
+// BatchGet reads the keys at startTS. The locked keys are returned as the pairs with the lock errors, so the client
+// resolves the locks and retries only these keys, the other keys are read from a snapshot taken after all the locks
+// are checked.
+func (store *MVCCStore) BatchGet(reqCtx *requestCtx, keys [][]byte, startTS uint64) []Pair {
+	for _, key := range keys {
+		if err := store.checkGCSafePoint(key, startTS); err != nil {
+			return []Pair{{Err: err}}
+		}
+	}
+	var lockPairs []Pair
+	readKeys := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		if err := store.CheckKeysLock(reqCtx, startTS, key); err != nil {
+			lockPairs = append(lockPairs, Pair{Key: key, Err: err})
+			continue
+		}
+		readKeys = append(readKeys, key)
+	}
+	return append(lockPairs, reqCtx.getDBReader().BatchGet(readKeys, startTS)...)
+}
+
 func (store *MVCCStore) CheckRangeLock(startTS uint64, startKey, endKey []byte) error {
 	it := store.lockStore.NewIterator()
 	for it.Seek(startKey); it.Valid(); it.Next() {
@@ -471,25 +1063,203 @@ func (store *MVCCStore) CheckRangeLock(startTS uint64, startKey, endKey []byte)
 	return nil
 }
 
+// CollectRangeLocks returns up to limit locks in the range that block the read at startTS, so the client can
+// resolve them in a single batch instead of ping-ponging once per lock, a limit <= 0 means unlimited. The alive
+// primary locks are pushed over startTS instead of being returned.
+func (store *MVCCStore) CollectRangeLocks(reqCtx *requestCtx, startTS uint64, startKey, endKey []byte, limit int) []error {
+	var errs []error
+	var pushKeys [][]byte
+	var pushLockTSs []uint64
+	it := store.lockStore.NewIterator()
+	for it.Seek(startKey); it.Valid() && (limit <= 0 || len(errs) < limit); it.Next() {
+		if exceedEndKey(it.Key(), endKey) {
+			break
+		}
+		lock := decodeLock(it.Value())
+		// The iterator reuses the key buffer, so the key must be copied.
+		key := safeCopy(it.Key())
+		err := checkLock(lock, key, startTS)
+		if err == nil {
+			continue
+		}
+		if store.canPushLock(lock, key, startTS) {
+			pushKeys = append(pushKeys, key)
+			pushLockTSs = append(pushLockTSs, lock.startTS)
+			continue
+		}
+		if memErr := reqCtx.consumeMem(len(key) + len(lock.primary)); memErr != nil {
+			return []error{memErr}
+		}
+		errs = append(errs, err)
+	}
+	// Push the primary locks after the iteration, each push acquires the latch of the key.
+	for i, key := range pushKeys {
+		if err := store.pushMinCommitTS(reqCtx, key, pushLockTSs[i], startTS); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
 func (store *MVCCStore) Cleanup(reqCtx *requestCtx, key []byte, startTS uint64) error {
 	store.updateLatestTS(startTS)
 	hashVals := keysToHashVals(key)
 	regCtx := reqCtx.regCtx
 	lockBatch := newWriteLockBatch(reqCtx)
 
-	regCtx.acquireLatches(hashVals)
+	regCtx.acquireLatches(hashVals, reqCtx.isHighPriority())
 	reqCtx.trace(eventAcquireLatches)
 	defer regCtx.releaseLatches(hashVals)
 
-	status := store.rollbackKeyReadLock(lockBatch, key, startTS)
+	// Cleanup is sent to the primary key to decide the transaction status, the rollback record must be protected.
+	status := store.rollbackKeyReadLock(lockBatch, key, startTS, true)
 	if status != rollbackStatusDone {
-		err := store.rollbackKeyReadDB(reqCtx, lockBatch, key, startTS, status == rollbackStatusNewLock)
+		err := store.rollbackKeyReadDB(reqCtx, lockBatch, key, startTS, status == rollbackStatusNewLock, true)
 		reqCtx.trace(eventReadDB)
 		if err != nil {
 			return err
 		}
 	}
-	return store.writeLocks(lockBatch)
+	err := store.writeLocks(lockBatch)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	store.lockWaiterManager.wakeUp(hashVals)
+	return nil
+}
+
+// TxnStatus is the status of a transaction decided on its primary key.
+type TxnStatus struct {
+	LockTTL  uint64
+	CommitTS uint64
+	Action   kvrpcpb.Action
+	Lock     *kvrpcpb.LockInfo
+}
+
+// CheckTxnStatus checks the status of the transaction by its primary key. The expired lock is rolled back, the
+// alive lock's min commit ts is pushed over callerStartTS, so the reader doesn't need to wait for it. Only the
+// primary lock is pushed, the secondary locks are committed after the primary and must not be pushed, and the
+// transaction can't commit under the pushed primary until its commit ts is over callerStartTS.
+func (store *MVCCStore) CheckTxnStatus(reqCtx *requestCtx, primary []byte, lockTS, callerStartTS, currentTS uint64,
+	rollbackIfNotExist bool) (TxnStatus, error) {
+	store.updateLatestTS(currentTS)
+	hashVals := keysToHashVals(primary)
+	regCtx := reqCtx.regCtx
+	lockBatch := newWriteLockBatch(reqCtx)
+
+	regCtx.acquireLatches(hashVals, reqCtx.isHighPriority())
+	reqCtx.trace(eventAcquireLatches)
+	defer regCtx.releaseLatches(hashVals)
+
+	buf := store.lockStore.Get(primary, nil)
+	if len(buf) > 0 {
+		lock := decodeLock(buf)
+		if lock.startTS == lockTS {
+			if tsSub(currentTS, lock.startTS) >= time.Duration(lock.ttl)*time.Millisecond {
+				rollbackKey := encodeRollbackKey(nil, primary, lockTS)
+				store.addRollback(lockBatch, primary, rollbackKey, true)
+				lockBatch.delete(primary)
+				if err := store.writeLocks(lockBatch); err != nil {
+					return TxnStatus{}, errors.Trace(err)
+				}
+				store.lockWaiterManager.wakeUp(hashVals)
+				store.DeadlockDetector.CleanUp(lockTS)
+				return TxnStatus{Action: kvrpcpb.Action_TTLExpireRollback}, nil
+			}
+			status := TxnStatus{LockTTL: uint64(lock.ttl)}
+			if lock.minCommitTS > 0 && callerStartTS != maxSystemTS && lock.minCommitTS <= callerStartTS {
+				lock.minCommitTS = callerStartTS + 1
+				lockBatch.delete(primary)
+				lockBatch.set(primary, lock.MarshalBinary())
+				if err := store.writeLocks(lockBatch); err != nil {
+					return TxnStatus{}, errors.Trace(err)
+				}
+				status.Action = kvrpcpb.Action_MinCommitTSPushed
+			}
+			status.Lock = newLockInfo(primary, &lock)
+			return status, nil
+		}
+	}
+	commitTS, finished, err := store.primaryStatus(reqCtx.getDBReader(), primary, lockTS)
+	if err != nil {
+		return TxnStatus{}, err
+	}
+	if finished {
+		return TxnStatus{CommitTS: commitTS}, nil
+	}
+	if !rollbackIfNotExist {
+		return TxnStatus{}, &ErrTxnNotFound{StartTS: lockTS, PrimaryKey: primary}
+	}
+	// The prewrite of the primary hasn't arrived, write a protected rollback record to prevent it.
+	store.addRollback(lockBatch, primary, encodeRollbackKey(nil, primary, lockTS), true)
+	if err = store.writeLocks(lockBatch); err != nil {
+		return TxnStatus{}, errors.Trace(err)
+	}
+	return TxnStatus{Action: kvrpcpb.Action_LockNotExistRollback}, nil
+}
+
+// CheckSecondaryLocks checks the secondary locks of an async commit transaction, it returns at the first key that
+// is committed or rolled back. It returns the commit ts if the key is committed, or nil locks and zero commit ts if
+// the key is rolled back, in which case the missing lock is rolled back with a protected rollback record to prevent
+// the late prewrite. Otherwise all the locks are returned.
+func (store *MVCCStore) CheckSecondaryLocks(reqCtx *requestCtx, keys [][]byte, startTS uint64) ([]*kvrpcpb.LockInfo, uint64, error) {
+	store.updateLatestTS(startTS)
+	hashVals := keysToHashVals(keys...)
+	regCtx := reqCtx.regCtx
+	lockBatch := newWriteLockBatch(reqCtx)
+
+	regCtx.acquireLatches(hashVals, reqCtx.isHighPriority())
+	reqCtx.trace(eventAcquireLatches)
+	defer regCtx.releaseLatches(hashVals)
+
+	var locks []*kvrpcpb.LockInfo
+	var buf []byte
+	rolledBack := false
+	for _, key := range keys {
+		buf = store.lockStore.Get(key, buf)
+		if len(buf) > 0 {
+			lock := decodeLock(buf)
+			if lock.startTS == startTS {
+				if lock.op == uint8(kvrpcpb.Op_PessimisticLock) {
+					// The key is not prewritten, the transaction can not be committed.
+					store.rollbackKeyReadLock(lockBatch, key, startTS, true)
+					rolledBack = true
+					break
+				}
+				locks = append(locks, &kvrpcpb.LockInfo{
+					PrimaryLock: lock.primary,
+					LockVersion: lock.startTS,
+					Key:         key,
+					LockTtl:     uint64(lock.ttl),
+				})
+				continue
+			}
+		}
+		status := store.rollbackKeyReadLock(lockBatch, key, startTS, true)
+		if status != rollbackStatusDone {
+			err := store.rollbackKeyReadDB(reqCtx, lockBatch, key, startTS, status == rollbackStatusNewLock, true)
+			if commitTS, ok := errors.Cause(err).(ErrAlreadyCommitted); ok {
+				return nil, uint64(commitTS), nil
+			}
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		// The transaction is rolled back, the rest of the keys are not checked.
+		rolledBack = true
+		break
+	}
+	reqCtx.trace(eventReadDB)
+	if !rolledBack {
+		return locks, 0, nil
+	}
+	err := store.writeLocks(lockBatch)
+	reqCtx.trace(eventEndWriteLock)
+	if err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+	store.lockWaiterManager.wakeUp(hashVals)
+	return nil, 0, nil
 }
 
 func (store *MVCCStore) ScanLock(reqCtx *requestCtx, maxSystemTS uint64) ([]*kvrpcpb.LockInfo, error) {
@@ -501,18 +1271,38 @@ func (store *MVCCStore) ScanLock(reqCtx *requestCtx, maxSystemTS uint64) ([]*kvr
 		}
 		lock := decodeLock(it.Value())
 		if lock.startTS < maxSystemTS {
-			locks = append(locks, &kvrpcpb.LockInfo{
-				PrimaryLock: lock.primary,
-				LockVersion: lock.startTS,
-				Key:         codec.EncodeBytes(nil, it.Key()),
-				LockTtl:     uint64(lock.ttl),
-			})
+			if err := reqCtx.consumeMem(len(it.Key()) + len(lock.primary)); err != nil {
+				return nil, err
+			}
+			locks = append(locks, newLockInfo(it.Key(), &lock))
 		}
 	}
 	reqCtx.trace(eventReadLock)
 	return locks, nil
 }
 
+// PhysicalScanLock scans the locks of the whole store from startKey regardless of the regions, it returns at most
+// limit locks with start ts not greater than maxTS, 0 limit means unlimited.
+func (store *MVCCStore) PhysicalScanLock(startKey []byte, maxTS uint64, limit int) []*kvrpcpb.LockInfo {
+	var locks []*kvrpcpb.LockInfo
+	it := store.lockStore.NewIterator()
+	for it.Seek(startKey); it.Valid(); it.Next() {
+		lock := decodeLock(it.Value())
+		if lock.startTS > maxTS {
+			continue
+		}
+		locks = append(locks, newLockInfo(it.Key(), &lock))
+		if len(locks) == limit {
+			break
+		}
+	}
+	return locks
+}
+
+func newLockInfo(key []byte, lock *mvccLock) *kvrpcpb.LockInfo {
+	return newErrLocked(codec.EncodeBytes(nil, key), lock).lockInfo()
+}
+
 func (store *MVCCStore) ResolveLock(reqCtx *requestCtx, startTS, commitTS uint64) error {
 	regCtx := reqCtx.regCtx
 	var lockKeys [][]byte
@@ -530,29 +1320,106 @@ func (store *MVCCStore) ResolveLock(reqCtx *requestCtx, startTS, commitTS uint64
 		lockVals = append(lockVals, safeCopy(it.Value()))
 	}
 	reqCtx.trace(eventReadLock)
+	return store.resolveLocks(reqCtx, lockKeys, lockVals, repeatTS(commitTS, len(lockKeys)))
+}
+
+// ResolveLockKeys resolves the locks of the transaction on the specified keys only, it avoids iterating
+// the whole region's lockStore.
+func (store *MVCCStore) ResolveLockKeys(reqCtx *requestCtx, keys [][]byte, startTS, commitTS uint64) error {
+	var lockKeys [][]byte
+	var lockVals [][]byte
+	var buf []byte
+	for _, key := range keys {
+		buf = store.lockStore.Get(key, buf)
+		if len(buf) == 0 {
+			continue
+		}
+		lock := decodeLock(buf)
+		if lock.startTS != startTS {
+			continue
+		}
+		lockKeys = append(lockKeys, key)
+		lockVals = append(lockVals, safeCopy(buf))
+	}
+	reqCtx.trace(eventReadLock)
+	return store.resolveLocks(reqCtx, lockKeys, lockVals, repeatTS(commitTS, len(lockKeys)))
+}
+
+// BatchResolveLock walks the region's lockStore once and resolves the locks of all the transactions in txnInfos,
+// which maps start ts to commit ts, a zero commit ts means the transaction is rolled back.
+func (store *MVCCStore) BatchResolveLock(reqCtx *requestCtx, txnInfos map[uint64]uint64) error {
+	regCtx := reqCtx.regCtx
+	var lockKeys [][]byte
+	var lockVals [][]byte
+	var commitTSs []uint64
+	it := store.lockStore.NewIterator()
+	for it.Seek(regCtx.startKey); it.Valid(); it.Next() {
+		if exceedEndKey(it.Key(), regCtx.endKey) {
+			break
+		}
+		lock := decodeLock(it.Value())
+		commitTS, ok := txnInfos[lock.startTS]
+		if !ok {
+			continue
+		}
+		lockKeys = append(lockKeys, safeCopy(it.Key()))
+		lockVals = append(lockVals, safeCopy(it.Value()))
+		commitTSs = append(commitTSs, commitTS)
+	}
+	reqCtx.trace(eventReadLock)
+	return store.resolveLocks(reqCtx, lockKeys, lockVals, commitTSs)
+}
+
+func repeatTS(ts uint64, n int) []uint64 {
+	tss := make([]uint64, n)
+	for i := range tss {
+		tss[i] = ts
+	}
+	return tss
+}
+
+// resolveLocks commits the locks whose commitTS > 0 and rolls back the others, lockVals are used to
+// check the locks are not changed.
+func (store *MVCCStore) resolveLocks(reqCtx *requestCtx, lockKeys, lockVals [][]byte, commitTSs []uint64) error {
 	if len(lockKeys) == 0 {
 		return nil
 	}
+	regCtx := reqCtx.regCtx
 	hashVals := keysToHashVals(lockKeys...)
 	lockBatch := newWriteLockBatch(reqCtx)
-	var dbBatch *writeDBBatch
-	if commitTS > 0 {
-		dbBatch = newWriteDBBatch(reqCtx)
-	}
+	dbBatch := newWriteDBBatch(reqCtx)
 
-	regCtx.acquireLatches(hashVals)
+	regCtx.acquireLatches(hashVals, reqCtx.isHighPriority())
 	reqCtx.trace(eventAcquireLatches)
-	defer regCtx.releaseLatches(hashVals)
+	var pub publication
+	defer func() {
+		regCtx.releaseLatches(hashVals)
+		pub.publish()
+	}()
 
 	var buf []byte
+	var entries []CommittedEntry
+	var movedKeys [][]byte
 	for i, lockKey := range lockKeys {
 		buf = store.lockStore.Get(lockKey, buf)
 		// We need to check again make sure the lock is not changed.
 		if bytes.Equal(buf, lockVals[i]) {
-			if commitTS > 0 {
-				lock := decodeLock(lockVals[i])
-				mvVal := lockToValue(lock, commitTS)
-				dbBatch.set(lockKey, mvVal.MarshalBinary())
+			lock := decodeLock(lockVals[i])
+			if commitTSs[i] > 0 && (lock.op == uint8(kvrpcpb.Op_Put) || lock.op == uint8(kvrpcpb.Op_Del)) {
+				if lock.hasOldVer {
+					moved, err := moveLatestToOld(reqCtx.getDBReader().txn, lockKey, dbBatch)
+					if err != nil {
+						return err
+					}
+					if moved {
+						movedKeys = append(movedKeys, lockKey)
+					}
+				}
+				mvVal := lockToValue(lock, commitTSs[i])
+				dbBatch.commit(lockKey, mvVal)
+				if store.hasSubscriptions() {
+					entries = append(entries, CommittedEntry{Key: lockKey, Value: mvVal.value, StartTS: lock.startTS, CommitTS: commitTSs[i]})
+				}
 			}
 			lockBatch.delete(lockKey)
 		}
@@ -561,48 +1428,40 @@ func (store *MVCCStore) ResolveLock(reqCtx *requestCtx, startTS, commitTS uint64
 	if len(lockBatch.entries) == 0 {
 		return nil
 	}
-	if dbBatch != nil {
+	if len(dbBatch.entries) > 0 {
 		atomic.AddInt64(&regCtx.diff, dbBatch.size())
 		err := store.writeDB(dbBatch)
 		if err != nil {
 			return errors.Trace(err)
 		}
+		pub = store.newPublication(entries)
+		store.countOldVersions(movedKeys)
 	}
 	err := store.writeLocks(lockBatch)
 	reqCtx.trace(eventEndWriteLock)
-	return errors.Trace(err)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	store.lockWaiterManager.wakeUp(hashVals)
+	return nil
 }
 
 const delRangeBatchSize = 4096
 
-func (store *MVCCStore) DeleteRange(reqCtx *requestCtx, startKey, endKey []byte) error {
-	keys := make([][]byte, 0, delRangeBatchSize)
-	oldStartKey := encodeOldKey(startKey, maxSystemTS)
-	oldEndKey := encodeOldKey(endKey, maxSystemTS)
-	reader := reqCtx.getDBReader()
-	keys = store.collectRangeKeys(reader.getIter(), startKey, endKey, keys)
-	keys = store.collectRangeKeys(reader.getIter(), oldStartKey, oldEndKey, keys)
-	reqCtx.trace(eventReadDB)
-	err := store.deleteKeysInBatch(reqCtx, keys, delRangeBatchSize)
+// DeleteRange deletes all the versions in [startKey, endKey). If logical is true, a range tombstone is written
+// instead that hides the versions immediately, and the versions are deleted by GC later so the write path is not
+// blocked by the deletion. The physical deletion is tracked as a DeleteRange task and can be canceled.
+func (store *MVCCStore) DeleteRange(reqCtx *requestCtx, startKey, endKey []byte, logical bool) error {
+	if logical {
+		return store.deleteRangeLogically(startKey, endKey)
+	}
+	task := store.deleteRangeTasks.add(startKey, endKey)
+	err := store.runDeleteRangeTask(reqCtx.regCtx, reqCtx.priority, task)
 	if err != nil {
 		log.Error(err)
+		return errors.Trace(err)
 	}
-	return errors.Trace(err)
-}
-
-func (store *MVCCStore) collectRangeKeys(it *badger.Iterator, startKey, endKey []byte, keys [][]byte) [][]byte {
-	for it.Seek(startKey); it.Valid(); it.Next() {
-		item := it.Item()
-		key := item.KeyCopy(nil)
-		if exceedEndKey(key, endKey) {
-			break
-		}
-		keys = append(keys, key)
-		if len(keys) == delRangeBatchSize {
-			break
-		}
-	}
-	return keys
+	return nil
 }
 
 func (store *MVCCStore) deleteKeysInBatch(reqCtx *requestCtx, keys [][]byte, batchSize int) error {
@@ -617,7 +1476,13 @@ func (store *MVCCStore) deleteKeysInBatch(reqCtx *requestCtx, keys [][]byte, bat
 			dbBatch.delete(key)
 		}
 
-		regCtx.acquireLatches(hashVals)
+		if regCtx == nil {
+			if err := store.writeDB(dbBatch); err != nil {
+				return errors.Trace(err)
+			}
+			continue
+		}
+		regCtx.acquireLatches(hashVals, reqCtx.isHighPriority())
 		err := store.writeDB(dbBatch)
 		regCtx.releaseLatches(hashVals)
 		if err != nil {
@@ -626,8 +1491,3 @@ func (store *MVCCStore) deleteKeysInBatch(reqCtx *requestCtx, keys [][]byte, bat
 	}
 	return nil
 }
-
-func (store *MVCCStore) GC(reqCtx *requestCtx, safePoint uint64) error {
-	// TODO: implement GC in badger.
-	return nil
-}
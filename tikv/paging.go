@@ -0,0 +1,56 @@
+package tikv
+
+import (
+	"github.com/pingcap/kvproto/pkg/coprocessor"
+	"github.com/pingcap/tidb/kv"
+	tipb "github.com/pingcap/tipb/go-tipb"
+)
+
+// isPageable returns true if the rows of the DAG are output as they are scanned, so the request can stop after a
+// page of rows and the next request can continue after the last scanned key. The aggregations and TopN read all
+// the rows before the output, the paging size is ignored for them.
+func isPageable(dagReq *tipb.DAGRequest) bool {
+	for _, exec := range dagReq.Executors {
+		switch exec.Tp {
+		case tipb.ExecType_TypeAggregation, tipb.ExecType_TypeStreamAgg, tipb.ExecType_TypeTopN:
+			return false
+		}
+	}
+	return true
+}
+
+// scannedRange returns the range the paged request has scanned, TiDB sends the next request of the rest of the
+// ranges. All the ranges are scanned unless the request stops after a page, the range is empty without ranges.
+func scannedRange(ranges []*coprocessor.KeyRange, e executor, paged bool) *coprocessor.KeyRange {
+	if len(ranges) == 0 {
+		return &coprocessor.KeyRange{}
+	}
+	scanned := &coprocessor.KeyRange{Start: ranges[0].Start, End: ranges[len(ranges)-1].End}
+	if !paged {
+		return scanned
+	}
+	lastKey, desc := lastScannedKey(e)
+	if lastKey == nil {
+		return scanned
+	}
+	if desc {
+		scanned.Start = lastKey
+	} else {
+		scanned.End = []byte(kv.Key(lastKey).PrefixNext())
+	}
+	return scanned
+}
+
+// lastScannedKey returns the key of the last row returned by the scan under the executor.
+func lastScannedKey(e executor) (key []byte, desc bool) {
+	for e.GetSrcExec() != nil {
+		e = e.GetSrcExec()
+	}
+	switch x := e.(type) {
+	case *tableScanExec:
+		return x.lastKey, x.Desc
+	case *indexScanExec:
+		return x.lastKey, x.Desc
+	}
+	return nil, false
+}
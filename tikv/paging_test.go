@@ -0,0 +1,21 @@
+package tikv
+
+import (
+	"testing"
+
+	"github.com/pingcap/kvproto/pkg/coprocessor"
+	tipb "github.com/pingcap/tipb/go-tipb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScannedRange(t *testing.T) {
+	require.Equal(t, &coprocessor.KeyRange{}, scannedRange(nil, nil, true))
+	ranges := []*coprocessor.KeyRange{{Start: []byte("t1"), End: []byte("t2")}, {Start: []byte("t3"), End: []byte("t4")}}
+	require.Equal(t, &coprocessor.KeyRange{Start: []byte("t1"), End: []byte("t4")}, scannedRange(ranges, nil, false))
+
+	// The paged request has scanned up to the last key returned.
+	e := &tableScanExec{TableScan: &tipb.TableScan{}, lastKey: []byte("t3a")}
+	require.Equal(t, &coprocessor.KeyRange{Start: []byte("t1"), End: []byte("t3b")}, scannedRange(ranges, e, true))
+	e = &tableScanExec{TableScan: &tipb.TableScan{Desc: true}, lastKey: []byte("t1a")}
+	require.Equal(t, &coprocessor.KeyRange{Start: []byte("t1a"), End: []byte("t4")}, scannedRange(ranges, e, true))
+}
@@ -0,0 +1,24 @@
+package tikv
+
+import (
+	"github.com/juju/errors"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/util/codec"
+)
+
+// extraPhysTblID is the id of the column TiDB requests for the physical table ids of the rows, which tell the
+// partitions of the rows apart when the ranges of a request are in several partitions.
+const extraPhysTblID int64 = -3
+
+// encodePhysTblID returns the datum of the physical table id in the record or index key.
+func encodePhysTblID(key []byte) ([]byte, error) {
+	if len(key) < 9 || key[0] != 't' {
+		return nil, errors.Errorf("invalid table key %q", key)
+	}
+	_, id, err := codec.DecodeInt(key[1:9])
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	b, err := codec.EncodeValue(nil, nil, types.NewIntDatum(id))
+	return b, errors.Trace(err)
+}
@@ -0,0 +1,52 @@
+package tikv
+
+import (
+	"sync"
+
+	"github.com/coocood/badger"
+	"github.com/juju/errors"
+)
+
+// lockBufPool holds the buffers PointGet reads the locks into.
+var lockBufPool = sync.Pool{New: func() interface{} { return new([]byte) }}
+
+// PointGet reads the key at startTS with a badger txn.Get and no iterator, which is enough if the latest version is
+// visible. Otherwise the old version is read by the DBReader of the request. The ts are 0 if the key doesn't exist.
+func (store *MVCCStore) PointGet(reqCtx *requestCtx, key []byte, startTS uint64) (val []byte, verStartTS, commitTS uint64, err error) {
+	bufp := lockBufPool.Get().(*[]byte)
+	buf := store.lockStore.Get(key, *bufp)
+	locked := len(buf) > 0
+	if buf != nil {
+		*bufp = buf
+	}
+	lockBufPool.Put(bufp)
+	if locked {
+		// Locked keys are rare, CheckKeysLock reads the lock again to check and push it.
+		if err = store.CheckKeysLock(reqCtx, startTS, key); err != nil {
+			return nil, 0, 0, err
+		}
+	}
+	if err = store.checkGCSafePoint(key, startTS); err != nil {
+		return nil, 0, 0, err
+	}
+	txn := store.db.NewTransaction(false)
+	defer txn.Discard()
+	item, err := txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return nil, 0, 0, nil
+	}
+	if err != nil {
+		return nil, 0, 0, errors.Trace(err)
+	}
+	mvVal, err := decodeValue(item)
+	if err != nil {
+		return nil, 0, 0, errors.Trace(err)
+	}
+	if mvVal.commitTS > startTS {
+		return reqCtx.getDBReader().GetVersion(key, startTS)
+	}
+	if len(mvVal.value) == 0 || store.isRangeDeleted(key, mvVal.commitTS, startTS) {
+		return nil, 0, 0, nil
+	}
+	return mvVal.value, mvVal.startTS, mvVal.commitTS, nil
+}
@@ -0,0 +1,208 @@
+package tikv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+
+	"github.com/coocood/badger"
+	"github.com/juju/errors"
+)
+
+// rangeTombstones holds the ranges deleted logically by DeleteRange, the versions in a range committed not later
+// than its deleteTS are invisible to the reads at or after deleteTS, and are deleted physically by GC once the safe
+// point reaches deleteTS.
+type rangeTombstones struct {
+	mu      sync.RWMutex
+	cnt     int32
+	lastSeq uint64
+	list    []rangeTombstone
+}
+
+type rangeTombstone struct {
+	seq      uint64
+	startKey []byte
+	endKey   []byte
+	deleteTS uint64
+}
+
+func (t rangeTombstone) contains(key []byte) bool {
+	return bytes.Compare(key, t.startKey) >= 0 && !exceedEndKey(key, t.endKey)
+}
+
+func rangeTombstoneKey(seq uint64) []byte {
+	key := make([]byte, len(InternalRangeTombstonePrefix)+8)
+	copy(key, InternalRangeTombstonePrefix)
+	binary.BigEndian.PutUint64(key[len(InternalRangeTombstonePrefix):], seq)
+	return key
+}
+
+func (t rangeTombstone) marshal() []byte {
+	val := make([]byte, 12, 12+len(t.startKey)+len(t.endKey))
+	binary.LittleEndian.PutUint64(val, t.deleteTS)
+	binary.LittleEndian.PutUint32(val[8:], uint32(len(t.startKey)))
+	val = append(val, t.startKey...)
+	return append(val, t.endKey...)
+}
+
+func (t *rangeTombstone) unmarshal(key, val []byte) error {
+	if len(val) < 12 || len(val) < 12+int(binary.LittleEndian.Uint32(val[8:])) {
+		return errors.Errorf("invalid range tombstone %q", key)
+	}
+	t.seq = binary.BigEndian.Uint64(key[len(InternalRangeTombstonePrefix):])
+	t.deleteTS = binary.LittleEndian.Uint64(val)
+	startLen := int(binary.LittleEndian.Uint32(val[8:]))
+	t.startKey = safeCopy(val[12 : 12+startLen])
+	t.endKey = safeCopy(val[12+startLen:])
+	return nil
+}
+
+// deleteRangeLogically writes a range tombstone that hides the versions in the range committed before the
+// request from the reads after it, the versions committed later with an older commit ts are hidden too.
+func (store *MVCCStore) deleteRangeLogically(startKey, endKey []byte) error {
+	rts := &store.rangeTombstones
+	rts.mu.Lock()
+	defer rts.mu.Unlock()
+	t := rangeTombstone{
+		seq:      rts.lastSeq + 1,
+		startKey: safeCopy(startKey),
+		endKey:   safeCopy(endKey),
+		deleteTS: store.getLatestTS(),
+	}
+	err := store.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(rangeTombstoneKey(t.seq), t.marshal())
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	rts.lastSeq = t.seq
+	rts.list = append(rts.list, t)
+	atomic.StoreInt32(&rts.cnt, int32(len(rts.list)))
+	store.bumpDataVersion(nil)
+	return nil
+}
+
+// rangeDeletedTS returns the max deleteTS not later than readTS of the range tombstones containing the key, 0 means
+// not deleted.
+func (store *MVCCStore) rangeDeletedTS(key []byte, readTS uint64) uint64 {
+	rts := &store.rangeTombstones
+	if atomic.LoadInt32(&rts.cnt) == 0 {
+		return 0
+	}
+	rts.mu.RLock()
+	defer rts.mu.RUnlock()
+	var deleteTS uint64
+	for _, t := range rts.list {
+		if t.deleteTS > deleteTS && t.deleteTS <= readTS && t.contains(key) {
+			deleteTS = t.deleteTS
+		}
+	}
+	return deleteTS
+}
+
+// isRangeDeleted returns true if the version of the key committed at commitTS is hidden by a range tombstone from
+// the read at readTS.
+func (store *MVCCStore) isRangeDeleted(key []byte, commitTS, readTS uint64) bool {
+	return commitTS <= store.rangeDeletedTS(key, readTS)
+}
+
+func (store *MVCCStore) lastRangeTombstoneSeq() uint64 {
+	rts := &store.rangeTombstones
+	rts.mu.RLock()
+	defer rts.mu.RUnlock()
+	return rts.lastSeq
+}
+
+// trimRangeTombstones removes [startKey, endKey) from the range tombstones not newer than maxSeq and not later than
+// safePoint after GC has deleted the versions they hide in the range.
+func (store *MVCCStore) trimRangeTombstones(startKey, endKey []byte, maxSeq, safePoint uint64) error {
+	return store.trimRangeTombstonesIf(startKey, endKey, func(t rangeTombstone) bool {
+		return t.seq <= maxSeq && t.deleteTS <= safePoint
+	})
+}
+
+// trimRangeTombstonesAfter removes [startKey, endKey) from the range tombstones later than ts, a restored snapshot
+// at ts is not hidden by the deletes after it.
+func (store *MVCCStore) trimRangeTombstonesAfter(startKey, endKey []byte, ts uint64) error {
+	return store.trimRangeTombstonesIf(startKey, endKey, func(t rangeTombstone) bool {
+		return t.deleteTS > ts
+	})
+}
+
+// trimRangeTombstonesIf removes [startKey, endKey) from the range tombstones that match trim.
+func (store *MVCCStore) trimRangeTombstonesIf(startKey, endKey []byte, trim func(t rangeTombstone) bool) error {
+	rts := &store.rangeTombstones
+	if atomic.LoadInt32(&rts.cnt) == 0 {
+		return nil
+	}
+	rts.mu.Lock()
+	defer rts.mu.Unlock()
+	var removed []rangeTombstone
+	list := make([]rangeTombstone, 0, len(rts.list))
+	seq := rts.lastSeq
+	for _, t := range rts.list {
+		if !trim(t) || exceedEndKey(startKey, t.endKey) || (len(endKey) > 0 && bytes.Compare(t.startKey, endKey) >= 0) {
+			list = append(list, t)
+			continue
+		}
+		removed = append(removed, t)
+		if bytes.Compare(t.startKey, startKey) < 0 {
+			seq++
+			list = append(list, rangeTombstone{seq: seq, startKey: t.startKey, endKey: safeCopy(startKey), deleteTS: t.deleteTS})
+		}
+		if len(endKey) > 0 && !exceedEndKey(endKey, t.endKey) {
+			seq++
+			list = append(list, rangeTombstone{seq: seq, startKey: safeCopy(endKey), endKey: t.endKey, deleteTS: t.deleteTS})
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	err := store.db.Update(func(txn *badger.Txn) error {
+		for _, t := range removed {
+			if err := txn.Delete(rangeTombstoneKey(t.seq)); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		for _, t := range list {
+			if t.seq > rts.lastSeq {
+				if err := txn.Set(rangeTombstoneKey(t.seq), t.marshal()); err != nil {
+					return errors.Trace(err)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	rts.lastSeq = seq
+	rts.list = list
+	atomic.StoreInt32(&rts.cnt, int32(len(rts.list)))
+	return nil
+}
+
+func (store *MVCCStore) loadRangeTombstones() error {
+	rts := &store.rangeTombstones
+	err := store.db.View(func(txn *badger.Txn) error {
+		it := newIterator(txn, false)
+		defer it.Close()
+		for it.Seek(InternalRangeTombstonePrefix); it.ValidForPrefix(InternalRangeTombstonePrefix); it.Next() {
+			item := it.Item()
+			val, err := item.Value()
+			if err != nil {
+				return errors.Trace(err)
+			}
+			var t rangeTombstone
+			if err = t.unmarshal(item.Key(), val); err != nil {
+				return err
+			}
+			rts.list = append(rts.list, t)
+			rts.lastSeq = t.seq
+		}
+		return nil
+	})
+	atomic.StoreInt32(&rts.cnt, int32(len(rts.list)))
+	return err
+}
@@ -0,0 +1,37 @@
+package tikv_test
+
+import (
+	"testing"
+
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestRangeTombstoneReadTS(t *testing.T) {
+	c := newTableCluster(t)
+	commitTS, err := c.Put([]byte("t1"), []byte("v"))
+	require.NoError(t, err)
+	// The delete ts is the latest ts of the store, which is the commit ts of the key out of the range.
+	deleteTS, err := c.Put([]byte("v1"), []byte("v"))
+	require.NoError(t, err)
+	resp, err := c.Server.KvDeleteRange(context.Background(), &kvrpcpb.DeleteRangeRequest{
+		Context:    regionCtx(t, c, []byte("t1")),
+		StartKey:   []byte("t"),
+		EndKey:     []byte("u"),
+		NotifyOnly: true,
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp.RegionError)
+	require.Empty(t, resp.Error)
+
+	// The snapshot before the delete still sees the key.
+	val, err := c.Get([]byte("t1"), commitTS)
+	require.NoError(t, err)
+	require.Equal(t, []byte("v"), val)
+	for _, ts := range []uint64{deleteTS, deleteTS + 1} {
+		val, err = c.Get([]byte("t1"), ts)
+		require.NoError(t, err)
+		require.Nil(t, val)
+	}
+}
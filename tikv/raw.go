@@ -0,0 +1,474 @@
+package tikv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc64"
+	"sync/atomic"
+	"time"
+
+	"github.com/coocood/badger"
+	"github.com/juju/errors"
+)
+
+const rawDefaultCF = "default"
+
+// rawCFPrefix returns the prefix of the raw keys of the column family, the raw keys are stored in the internal
+// keyspace so the MVCC scans never see them.
+func rawCFPrefix(cf string) []byte {
+	if cf == "" {
+		cf = rawDefaultCF
+	}
+	prefix := make([]byte, 0, len(InternalRawPrefix)+len(cf)+1)
+	prefix = append(prefix, InternalRawPrefix...)
+	prefix = append(prefix, cf...)
+	return append(prefix, '/')
+}
+
+func rawKey(cf string, key []byte) []byte {
+	return append(rawCFPrefix(cf), key...)
+}
+
+// rawValueHdrSize is the size of the expire time encoded before the raw values with ttl, in unix seconds.
+const rawValueHdrSize = 8
+
+// setRawValue sets the raw value of the key. A value with ttl is stored after its expire time and marked by
+// userMetaRawTTL, the other values are stored as is, like the values written before ttl was supported.
+func (batch *writeDBBatch) setRawValue(key, value []byte, ttl uint64) {
+	entry := &badger.Entry{Key: key, Value: value}
+	if ttl > 0 {
+		buf := make([]byte, rawValueHdrSize+len(value))
+		binary.LittleEndian.PutUint64(buf, uint64(clock.Now().Unix())+ttl)
+		copy(buf[rawValueHdrSize:], value)
+		entry.Value, entry.UserMeta = buf, userMetaRawTTL
+	}
+	batch.entries = append(batch.entries, entry)
+}
+
+// decodeRawValue returns the value and the expire time of the raw value of the item, 0 means never.
+func decodeRawValue(item *badger.Item) (value []byte, expireAt uint64, err error) {
+	data, err := item.Value()
+	if err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+	if item.UserMeta() != userMetaRawTTL {
+		return data, 0, nil
+	}
+	if len(data) < rawValueHdrSize {
+		return nil, 0, errors.Errorf("invalid raw value length %d", len(data))
+	}
+	return data[rawValueHdrSize:], binary.LittleEndian.Uint64(data), nil
+}
+
+func rawExpired(expireAt uint64, now int64) bool {
+	return expireAt > 0 && expireAt <= uint64(now)
+}
+
+// rawGet returns a copy of the value of the raw key, nil is returned if the key doesn't exist or is expired.
+func rawGet(txn *badger.Txn, cf string, key []byte, now int64) ([]byte, error) {
+	item, err := txn.Get(rawKey(cf, key))
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	val, expireAt, err := decodeRawValue(item)
+	if err != nil || rawExpired(expireAt, now) {
+		return nil, err
+	}
+	return safeCopy(val), nil
+}
+
+// RawGet returns the value of the raw key, nil is returned if the key doesn't exist or is expired.
+func (store *MVCCStore) RawGet(cf string, key []byte) ([]byte, error) {
+	var val []byte
+	err := store.db.View(func(txn *badger.Txn) error {
+		var err error
+		val, err = rawGet(txn, cf, key, clock.Now().Unix())
+		return err
+	})
+	return val, err
+}
+
+// RawBatchGet returns the pairs of the raw keys that exist, the keys are read in one snapshot.
+func (store *MVCCStore) RawBatchGet(cf string, keys [][]byte) ([]Pair, error) {
+	pairs := make([]Pair, 0, len(keys))
+	now := clock.Now().Unix()
+	err := store.db.View(func(txn *badger.Txn) error {
+		for _, key := range keys {
+			val, err := rawGet(txn, cf, key, now)
+			if err != nil {
+				return err
+			}
+			if val != nil {
+				pairs = append(pairs, Pair{Key: key, Value: val})
+			}
+		}
+		return nil
+	})
+	return pairs, err
+}
+
+// RawPut writes the raw key bypassing MVCC, the key expires after ttl seconds if ttl is not 0.
+func (store *MVCCStore) RawPut(reqCtx *requestCtx, cf string, key, value []byte, ttl uint64) error {
+	return store.RawBatchPut(reqCtx, cf, [][]byte{key}, [][]byte{value}, []uint64{ttl})
+}
+
+// RawBatchPut writes the raw keys bypassing MVCC in a single batch, ttls are the ttl of every key, or a single ttl
+// for all the keys.
+func (store *MVCCStore) RawBatchPut(reqCtx *requestCtx, cf string, keys, values [][]byte, ttls []uint64) error {
+	dbBatch := newWriteDBBatch(reqCtx)
+	for i, key := range keys {
+		var ttl uint64
+		if len(ttls) == 1 {
+			ttl = ttls[0]
+		} else if len(ttls) > i {
+			ttl = ttls[i]
+		}
+		if ttl > 0 {
+			atomic.StoreInt32(&store.rawTTLUsed, 1)
+		}
+		dbBatch.setRawValue(rawKey(cf, key), values[i], ttl)
+	}
+	return store.writeRawBatch(reqCtx, dbBatch)
+}
+
+// RawDelete deletes the raw key bypassing MVCC.
+func (store *MVCCStore) RawDelete(reqCtx *requestCtx, cf string, key []byte) error {
+	return store.RawBatchDelete(reqCtx, cf, [][]byte{key})
+}
+
+// RawBatchDelete deletes the raw keys bypassing MVCC in a single batch.
+func (store *MVCCStore) RawBatchDelete(reqCtx *requestCtx, cf string, keys [][]byte) error {
+	dbBatch := newWriteDBBatch(reqCtx)
+	for _, key := range keys {
+		dbBatch.delete(rawKey(cf, key))
+	}
+	return store.writeRawBatch(reqCtx, dbBatch)
+}
+
+// writeRawBatch writes the batch holding the latches of the raw keys, so the writes don't interleave with
+// RawCompareAndSwap.
+func (store *MVCCStore) writeRawBatch(reqCtx *requestCtx, dbBatch *writeDBBatch) error {
+	if reqCtx.regCtx == nil || len(dbBatch.entries) == 0 {
+		return store.writeDB(dbBatch)
+	}
+	hashVals := make([]uint64, 0, len(dbBatch.entries))
+	for _, e := range dbBatch.entries {
+		hashVals = append(hashVals, keysToHashVals(e.Key)...)
+	}
+	reqCtx.regCtx.acquireLatches(hashVals, reqCtx.isHighPriority())
+	defer reqCtx.regCtx.releaseLatches(hashVals)
+	return store.writeDB(dbBatch)
+}
+
+// RawCompareAndSwap writes value to the raw key if the current value equals prevValue, or the key doesn't exist if
+// prevNotExist is true. The current value is returned, nil means the key doesn't exist.
+func (store *MVCCStore) RawCompareAndSwap(reqCtx *requestCtx, cf string, key, value, prevValue []byte,
+	prevNotExist bool, ttl uint64) (succeed bool, current []byte, err error) {
+	hashVals := keysToHashVals(rawKey(cf, key))
+	reqCtx.regCtx.acquireLatches(hashVals, reqCtx.isHighPriority())
+	defer reqCtx.regCtx.releaseLatches(hashVals)
+	current, err = store.RawGet(cf, key)
+	if err != nil {
+		return false, nil, errors.Trace(err)
+	}
+	if prevNotExist {
+		succeed = current == nil
+	} else {
+		succeed = current != nil && bytes.Equal(current, prevValue)
+	}
+	if !succeed {
+		return false, current, nil
+	}
+	if ttl > 0 {
+		atomic.StoreInt32(&store.rawTTLUsed, 1)
+	}
+	dbBatch := newWriteDBBatch(reqCtx)
+	dbBatch.setRawValue(rawKey(cf, key), value, ttl)
+	if err = store.writeDB(dbBatch); err != nil {
+		return false, current, errors.Trace(err)
+	}
+	return true, current, nil
+}
+
+// RawScan returns at most limit raw pairs in [startKey, endKey), an empty endKey means unbounded. The values are
+// not returned if keyOnly is true, the expired keys are skipped. If reverse is true, it returns the pairs in
+// [endKey, startKey) in descending order like TiKV, an empty startKey means unbounded. The pairs are accounted to
+// the memory of reqCtx as they are added.
+func (store *MVCCStore) RawScan(reqCtx *requestCtx, cf string, startKey, endKey []byte, limit int, keyOnly, reverse bool) ([]Pair, error) {
+	return store.RawBatchScan(reqCtx, cf, []KeyRange{{StartKey: startKey, EndKey: endKey}}, limit, keyOnly, reverse)
+}
+
+// RawBatchScan is RawScan over the ranges with at most eachLimit pairs for each range, the ranges are scanned in a
+// snapshot by a shared iterator and the pairs are returned in the order of the ranges.
+func (store *MVCCStore) RawBatchScan(reqCtx *requestCtx, cf string, ranges []KeyRange, eachLimit int, keyOnly, reverse bool) ([]Pair, error) {
+	var pairs []Pair
+	prefix := rawCFPrefix(cf)
+	now := clock.Now().Unix()
+	err := store.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = !keyOnly
+		opts.Reverse = reverse
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for _, r := range ranges {
+			var err error
+			pairs, err = rawScanRange(reqCtx, it, prefix, r.StartKey, r.EndKey, eachLimit, keyOnly, reverse, now, pairs)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return pairs, err
+}
+
+// rawScanRange appends at most limit pairs of the range to pairs, it stops with ErrMemLimitExceeded if the pairs
+// exceed the memory limit of reqCtx.
+func rawScanRange(reqCtx *requestCtx, it *badger.Iterator, prefix, startKey, endKey []byte, limit int, keyOnly, reverse bool, now int64, pairs []Pair) ([]Pair, error) {
+	seekKey := append(safeCopy(prefix), startKey...)
+	if reverse && len(startKey) == 0 {
+		// The prefix ends with '/', the keys of the cf are less than the prefix with the last byte increased.
+		seekKey[len(seekKey)-1]++
+	}
+	var cnt int
+	for it.Seek(seekKey); it.ValidForPrefix(prefix) && cnt < limit; it.Next() {
+		item := it.Item()
+		key := item.Key()[len(prefix):]
+		if reverse {
+			if len(startKey) > 0 && bytes.Compare(key, startKey) >= 0 {
+				continue
+			}
+			if bytes.Compare(key, endKey) < 0 {
+				break
+			}
+		} else if len(endKey) > 0 && bytes.Compare(key, endKey) >= 0 {
+			break
+		}
+		val, expireAt, err := decodeRawValue(item)
+		if err != nil {
+			return nil, err
+		}
+		if rawExpired(expireAt, now) {
+			continue
+		}
+		if keyOnly {
+			val = nil
+		}
+		// The pair is accounted before it is copied.
+		if err = reqCtx.consumeMem(len(key) + len(val)); err != nil {
+			return nil, err
+		}
+		pair := Pair{Key: safeCopy(key)}
+		if !keyOnly {
+			pair.Value = safeCopy(val)
+		}
+		pairs = append(pairs, pair)
+		cnt++
+	}
+	return pairs, nil
+}
+
+var rawChecksumTable = crc64.MakeTable(crc64.ECMA)
+
+// RawChecksum returns the xor of the crc64 of every raw key and value in the ranges, with the number and the bytes
+// of the pairs, like the Crc64_Xor checksum of TiKV. The expired keys are skipped.
+func (store *MVCCStore) RawChecksum(cf string, ranges []KeyRange) (checksum, totalKvs, totalBytes uint64, err error) {
+	prefix := rawCFPrefix(cf)
+	now := clock.Now().Unix()
+	err = store.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for _, r := range ranges {
+			for it.Seek(rawKey(cf, r.StartKey)); it.ValidForPrefix(prefix); it.Next() {
+				item := it.Item()
+				key := item.Key()[len(prefix):]
+				if exceedEndKey(key, r.EndKey) {
+					break
+				}
+				val, expireAt, err := decodeRawValue(item)
+				if err != nil {
+					return err
+				}
+				if rawExpired(expireAt, now) {
+					continue
+				}
+				digest := crc64.New(rawChecksumTable)
+				digest.Write(key)
+				digest.Write(val)
+				checksum ^= digest.Sum64()
+				totalKvs++
+				totalBytes += uint64(len(key) + len(val))
+			}
+		}
+		return nil
+	})
+	return checksum, totalKvs, totalBytes, err
+}
+
+// RawDeleteRange deletes the raw keys in [startKey, endKey) bypassing MVCC, an empty endKey means unbounded. The
+// keys are deleted in batches, each batch holds the latches of its keys like RawBatchDelete.
+func (store *MVCCStore) RawDeleteRange(reqCtx *requestCtx, cf string, startKey, endKey []byte) error {
+	rawStart := rawKey(cf, startKey)
+	var rawEnd []byte
+	if len(endKey) > 0 {
+		rawEnd = rawKey(cf, endKey)
+	} else {
+		rawEnd = rawCFPrefix(cf)
+		rawEnd[len(rawEnd)-1]++
+	}
+	size, err := store.rawRangeSize(rawStart, rawEnd)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err = store.deleteRawKeys(reqCtx, rawStart, rawEnd); err != nil {
+		return errors.Trace(err)
+	}
+	if reqCtx.regCtx != nil {
+		atomic.AddInt64(&reqCtx.regCtx.diff, -size)
+	}
+	return nil
+}
+
+func (store *MVCCStore) deleteRawKeys(reqCtx *requestCtx, startKey, endKey []byte) error {
+	for {
+		dbBatch := newWriteDBBatch(reqCtx)
+		err := store.db.View(func(txn *badger.Txn) error {
+			it := txn.NewIterator(badger.IteratorOptions{PrefetchValues: false})
+			defer it.Close()
+			for it.Seek(startKey); it.Valid() && len(dbBatch.entries) < delRangeBatchSize; it.Next() {
+				key := it.Item().KeyCopy(nil)
+				if exceedEndKey(key, endKey) {
+					break
+				}
+				dbBatch.delete(key)
+			}
+			return nil
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(dbBatch.entries) == 0 {
+			return nil
+		}
+		if err = store.writeRawBatch(reqCtx, dbBatch); err != nil {
+			return errors.Trace(err)
+		}
+		if len(dbBatch.entries) < delRangeBatchSize {
+			return nil
+		}
+		lastKey := dbBatch.entries[len(dbBatch.entries)-1].Key
+		startKey = append(lastKey, 0)
+	}
+}
+
+// rawRangeSize returns the estimated size of the keys in the range.
+func (store *MVCCStore) rawRangeSize(startKey, endKey []byte) (int64, error) {
+	var size int64
+	err := store.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{PrefetchValues: false})
+		defer it.Close()
+		for it.Seek(startKey); it.Valid(); it.Next() {
+			item := it.Item()
+			if exceedEndKey(item.Key(), endKey) {
+				break
+			}
+			size += item.EstimatedSize()
+		}
+		return nil
+	})
+	return size, err
+}
+
+const (
+	rawTTLPurgeInterval  = time.Minute
+	rawTTLPurgeBatchSize = 1024
+)
+
+// rawTTLPurger deletes the expired raw keys periodically, the scan is skipped if no key is written with ttl since
+// the last round found none.
+type rawTTLPurger struct {
+	store *MVCCStore
+}
+
+func (p *rawTTLPurger) tick() error {
+	store := p.store
+	if !atomic.CompareAndSwapInt32(&store.rawTTLUsed, 1, 0) {
+		return nil
+	}
+	found, err := p.purge()
+	if found || err != nil {
+		atomic.StoreInt32(&store.rawTTLUsed, 1)
+	}
+	return err
+}
+
+// purge deletes the expired raw keys, found is true if any key with ttl is not expired yet.
+func (p *rawTTLPurger) purge() (found bool, err error) {
+	store := p.store
+	startKey := safeCopy(InternalRawPrefix)
+	for {
+		var expired [][]byte
+		now := clock.Now().Unix()
+		err = store.db.View(func(txn *badger.Txn) error {
+			it := newIterator(txn, false)
+			defer it.Close()
+			for it.Seek(startKey); it.ValidForPrefix(InternalRawPrefix); it.Next() {
+				item := it.Item()
+				startKey = append(item.KeyCopy(startKey[:0]), 0)
+				_, expireAt, err := decodeRawValue(item)
+				if err != nil || expireAt == 0 {
+					continue
+				}
+				if !rawExpired(expireAt, now) {
+					found = true
+					continue
+				}
+				expired = append(expired, item.KeyCopy(nil))
+				if len(expired) == rawTTLPurgeBatchSize {
+					return nil
+				}
+			}
+			startKey = nil
+			return nil
+		})
+		if err != nil {
+			return found, errors.Trace(err)
+		}
+		if len(expired) > 0 {
+			if err = store.deleteExpiredRawKeys(expired); err != nil {
+				return found, err
+			}
+		}
+		if startKey == nil {
+			return found, nil
+		}
+	}
+}
+
+// deleteExpiredRawKeys deletes the keys that are still expired, the keys are checked again in the badger transaction
+// so the keys written after the scan are kept.
+func (store *MVCCStore) deleteExpiredRawKeys(keys [][]byte) error {
+	now := clock.Now().Unix()
+	err := store.db.Update(func(txn *badger.Txn) error {
+		for _, key := range keys {
+			item, err := txn.Get(key)
+			if err == badger.ErrKeyNotFound {
+				continue
+			}
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if _, expireAt, err := decodeRawValue(item); err != nil || !rawExpired(expireAt, now) {
+				continue
+			}
+			if err = txn.Delete(key); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		return nil
+	})
+	return errors.Trace(err)
+}
@@ -0,0 +1,68 @@
+package tikv_test
+
+import (
+	"testing"
+
+	"github.com/ngaut/faketikv/testutil"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestRawBatchScan(t *testing.T) {
+	c := newTestCluster(t)
+	keys := [][]byte{[]byte("a1"), []byte("a2"), []byte("b1"), []byte("b2")}
+	pairs := make([]*kvrpcpb.KvPair, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, &kvrpcpb.KvPair{Key: key, Value: key})
+	}
+	putResp, err := c.Server.RawBatchPut(context.Background(), &kvrpcpb.RawBatchPutRequest{
+		Context: regionCtx(t, c, keys[0]),
+		Pairs:   pairs,
+	})
+	require.NoError(t, err)
+	require.Empty(t, putResp.Error)
+
+	// Each range returns at most EachLimit pairs, in the order of the ranges.
+	kvs := rawBatchScan(t, c, &kvrpcpb.RawBatchScanRequest{
+		Ranges:    []*kvrpcpb.KeyRange{{StartKey: []byte("b")}, {StartKey: []byte("a"), EndKey: []byte("b")}},
+		EachLimit: 1,
+	})
+	checkRawPairs(t, kvs, false, keys[2], keys[0])
+	kvs = rawBatchScan(t, c, &kvrpcpb.RawBatchScanRequest{
+		Ranges:    []*kvrpcpb.KeyRange{{StartKey: []byte("a"), EndKey: []byte("b")}},
+		EachLimit: 10,
+		KeyOnly:   true,
+	})
+	checkRawPairs(t, kvs, true, keys[0], keys[1])
+
+	// The range of a reverse scan is [EndKey, StartKey), an empty StartKey scans from the last key.
+	kvs = rawBatchScan(t, c, &kvrpcpb.RawBatchScanRequest{
+		Ranges:    []*kvrpcpb.KeyRange{{StartKey: []byte("b"), EndKey: []byte("a")}, {EndKey: []byte("b")}},
+		EachLimit: 1,
+		Reverse:   true,
+	})
+	checkRawPairs(t, kvs, false, keys[1], keys[3])
+}
+
+func rawBatchScan(t *testing.T, c *testutil.Cluster, req *kvrpcpb.RawBatchScanRequest) []*kvrpcpb.KvPair {
+	req.Context = regionCtx(t, c, []byte("a"))
+	resp, err := c.Server.RawBatchScan(context.Background(), req)
+	require.NoError(t, err)
+	require.Nil(t, resp.RegionError)
+	return resp.Kvs
+}
+
+// checkRawPairs checks the pairs are the keys in order, the value of every key is the key itself.
+func checkRawPairs(t *testing.T, kvs []*kvrpcpb.KvPair, keyOnly bool, keys ...[]byte) {
+	require.Len(t, kvs, len(keys))
+	for i, kv := range kvs {
+		require.Nil(t, kv.Error)
+		require.Equal(t, keys[i], kv.Key)
+		if keyOnly {
+			require.Empty(t, kv.Value)
+		} else {
+			require.Equal(t, keys[i], kv.Value)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package tikv
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/coocood/badger"
+	"github.com/juju/errors"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	recoverdatapb "github.com/pingcap/kvproto/pkg/recoverdatapb"
+	"golang.org/x/net/context"
+)
+
+// mvccKeyPrefixes are the prefixes of the keys written by transactions.
+var mvccKeyPrefixes = [][]byte{{'m'}, {'t'}}
+
+// WaitApply is the wait_apply step of snapshot recovery. There is no raft log in unistore,
+// a write is applied once its request returns, so there is nothing to wait for.
+func (store *MVCCStore) WaitApply() error {
+	return nil
+}
+
+// ResolveData resolves the data to resolvedTS for snapshot recovery, all the locks are removed,
+// and the versions committed after resolvedTS are dropped so the latest visible version becomes the latest.
+// It returns the number of resolved keys.
+func (store *MVCCStore) ResolveData(resolvedTS uint64) (int, error) {
+	reqCtx := new(requestCtx)
+	lockBatch := newWriteLockBatch(reqCtx)
+	it := store.lockStore.NewIterator()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		lockBatch.delete(safeCopy(it.Key()))
+	}
+	err := store.writeLocks(lockBatch)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	reader := store.NewDBReader(reqCtx)
+	defer reader.Close()
+	var keys [][]byte
+	iter := reader.getIter()
+	for _, prefix := range mvccKeyPrefixes {
+		for iter.Seek(prefix); iter.ValidForPrefix(prefix); iter.Next() {
+			item := iter.Item()
+			mvVal, err := decodeValue(item)
+			if err != nil {
+				return 0, errors.Trace(err)
+			}
+			if mvVal.commitTS > resolvedTS {
+				keys = append(keys, item.KeyCopy(nil))
+			}
+		}
+	}
+	resolved := len(keys)
+	for len(keys) > 0 {
+		batchSize := delRangeBatchSize
+		if batchSize > len(keys) {
+			batchSize = len(keys)
+		}
+		dbBatch := newWriteDBBatch(reqCtx)
+		for _, key := range keys[:batchSize] {
+			err = store.resolveKeyToTS(reader, dbBatch, key, resolvedTS)
+			if err != nil {
+				return 0, errors.Trace(err)
+			}
+		}
+		err = store.writeDB(dbBatch)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		keys = keys[batchSize:]
+	}
+	log.Infof("resolve data to ts %d, %d locks removed, %d keys resolved", resolvedTS, len(lockBatch.entries), resolved)
+	return resolved, nil
+}
+
+// resolveKeyToTS restores the latest version of the key committed not after resolvedTS, and deletes the newer old versions.
+func (store *MVCCStore) resolveKeyToTS(reader *DBReader, dbBatch *writeDBBatch, key []byte, resolvedTS uint64) error {
+	oldIter := reader.getOldIter()
+	oldPrefix := encodeOldKey(key, maxSystemTS)
+	oldPrefix = oldPrefix[:len(oldPrefix)-8]
+	var restored bool
+	for oldIter.Seek(oldPrefix); oldIter.ValidForPrefix(oldPrefix); oldIter.Next() {
+		item := oldIter.Item()
+		if len(item.Key()) != len(oldPrefix)+8 {
+			// A longer key with the same prefix.
+			continue
+		}
+		if !isVisibleKey(item.Key(), resolvedTS) {
+			dbBatch.delete(item.KeyCopy(nil))
+			continue
+		}
+		mvVal, err := decodeValue(item)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		dbBatch.set(key, mvVal.MarshalBinary())
+		dbBatch.delete(item.KeyCopy(nil))
+		restored = true
+		break
+	}
+	if !restored {
+		dbBatch.delete(key)
+	}
+	return nil
+}
+
+// RecoverOrphanLocks resolves the secondary locks loaded at startup whose primary key is already committed or rolled
+// back, so the clients don't have to resolve them after the restart. The locks of the transactions in progress and
+// the primary locks are kept. It must be called before serving.
+func (store *MVCCStore) RecoverOrphanLocks() (committed, rolledBack int, err error) {
+	reqCtx := new(requestCtx)
+	reader := store.NewDBReader(reqCtx)
+	defer reader.Close()
+	reqCtx.reader = reader
+	var lockKeys [][]byte
+	var commitTSs []uint64
+	it := store.lockStore.NewIterator()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		lock := decodeLock(it.Value())
+		if bytes.Equal(it.Key(), lock.primary) {
+			continue
+		}
+		commitTS, finished, err := store.primaryStatus(reader, lock.primary, lock.startTS)
+		if err != nil {
+			return 0, 0, errors.Trace(err)
+		}
+		if finished {
+			lockKeys = append(lockKeys, safeCopy(it.Key()))
+			commitTSs = append(commitTSs, commitTS)
+		}
+	}
+	for len(lockKeys) > 0 {
+		batchSize := delRangeBatchSize
+		if batchSize > len(lockKeys) {
+			batchSize = len(lockKeys)
+		}
+		c, r, err := store.resolveOrphanLocks(reqCtx, lockKeys[:batchSize], commitTSs[:batchSize])
+		if err != nil {
+			return 0, 0, errors.Trace(err)
+		}
+		committed += c
+		rolledBack += r
+		lockKeys, commitTSs = lockKeys[batchSize:], commitTSs[batchSize:]
+	}
+	log.Infof("recover orphan locks, %d committed, %d rolled back", committed, rolledBack)
+	return committed, rolledBack, nil
+}
+
+// primaryStatus returns whether the transaction of the primary key is committed or rolled back, the commit ts is 0
+// if it's rolled back.
+func (store *MVCCStore) primaryStatus(reader *DBReader, primary []byte, startTS uint64) (commitTS uint64, finished bool, err error) {
+	buf := store.lockStore.Get(primary, nil)
+	if len(buf) > 0 && decodeLock(buf).startTS == startTS {
+		return 0, false, nil
+	}
+	if store.hasRollback(encodeRollbackKey(nil, primary, startTS)) {
+		return 0, true, nil
+	}
+	item, err := reader.txn.Get(primary)
+	if err == badger.ErrKeyNotFound {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, errors.Trace(err)
+	}
+	mvVal, err := decodeValue(item)
+	if err != nil {
+		return 0, false, errors.Trace(err)
+	}
+	if mvVal.startTS == startTS {
+		return mvVal.commitTS, true, nil
+	}
+	if mvVal.commitTS < startTS {
+		return 0, false, nil
+	}
+	oldKey := encodeOldKey(primary, mvVal.commitTS)
+	for it := reader.seekOldIter(oldKey); it.ValidForPrefix(oldKey[:len(oldKey)-8]); it.Next() {
+		item := it.Item()
+		if len(item.Key()) != len(oldKey) {
+			// A longer key with the same prefix.
+			continue
+		}
+		if isVisibleKey(item.Key(), startTS) {
+			break
+		}
+		mvVal, err = decodeValue(item)
+		if err != nil {
+			return 0, false, errors.Trace(err)
+		}
+		if mvVal.startTS == startTS {
+			return mvVal.commitTS, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// resolveOrphanLocks commits the locks whose commitTS > 0 like Commit and rolls back the others like Rollback.
+func (store *MVCCStore) resolveOrphanLocks(reqCtx *requestCtx, lockKeys [][]byte, commitTSs []uint64) (committed, rolledBack int, err error) {
+	lockBatch := newWriteLockBatch(reqCtx)
+	dbBatch := newWriteDBBatch(reqCtx)
+	txn := reqCtx.reader.txn
+	var movedKeys [][]byte
+	for i, key := range lockKeys {
+		lock := decodeLock(store.lockStore.Get(key, nil))
+		if commitTSs[i] == 0 {
+			store.rollbackKeyReadLock(lockBatch, key, lock.startTS, false)
+			rolledBack++
+			continue
+		}
+		store.updateLatestTS(commitTSs[i])
+		if lock.op == uint8(kvrpcpb.Op_Put) || lock.op == uint8(kvrpcpb.Op_Del) {
+			if lock.hasOldVer {
+				moved, err := moveLatestToOld(txn, key, dbBatch)
+				if err != nil {
+					return 0, 0, err
+				}
+				if moved {
+					movedKeys = append(movedKeys, key)
+				}
+			}
+			dbBatch.commit(key, lockToValue(lock, commitTSs[i]))
+		}
+		lockBatch.delete(key)
+		committed++
+	}
+	if len(dbBatch.entries) > 0 {
+		if err = store.writeDB(dbBatch); err != nil {
+			return 0, 0, errors.Trace(err)
+		}
+		store.countOldVersions(movedKeys)
+	}
+	if err = store.writeLocks(lockBatch); err != nil {
+		return 0, 0, errors.Trace(err)
+	}
+	return committed, rolledBack, nil
+}
+
+var _ recoverdatapb.RecoverDataServer = new(Server)
+
+// ReadRegionMeta is the ReadRegionMeta of the recover data service, every region has a single peer whose log is
+// fully applied.
+func (svr *Server) ReadRegionMeta(req *recoverdatapb.ReadRegionMetaRequest, stream recoverdatapb.RecoverData_ReadRegionMetaServer) error {
+	rm := svr.regionManager
+	rm.mu.RLock()
+	metas := make([]*recoverdatapb.RegionMeta, 0, len(rm.regions))
+	for _, regCtx := range rm.regions {
+		metas = append(metas, &recoverdatapb.RegionMeta{
+			RegionId: regCtx.meta.Id,
+			PeerId:   regCtx.meta.Peers[0].Id,
+			Version:  regCtx.meta.RegionEpoch.Version,
+			StartKey: regCtx.meta.StartKey,
+			EndKey:   regCtx.meta.EndKey,
+		})
+	}
+	rm.mu.RUnlock()
+	for _, meta := range metas {
+		if err := stream.Send(meta); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// RecoverRegion is the RecoverRegion of the recover data service, there is no raft group to recover.
+func (svr *Server) RecoverRegion(stream recoverdatapb.RecoverData_RecoverRegionServer) error {
+	for {
+		_, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&recoverdatapb.RecoverRegionResponse{StoreId: svr.regionManager.storeMeta.Id})
+		}
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+}
+
+// WaitApply is the WaitApply of the recover data service.
+func (svr *Server) WaitApply(ctx context.Context, req *recoverdatapb.WaitApplyRequest) (*recoverdatapb.WaitApplyResponse, error) {
+	if err := svr.mvccStore.WaitApply(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &recoverdatapb.WaitApplyResponse{}, nil
+}
+
+// ResolveKvData is the ResolveKvData of the recover data service.
+func (svr *Server) ResolveKvData(req *recoverdatapb.ResolveKvDataRequest, stream recoverdatapb.RecoverData_ResolveKvDataServer) error {
+	if svr.readOnly {
+		return errors.New("the store is read-only")
+	}
+	resolved, err := svr.mvccStore.ResolveData(req.ResolvedTs)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return stream.Send(&recoverdatapb.ResolveKvDataResponse{
+		StoreId:          svr.regionManager.storeMeta.Id,
+		ResolvedKeyCount: uint64(resolved),
+	})
+}
@@ -11,7 +11,6 @@ import (
 
 	"github.com/coocood/badger"
 	"github.com/juju/errors"
-	"github.com/ngaut/log"
 	"github.com/pingcap/kvproto/pkg/errorpb"
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
 	"github.com/pingcap/kvproto/pkg/metapb"
@@ -24,6 +23,18 @@ var (
 	InternalKeyPrefix        = []byte(`i`)
 	InternalRegionMetaPrefix = append(InternalKeyPrefix, "region"...)
 	InternalStoreMetaKey     = append(InternalKeyPrefix, "store"...)
+	// InternalRollbackGCTSKey stores the max start ts of collected rollback keys.
+	InternalRollbackGCTSKey = append(InternalKeyPrefix, "rollback_gc_ts"...)
+	// InternalGCPolicyPrefix is the prefix of the per key prefix GC retention policies.
+	InternalGCPolicyPrefix = append(InternalKeyPrefix, "gc_policy"...)
+	// InternalGCSafePointKey stores the GC safe point, reads older than it are rejected.
+	InternalGCSafePointKey = append(InternalKeyPrefix, "gc_safe_point"...)
+	// InternalRollbackPrefix is the prefix of the rollback records spilled from memory.
+	InternalRollbackPrefix = append(InternalKeyPrefix, "rollback/"...)
+	// InternalRawPrefix is the prefix of the RawKV keys.
+	InternalRawPrefix = append(InternalKeyPrefix, "raw/"...)
+	// InternalRangeTombstonePrefix is the prefix of the ranges deleted logically.
+	InternalRangeTombstonePrefix = append(InternalKeyPrefix, "range_tombstone/"...)
 )
 
 func InternalRegionMetaKey(regionId uint64) []byte {
@@ -36,19 +47,40 @@ type regionCtx struct {
 	endKey   []byte
 	sizeHint int64
 	diff     int64
+	heat     regionHeat
+
+	writeBucket tokenBucket
 
 	latches   map[uint64]*sync.WaitGroup
 	latchesMu sync.RWMutex
+	// reserved holds the latches that high priority requests are waiting for, normal requests must not
+	// take them until the high priority ones get them.
+	reserved map[uint64]*latchReservation
 
 	refCount sync.WaitGroup
 	parent   *regionCtx // Parent is used to wait for all latches being released.
+
+	// dataVersion is bumped by the writes in the region to validate the cached coprocessor results. It starts at
+	// the creation time, so the versions after a restart or a split don't match the old ones.
+	dataVersion uint64
+	// maxCommitTS is the max commit ts of the region, the cached coprocessor results read before it are stale.
+	maxCommitTS uint64
 }
 
 func newRegionCtx(meta *metapb.Region, parent *regionCtx) *regionCtx {
 	regCtx := &regionCtx{
-		meta:    meta,
-		latches: make(map[uint64]*sync.WaitGroup),
-		parent:  parent,
+		meta:     meta,
+		latches:  make(map[uint64]*sync.WaitGroup),
+		reserved: make(map[uint64]*latchReservation),
+		parent:   parent,
+
+		dataVersion: uint64(time.Now().UnixNano()),
+	}
+	if parent != nil {
+		regCtx.maxCommitTS = atomic.LoadUint64(&parent.maxCommitTS)
+	} else {
+		// The commits before the restart are not tracked, they are committed before now.
+		regCtx.maxCommitTS = uint64(time.Now().UnixNano()/int64(time.Millisecond)) << 18
 	}
 	regCtx.startKey = regCtx.rawStartKey()
 	regCtx.endKey = regCtx.rawEndKey()
@@ -99,6 +131,7 @@ func (ri *regionCtx) unmarshal(data []byte) error {
 		return errors.Trace(err)
 	}
 	ri.latches = make(map[uint64]*sync.WaitGroup)
+	ri.reserved = make(map[uint64]*latchReservation)
 	ri.startKey = ri.rawStartKey()
 	ri.endKey = ri.rawEndKey()
 	ri.refCount.Add(1)
@@ -115,7 +148,12 @@ func (ri *regionCtx) marshal() []byte {
 	return data
 }
 
-func (ri *regionCtx) tryAcquireLatches(hashVals []uint64) (bool, *sync.WaitGroup) {
+type latchReservation struct {
+	wg  *sync.WaitGroup
+	cnt int
+}
+
+func (ri *regionCtx) tryAcquireLatches(hashVals []uint64, highPri bool) (bool, *sync.WaitGroup) {
 	wg := new(sync.WaitGroup)
 	wg.Add(1)
 	ri.latchesMu.Lock()
@@ -125,23 +163,68 @@ func (ri *regionCtx) tryAcquireLatches(hashVals []uint64) (bool, *sync.WaitGroup
 			return false, wg
 		}
 	}
+	if !highPri {
+		for _, hashVal := range hashVals {
+			if r, ok := ri.reserved[hashVal]; ok {
+				return false, r.wg
+			}
+		}
+	}
 	for _, hashVal := range hashVals {
 		ri.latches[hashVal] = wg
 	}
 	return true, nil
 }
 
-func (ri *regionCtx) acquireLatches(hashVals []uint64) {
+// reserveLatches makes the normal requests wait for the high priority waiter on the latches.
+func (ri *regionCtx) reserveLatches(hashVals []uint64) {
+	ri.latchesMu.Lock()
+	defer ri.latchesMu.Unlock()
+	for _, hashVal := range hashVals {
+		r, ok := ri.reserved[hashVal]
+		if !ok {
+			r = &latchReservation{wg: new(sync.WaitGroup)}
+			r.wg.Add(1)
+			ri.reserved[hashVal] = r
+		}
+		r.cnt++
+	}
+}
+
+func (ri *regionCtx) unreserveLatches(hashVals []uint64) {
+	ri.latchesMu.Lock()
+	defer ri.latchesMu.Unlock()
+	for _, hashVal := range hashVals {
+		r := ri.reserved[hashVal]
+		r.cnt--
+		if r.cnt == 0 {
+			delete(ri.reserved, hashVal)
+			r.wg.Done()
+		}
+	}
+}
+
+// acquireLatches blocks until all the latches are acquired, the high priority requests are served before the normal
+// ones waiting for the same latches.
+func (ri *regionCtx) acquireLatches(hashVals []uint64, highPri bool) {
 	start := time.Now()
+	var reserved bool
 	for {
-		ok, wg := ri.tryAcquireLatches(hashVals)
+		ok, wg := ri.tryAcquireLatches(hashVals, highPri)
 		if ok {
+			if reserved {
+				ri.unreserveLatches(hashVals)
+			}
 			dur := time.Since(start)
 			if dur > time.Millisecond*50 {
 				log.Warnf("acquire %d locks takes %v", len(hashVals), dur)
 			}
 			return
 		}
+		if highPri && !reserved {
+			ri.reserveLatches(hashVals)
+			reserved = true
+		}
 		wg.Wait()
 	}
 }
@@ -160,6 +243,18 @@ type RegionOptions struct {
 	StoreAddr  string
 	PDAddr     string
 	RegionSize int64
+	// WriteRateLimit is the write bytes per second allowed for a region, 0 means no limit.
+	WriteRateLimit int64
+	// WriteBurst is the max write bytes a region can take at once.
+	WriteBurst int64
+	// PDClient is used instead of connecting to PDAddr if not nil.
+	PDClient Client
+	// SplitKeys are the raw keys the store is split at when it is initialized, nil means the default split keys.
+	SplitKeys [][]byte
+	// APIVersion adds the split keys of the API V2 txn keys to the default split keys if it is V2.
+	APIVersion kvrpcpb.APIVersion
+	// ReadOnly serves a read-only db, the regions are not split and nothing is written to the db.
+	ReadOnly bool
 }
 
 type RegionManager struct {
@@ -172,12 +267,21 @@ type RegionManager struct {
 	regionSize int64
 	closeCh    chan struct{}
 	wg         sync.WaitGroup
+	heatRing   *heatRing
+
+	writeRateLimit int64
+	writeBurst     int64
+	readOnly       bool
 }
 
 func NewRegionManager(db *badger.DB, opts RegionOptions) *RegionManager {
-	pdc, err := NewClient(opts.PDAddr, "")
-	if err != nil {
-		log.Fatal(err)
+	var err error
+	pdc := opts.PDClient
+	if pdc == nil {
+		pdc, err = NewClient(opts.PDAddr, "")
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 	clusterID := pdc.GetClusterID(context.TODO())
 	log.Infof("cluster id %v", clusterID)
@@ -188,6 +292,11 @@ func NewRegionManager(db *badger.DB, opts RegionOptions) *RegionManager {
 		regions:    make(map[uint64]*regionCtx),
 		regionSize: opts.RegionSize,
 		closeCh:    make(chan struct{}),
+		heatRing:   newHeatRing(keyVizCapacity),
+
+		writeRateLimit: opts.WriteRateLimit,
+		writeBurst:     opts.WriteBurst,
+		readOnly:       opts.ReadOnly,
 	}
 	err = rm.db.View(func(txn *badger.Txn) error {
 		item, err1 := txn.Get(InternalStoreMetaKey)
@@ -224,8 +333,22 @@ func NewRegionManager(db *badger.DB, opts RegionOptions) *RegionManager {
 	if err != nil && err != badger.ErrKeyNotFound {
 		log.Fatal(err)
 	}
+	err = rm.fenceClusterID()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if rm.storeMeta.Id == 0 && rm.readOnly {
+		log.Fatal("the read-only db is not initialized")
+	}
 	if rm.storeMeta.Id == 0 {
-		err = rm.initStore(opts.StoreAddr)
+		splitKeys := opts.SplitKeys
+		if splitKeys == nil {
+			splitKeys = defaultSplitKeys
+			if opts.APIVersion == kvrpcpb.APIVersion_V2 {
+				splitKeys = apiV2SplitKeys
+			}
+		}
+		err = rm.initStore(opts.StoreAddr, splitKeys)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -233,12 +356,16 @@ func NewRegionManager(db *badger.DB, opts RegionOptions) *RegionManager {
 	rm.storeMeta.Address = opts.StoreAddr
 	rm.pdc.PutStore(context.TODO(), &rm.storeMeta)
 	rm.wg.Add(2)
-	go rm.runSplitWorker()
+	if !rm.readOnly {
+		rm.wg.Add(1)
+		go rm.runSplitWorker()
+	}
 	go rm.storeHeartBeatLoop()
+	go rm.keyVizLoop()
 	return rm
 }
 
-func (rm *RegionManager) initStore(storeAddr string) error {
+func (rm *RegionManager) initStore(storeAddr string, splitKeys [][]byte) error {
 	log.Info("initializing store")
 	ids, err := rm.allocIDs(3)
 	if err != nil {
@@ -259,7 +386,7 @@ func (rm *RegionManager) initStore(storeAddr string) error {
 	if err != nil {
 		log.Fatal("Initialize failed: ", err)
 	}
-	rm.initialSplit(rootRegion)
+	rm.initialSplit(rootRegion, splitKeys)
 	storeBuf, err := rm.storeMeta.Marshal()
 	if err != nil {
 		log.Fatal("%+v", err)
@@ -282,45 +409,34 @@ func (rm *RegionManager) initStore(storeAddr string) error {
 	return nil
 }
 
-// initSplit splits the cluster into 5 regions, [nil, 'm'), ['m', 'n'), ['n', 't'), ('t', 'u'), ['u', nil)
-func (rm *RegionManager) initialSplit(root *metapb.Region) {
+// defaultSplitKeys splits the cluster into 5 regions, [nil, 'm'), ['m', 'n'), ['n', 't'), ('t', 'u'), ['u', nil)
+var defaultSplitKeys = [][]byte{{'m'}, {'n'}, {'t'}, {'u'}}
+
+// initialSplit splits the root region at the sorted split keys.
+func (rm *RegionManager) initialSplit(root *metapb.Region, splitKeys [][]byte) {
+	if len(splitKeys) == 0 {
+		return
+	}
 	// allocate retion id
-	ids, err := rm.allocIDs(8)
+	ids, err := rm.allocIDs(2 * len(splitKeys))
 	if err != nil {
 		log.Fatal(err)
 	}
-	root.EndKey = codec.EncodeBytes(nil, []byte{'m'})
+	root.EndKey = codec.EncodeBytes(nil, splitKeys[0])
 	root.RegionEpoch.Version = 2
-	newRegions := []*metapb.Region{
-		root,
-		{
-			Id:          ids[0],
-			RegionEpoch: &metapb.RegionEpoch{ConfVer: 1, Version: 1},
-			Peers:       []*metapb.Peer{&metapb.Peer{Id: ids[1], StoreId: rm.storeMeta.Id}},
-			StartKey:    codec.EncodeBytes(nil, []byte{'m'}),
-			EndKey:      codec.EncodeBytes(nil, []byte{'n'}),
-		},
-		{
-			Id:          ids[2],
-			RegionEpoch: &metapb.RegionEpoch{ConfVer: 1, Version: 1},
-			Peers:       []*metapb.Peer{&metapb.Peer{Id: ids[3], StoreId: rm.storeMeta.Id}},
-			StartKey:    codec.EncodeBytes(nil, []byte{'n'}),
-			EndKey:      codec.EncodeBytes(nil, []byte{'t'}),
-		},
-		{
-			Id:          ids[4],
-			RegionEpoch: &metapb.RegionEpoch{ConfVer: 1, Version: 1},
-			Peers:       []*metapb.Peer{&metapb.Peer{Id: ids[5], StoreId: rm.storeMeta.Id}},
-			StartKey:    codec.EncodeBytes(nil, []byte{'t'}),
-			EndKey:      codec.EncodeBytes(nil, []byte{'u'}),
-		},
-		{
-			Id:          ids[6],
+	newRegions := []*metapb.Region{root}
+	for i, splitKey := range splitKeys {
+		endKey := []byte{}
+		if i+1 < len(splitKeys) {
+			endKey = codec.EncodeBytes(nil, splitKeys[i+1])
+		}
+		newRegions = append(newRegions, &metapb.Region{
+			Id:          ids[2*i],
 			RegionEpoch: &metapb.RegionEpoch{ConfVer: 1, Version: 1},
-			Peers:       []*metapb.Peer{&metapb.Peer{Id: ids[7], StoreId: rm.storeMeta.Id}},
-			StartKey:    codec.EncodeBytes(nil, []byte{'u'}),
-			EndKey:      []byte{},
-		},
+			Peers:       []*metapb.Peer{&metapb.Peer{Id: ids[2*i+1], StoreId: rm.storeMeta.Id}},
+			StartKey:    codec.EncodeBytes(nil, splitKey),
+			EndKey:      endKey,
+		})
 	}
 	for _, region := range newRegions {
 		rm.regions[region.Id] = newRegionCtx(region, nil)
@@ -359,6 +475,34 @@ func (rm *RegionManager) storeHeartBeatLoop() {
 	}
 }
 
+const gcSafePointSyncInterval = 10 * time.Second
+
+// SyncGCSafePoint keeps the GC safe point of the store up to date with the one in PD, so the reads older than it
+// are rejected even before the GC requests arrive.
+func (rm *RegionManager) SyncGCSafePoint(store *MVCCStore) {
+	rm.wg.Add(1)
+	go func() {
+		defer rm.wg.Done()
+		for {
+			timer := clock.NewTimer(gcSafePointSyncInterval)
+			select {
+			case <-rm.closeCh:
+				timer.Stop()
+				return
+			case <-timer.C():
+			}
+			safePoint, err := rm.pdc.GetGCSafePoint(context.Background())
+			if err != nil {
+				log.Warnf("get GC safe point failed: %v", err)
+				continue
+			}
+			if err = store.UpdateGCSafePoint(safePoint); err != nil {
+				log.Error(err)
+			}
+		}
+	}()
+}
+
 func (rm *RegionManager) getRegionFromCtx(ctx *kvrpcpb.Context) (*regionCtx, *errorpb.Error) {
 	ctxPeer := ctx.GetPeer()
 	if ctxPeer != nil && ctxPeer.GetStoreId() != rm.storeMeta.Id {
@@ -404,6 +548,41 @@ func (rm *RegionManager) getRegionFromCtx(ctx *kvrpcpb.Context) (*regionCtx, *er
 	return ri, nil
 }
 
+// rangeNotInRegion returns the KeyNotInRegion error if [startKey, endKey) is not in the region, an empty endKey
+// means unbounded.
+func rangeNotInRegion(regCtx *regionCtx, startKey, endKey []byte) *errorpb.Error {
+	key := startKey
+	inRegion := bytes.Compare(startKey, regCtx.startKey) >= 0
+	if inRegion && len(regCtx.endKey) > 0 {
+		inRegion = len(endKey) > 0 && bytes.Compare(endKey, regCtx.endKey) <= 0
+		key = endKey
+	}
+	if inRegion {
+		return nil
+	}
+	return &errorpb.Error{
+		Message: "key not in region",
+		KeyNotInRegion: &errorpb.KeyNotInRegion{
+			Key:      key,
+			RegionId: regCtx.meta.Id,
+			StartKey: regCtx.startKey,
+			EndKey:   regCtx.endKey,
+		},
+	}
+}
+
+// getRegionByKey returns the region containing the raw key, or nil if it's not found.
+func (rm *RegionManager) getRegionByKey(key []byte) *regionCtx {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	for _, ri := range rm.regions {
+		if !ri.lessThanStartKey(key) && !ri.greaterEqualEndKey(key) {
+			return ri
+		}
+	}
+	return nil
+}
+
 type keySample struct {
 	key      []byte
 	leftSize int64
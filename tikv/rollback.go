@@ -0,0 +1,167 @@
+package tikv
+
+import (
+	"math"
+	"sort"
+	"sync/atomic"
+
+	"github.com/coocood/badger"
+	"github.com/juju/errors"
+)
+
+// RollbackStats is the state of the rollback records collected by the rollbackGCWorker in the latest round.
+type RollbackStats struct {
+	MemCount     int64 `json:"mem_count"`
+	MemBytes     int64 `json:"mem_bytes"`
+	SpilledCount int64 `json:"spilled_count"`
+	// OldestAgeMs is the age of the oldest rollback record in milliseconds.
+	OldestAgeMs int64 `json:"oldest_age_ms"`
+}
+
+type rollbackRecord struct {
+	key []byte
+	val []byte
+	ts  uint64
+}
+
+func spilledRollbackKey(rollbackKey []byte) []byte {
+	return append(append([]byte{}, InternalRollbackPrefix...), rollbackKey...)
+}
+
+// hasRollback returns true if the rollback record exists in memory or in the spilled records.
+func (store *MVCCStore) hasRollback(rollbackKey []byte) bool {
+	if len(store.rollbackStore.Get(rollbackKey, nil)) > 0 {
+		return true
+	}
+	if atomic.LoadInt64(&store.spilledRollbacks) == 0 {
+		return false
+	}
+	var found bool
+	err := store.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(spilledRollbackKey(rollbackKey))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		found = err == nil
+		return err
+	})
+	if err != nil {
+		log.Error(err)
+	}
+	return found
+}
+
+// newestSpilledRollbackTS returns the max start ts of the spilled rollback records of the key.
+func (store *MVCCStore) newestSpilledRollbackTS(key []byte) uint64 {
+	if atomic.LoadInt64(&store.spilledRollbacks) == 0 {
+		return 0
+	}
+	var ts uint64
+	seekKey := spilledRollbackKey(encodeRollbackKey(nil, key, math.MaxUint64))
+	prefix := seekKey[:len(seekKey)-8]
+	err := store.db.View(func(txn *badger.Txn) error {
+		it := newIterator(txn, false)
+		defer it.Close()
+		for it.Seek(seekKey); it.ValidForPrefix(prefix); it.Next() {
+			if len(it.Item().Key()) == len(seekKey) {
+				ts = decodeRollbackTS(it.Item().Key())
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error(err)
+	}
+	return ts
+}
+
+// spillRollbacks moves the oldest records to badger until the memory used by the records is under the limit.
+func (store *MVCCStore) spillRollbacks(records []rollbackRecord, memBytes int64) (int, error) {
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].ts < records[j].ts
+	})
+	var n int
+	for n < len(records) && memBytes > store.RollbackMemLimit {
+		memBytes -= int64(len(records[n].key) + len(records[n].val))
+		n++
+	}
+	spilled := records[:n]
+	if len(spilled) == 0 {
+		return 0, nil
+	}
+	err := store.db.Update(func(txn *badger.Txn) error {
+		for _, r := range spilled {
+			if err := txn.Set(spilledRollbackKey(r.key), r.val); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	atomic.AddInt64(&store.spilledRollbacks, int64(len(spilled)))
+	lockBatch := newWriteLockBatch(new(requestCtx))
+	for _, r := range spilled {
+		lockBatch.rollbackGC(r.key)
+	}
+	return len(spilled), store.writeLocks(lockBatch)
+}
+
+// collectSpilledRollbacks deletes the expired spilled records, the rollback GC ts must be saved before calling it.
+func (store *MVCCStore) collectSpilledRollbacks(expired [][]byte) error {
+	if len(expired) == 0 {
+		return nil
+	}
+	err := store.db.Update(func(txn *badger.Txn) error {
+		for _, key := range expired {
+			if err := txn.Delete(key); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	atomic.AddInt64(&store.spilledRollbacks, -int64(len(expired)))
+	return nil
+}
+
+// scanSpilledRollbacks calls f for every spilled record with the rollback key.
+func (store *MVCCStore) scanSpilledRollbacks(f func(key, rollbackKey, val []byte) error) error {
+	return store.db.View(func(txn *badger.Txn) error {
+		it := newIterator(txn, false)
+		defer it.Close()
+		for it.Seek(InternalRollbackPrefix); it.ValidForPrefix(InternalRollbackPrefix); it.Next() {
+			item := it.Item()
+			val, err := item.Value()
+			if err != nil {
+				return errors.Trace(err)
+			}
+			key := item.KeyCopy(nil)
+			if err = f(key, key[len(InternalRollbackPrefix):], val); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (store *MVCCStore) loadSpilledRollbacks() error {
+	var cnt int64
+	err := store.scanSpilledRollbacks(func(key, rollbackKey, val []byte) error {
+		cnt++
+		return nil
+	})
+	atomic.StoreInt64(&store.spilledRollbacks, cnt)
+	return err
+}
+
+// RollbackStats returns the state of the rollback records.
+func (store *MVCCStore) RollbackStats() RollbackStats {
+	stats := store.rollbackStats.Load().(RollbackStats)
+	stats.SpilledCount = atomic.LoadInt64(&store.spilledRollbacks)
+	return stats
+}
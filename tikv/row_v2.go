@@ -0,0 +1,161 @@
+package tikv
+
+import (
+	"encoding/binary"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/tidb/mysql"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/util/codec"
+	tipb "github.com/pingcap/tipb/go-tipb"
+)
+
+const (
+	// rowV2CodecVer is the first byte of a row of the format v2, which is never the flag of a column id of v1.
+	rowV2CodecVer = 128
+	// rowV2FlagLarge is set if any column id of the row is larger than 255 or the row is longer than 65535 bytes.
+	rowV2FlagLarge = 1
+
+	// The flags of the datums the values of v2 are encoded to, codec doesn't export them.
+	decimalFlag byte = 6
+	jsonFlag    byte = 10
+)
+
+func isRowV2(value []byte) bool {
+	return len(value) > 0 && value[0] == rowV2CodecVer
+}
+
+// cutRowV2Columns cuts the values of the columns in colIDs from a row of the format v2. The values are encoded as
+// the datums of the format v1, so the executors decode the rows of both formats the same way. The row is the
+// version, the flag, the numbers of the not null and the null columns, the sorted ids of the not null and the null
+// columns, the end offsets of the not null values and the values.
+func cutRowV2Columns(data []byte, columns []*tipb.ColumnInfo, colIDs map[int64]int) ([][]byte, error) {
+	row := make([][]byte, len(columns))
+	if len(data) < 6 {
+		return nil, errors.Errorf("invalid row v2 %q", data)
+	}
+	idLen, offLen := 1, 2
+	if data[1]&rowV2FlagLarge > 0 {
+		idLen, offLen = 4, 4
+	}
+	numNotNull := int(binary.LittleEndian.Uint16(data[2:]))
+	numNull := int(binary.LittleEndian.Uint16(data[4:]))
+	data = data[6:]
+	idsEnd := (numNotNull + numNull) * idLen
+	offsEnd := idsEnd + numNotNull*offLen
+	if len(data) < offsEnd {
+		return nil, errors.Errorf("invalid row v2 of %d not null and %d null columns", numNotNull, numNull)
+	}
+	ids, offs, vals := data[:idsEnd], data[idsEnd:offsEnd], data[offsEnd:]
+	readUint := func(b []byte, size, i int) int {
+		if size == 1 {
+			return int(b[i])
+		} else if size == 2 {
+			return int(binary.LittleEndian.Uint16(b[2*i:]))
+		}
+		return int(binary.LittleEndian.Uint32(b[4*i:]))
+	}
+	for i := 0; i < numNotNull+numNull; i++ {
+		offset, ok := colIDs[int64(readUint(ids, idLen, i))]
+		if !ok {
+			continue
+		}
+		if i >= numNotNull {
+			row[offset] = []byte{codec.NilFlag}
+			continue
+		}
+		var start int
+		if i > 0 {
+			start = readUint(offs, offLen, i-1)
+		}
+		end := readUint(offs, offLen, i)
+		if start > end || end > len(vals) {
+			return nil, errors.Errorf("invalid row v2 offset %d", end)
+		}
+		var err error
+		row[offset], err = encodeRowV2Value(vals[start:end], columns[offset])
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	return row, nil
+}
+
+// encodeRowV2Value encodes a value of v2 as the datum of v1. The integers are little endian of 1, 2, 4 or 8 bytes,
+// the times are packed, the floats and the decimals are encoded by codec without the flag.
+func encodeRowV2Value(val []byte, col *tipb.ColumnInfo) ([]byte, error) {
+	var d types.Datum
+	switch byte(col.GetTp()) {
+	case mysql.TypeTiny, mysql.TypeShort, mysql.TypeInt24, mysql.TypeLong, mysql.TypeLonglong, mysql.TypeYear:
+		if mysql.HasUnsignedFlag(uint(col.GetFlag())) {
+			u, err := decodeRowV2Uint(val)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			d = types.NewUintDatum(u)
+		} else {
+			i, err := decodeRowV2Int(val)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			d = types.NewIntDatum(i)
+		}
+	case mysql.TypeDate, mysql.TypeDatetime, mysql.TypeTimestamp, mysql.TypeEnum, mysql.TypeSet, mysql.TypeBit:
+		u, err := decodeRowV2Uint(val)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		d = types.NewUintDatum(u)
+	case mysql.TypeDuration:
+		i, err := decodeRowV2Int(val)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		d = types.NewIntDatum(i)
+	case mysql.TypeFloat, mysql.TypeDouble:
+		_, f, err := codec.DecodeFloat(val)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		d = types.NewFloat64Datum(f)
+	case mysql.TypeVarchar, mysql.TypeVarString, mysql.TypeString, mysql.TypeTinyBlob, mysql.TypeMediumBlob,
+		mysql.TypeLongBlob, mysql.TypeBlob:
+		d = types.NewBytesDatum(val)
+	case mysql.TypeNewDecimal:
+		return append([]byte{decimalFlag}, val...), nil
+	case mysql.TypeJSON:
+		return append([]byte{jsonFlag}, val...), nil
+	default:
+		return nil, errors.Errorf("unsupported column type %d of row v2", col.GetTp())
+	}
+	b, err := codec.EncodeValue(nil, nil, d)
+	return b, errors.Trace(err)
+}
+
+func decodeRowV2Int(val []byte) (int64, error) {
+	switch len(val) {
+	case 1:
+		return int64(int8(val[0])), nil
+	case 2:
+		return int64(int16(binary.LittleEndian.Uint16(val))), nil
+	case 4:
+		return int64(int32(binary.LittleEndian.Uint32(val))), nil
+	case 8:
+		return int64(binary.LittleEndian.Uint64(val)), nil
+	}
+	return 0, errors.Errorf("invalid row v2 int %q", val)
+}
+
+func decodeRowV2Uint(val []byte) (uint64, error) {
+	switch len(val) {
+	case 1:
+		return uint64(val[0]), nil
+	case 2:
+		return uint64(binary.LittleEndian.Uint16(val)), nil
+	case 4:
+		return uint64(binary.LittleEndian.Uint32(val)), nil
+	case 8:
+		return binary.LittleEndian.Uint64(val), nil
+	}
+	return 0, errors.Errorf("invalid row v2 uint %q", val)
+}
@@ -0,0 +1,55 @@
+package tikv
+
+import (
+	"testing"
+
+	"github.com/pingcap/tidb/mysql"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/util/codec"
+	tipb "github.com/pingcap/tipb/go-tipb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCutRowV2Columns(t *testing.T) {
+	columns := []*tipb.ColumnInfo{
+		{ColumnId: 1, Tp: int32(mysql.TypeLong)},
+		{ColumnId: 2, Tp: int32(mysql.TypeLong)},
+		{ColumnId: 3, Tp: int32(mysql.TypeVarString)},
+	}
+	// The not null columns 1 and 3 and the null column 2, the value of column 1 is the int8 -5.
+	row := []byte{rowV2CodecVer, 0, 2, 0, 1, 0, 1, 3, 2, 1, 0, 4, 0, 0xfb, 'a', 'b', 'c'}
+	require.True(t, isRowV2(row))
+	require.False(t, isRowV2(encodeDatum(t, types.NewIntDatum(1))))
+
+	values, err := cutRowV2Columns(row, columns, map[int64]int{1: 0, 2: 1, 3: 2})
+	require.NoError(t, err)
+	require.Equal(t, encodeDatum(t, types.NewIntDatum(-5)), values[0])
+	require.Equal(t, []byte{codec.NilFlag}, values[1])
+	require.Equal(t, encodeDatum(t, types.NewBytesDatum([]byte("abc"))), values[2])
+	// The columns not requested are left nil.
+	values, err = cutRowV2Columns(row, columns, map[int64]int{3: 2})
+	require.NoError(t, err)
+	require.Nil(t, values[0])
+	require.Nil(t, values[1])
+	require.Equal(t, encodeDatum(t, types.NewBytesDatum([]byte("abc"))), values[2])
+
+	// The ids and the offsets of a large row are 4 bytes.
+	large := []byte{rowV2CodecVer, rowV2FlagLarge, 1, 0, 0, 0, 3, 0, 0, 0, 3, 0, 0, 0, 'a', 'b', 'c'}
+	values, err = cutRowV2Columns(large, columns, map[int64]int{3: 2})
+	require.NoError(t, err)
+	require.Equal(t, encodeDatum(t, types.NewBytesDatum([]byte("abc"))), values[2])
+
+	_, err = cutRowV2Columns(row[:8], columns, map[int64]int{1: 0})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid row v2")
+	// The 3 bytes value of column 3 read as the int column 1 has no valid length.
+	_, err = cutRowV2Columns(row, columns, map[int64]int{3: 0})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid row v2 int")
+}
+
+func encodeDatum(t *testing.T, d types.Datum) []byte {
+	b, err := codec.EncodeValue(nil, nil, d)
+	require.NoError(t, err)
+	return b
+}
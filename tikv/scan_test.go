@@ -0,0 +1,99 @@
+package tikv_test
+
+import (
+	"testing"
+
+	"github.com/ngaut/faketikv/testutil"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestScanRangeLocks(t *testing.T) {
+	c := newTableCluster(t)
+	keys := [][]byte{[]byte("t1"), []byte("t2"), []byte("t3")}
+	startTS := c.AllocTS()
+	prewrite(t, c, startTS, primaryKey, keys...)
+	// All the locks blocking the scan are returned in one response.
+	pairs := scan(t, c, &kvrpcpb.ScanRequest{StartKey: []byte("t"), Limit: 10})
+	require.Len(t, pairs, 3)
+	for i, pair := range pairs {
+		require.NotNil(t, pair.Error)
+		require.NotNil(t, pair.Error.Locked)
+		require.Equal(t, keys[i], pair.Error.Locked.Key)
+		require.Equal(t, startTS, pair.Error.Locked.LockVersion)
+	}
+	// The locks beyond the limit are not collected.
+	require.Len(t, scan(t, c, &kvrpcpb.ScanRequest{StartKey: []byte("t"), Limit: 2}), 2)
+}
+
+func TestScanPushesPrimaryLock(t *testing.T) {
+	c := newTableCluster(t)
+	primary, secondary := []byte("t1"), []byte("t2")
+	startTS := c.AllocTS()
+	prewrite(t, c, startTS, primary, primary, secondary)
+	commitTS, readTS := c.AllocTS(), c.AllocTS()
+	// The scan pushes the primary lock and skips it, only the secondary lock is returned.
+	pairs := scan(t, c, &kvrpcpb.ScanRequest{StartKey: []byte("t"), Limit: 10, Version: readTS})
+	require.Len(t, pairs, 1)
+	require.NotNil(t, pairs[0].Error)
+	require.Equal(t, secondary, pairs[0].Error.Locked.Key)
+	keyErr := commit(t, c, primary, startTS, commitTS)
+	require.NotNil(t, keyErr)
+	require.Equal(t, readTS+1, keyErr.CommitTsExpired.MinCommitTs)
+}
+
+func TestScanMemLimit(t *testing.T) {
+	c := newTableCluster(t)
+	for _, key := range [][]byte{[]byte("t1"), []byte("t2"), []byte("t3")} {
+		_, err := c.Put(key, key)
+		require.NoError(t, err)
+	}
+	require.Len(t, scan(t, c, &kvrpcpb.ScanRequest{StartKey: []byte("t"), Limit: 10}), 3)
+	c.Store.RequestMemLimit = 1 << 20
+	require.Len(t, scan(t, c, &kvrpcpb.ScanRequest{StartKey: []byte("t"), Limit: 10}), 3)
+
+	// The scan fails once its pairs exceed the limit instead of returning them.
+	c.Store.RequestMemLimit = 8
+	pairs := scan(t, c, &kvrpcpb.ScanRequest{StartKey: []byte("t"), Limit: 10})
+	require.Len(t, pairs, 1)
+	require.NotNil(t, pairs[0].Error)
+	require.Contains(t, pairs[0].Error.Abort, "memory limit")
+}
+
+func TestReverseScan(t *testing.T) {
+	c := newTableCluster(t)
+	keys := [][]byte{[]byte("t1"), []byte("t2"), []byte("t3")}
+	for _, key := range keys {
+		_, err := c.Put(key, key)
+		require.NoError(t, err)
+	}
+	// The range of a reverse scan is [EndKey, StartKey).
+	pairs := scan(t, c, &kvrpcpb.ScanRequest{StartKey: []byte("t3"), EndKey: []byte("t1"), Limit: 10, Reverse: true})
+	checkScanKeys(t, pairs, keys[1], keys[0])
+	pairs = scan(t, c, &kvrpcpb.ScanRequest{StartKey: []byte("u"), EndKey: []byte("t"), Limit: 2, Reverse: true})
+	checkScanKeys(t, pairs, keys[2], keys[1])
+	// An empty StartKey scans from the end of the region.
+	pairs = scan(t, c, &kvrpcpb.ScanRequest{EndKey: []byte("t2"), Limit: 10, Reverse: true})
+	checkScanKeys(t, pairs, keys[2], keys[1])
+}
+
+func checkScanKeys(t *testing.T, pairs []*kvrpcpb.KvPair, keys ...[]byte) {
+	require.Len(t, pairs, len(keys))
+	for i, pair := range pairs {
+		require.Nil(t, pair.Error)
+		require.Equal(t, keys[i], pair.Key)
+	}
+}
+
+// scan sends the KvScan to the region [t, u), at a new ts if the version is not set.
+func scan(t *testing.T, c *testutil.Cluster, req *kvrpcpb.ScanRequest) []*kvrpcpb.KvPair {
+	req.Context = regionCtx(t, c, []byte("t"))
+	if req.Version == 0 {
+		req.Version = c.AllocTS()
+	}
+	resp, err := c.Server.KvScan(context.Background(), req)
+	require.NoError(t, err)
+	require.Nil(t, resp.RegionError)
+	return resp.Pairs
+}
@@ -0,0 +1,88 @@
+package tikv_test
+
+import (
+	"testing"
+
+	"github.com/ngaut/faketikv/testutil"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestCheckSecondaryLocks(t *testing.T) {
+	c := newTestCluster(t)
+	k1, k2 := []byte("t1"), []byte("t2")
+	startTS := c.AllocTS()
+	prewrite(t, c, startTS, k1, k1, k2)
+	resp := checkSecondaryLocks(t, c, startTS, k1, k2)
+	require.Len(t, resp.Locks, 2)
+	require.Zero(t, resp.CommitTs)
+	checkLocked(t, get(t, c, k2, c.AllocTS()), startTS)
+
+	commitTS := c.AllocTS()
+	require.Nil(t, commit(t, c, k1, startTS, commitTS))
+	resp = checkSecondaryLocks(t, c, startTS, k1, k2)
+	require.Empty(t, resp.Locks)
+	require.Equal(t, commitTS, resp.CommitTs)
+	checkLocked(t, get(t, c, k2, c.AllocTS()), startTS)
+
+	// The check returns at the rolled back key, the locks after it are not checked.
+	k3, k4, missing := []byte("t3"), []byte("t4"), []byte("t5")
+	startTS = c.AllocTS()
+	prewrite(t, c, startTS, k3, k3, k4)
+	resp = checkSecondaryLocks(t, c, startTS, missing, k4)
+	require.Empty(t, resp.Locks)
+	require.Zero(t, resp.CommitTs)
+	checkLocked(t, get(t, c, k4, c.AllocTS()), startTS)
+	// The missing key is rolled back, its late prewrite fails.
+	require.NotEmpty(t, tryPrewrite(t, c, startTS, k3, missing))
+}
+
+func TestCheckSecondaryLocksUnderNewerLock(t *testing.T) {
+	c := newTestCluster(t)
+	primary, secondary := []byte("t1"), []byte("t2")
+	startTS := c.AllocTS()
+	prewrite(t, c, startTS, primary, primary)
+	newerTS := c.AllocTS()
+	prewrite(t, c, newerTS, secondary, secondary)
+	// The secondary locked by a newer transaction is reported as rolled back, and its rollback record is written.
+	resp := checkSecondaryLocks(t, c, startTS, secondary)
+	require.Empty(t, resp.Locks)
+	require.Zero(t, resp.CommitTs)
+	rollback(t, c, secondary, newerTS)
+	errs := tryPrewrite(t, c, startTS, primary, secondary)
+	require.Len(t, errs, 1)
+	require.Contains(t, errs[0].Retryable, "already rollback")
+}
+
+func TestPrewriteAsyncCommit(t *testing.T) {
+	c := newTestCluster(t)
+	key := []byte("t1")
+	for _, req := range []*kvrpcpb.PrewriteRequest{{UseAsyncCommit: true}, {TryOnePc: true}} {
+		req.Context = regionCtx(t, c, key)
+		req.Mutations = []*kvrpcpb.Mutation{{Op: kvrpcpb.Op_Put, Key: key, Value: key}}
+		req.PrimaryLock = key
+		req.StartVersion = c.AllocTS()
+		req.LockTtl = 3000
+		resp, err := c.Server.KvPrewrite(context.Background(), req)
+		require.NoError(t, err)
+		require.Len(t, resp.Errors, 1)
+		require.Contains(t, resp.Errors[0].Abort, "not supported")
+		// Nothing is locked, so the check finds no lock of the transaction and rolls the key back.
+		resp2 := checkSecondaryLocks(t, c, req.StartVersion, key)
+		require.Empty(t, resp2.Locks)
+		require.Zero(t, resp2.CommitTs)
+	}
+}
+
+func checkSecondaryLocks(t *testing.T, c *testutil.Cluster, startTS uint64, keys ...[]byte) *kvrpcpb.CheckSecondaryLocksResponse {
+	resp, err := c.Server.KvCheckSecondaryLocks(context.Background(), &kvrpcpb.CheckSecondaryLocksRequest{
+		Context:      regionCtx(t, c, keys[0]),
+		Keys:         keys,
+		StartVersion: startTS,
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp.RegionError)
+	require.Nil(t, resp.Error)
+	return resp
+}
@@ -6,13 +6,14 @@ import (
 	"time"
 
 	"github.com/juju/errors"
-	"github.com/ngaut/log"
 	"github.com/pingcap/kvproto/pkg/coprocessor"
 	"github.com/pingcap/kvproto/pkg/errorpb"
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
 	"github.com/pingcap/kvproto/pkg/tikvpb"
 	"github.com/pingcap/tidb/kv"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 )
 
 var _ tikvpb.TikvServer = new(Server)
@@ -23,6 +24,14 @@ type Server struct {
 	wg            sync.WaitGroup
 	refCount      int32
 	stopped       int32
+	// readOnly rejects all the write requests and serves reads at snapshotTS, for querying a backup.
+	readOnly   bool
+	snapshotTS uint64
+	apiVersion kvrpcpb.APIVersion
+	// gatewayInterceptor is the interceptor of the gRPC server applied to the gateway requests.
+	gatewayInterceptor grpc.UnaryServerInterceptor
+	// admission admits the stream requests, the unary requests are admitted by its interceptor.
+	admission *Admission
 }
 
 func NewServer(rm *RegionManager, store *MVCCStore) *Server {
@@ -32,6 +41,45 @@ func NewServer(rm *RegionManager, store *MVCCStore) *Server {
 	}
 }
 
+// SetReadOnly makes the server reject write requests and read at snapshotTS, a zero snapshotTS reads the
+// latest data. It must be called before serving.
+func (svr *Server) SetReadOnly(snapshotTS uint64) {
+	if snapshotTS == 0 {
+		snapshotTS = maxSystemTS
+	}
+	svr.readOnly = true
+	svr.snapshotTS = snapshotTS
+}
+
+// readTS limits the read ts to the snapshot ts in read-only mode.
+func (svr *Server) readTS(ts uint64) uint64 {
+	if svr.readOnly && ts > svr.snapshotTS {
+		return svr.snapshotTS
+	}
+	return ts
+}
+
+// writeMethods are the methods rejected in read-only mode.
+var writeMethods = map[string]bool{
+	"KvPrewrite":            true,
+	"KvCommit":              true,
+	"KvPessimisticLock":     true,
+	"KvPessimisticRollback": true,
+	"KvCleanup":             true,
+	"KvCheckTxnStatus":      true,
+	"KvCheckSecondaryLocks": true,
+	"KvBatchRollback":       true,
+	"KvResolveLock":         true,
+	"KvGC":                  true,
+	"KvDeleteRange":         true,
+	"RawPut":                true,
+	"RawDelete":             true,
+	"RawBatchPut":           true,
+	"RawBatchDelete":        true,
+	"RawDeleteRange":        true,
+	"RawCompareAndSwap":     true,
+}
+
 const requestMaxSize = 6 * 1024 * 1024
 
 func (svr *Server) checkRequestSize(size int) *errorpb.Error {
@@ -62,8 +110,13 @@ type requestCtx struct {
 	buf       []byte
 	reader    *DBReader
 	method    string
+	priority  kvrpcpb.CommandPri
 	startTime time.Time
 	traces    []traceItem
+	// readTS is the start ts of the coprocessor request.
+	readTS uint64
+	// memUsed is the bytes of the scan results, the locks and the coprocessor data held by the request.
+	memUsed int64
 }
 
 type traceItem struct {
@@ -88,6 +141,15 @@ func (ti traceItem) String() string {
 }
 
 func newRequestCtx(svr *Server, ctx *kvrpcpb.Context, method string) (*requestCtx, error) {
+	if svr.readOnly && writeMethods[method] {
+		return nil, ErrReadOnly
+	}
+	if err := svr.checkAPIVersion(ctx); err != nil {
+		return nil, err
+	}
+	if err := svr.checkClusterID(ctx); err != nil {
+		return nil, err
+	}
 	atomic.AddInt32(&svr.refCount, 1)
 	if atomic.LoadInt32(&svr.stopped) > 0 {
 		atomic.AddInt32(&svr.refCount, -1)
@@ -96,16 +158,19 @@ func newRequestCtx(svr *Server, ctx *kvrpcpb.Context, method string) (*requestCt
 	req := &requestCtx{
 		svr:       svr,
 		method:    method,
+		priority:  ctx.GetPriority(),
 		startTime: time.Now(),
 		traces:    make([]traceItem, 0, 16),
 	}
 	req.regCtx, req.regErr = svr.regionManager.getRegionFromCtx(ctx)
-	if req.regErr != nil {
-		return req, nil
-	}
 	return req, nil
 }
 
+// isHighPriority returns true if the request should be scheduled ahead of the normal ones on latches and write workers.
+func (req *requestCtx) isHighPriority() bool {
+	return req.priority == kvrpcpb.CommandPri_High
+}
+
 func (req *requestCtx) trace(event string) {
 	req.traces = append(req.traces, traceItem{
 		event:      event,
@@ -128,6 +193,23 @@ func (req *requestCtx) getDBReader() *DBReader {
 	return req.reader
 }
 
+// consumeMem accounts n bytes to the request, it returns ErrMemLimitExceeded if the request uses more than the
+// RequestMemLimit of the store, or the CopMemQuota for a coprocessor request.
+func (req *requestCtx) consumeMem(n int) error {
+	if req == nil || req.svr == nil {
+		return nil
+	}
+	limit := req.svr.mvccStore.RequestMemLimit
+	if quota := req.svr.mvccStore.CopMemQuota; quota > 0 && (req.method == "Coprocessor" || req.method == "BatchCoprocessor") {
+		limit = quota
+	}
+	req.memUsed += int64(n)
+	if limit > 0 && req.memUsed > limit {
+		return &ErrMemLimitExceeded{Method: req.method, Limit: limit}
+	}
+	return nil
+}
+
 var LogTraceMS uint = 300
 
 func (req *requestCtx) finish() {
@@ -154,23 +236,40 @@ func (svr *Server) KvGet(ctx context.Context, req *kvrpcpb.GetRequest) (*kvrpcpb
 	if reqCtx.regErr != nil {
 		return &kvrpcpb.GetResponse{RegionError: reqCtx.regErr}, nil
 	}
-	err = svr.mvccStore.CheckKeysLock(req.GetVersion(), req.Key)
-	if err != nil {
-		return &kvrpcpb.GetResponse{Error: convertToKeyError(err)}, nil
-	}
-	reader := reqCtx.getDBReader()
-	val, err := reader.Get(req.Key, req.GetVersion())
+	req.Version = svr.readTS(req.Version)
+	val, _, commitTS, err := svr.mvccStore.PointGet(reqCtx, req.Key, req.GetVersion())
 	if err != nil {
 		return &kvrpcpb.GetResponse{
 			Error: convertToKeyError(err),
 		}, nil
 	}
-	return &kvrpcpb.GetResponse{
+	reqCtx.regCtx.heat.addRead(1, len(req.Key)+len(val))
+	resp := &kvrpcpb.GetResponse{
 		Value: val,
-	}, nil
+	}
+	if req.NeedCommitTs {
+		resp.CommitTs = commitTS
+	}
+	return resp, nil
 }
 
+// ScanResumeHeader is the gRPC metadata key of the KvScan requests that accept the responses cut by
+// ScanMaxResponseBytes, the client must resume from the last key until a scan returns no pairs.
+const ScanResumeHeader = "unistore-scan-resume"
+
 func (svr *Server) KvScan(ctx context.Context, req *kvrpcpb.ScanRequest) (*kvrpcpb.ScanResponse, error) {
+	var maxBytes int
+	if md, ok := metadata.FromIncomingContext(ctx); ok && len(md[ScanResumeHeader]) > 0 {
+		maxBytes = int(svr.mvccStore.ScanMaxResponseBytes)
+	}
+	resp, _ := svr.scan(req, maxBytes)
+	return resp, nil
+}
+
+// scan serves the ScanRequest, the pairs are limited to maxBytes if it's positive. The resume key is returned if the
+// scan stopped at the limit or maxBytes in the region, it's the start key of the next forward scan or the end key
+// of the next reverse scan.
+func (svr *Server) scan(req *kvrpcpb.ScanRequest, maxBytes int) (resp *kvrpcpb.ScanResponse, resumeKey []byte) {
 	reqCtx, err := newRequestCtx(svr, req.Context, "KvScan")
 	if err != nil {
 		return &kvrpcpb.ScanResponse{Pairs: convertToPbPairs([]Pair{{Err: err}})}, nil
@@ -182,20 +281,56 @@ func (svr *Server) KvScan(ctx context.Context, req *kvrpcpb.ScanRequest) (*kvrpc
 	if !isMvccRegion(reqCtx.regCtx) {
 		return &kvrpcpb.ScanResponse{}, nil
 	}
-	startKey := req.GetStartKey()
-	endKey := reqCtx.regCtx.rawEndKey()
-	err = svr.mvccStore.CheckRangeLock(req.GetVersion(), startKey, endKey)
-	if err != nil {
-		return &kvrpcpb.ScanResponse{Pairs: convertToPbPairs([]Pair{{Err: err}})}, nil
+	startKey, endKey := req.GetStartKey(), req.GetEndKey()
+	if req.Reverse {
+		// The range of a reverse scan is [EndKey, StartKey).
+		startKey, endKey = endKey, startKey
+	}
+	if reqCtx.regCtx.lessThanStartKey(startKey) {
+		startKey = reqCtx.regCtx.startKey
+	}
+	if len(endKey) == 0 || reqCtx.regCtx.greaterThanEndKey(endKey) {
+		endKey = reqCtx.regCtx.endKey
+	}
+	req.Version = svr.readTS(req.Version)
+	lockErrs := svr.mvccStore.CollectRangeLocks(reqCtx, req.GetVersion(), startKey, endKey, int(req.GetLimit()))
+	if len(lockErrs) > 0 {
+		lockPairs := make([]Pair, 0, len(lockErrs))
+		for _, lockErr := range lockErrs {
+			lockPairs = append(lockPairs, Pair{Err: lockErr})
+		}
+		return &kvrpcpb.ScanResponse{Pairs: convertToPbPairs(lockPairs)}, nil
 	}
 	reader := reqCtx.getDBReader()
-	pairs := reader.Scan(startKey, endKey, int(req.GetLimit()), req.GetVersion())
+	var pairs []Pair
+	if req.Reverse {
+		pairs = reader.ReverseScan(startKey, endKey, int(req.GetLimit()), req.GetVersion(), req.KeyOnly, int(req.SampleStep), maxBytes)
+	} else {
+		pairs = reader.Scan(startKey, endKey, int(req.GetLimit()), req.GetVersion(), req.KeyOnly, int(req.SampleStep), maxBytes)
+	}
+	size := pairsSize(pairs)
+	reqCtx.regCtx.heat.addRead(len(pairs), size)
+	if n := len(pairs); n > 0 && pairs[n-1].Err == nil && (n >= int(req.GetLimit()) || (maxBytes > 0 && size >= maxBytes)) {
+		resumeKey = pairs[n-1].Key
+		if !req.Reverse {
+			resumeKey = append(safeCopy(resumeKey), 0)
+		}
+	}
 	return &kvrpcpb.ScanResponse{
 		Pairs: convertToPbPairs(pairs),
-	}, nil
+	}, resumeKey
 }
 
 func (svr *Server) KvPrewrite(ctx context.Context, req *kvrpcpb.PrewriteRequest) (*kvrpcpb.PrewriteResponse, error) {
+	// The async commit and 1PC prewrites fail like any other prewrite error, so the client falls back to 2PC. No async
+	// commit lock is ever written, KvCheckSecondaryLocks only serves the clients resolving locks by that protocol, and
+	// reports the ordinary locks it finds.
+	if req.UseAsyncCommit {
+		return &kvrpcpb.PrewriteResponse{Errors: convertToKeyErrors([]error{errors.New("async commit is not supported")})}, nil
+	}
+	if req.TryOnePc {
+		return &kvrpcpb.PrewriteResponse{Errors: convertToKeyErrors([]error{errors.New("1PC is not supported")})}, nil
+	}
 	reqCtx, err := newRequestCtx(svr, req.Context, "KvPrewrite")
 	if err != nil {
 		return &kvrpcpb.PrewriteResponse{Errors: convertToKeyErrors([]error{err})}, nil
@@ -204,7 +339,10 @@ func (svr *Server) KvPrewrite(ctx context.Context, req *kvrpcpb.PrewriteRequest)
 	if reqCtx.regErr != nil {
 		return &kvrpcpb.PrewriteResponse{RegionError: reqCtx.regErr}, nil
 	}
-	errs := svr.mvccStore.Prewrite(reqCtx, req.Mutations, req.PrimaryLock, req.GetStartVersion(), req.GetLockTtl())
+	if busy := svr.regionManager.checkWriteBudget(reqCtx.regCtx, mutationsSize(req.Mutations)); busy != nil {
+		return &kvrpcpb.PrewriteResponse{RegionError: busy}, nil
+	}
+	errs := svr.mvccStore.Prewrite(reqCtx, req)
 	return &kvrpcpb.PrewriteResponse{
 		Errors: convertToKeyErrors(errs),
 	}, nil
@@ -219,15 +357,106 @@ func (svr *Server) KvCommit(ctx context.Context, req *kvrpcpb.CommitRequest) (*k
 	if reqCtx.regErr != nil {
 		return &kvrpcpb.CommitResponse{RegionError: reqCtx.regErr}, nil
 	}
-	err = svr.mvccStore.Commit(reqCtx, req.Keys, req.GetStartVersion(), req.GetCommitVersion())
+	if svr.mvccStore.AsyncCommitSecondaries {
+		err = svr.commitPrimaryFirst(reqCtx, req)
+	} else {
+		err = svr.mvccStore.Commit(reqCtx, req.Keys, req.GetStartVersion(), req.GetCommitVersion())
+	}
 	return &kvrpcpb.CommitResponse{
 		Error: convertToKeyError(err),
 	}, nil
 }
 
+// commitPrimaryFirst commits the primary key and returns, the secondary keys in the request are committed
+// asynchronously. If the async commit fails, the secondary locks are resolved by the primary status later.
+func (svr *Server) commitPrimaryFirst(reqCtx *requestCtx, req *kvrpcpb.CommitRequest) error {
+	store := svr.mvccStore
+	primary, secondaries := store.splitPrimary(req.Keys, req.StartVersion)
+	if len(secondaries) == 0 {
+		return store.Commit(reqCtx, req.Keys, req.StartVersion, req.CommitVersion)
+	}
+	secCtx, err := newRequestCtx(svr, req.Context, "KvCommitSecondaries")
+	if err != nil {
+		return store.Commit(reqCtx, req.Keys, req.StartVersion, req.CommitVersion)
+	}
+	if secCtx.regErr != nil {
+		secCtx.finish()
+		return store.Commit(reqCtx, req.Keys, req.StartVersion, req.CommitVersion)
+	}
+	err = store.Commit(reqCtx, [][]byte{primary}, req.StartVersion, req.CommitVersion)
+	if err != nil {
+		secCtx.finish()
+		return err
+	}
+	go func() {
+		defer secCtx.finish()
+		err := store.Commit(secCtx, secondaries, req.StartVersion, req.CommitVersion)
+		if err != nil {
+			log.Warnf("async commit secondaries of txn %d failed: %v", req.StartVersion, err)
+		}
+	}()
+	return nil
+}
+
+func (svr *Server) KvPessimisticLock(ctx context.Context, req *kvrpcpb.PessimisticLockRequest) (*kvrpcpb.PessimisticLockResponse, error) {
+	reqCtx, err := newRequestCtx(svr, req.Context, "KvPessimisticLock")
+	if err != nil {
+		return &kvrpcpb.PessimisticLockResponse{Errors: convertToKeyErrors([]error{err})}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.PessimisticLockResponse{RegionError: reqCtx.regErr}, nil
+	}
+	store := svr.mvccStore
+	resp := &kvrpcpb.PessimisticLockResponse{}
+	deadline := clock.Now().Add(lockWaitTimeout(req.WaitTimeout))
+	for {
+		waiter, err := store.PessimisticLock(reqCtx, req, resp)
+		if waiter == nil {
+			resp.Errors = convertToKeyErrors([]error{err})
+			return resp, nil
+		}
+		// The latches are released, wait for the lock to be released and retry.
+		woken := store.lockWaiterManager.wait(waiter, deadline.Sub(clock.Now()))
+		store.DeadlockDetector.CleanUpWaitFor(waiter.startTS, waiter.lockTS, waiter.keyHash)
+		if !woken {
+			return &kvrpcpb.PessimisticLockResponse{Errors: convertToKeyErrors([]error{waiter.lockErr})}, nil
+		}
+	}
+}
+
+func (svr *Server) KVPessimisticRollback(ctx context.Context, req *kvrpcpb.PessimisticRollbackRequest) (*kvrpcpb.PessimisticRollbackResponse, error) {
+	reqCtx, err := newRequestCtx(svr, req.Context, "KvPessimisticRollback")
+	if err != nil {
+		return &kvrpcpb.PessimisticRollbackResponse{Errors: convertToKeyErrors([]error{err})}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.PessimisticRollbackResponse{RegionError: reqCtx.regErr}, nil
+	}
+	err = svr.mvccStore.PessimisticRollback(reqCtx, req.Keys, req.StartVersion, req.ForUpdateTs)
+	return &kvrpcpb.PessimisticRollbackResponse{Errors: convertToKeyErrors([]error{err})}, nil
+}
+
+func (svr *Server) KvCheckSecondaryLocks(ctx context.Context, req *kvrpcpb.CheckSecondaryLocksRequest) (*kvrpcpb.CheckSecondaryLocksResponse, error) {
+	reqCtx, err := newRequestCtx(svr, req.Context, "KvCheckSecondaryLocks")
+	if err != nil {
+		return &kvrpcpb.CheckSecondaryLocksResponse{Error: convertToKeyError(err)}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.CheckSecondaryLocksResponse{RegionError: reqCtx.regErr}, nil
+	}
+	locks, commitTS, err := svr.mvccStore.CheckSecondaryLocks(reqCtx, req.Keys, req.StartVersion)
+	return &kvrpcpb.CheckSecondaryLocksResponse{
+		Locks:    locks,
+		CommitTs: commitTS,
+		Error:    convertToKeyError(err),
+	}, nil
+}
+
 func (svr *Server) KvImport(context.Context, *kvrpcpb.ImportRequest) (*kvrpcpb.ImportResponse, error) {
-	// TODO
-	return &kvrpcpb.ImportResponse{}, nil
+	return nil, errUnimplemented("KvImport is not supported")
 }
 
 func (svr *Server) KvCleanup(ctx context.Context, req *kvrpcpb.CleanupRequest) (*kvrpcpb.CleanupResponse, error) {
@@ -250,6 +479,28 @@ func (svr *Server) KvCleanup(ctx context.Context, req *kvrpcpb.CleanupRequest) (
 	return resp, nil
 }
 
+func (svr *Server) KvCheckTxnStatus(ctx context.Context, req *kvrpcpb.CheckTxnStatusRequest) (*kvrpcpb.CheckTxnStatusResponse, error) {
+	reqCtx, err := newRequestCtx(svr, req.Context, "KvCheckTxnStatus")
+	if err != nil {
+		return &kvrpcpb.CheckTxnStatusResponse{Error: convertToKeyError(err)}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.CheckTxnStatusResponse{RegionError: reqCtx.regErr}, nil
+	}
+	status, err := svr.mvccStore.CheckTxnStatus(reqCtx, req.PrimaryKey, req.LockTs, req.CallerStartTs, req.CurrentTs,
+		req.RollbackIfNotExist)
+	if err != nil {
+		return &kvrpcpb.CheckTxnStatusResponse{Error: convertToKeyError(err)}, nil
+	}
+	return &kvrpcpb.CheckTxnStatusResponse{
+		LockTtl:       status.LockTTL,
+		CommitVersion: status.CommitTS,
+		Action:        status.Action,
+		LockInfo:      status.Lock,
+	}, nil
+}
+
 func (svr *Server) KvBatchGet(ctx context.Context, req *kvrpcpb.BatchGetRequest) (*kvrpcpb.BatchGetResponse, error) {
 	reqCtx, err := newRequestCtx(svr, req.Context, "KvBatchGet")
 	if err != nil {
@@ -259,13 +510,17 @@ func (svr *Server) KvBatchGet(ctx context.Context, req *kvrpcpb.BatchGetRequest)
 	if reqCtx.regErr != nil {
 		return &kvrpcpb.BatchGetResponse{RegionError: reqCtx.regErr}, nil
 	}
-	err = svr.mvccStore.CheckKeysLock(req.GetVersion(), req.Keys...)
-	if err != nil {
-		return &kvrpcpb.BatchGetResponse{Pairs: convertToPbPairs([]Pair{{Err: err}})}, nil
+	req.Version = svr.readTS(req.Version)
+	pairs := svr.mvccStore.BatchGet(reqCtx, req.Keys, req.GetVersion())
+	reqCtx.regCtx.heat.addRead(len(pairs), pairsSize(pairs))
+	pbPairs := convertToPbPairs(pairs)
+	if req.NeedCommitTs {
+		for i, pair := range pairs {
+			pbPairs[i].CommitTs = pair.CommitTS
+		}
 	}
-	pairs := reqCtx.getDBReader().BatchGet(req.Keys, req.GetVersion())
 	return &kvrpcpb.BatchGetResponse{
-		Pairs: convertToPbPairs(pairs),
+		Pairs: pbPairs,
 	}, nil
 }
 
@@ -316,13 +571,20 @@ func (svr *Server) KvResolveLock(ctx context.Context, req *kvrpcpb.ResolveLockRe
 	}
 	resp := &kvrpcpb.ResolveLockResponse{}
 	if len(req.TxnInfos) > 0 {
+		txnInfos := make(map[uint64]uint64, len(req.TxnInfos))
 		for _, txnInfo := range req.TxnInfos {
-			log.Debugf("kv resolve lock region:%d txn:%v", reqCtx.regCtx.meta.Id, txnInfo.Txn)
-			err := svr.mvccStore.ResolveLock(reqCtx, txnInfo.Txn, txnInfo.Status)
-			if err != nil {
-				resp.Error = convertToKeyError(err)
-				break
-			}
+			txnInfos[txnInfo.Txn] = txnInfo.Status
+		}
+		log.Debugf("kv batch resolve lock region:%d txns:%d", reqCtx.regCtx.meta.Id, len(txnInfos))
+		err := svr.mvccStore.BatchResolveLock(reqCtx, txnInfos)
+		if err != nil {
+			resp.Error = convertToKeyError(err)
+		}
+	} else if len(req.Keys) > 0 {
+		log.Debugf("kv resolve lock lite region:%d txn:%v keys:%d", reqCtx.regCtx.meta.Id, req.StartVersion, len(req.Keys))
+		err := svr.mvccStore.ResolveLockKeys(reqCtx, req.Keys, req.StartVersion, req.CommitVersion)
+		if err != nil {
+			resp.Error = convertToKeyError(err)
 		}
 	} else {
 		log.Debugf("kv resolve lock region:%d txn:%v", reqCtx.regCtx.meta.Id, req.StartVersion)
@@ -363,47 +625,260 @@ func (svr *Server) KvDeleteRange(ctx context.Context, req *kvrpcpb.DeleteRangeRe
 	if !isMvccRegion(reqCtx.regCtx) {
 		return &kvrpcpb.DeleteRangeResponse{}, nil
 	}
-	err = svr.mvccStore.DeleteRange(reqCtx, req.StartKey, req.EndKey)
+	logical := req.NotifyOnly || svr.mvccStore.LogicalDeleteRange
+	if !logical && svr.mvccStore.AsyncDeleteRange {
+		id := svr.mvccStore.StartDeleteRange(req.StartKey, req.EndKey)
+		log.Infof("delete range [%q, %q) started as task %d", req.StartKey, req.EndKey, id)
+		return &kvrpcpb.DeleteRangeResponse{}, nil
+	}
+	err = svr.mvccStore.DeleteRange(reqCtx, req.StartKey, req.EndKey, logical)
 	if err != nil {
 		log.Error(err)
 	}
 	return &kvrpcpb.DeleteRangeResponse{}, nil
 }
 
+func (svr *Server) UnsafeDestroyRange(ctx context.Context, req *kvrpcpb.UnsafeDestroyRangeRequest) (*kvrpcpb.UnsafeDestroyRangeResponse, error) {
+	if svr.readOnly {
+		return &kvrpcpb.UnsafeDestroyRangeResponse{Error: ErrReadOnly.Error()}, nil
+	}
+	err := svr.mvccStore.UnsafeDestroyRange(req.StartKey, req.EndKey)
+	if err != nil {
+		log.Error(err)
+		return &kvrpcpb.UnsafeDestroyRangeResponse{Error: err.Error()}, nil
+	}
+	return &kvrpcpb.UnsafeDestroyRangeResponse{}, nil
+}
+
+func (svr *Server) PhysicalScanLock(ctx context.Context, req *kvrpcpb.PhysicalScanLockRequest) (*kvrpcpb.PhysicalScanLockResponse, error) {
+	locks := svr.mvccStore.PhysicalScanLock(req.StartKey, req.MaxTs, int(req.Limit))
+	return &kvrpcpb.PhysicalScanLockResponse{Locks: locks}, nil
+}
+
+func (svr *Server) RegisterLockObserver(ctx context.Context, req *kvrpcpb.RegisterLockObserverRequest) (*kvrpcpb.RegisterLockObserverResponse, error) {
+	if err := svr.mvccStore.RegisterLockObserver(req.MaxTs); err != nil {
+		return &kvrpcpb.RegisterLockObserverResponse{Error: err.Error()}, nil
+	}
+	return &kvrpcpb.RegisterLockObserverResponse{}, nil
+}
+
+func (svr *Server) CheckLockObserver(ctx context.Context, req *kvrpcpb.CheckLockObserverRequest) (*kvrpcpb.CheckLockObserverResponse, error) {
+	locks, clean, err := svr.mvccStore.CheckLockObserver(req.MaxTs)
+	if err != nil {
+		return &kvrpcpb.CheckLockObserverResponse{Error: err.Error()}, nil
+	}
+	return &kvrpcpb.CheckLockObserverResponse{IsClean: clean, Locks: locks}, nil
+}
+
+func (svr *Server) RemoveLockObserver(ctx context.Context, req *kvrpcpb.RemoveLockObserverRequest) (*kvrpcpb.RemoveLockObserverResponse, error) {
+	if err := svr.mvccStore.RemoveLockObserver(req.MaxTs); err != nil {
+		return &kvrpcpb.RemoveLockObserverResponse{Error: err.Error()}, nil
+	}
+	return &kvrpcpb.RemoveLockObserverResponse{}, nil
+}
+
 // RawKV commands.
-func (svr *Server) RawGet(context.Context, *kvrpcpb.RawGetRequest) (*kvrpcpb.RawGetResponse, error) {
-	return &kvrpcpb.RawGetResponse{}, nil
+func (svr *Server) RawGet(ctx context.Context, req *kvrpcpb.RawGetRequest) (*kvrpcpb.RawGetResponse, error) {
+	reqCtx, err := newRequestCtx(svr, req.Context, "RawGet")
+	if err != nil {
+		return &kvrpcpb.RawGetResponse{Error: err.Error()}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.RawGetResponse{RegionError: reqCtx.regErr}, nil
+	}
+	val, err := svr.mvccStore.RawGet(req.Cf, req.Key)
+	if err != nil {
+		return &kvrpcpb.RawGetResponse{Error: err.Error()}, nil
+	}
+	return &kvrpcpb.RawGetResponse{Value: val, NotFound: val == nil}, nil
 }
 
-func (svr *Server) RawPut(context.Context, *kvrpcpb.RawPutRequest) (*kvrpcpb.RawPutResponse, error) {
+func (svr *Server) RawPut(ctx context.Context, req *kvrpcpb.RawPutRequest) (*kvrpcpb.RawPutResponse, error) {
+	reqCtx, err := newRequestCtx(svr, req.Context, "RawPut")
+	if err != nil {
+		return &kvrpcpb.RawPutResponse{Error: err.Error()}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.RawPutResponse{RegionError: reqCtx.regErr}, nil
+	}
+	if err = svr.mvccStore.RawPut(reqCtx, req.Cf, req.Key, req.Value, req.Ttl); err != nil {
+		return &kvrpcpb.RawPutResponse{Error: err.Error()}, nil
+	}
 	return &kvrpcpb.RawPutResponse{}, nil
 }
 
-func (svr *Server) RawDelete(context.Context, *kvrpcpb.RawDeleteRequest) (*kvrpcpb.RawDeleteResponse, error) {
+func (svr *Server) RawDelete(ctx context.Context, req *kvrpcpb.RawDeleteRequest) (*kvrpcpb.RawDeleteResponse, error) {
+	reqCtx, err := newRequestCtx(svr, req.Context, "RawDelete")
+	if err != nil {
+		return &kvrpcpb.RawDeleteResponse{Error: err.Error()}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.RawDeleteResponse{RegionError: reqCtx.regErr}, nil
+	}
+	if err = svr.mvccStore.RawDelete(reqCtx, req.Cf, req.Key); err != nil {
+		return &kvrpcpb.RawDeleteResponse{Error: err.Error()}, nil
+	}
 	return &kvrpcpb.RawDeleteResponse{}, nil
 }
 
-func (svr *Server) RawScan(context.Context, *kvrpcpb.RawScanRequest) (*kvrpcpb.RawScanResponse, error) {
-	return &kvrpcpb.RawScanResponse{}, nil
+func (svr *Server) RawCompareAndSwap(ctx context.Context, req *kvrpcpb.RawCASRequest) (*kvrpcpb.RawCASResponse, error) {
+	reqCtx, err := newRequestCtx(svr, req.Context, "RawCompareAndSwap")
+	if err != nil {
+		return &kvrpcpb.RawCASResponse{Error: err.Error()}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.RawCASResponse{RegionError: reqCtx.regErr}, nil
+	}
+	succeed, prev, err := svr.mvccStore.RawCompareAndSwap(reqCtx, req.Cf, req.Key, req.Value, req.PreviousValue,
+		req.PreviousNotExist, req.Ttl)
+	if err != nil {
+		return &kvrpcpb.RawCASResponse{Error: err.Error()}, nil
+	}
+	return &kvrpcpb.RawCASResponse{
+		Succeed:          succeed,
+		PreviousNotExist: prev == nil,
+		PreviousValue:    prev,
+	}, nil
 }
 
-func (svr *Server) RawBatchDelete(context.Context, *kvrpcpb.RawBatchDeleteRequest) (*kvrpcpb.RawBatchDeleteResponse, error) {
+func (svr *Server) RawScan(ctx context.Context, req *kvrpcpb.RawScanRequest) (*kvrpcpb.RawScanResponse, error) {
+	reqCtx, err := newRequestCtx(svr, req.Context, "RawScan")
+	if err != nil {
+		return &kvrpcpb.RawScanResponse{Kvs: []*kvrpcpb.KvPair{{Error: convertToKeyError(err)}}}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.RawScanResponse{RegionError: reqCtx.regErr}, nil
+	}
+	pairs, err := svr.mvccStore.RawScan(reqCtx, req.Cf, req.StartKey, req.EndKey, int(req.Limit), req.KeyOnly, req.Reverse)
+	if err != nil {
+		return &kvrpcpb.RawScanResponse{Kvs: []*kvrpcpb.KvPair{{Error: convertToKeyError(err)}}}, nil
+	}
+	return &kvrpcpb.RawScanResponse{Kvs: convertToPbPairs(pairs)}, nil
+}
+
+func (svr *Server) RawBatchDelete(ctx context.Context, req *kvrpcpb.RawBatchDeleteRequest) (*kvrpcpb.RawBatchDeleteResponse, error) {
+	reqCtx, err := newRequestCtx(svr, req.Context, "RawBatchDelete")
+	if err != nil {
+		return &kvrpcpb.RawBatchDeleteResponse{Error: err.Error()}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.RawBatchDeleteResponse{RegionError: reqCtx.regErr}, nil
+	}
+	if err = svr.mvccStore.RawBatchDelete(reqCtx, req.Cf, req.Keys); err != nil {
+		return &kvrpcpb.RawBatchDeleteResponse{Error: err.Error()}, nil
+	}
 	return &kvrpcpb.RawBatchDeleteResponse{}, nil
 }
 
-func (svr *Server) RawBatchGet(context.Context, *kvrpcpb.RawBatchGetRequest) (*kvrpcpb.RawBatchGetResponse, error) {
-	return &kvrpcpb.RawBatchGetResponse{}, nil
+func (svr *Server) RawBatchGet(ctx context.Context, req *kvrpcpb.RawBatchGetRequest) (*kvrpcpb.RawBatchGetResponse, error) {
+	reqCtx, err := newRequestCtx(svr, req.Context, "RawBatchGet")
+	if err != nil {
+		return &kvrpcpb.RawBatchGetResponse{Pairs: []*kvrpcpb.KvPair{{Error: convertToKeyError(err)}}}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.RawBatchGetResponse{RegionError: reqCtx.regErr}, nil
+	}
+	pairs, err := svr.mvccStore.RawBatchGet(req.Cf, req.Keys)
+	if err != nil {
+		return &kvrpcpb.RawBatchGetResponse{Pairs: []*kvrpcpb.KvPair{{Error: convertToKeyError(err)}}}, nil
+	}
+	return &kvrpcpb.RawBatchGetResponse{Pairs: convertToPbPairs(pairs)}, nil
 }
 
-func (svr *Server) RawBatchPut(context.Context, *kvrpcpb.RawBatchPutRequest) (*kvrpcpb.RawBatchPutResponse, error) {
+func (svr *Server) RawBatchPut(ctx context.Context, req *kvrpcpb.RawBatchPutRequest) (*kvrpcpb.RawBatchPutResponse, error) {
+	reqCtx, err := newRequestCtx(svr, req.Context, "RawBatchPut")
+	if err != nil {
+		return &kvrpcpb.RawBatchPutResponse{Error: err.Error()}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.RawBatchPutResponse{RegionError: reqCtx.regErr}, nil
+	}
+	ttls := req.Ttls
+	if len(ttls) == 0 && req.Ttl > 0 {
+		ttls = []uint64{req.Ttl}
+	}
+	keys := make([][]byte, 0, len(req.Pairs))
+	values := make([][]byte, 0, len(req.Pairs))
+	for _, pair := range req.Pairs {
+		keys = append(keys, pair.Key)
+		values = append(values, pair.Value)
+	}
+	if err = svr.mvccStore.RawBatchPut(reqCtx, req.Cf, keys, values, ttls); err != nil {
+		return &kvrpcpb.RawBatchPutResponse{Error: err.Error()}, nil
+	}
 	return &kvrpcpb.RawBatchPutResponse{}, nil
 }
 
-func (svr *Server) RawBatchScan(context.Context, *kvrpcpb.RawBatchScanRequest) (*kvrpcpb.RawBatchScanResponse, error) {
-	return &kvrpcpb.RawBatchScanResponse{}, nil
+func (svr *Server) RawChecksum(ctx context.Context, req *kvrpcpb.RawChecksumRequest) (*kvrpcpb.RawChecksumResponse, error) {
+	if req.Algorithm != kvrpcpb.ChecksumAlgorithm_Crc64_Xor {
+		return nil, errUnimplemented("RawChecksum: algorithm %s is not supported", req.Algorithm)
+	}
+	reqCtx, err := newRequestCtx(svr, req.Context, "RawChecksum")
+	if err != nil {
+		return &kvrpcpb.RawChecksumResponse{Error: err.Error()}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.RawChecksumResponse{RegionError: reqCtx.regErr}, nil
+	}
+	ranges := make([]KeyRange, 0, len(req.Ranges))
+	for _, r := range req.Ranges {
+		ranges = append(ranges, KeyRange{StartKey: r.StartKey, EndKey: r.EndKey})
+	}
+	checksum, totalKvs, totalBytes, err := svr.mvccStore.RawChecksum(rawDefaultCF, ranges)
+	if err != nil {
+		return &kvrpcpb.RawChecksumResponse{Error: err.Error()}, nil
+	}
+	return &kvrpcpb.RawChecksumResponse{
+		Checksum:   checksum,
+		TotalKvs:   totalKvs,
+		TotalBytes: totalBytes,
+	}, nil
+}
+
+func (svr *Server) RawBatchScan(ctx context.Context, req *kvrpcpb.RawBatchScanRequest) (*kvrpcpb.RawBatchScanResponse, error) {
+	reqCtx, err := newRequestCtx(svr, req.Context, "RawBatchScan")
+	if err != nil {
+		return &kvrpcpb.RawBatchScanResponse{Kvs: []*kvrpcpb.KvPair{{Error: convertToKeyError(err)}}}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.RawBatchScanResponse{RegionError: reqCtx.regErr}, nil
+	}
+	ranges := make([]KeyRange, 0, len(req.Ranges))
+	for _, r := range req.Ranges {
+		ranges = append(ranges, KeyRange{StartKey: r.StartKey, EndKey: r.EndKey})
+	}
+	pairs, err := svr.mvccStore.RawBatchScan(reqCtx, req.Cf, ranges, int(req.EachLimit), req.KeyOnly, req.Reverse)
+	if err != nil {
+		return &kvrpcpb.RawBatchScanResponse{Kvs: []*kvrpcpb.KvPair{{Error: convertToKeyError(err)}}}, nil
+	}
+	return &kvrpcpb.RawBatchScanResponse{Kvs: convertToPbPairs(pairs)}, nil
 }
 
-func (svr *Server) RawDeleteRange(context.Context, *kvrpcpb.RawDeleteRangeRequest) (*kvrpcpb.RawDeleteRangeResponse, error) {
+func (svr *Server) RawDeleteRange(ctx context.Context, req *kvrpcpb.RawDeleteRangeRequest) (*kvrpcpb.RawDeleteRangeResponse, error) {
+	reqCtx, err := newRequestCtx(svr, req.Context, "RawDeleteRange")
+	if err != nil {
+		return &kvrpcpb.RawDeleteRangeResponse{Error: err.Error()}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.RawDeleteRangeResponse{RegionError: reqCtx.regErr}, nil
+	}
+	if regErr := rangeNotInRegion(reqCtx.regCtx, req.StartKey, req.EndKey); regErr != nil {
+		return &kvrpcpb.RawDeleteRangeResponse{RegionError: regErr}, nil
+	}
+	if err = svr.mvccStore.RawDeleteRange(reqCtx, req.Cf, req.StartKey, req.EndKey); err != nil {
+		return &kvrpcpb.RawDeleteRangeResponse{Error: err.Error()}, nil
+	}
 	return &kvrpcpb.RawDeleteRangeResponse{}, nil
 }
 
@@ -419,41 +894,41 @@ func (svr *Server) Coprocessor(ctx context.Context, req *coprocessor.Request) (*
 	}
 	switch req.Tp {
 	case kv.ReqTypeDAG:
-		return svr.handleCopDAGRequest(reqCtx, req), nil
+		return svr.handleCopWithCache(reqCtx, req, func() (*coprocessor.Response, error) {
+			return svr.execDAGRequest(reqCtx, req)
+		}), nil
 	case kv.ReqTypeAnalyze:
 		return svr.handleCopAnalyzeRequest(reqCtx, req), nil
+	case kv.ReqTypeChecksum:
+		return svr.handleCopChecksumRequest(reqCtx, req), nil
 	}
-	return nil, errors.Errorf("unsupported request type %d", req.GetTp())
+	return nil, errUnimplemented("Coprocessor: request type %d is not supported", req.GetTp())
 }
 
 func (svr *Server) CoprocessorStream(*coprocessor.Request, tikvpb.Tikv_CoprocessorStreamServer) error {
-	// TODO
-	return nil
+	return errUnimplemented("CoprocessorStream is not supported")
 }
 
 // Raft commands (tikv <-> tikv).
 func (svr *Server) Raft(tikvpb.Tikv_RaftServer) error {
-	return nil
+	return errUnimplemented("Raft is not supported")
 }
 func (svr *Server) Snapshot(tikvpb.Tikv_SnapshotServer) error {
-	return nil
+	return errUnimplemented("Snapshot is not supported")
 }
 
 // Region commands.
 func (svr *Server) SplitRegion(ctx context.Context, req *kvrpcpb.SplitRegionRequest) (*kvrpcpb.SplitRegionResponse, error) {
-	// TODO
-	return &kvrpcpb.SplitRegionResponse{}, nil
+	return nil, errUnimplemented("SplitRegion is not supported")
 }
 
 // transaction debugger commands.
 func (svr *Server) MvccGetByKey(context.Context, *kvrpcpb.MvccGetByKeyRequest) (*kvrpcpb.MvccGetByKeyResponse, error) {
-	// TODO
-	return nil, nil
+	return nil, errUnimplemented("MvccGetByKey is not supported")
 }
 
 func (svr *Server) MvccGetByStartTs(context.Context, *kvrpcpb.MvccGetByStartTsRequest) (*kvrpcpb.MvccGetByStartTsResponse, error) {
-	// TODO
-	return nil, nil
+	return nil, errUnimplemented("MvccGetByStartTs is not supported")
 }
 
 func convertToKeyError(err error) *kvrpcpb.KeyError {
@@ -462,11 +937,40 @@ func convertToKeyError(err error) *kvrpcpb.KeyError {
 	}
 	if locked, ok := errors.Cause(err).(*ErrLocked); ok {
 		return &kvrpcpb.KeyError{
-			Locked: &kvrpcpb.LockInfo{
-				Key:         locked.Key,
-				PrimaryLock: locked.Primary,
-				LockVersion: locked.StartTS,
-				LockTtl:     locked.TTL,
+			Locked: locked.lockInfo(),
+		}
+	}
+	if exist, ok := errors.Cause(err).(*ErrKeyAlreadyExist); ok {
+		return &kvrpcpb.KeyError{
+			AlreadyExist: &kvrpcpb.AlreadyExist{
+				Key: exist.Key,
+			},
+		}
+	}
+	if expire, ok := errors.Cause(err).(*ErrCommitExpire); ok {
+		return &kvrpcpb.KeyError{
+			CommitTsExpired: &kvrpcpb.CommitTsExpired{
+				StartTs:           expire.StartTS,
+				AttemptedCommitTs: expire.CommitTS,
+				Key:               expire.Key,
+				MinCommitTs:       expire.MinCommitTS,
+			},
+		}
+	}
+	if notFound, ok := errors.Cause(err).(*ErrTxnNotFound); ok {
+		return &kvrpcpb.KeyError{
+			TxnNotFound: &kvrpcpb.TxnNotFound{
+				StartTs:    notFound.StartTS,
+				PrimaryKey: notFound.PrimaryKey,
+			},
+		}
+	}
+	if deadlock, ok := errors.Cause(err).(*ErrDeadlock); ok {
+		return &kvrpcpb.KeyError{
+			Deadlock: &kvrpcpb.Deadlock{
+				LockTs:          deadlock.LockTS,
+				LockKey:         deadlock.LockKey,
+				DeadlockKeyHash: deadlock.DeadlockKeyHash,
 			},
 		}
 	}
@@ -490,6 +994,14 @@ func convertToKeyErrors(errs []error) []*kvrpcpb.KeyError {
 	return keyErrors
 }
 
+func pairsSize(pairs []Pair) int {
+	var size int
+	for _, p := range pairs {
+		size += len(p.Key) + len(p.Value)
+	}
+	return size
+}
+
 func convertToPbPairs(pairs []Pair) []*kvrpcpb.KvPair {
 	kvPairs := make([]*kvrpcpb.KvPair, 0, len(pairs))
 	for _, p := range pairs {
@@ -501,6 +1013,7 @@ func convertToPbPairs(pairs []Pair) []*kvrpcpb.KvPair {
 			}
 		} else {
 			kvPair = &kvrpcpb.KvPair{
+				Key:   p.Key,
 				Error: convertToKeyError(p.Err),
 			}
 		}
@@ -514,5 +1027,5 @@ func isMvccRegion(regCtx *regionCtx) bool {
 		return false
 	}
 	first := regCtx.startKey[0]
-	return first == 't' || first == 'm'
+	return first == 't' || first == 'm' || first == apiV2TxnMode
 }
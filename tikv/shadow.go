@@ -0,0 +1,206 @@
+package tikv
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgryski/go-farm"
+	"github.com/golang/protobuf/proto"
+	"github.com/juju/errors"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/tidb/util/codec"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	shadowQueueSize     = 4096
+	shadowTimeout       = 5 * time.Second
+	shadowStatsInterval = time.Minute
+)
+
+// Shadow mirrors a sample of the write requests to another unistore asynchronously and counts the responses
+// different from the local ones, for validating a new version with real traffic.
+// The requests of a transaction are sampled together by the start ts, and are routed to the regions of the
+// shadow store by their first keys.
+type Shadow struct {
+	conn       *grpc.ClientConn
+	pdc        Client
+	authToken  string
+	sampleRate float64
+	reqCh      chan shadowRequest
+	closeCh    chan struct{}
+	wg         sync.WaitGroup
+
+	sent       int64
+	dropped    int64
+	failed     int64
+	mismatched int64
+}
+
+type shadowRequest struct {
+	method string
+	req    proto.Message
+	resp   proto.Message
+	key    []byte
+	ctx    *kvrpcpb.Context
+}
+
+// NewShadow creates a Shadow that mirrors sampleRate of the write requests to the unistore at storeAddr in the
+// cluster of pdAddr, the requests carry authToken if it's not empty.
+func NewShadow(storeAddr, pdAddr string, sampleRate float64, authToken string) (*Shadow, error) {
+	pdc, err := NewClient(pdAddr, "shadow")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	conn, err := grpc.Dial(storeAddr, grpc.WithInsecure())
+	if err != nil {
+		pdc.Close()
+		return nil, errors.Trace(err)
+	}
+	s := &Shadow{
+		conn:       conn,
+		pdc:        pdc,
+		authToken:  authToken,
+		sampleRate: sampleRate,
+		reqCh:      make(chan shadowRequest, shadowQueueSize),
+		closeCh:    make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.run()
+	return s, nil
+}
+
+// UnaryInterceptor returns the interceptor that queues the sampled write requests after they are handled locally,
+// the requests are dropped if the queue is full.
+func (s *Shadow) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		resp, err := handler(ctx, req)
+		method := info.FullMethod[strings.LastIndex(info.FullMethod, "/")+1:]
+		if err != nil || !writeMethods[method] {
+			return resp, err
+		}
+		key, startTS, reqCtx, ok := shadowRouting(req)
+		if !ok || reqCtx == nil || !s.sampled(startTS) {
+			return resp, err
+		}
+		shadowReq := shadowRequest{
+			method: info.FullMethod,
+			req:    req.(proto.Message),
+			resp:   resp.(proto.Message),
+			key:    key,
+			ctx:    reqCtx,
+		}
+		select {
+		case s.reqCh <- shadowReq:
+		default:
+			atomic.AddInt64(&s.dropped, 1)
+		}
+		return resp, err
+	}
+}
+
+func (s *Shadow) sampled(startTS uint64) bool {
+	var buf [8]byte
+	for i := range buf {
+		buf[i] = byte(startTS >> (8 * uint(i)))
+	}
+	return float64(farm.Fingerprint64(buf[:])%10000) < s.sampleRate*10000
+}
+
+// shadowRouting returns the key to locate the region, the start ts to sample and the context of the request.
+func shadowRouting(req interface{}) (key []byte, startTS uint64, ctx *kvrpcpb.Context, ok bool) {
+	switch r := req.(type) {
+	case *kvrpcpb.PrewriteRequest:
+		if len(r.Mutations) > 0 {
+			return r.Mutations[0].Key, r.StartVersion, r.Context, true
+		}
+	case *kvrpcpb.PessimisticLockRequest:
+		if len(r.Mutations) > 0 {
+			return r.Mutations[0].Key, r.StartVersion, r.Context, true
+		}
+	case *kvrpcpb.CommitRequest:
+		if len(r.Keys) > 0 {
+			return r.Keys[0], r.StartVersion, r.Context, true
+		}
+	case *kvrpcpb.PessimisticRollbackRequest:
+		if len(r.Keys) > 0 {
+			return r.Keys[0], r.StartVersion, r.Context, true
+		}
+	case *kvrpcpb.BatchRollbackRequest:
+		if len(r.Keys) > 0 {
+			return r.Keys[0], r.StartVersion, r.Context, true
+		}
+	case *kvrpcpb.CheckSecondaryLocksRequest:
+		if len(r.Keys) > 0 {
+			return r.Keys[0], r.StartVersion, r.Context, true
+		}
+	case *kvrpcpb.CleanupRequest:
+		return r.Key, r.StartVersion, r.Context, true
+	}
+	// The requests without a key such as ResolveLock and GC are not mirrored, the shadow store resolves the
+	// locks itself.
+	return nil, 0, nil, false
+}
+
+func (s *Shadow) run() {
+	defer s.wg.Done()
+	timer := clock.NewTimer(shadowStatsInterval)
+	defer func() { timer.Stop() }()
+	for {
+		select {
+		case <-s.closeCh:
+			return
+		case <-timer.C():
+			timer = clock.NewTimer(shadowStatsInterval)
+			log.Infof("shadow sent %d, dropped %d, failed %d, mismatched %d", atomic.LoadInt64(&s.sent),
+				atomic.LoadInt64(&s.dropped), atomic.LoadInt64(&s.failed), atomic.LoadInt64(&s.mismatched))
+		case req := <-s.reqCh:
+			if err := s.send(req); err != nil {
+				atomic.AddInt64(&s.failed, 1)
+				log.Debugf("shadow %s failed: %v", req.method, err)
+			}
+		}
+	}
+}
+
+func (s *Shadow) send(req shadowRequest) error {
+	ctx, cancel := context.WithTimeout(context.Background(), shadowTimeout)
+	defer cancel()
+	region, leader, err := s.pdc.GetRegion(ctx, codec.EncodeBytes(nil, req.key))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if region == nil || leader == nil {
+		return errors.Errorf("region of key %q not found", req.key)
+	}
+	// The local request context is kept, only the region is replaced.
+	req.ctx.RegionId = region.Id
+	req.ctx.RegionEpoch = region.RegionEpoch
+	req.ctx.Peer = leader
+	if s.authToken != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, AuthTokenHeader, s.authToken)
+	}
+	resp := reflect.New(reflect.TypeOf(req.resp).Elem()).Interface().(proto.Message)
+	if err = s.conn.Invoke(ctx, req.method, req.req, resp); err != nil {
+		return errors.Trace(err)
+	}
+	atomic.AddInt64(&s.sent, 1)
+	if !proto.Equal(req.resp, resp) {
+		atomic.AddInt64(&s.mismatched, 1)
+		log.Debugf("shadow %s mismatched, local %v, shadow %v", req.method, req.resp, resp)
+	}
+	return nil
+}
+
+// Close stops mirroring, the queued requests are discarded.
+func (s *Shadow) Close() {
+	close(s.closeCh)
+	s.wg.Wait()
+	s.conn.Close()
+	s.pdc.Close()
+}
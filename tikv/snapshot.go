@@ -0,0 +1,427 @@
+package tikv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/coocood/badger"
+	"github.com/juju/errors"
+)
+
+const (
+	snapshotDirName   = "snapshots"
+	snapshotDataExt   = ".snap"
+	snapshotMetaExt   = ".json"
+	snapshotTmpSuffix = ".tmp"
+)
+
+// SnapshotRetention limits the snapshots kept in the data directory, zero values mean no limit.
+type SnapshotRetention struct {
+	MaxAge   time.Duration
+	MaxCount int
+}
+
+// KeyRange is a [StartKey, EndKey) range, an empty EndKey means unbounded.
+type KeyRange struct {
+	StartKey []byte `json:"start_key"`
+	EndKey   []byte `json:"end_key"`
+}
+
+// SnapshotMeta describes a snapshot created by CreateSnapshot.
+type SnapshotMeta struct {
+	Name       string     `json:"name"`
+	TS         uint64     `json:"ts"`
+	Size       int64      `json:"size"`
+	Keys       int64      `json:"keys"`
+	Ranges     []KeyRange `json:"ranges"`
+	CreateTime time.Time  `json:"create_time"`
+}
+
+func (store *MVCCStore) snapshotDir() string {
+	return filepath.Join(store.dir, snapshotDirName)
+}
+
+// CreateSnapshot dumps the latest and old versions of the ranges to a file in the snapshot directory, the whole
+// user key space is dumped if no range is given. The locks are not included. Old snapshots are deleted by the
+// SnapshotRetention afterwards.
+func (store *MVCCStore) CreateSnapshot(ranges []KeyRange) (*SnapshotMeta, error) {
+	dir := store.snapshotDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Trace(err)
+	}
+	meta := &SnapshotMeta{
+		TS:         store.getLatestTS(),
+		Ranges:     ranges,
+		CreateTime: clock.Now(),
+	}
+	meta.Name = strconv.FormatInt(meta.CreateTime.UnixNano(), 10)
+	scanRanges := snapshotScanRanges(ranges)
+	dataFile := filepath.Join(dir, meta.Name+snapshotDataExt)
+	f, err := os.OpenFile(dataFile+snapshotTmpSuffix, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+	writer := bufio.NewWriter(f)
+	hdrBuf := make([]byte, 8)
+	hdr := (*lockEntryHdr)(unsafe.Pointer(&hdrBuf[0]))
+	dump := func(item *badger.Item) error {
+		val, err := item.Value()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		hdr.keyLen = uint32(len(item.Key()))
+		hdr.valLen = uint32(len(val))
+		if err = writeSnapshotEntry(writer, hdrBuf, item.Key(), val); err != nil {
+			return err
+		}
+		meta.Keys++
+		return nil
+	}
+	err = store.db.View(func(txn *badger.Txn) error {
+		it := newIterator(txn, false)
+		defer it.Close()
+		oldIt := newIterator(txn, false)
+		defer oldIt.Close()
+		for _, r := range scanRanges {
+			for it.Seek(r.StartKey); it.Valid(); it.Next() {
+				item := it.Item()
+				if exceedEndKey(item.Key(), r.EndKey) {
+					break
+				}
+				if bytes.HasPrefix(item.Key(), InternalKeyPrefix) {
+					continue
+				}
+				if err := dump(item); err != nil {
+					return err
+				}
+				if err := iterateInternalOldKeys(oldIt, item.Key(), dump); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err = writer.Flush(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err = f.Sync(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	meta.Size = info.Size()
+	if err = os.Rename(dataFile+snapshotTmpSuffix, dataFile); err != nil {
+		return nil, errors.Trace(err)
+	}
+	metaData, err := json.Marshal(meta)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// The meta file is written last, a snapshot without it is incomplete and ignored.
+	if err = ioutil.WriteFile(filepath.Join(dir, meta.Name+snapshotMetaExt), metaData, 0666); err != nil {
+		return nil, errors.Trace(err)
+	}
+	log.Infof("created snapshot %s at ts %d, %d keys %d bytes", meta.Name, meta.TS, meta.Keys, meta.Size)
+	if err = store.enforceSnapshotRetention(); err != nil {
+		log.Error(err)
+	}
+	return meta, nil
+}
+
+func writeSnapshotEntry(writer *bufio.Writer, hdrBuf, key, val []byte) error {
+	for _, b := range [][]byte{hdrBuf, key, val} {
+		if _, err := writer.Write(b); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// snapshotScanRanges returns the ranges of both the latest keys and the old keys of the ranges. The old keys are
+// in the same key space, so the ranges are merged to scan every key once, e.g. the old range of an empty start key
+// starts in the latest range.
+func snapshotScanRanges(ranges []KeyRange) []KeyRange {
+	if len(ranges) == 0 {
+		return []KeyRange{{}}
+	}
+	scanRanges := make([]KeyRange, 0, len(ranges)*2)
+	for _, r := range ranges {
+		scanRanges = append(scanRanges, r)
+		oldRange := KeyRange{StartKey: encodeOldKey(r.StartKey, maxSystemTS)}
+		if len(r.EndKey) > 0 {
+			oldRange.EndKey = encodeOldKey(r.EndKey, maxSystemTS)
+		}
+		scanRanges = append(scanRanges, oldRange)
+	}
+	return mergeKeyRanges(scanRanges)
+}
+
+// iterateInternalOldKeys calls fn on the old versions of the key if they have the internal key prefix, which are
+// the old versions of the keys starting with the byte before it. The scans skipping the internal keys reach them
+// from the latest key instead.
+func iterateInternalOldKeys(oldIt *badger.Iterator, key []byte, fn func(item *badger.Item) error) error {
+	if len(key) == 0 || key[0]+1 != InternalKeyPrefix[0] {
+		return nil
+	}
+	seekKey := encodeOldKey(key, maxSystemTS)
+	prefix := seekKey[:len(key)]
+	for oldIt.Seek(seekKey); oldIt.ValidForPrefix(prefix); oldIt.Next() {
+		if len(oldIt.Item().Key()) != len(seekKey) {
+			// The old key of a longer key with the same prefix.
+			continue
+		}
+		if err := fn(oldIt.Item()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeKeyRanges sorts the ranges and merges the overlapping ones.
+func mergeKeyRanges(ranges []KeyRange) []KeyRange {
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].StartKey, ranges[j].StartKey) < 0
+	})
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if exceedEndKey(r.StartKey, last.EndKey) && !bytes.Equal(r.StartKey, last.EndKey) {
+			merged = append(merged, r)
+			continue
+		}
+		if len(last.EndKey) > 0 && (len(r.EndKey) == 0 || bytes.Compare(r.EndKey, last.EndKey) > 0) {
+			last.EndKey = r.EndKey
+		}
+	}
+	return merged
+}
+
+// RestoreSnapshot replaces the data of the ranges of the snapshot with the snapshot, the whole user key space if
+// the snapshot has no range. The range tombstones after the snapshot are removed from the ranges. The new prewrites in
+// the ranges are frozen during the restore, and it fails if any key in the ranges is locked. The reads of the ranges
+// may see the data partially restored.
+func (store *MVCCStore) RestoreSnapshot(name string) error {
+	if name == "" || strings.ContainsAny(name, `/\`) {
+		return errors.Errorf("invalid snapshot name %q", name)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(store.snapshotDir(), name+snapshotMetaExt))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	meta := new(SnapshotMeta)
+	if err = json.Unmarshal(data, meta); err != nil {
+		return errors.Trace(err)
+	}
+	f, err := os.Open(filepath.Join(store.snapshotDir(), name+snapshotDataExt))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+	ranges := meta.Ranges
+	if len(ranges) == 0 {
+		ranges = []KeyRange{{}}
+	}
+	for _, r := range ranges {
+		id := store.FreezeRange(r.StartKey, r.EndKey, 0)
+		defer store.UnfreezeRange(id)
+	}
+	if err = store.checkRangeLocks(ranges); err != nil {
+		return err
+	}
+	if err = store.deleteSnapshotRanges(snapshotScanRanges(meta.Ranges)); err != nil {
+		return err
+	}
+	for _, r := range ranges {
+		if err = store.trimRangeTombstonesAfter(r.StartKey, r.EndKey, meta.TS); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	reqCtx := new(requestCtx)
+	reader := bufio.NewReader(f)
+	hdrBuf := make([]byte, 8)
+	hdr := (*lockEntryHdr)(unsafe.Pointer(&hdrBuf[0]))
+	var keys int64
+	dbBatch := newWriteDBBatch(reqCtx)
+	for {
+		if _, err = io.ReadFull(reader, hdrBuf); err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Trace(err)
+		}
+		entry := make([]byte, hdr.keyLen+hdr.valLen)
+		if _, err = io.ReadFull(reader, entry); err != nil {
+			return errors.Trace(err)
+		}
+		dbBatch.set(entry[:hdr.keyLen], entry[hdr.keyLen:])
+		keys++
+		if len(dbBatch.entries) == delRangeBatchSize {
+			if err = store.writeDB(dbBatch); err != nil {
+				return errors.Trace(err)
+			}
+			dbBatch = newWriteDBBatch(reqCtx)
+		}
+	}
+	if len(dbBatch.entries) > 0 {
+		if err = store.writeDB(dbBatch); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if keys != meta.Keys {
+		return errors.Errorf("snapshot %s has %d keys, %d expected", name, keys, meta.Keys)
+	}
+	store.updateLatestTS(meta.TS)
+	store.updateMaxCommitTS(nil, meta.TS)
+	log.Infof("restored snapshot %s at ts %d, %d keys", name, meta.TS, keys)
+	return nil
+}
+
+// checkRangeLocks returns the first lock in the ranges as the error.
+func (store *MVCCStore) checkRangeLocks(ranges []KeyRange) error {
+	it := store.lockStore.NewIterator()
+	for _, r := range ranges {
+		if it.Seek(r.StartKey); it.Valid() && !exceedEndKey(it.Key(), r.EndKey) {
+			lock := decodeLock(it.Value())
+			return newErrLocked(safeCopy(it.Key()), &lock)
+		}
+	}
+	return nil
+}
+
+// deleteSnapshotRanges deletes the user keys in the scan ranges.
+func (store *MVCCStore) deleteSnapshotRanges(scanRanges []KeyRange) error {
+	reqCtx := new(requestCtx)
+	for _, r := range scanRanges {
+		startKey := r.StartKey
+		for {
+			var keys [][]byte
+			err := store.db.View(func(txn *badger.Txn) error {
+				it := newIterator(txn, false)
+				defer it.Close()
+				oldIt := newIterator(txn, false)
+				defer oldIt.Close()
+				for it.Seek(startKey); it.Valid() && len(keys) < delRangeBatchSize; it.Next() {
+					key := it.Item().Key()
+					if exceedEndKey(key, r.EndKey) {
+						break
+					}
+					startKey = append(safeCopy(key), 0)
+					if bytes.HasPrefix(key, InternalKeyPrefix) {
+						continue
+					}
+					keys = append(keys, safeCopy(key))
+					err := iterateInternalOldKeys(oldIt, key, func(item *badger.Item) error {
+						keys = append(keys, item.KeyCopy(nil))
+						return nil
+					})
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if len(keys) == 0 {
+				break
+			}
+			dbBatch := newWriteDBBatch(reqCtx)
+			for _, key := range keys {
+				dbBatch.delete(key)
+			}
+			if err = store.writeDB(dbBatch); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+	return nil
+}
+
+// Snapshots returns the snapshots in the snapshot directory sorted by create time.
+func (store *MVCCStore) Snapshots() ([]*SnapshotMeta, error) {
+	files, err := ioutil.ReadDir(store.snapshotDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var metas []*SnapshotMeta
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), snapshotMetaExt) {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(store.snapshotDir(), file.Name()))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		meta := new(SnapshotMeta)
+		if err = json.Unmarshal(data, meta); err != nil {
+			log.Errorf("invalid snapshot meta %s: %v", file.Name(), err)
+			continue
+		}
+		metas = append(metas, meta)
+	}
+	sort.Slice(metas, func(i, j int) bool {
+		return metas[i].CreateTime.Before(metas[j].CreateTime)
+	})
+	return metas, nil
+}
+
+// DeleteSnapshot deletes the snapshot by name.
+func (store *MVCCStore) DeleteSnapshot(name string) error {
+	if name == "" || strings.ContainsAny(name, `/\`) {
+		return errors.Errorf("invalid snapshot name %q", name)
+	}
+	metaFile := filepath.Join(store.snapshotDir(), name+snapshotMetaExt)
+	// The meta file is deleted first so a partially deleted snapshot is not listed.
+	if err := os.Remove(metaFile); err != nil {
+		return errors.Trace(err)
+	}
+	err := os.Remove(filepath.Join(store.snapshotDir(), name+snapshotDataExt))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// enforceSnapshotRetention deletes the snapshots older than MaxAge and the oldest ones exceeding MaxCount.
+func (store *MVCCStore) enforceSnapshotRetention() error {
+	retention := store.SnapshotRetention
+	if retention.MaxAge == 0 && retention.MaxCount == 0 {
+		return nil
+	}
+	metas, err := store.Snapshots()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	now := clock.Now()
+	for i, meta := range metas {
+		expired := retention.MaxAge > 0 && now.Sub(meta.CreateTime) > retention.MaxAge
+		exceeded := retention.MaxCount > 0 && len(metas)-i > retention.MaxCount
+		if !expired && !exceeded {
+			continue
+		}
+		if err = store.DeleteSnapshot(meta.Name); err != nil {
+			return errors.Trace(err)
+		}
+		log.Infof("deleted snapshot %s created at %v", meta.Name, meta.CreateTime)
+	}
+	return nil
+}
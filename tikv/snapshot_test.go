@@ -0,0 +1,95 @@
+package tikv_test
+
+import (
+	"testing"
+
+	"github.com/ngaut/faketikv/tikv"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestRestoreSnapshot(t *testing.T) {
+	checkRestoreSnapshot(t, nil)
+	checkRestoreSnapshot(t, []tikv.KeyRange{{StartKey: []byte("t"), EndKey: []byte("u")}})
+	// The old range of the empty start key starts in the range of the latest keys.
+	checkRestoreSnapshot(t, []tikv.KeyRange{{EndKey: []byte("u")}})
+}
+
+func TestSnapshotOldVersionsUnderInternalPrefix(t *testing.T) {
+	c := newTestCluster(t)
+	// The old keys of h1 have the internal key prefix.
+	oldTS, err := c.Put([]byte("h1"), []byte("v0"))
+	require.NoError(t, err)
+	_, err = c.Put([]byte("h1"), []byte("v1"))
+	require.NoError(t, err)
+	meta, err := c.Store.CreateSnapshot(nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), meta.Keys)
+
+	_, err = c.Put([]byte("h1"), []byte("v2"))
+	require.NoError(t, err)
+	require.NoError(t, c.Store.RestoreSnapshot(meta.Name))
+	val, err := c.Get([]byte("h1"), c.AllocTS())
+	require.NoError(t, err)
+	require.Equal(t, []byte("v1"), val)
+	val, err = c.Get([]byte("h1"), oldTS)
+	require.NoError(t, err)
+	require.Equal(t, []byte("v0"), val)
+}
+
+func TestRestoreSnapshotAfterDeleteRange(t *testing.T) {
+	c := newTableCluster(t)
+	_, err := c.Put([]byte("t1"), []byte("v1"))
+	require.NoError(t, err)
+	meta, err := c.Store.CreateSnapshot([]tikv.KeyRange{{StartKey: []byte("t"), EndKey: []byte("u")}})
+	require.NoError(t, err)
+	// The delete ts is after the snapshot.
+	_, err = c.Put([]byte("t2"), []byte("v2"))
+	require.NoError(t, err)
+	resp, err := c.Server.KvDeleteRange(context.Background(), &kvrpcpb.DeleteRangeRequest{
+		Context:    regionCtx(t, c, []byte("t1")),
+		StartKey:   []byte("t"),
+		EndKey:     []byte("u"),
+		NotifyOnly: true,
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp.RegionError)
+	require.Empty(t, resp.Error)
+
+	require.NoError(t, c.Store.RestoreSnapshot(meta.Name))
+	val, err := c.Get([]byte("t1"), c.AllocTS())
+	require.NoError(t, err)
+	require.Equal(t, []byte("v1"), val)
+}
+
+// checkRestoreSnapshot snapshots the ranges of a new cluster, which must contain t1 and t2, and checks the writes after
+// the snapshot are discarded by the restore.
+func checkRestoreSnapshot(t *testing.T, ranges []tikv.KeyRange) {
+	c := newTestCluster(t)
+	oldTS, err := c.Put([]byte("t1"), []byte("v0"))
+	require.NoError(t, err)
+	_, err = c.Put([]byte("t1"), []byte("v1"))
+	require.NoError(t, err)
+	meta, err := c.Store.CreateSnapshot(ranges)
+	require.NoError(t, err)
+	// The latest and the old version of t1.
+	require.Equal(t, int64(2), meta.Keys)
+
+	_, err = c.Put([]byte("t1"), []byte("v2"))
+	require.NoError(t, err)
+	_, err = c.Put([]byte("t2"), []byte("v2"))
+	require.NoError(t, err)
+	require.NoError(t, c.Store.RestoreSnapshot(meta.Name))
+
+	ts := c.AllocTS()
+	val, err := c.Get([]byte("t1"), ts)
+	require.NoError(t, err)
+	require.Equal(t, []byte("v1"), val)
+	val, err = c.Get([]byte("t1"), oldTS)
+	require.NoError(t, err)
+	require.Equal(t, []byte("v0"), val)
+	val, err = c.Get([]byte("t2"), ts)
+	require.NoError(t, err)
+	require.Nil(t, val)
+}
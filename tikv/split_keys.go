@@ -0,0 +1,85 @@
+package tikv
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/coocood/badger/y"
+)
+
+// SuggestSplitKeys returns at most n-1 keys that split [startKey, endKey) into n parts of similar size.
+// The badger table boundaries are used if there are enough tables in the range, otherwise the keys are
+// sampled by scanning the range.
+func (store *MVCCStore) SuggestSplitKeys(startKey, endKey []byte, n int) ([][]byte, error) {
+	if n <= 1 {
+		return nil, nil
+	}
+	var boundaries [][]byte
+	for _, tbl := range store.db.Tables() {
+		left := y.ParseKey(tbl.Left)
+		if bytes.Compare(left, startKey) <= 0 || exceedEndKey(left, endKey) {
+			continue
+		}
+		boundaries = append(boundaries, safeCopy(left))
+	}
+	sort.Slice(boundaries, func(i, j int) bool {
+		return bytes.Compare(boundaries[i], boundaries[j]) < 0
+	})
+	boundaries = dedupKeys(boundaries)
+	if len(boundaries) >= n-1 {
+		return pickEvenly(boundaries, n), nil
+	}
+	return store.sampleSplitKeys(startKey, endKey, n)
+}
+
+func (store *MVCCStore) sampleSplitKeys(startKey, endKey []byte, n int) ([][]byte, error) {
+	reader := store.NewDBReader(new(requestCtx))
+	defer reader.Close()
+	s := newSampler()
+	iter := reader.getIter()
+	for iter.Seek(startKey); iter.Valid(); iter.Next() {
+		item := iter.Item()
+		if exceedEndKey(item.Key(), endKey) {
+			break
+		}
+		s.scanKey(item.Key(), item.EstimatedSize())
+	}
+	step := s.totalSize / int64(n)
+	if s.length == 0 || step == 0 {
+		return nil, nil
+	}
+	splitKeys := make([][]byte, 0, n-1)
+	target := step
+	for _, sample := range s.samples[:s.length] {
+		if len(splitKeys) == n-1 {
+			break
+		}
+		if sample.leftSize >= target && bytes.Compare(sample.key, startKey) > 0 {
+			splitKeys = append(splitKeys, safeCopy(sample.key))
+			target += step
+		}
+	}
+	return dedupKeys(splitKeys), nil
+}
+
+// pickEvenly picks n-1 keys evenly from the sorted keys.
+func pickEvenly(keys [][]byte, n int) [][]byte {
+	picked := make([][]byte, 0, n-1)
+	for i := 1; i < n; i++ {
+		picked = append(picked, keys[i*len(keys)/n])
+	}
+	return dedupKeys(picked)
+}
+
+func dedupKeys(sortedKeys [][]byte) [][]byte {
+	if len(sortedKeys) == 0 {
+		return sortedKeys
+	}
+	deduped := sortedKeys[:1]
+	for _, key := range sortedKeys[1:] {
+		if !bytes.Equal(key, deduped[len(deduped)-1]) {
+			deduped = append(deduped, key)
+		}
+	}
+	return deduped
+}
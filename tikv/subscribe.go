@@ -0,0 +1,285 @@
+package tikv
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+
+	"github.com/coocood/badger"
+	"github.com/juju/errors"
+)
+
+// ErrSubscriptionTooSlow is returned by Subscription.Err when the subscription is closed because its subscriber
+// doesn't receive the entries in time.
+var ErrSubscriptionTooSlow = errors.New("subscription is too slow")
+
+// maxPendingEntries is the max number of live entries buffered during the replay of a subscription.
+const maxPendingEntries = 64 << 10
+
+// CommittedEntry is a committed write delivered to the subscribers, an empty Value means the key is deleted.
+type CommittedEntry struct {
+	Key      []byte
+	Value    []byte
+	StartTS  uint64
+	CommitTS uint64
+}
+
+// Subscription receives the committed entries of a key range.
+type Subscription struct {
+	store    *MVCCStore
+	startKey []byte
+	endKey   []byte
+	ch       chan CommittedEntry
+	closeCh  chan struct{}
+	once     sync.Once
+	err      error
+
+	mu sync.Mutex
+	// The live entries are buffered in pending until the entries before the subscription are replayed.
+	replaying bool
+	pending   []CommittedEntry
+}
+
+type subscriptions struct {
+	mu   sync.RWMutex
+	cnt  int32
+	subs map[*Subscription]struct{}
+
+	// The publications are delivered in the order of their tickets, which are taken with the latches of the keys
+	// held, so the entries of a key are delivered in commit order after the latches are released.
+	ticketMu   sync.Mutex
+	ticketCond *sync.Cond
+	nextTicket uint64
+	doneTicket uint64
+}
+
+// Subscribe subscribes the entries committed in [startKey, endKey), an empty endKey means unbounded.
+// If fromTS is not zero, the entries committed after fromTS that are still in the store are replayed first, the
+// entries committed around the subscription may be delivered twice. The entries of a key are delivered in commit
+// order, while the entries of different keys are not ordered.
+// The commits never wait for the subscriber, the subscription is closed with ErrSubscriptionTooSlow when its
+// buffer of size bufSize is full, or when more than maxPendingEntries live entries are buffered during the replay.
+func (store *MVCCStore) Subscribe(startKey, endKey []byte, fromTS uint64, bufSize int) *Subscription {
+	sub := &Subscription{
+		store:     store,
+		startKey:  safeCopy(startKey),
+		endKey:    safeCopy(endKey),
+		ch:        make(chan CommittedEntry, bufSize),
+		closeCh:   make(chan struct{}),
+		replaying: fromTS > 0,
+	}
+	subs := &store.subscriptions
+	subs.mu.Lock()
+	if subs.subs == nil {
+		subs.subs = make(map[*Subscription]struct{})
+	}
+	subs.subs[sub] = struct{}{}
+	atomic.AddInt32(&subs.cnt, 1)
+	subs.mu.Unlock()
+	if fromTS > 0 {
+		go sub.replay(fromTS)
+	}
+	return sub
+}
+
+// Entries returns the channel of the committed entries, it is never closed.
+func (sub *Subscription) Entries() <-chan CommittedEntry {
+	return sub.ch
+}
+
+// Done returns a channel that is closed when the subscription is closed.
+func (sub *Subscription) Done() <-chan struct{} {
+	return sub.closeCh
+}
+
+// Err returns ErrSubscriptionTooSlow if the subscription is closed because the subscriber is too slow, it must be
+// called after Done is closed.
+func (sub *Subscription) Err() error {
+	return sub.err
+}
+
+// Close cancels the subscription.
+func (sub *Subscription) Close() {
+	sub.close(nil)
+}
+
+func (sub *Subscription) close(err error) {
+	sub.once.Do(func() {
+		sub.err = err
+		subs := &sub.store.subscriptions
+		subs.mu.Lock()
+		delete(subs.subs, sub)
+		atomic.AddInt32(&subs.cnt, -1)
+		subs.mu.Unlock()
+		close(sub.closeCh)
+	})
+}
+
+func (sub *Subscription) contains(key []byte) bool {
+	return bytes.Compare(key, sub.startKey) >= 0 && !exceedEndKey(key, sub.endKey)
+}
+
+// send returns false if the subscription or the store is closed.
+func (sub *Subscription) send(entry CommittedEntry) bool {
+	select {
+	case sub.ch <- entry:
+		return true
+	case <-sub.closeCh:
+	case <-sub.store.closeCh:
+	}
+	return false
+}
+
+// deliver never blocks, the subscription is closed if the entry can't be buffered.
+func (sub *Subscription) deliver(entry CommittedEntry) {
+	sub.mu.Lock()
+	if sub.replaying {
+		if len(sub.pending) < maxPendingEntries {
+			sub.pending = append(sub.pending, entry)
+			sub.mu.Unlock()
+			return
+		}
+		sub.pending = nil
+		sub.mu.Unlock()
+		sub.close(ErrSubscriptionTooSlow)
+		return
+	}
+	sub.mu.Unlock()
+	select {
+	case sub.ch <- entry:
+	case <-sub.closeCh:
+	default:
+		sub.close(ErrSubscriptionTooSlow)
+	}
+}
+
+func (sub *Subscription) replay(fromTS uint64) {
+	err := sub.store.db.View(func(txn *badger.Txn) error {
+		it := newIterator(txn, false)
+		defer it.Close()
+		oldIt := newIterator(txn, false)
+		defer oldIt.Close()
+		var entries []CommittedEntry
+		for it.Seek(sub.startKey); it.Valid(); it.Next() {
+			item := it.Item()
+			if exceedEndKey(item.Key(), sub.endKey) {
+				break
+			}
+			if bytes.HasPrefix(item.Key(), InternalKeyPrefix) {
+				continue
+			}
+			key := item.KeyCopy(nil)
+			mvVal, err := decodeValue(item)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if mvVal.commitTS <= fromTS {
+				continue
+			}
+			entries = append(entries[:0], CommittedEntry{Key: key, Value: mvVal.value, StartTS: mvVal.startTS, CommitTS: mvVal.commitTS})
+			oldKey := encodeOldKey(key, maxSystemTS)
+			for oldIt.Seek(oldKey); oldIt.ValidForPrefix(oldKey[:len(key)]); oldIt.Next() {
+				if len(oldIt.Item().Key()) != len(oldKey) {
+					continue
+				}
+				oldVal, err := decodeValue(oldIt.Item())
+				if err != nil {
+					return errors.Trace(err)
+				}
+				if oldVal.commitTS <= fromTS {
+					break
+				}
+				entries = append(entries, CommittedEntry{Key: key, Value: oldVal.value, StartTS: oldVal.startTS, CommitTS: oldVal.commitTS})
+			}
+			for i := len(entries) - 1; i >= 0; i-- {
+				if !sub.send(entries[i]) {
+					return nil
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("replay subscription from ts %d failed: %v", fromTS, err)
+	}
+	for {
+		sub.mu.Lock()
+		pending := sub.pending
+		sub.pending = nil
+		if len(pending) == 0 {
+			sub.replaying = false
+			sub.mu.Unlock()
+			return
+		}
+		sub.mu.Unlock()
+		for _, entry := range pending {
+			if !sub.send(entry) {
+				return
+			}
+		}
+	}
+}
+
+// publication is the committed entries of a request to deliver after its latches are released.
+type publication struct {
+	store   *MVCCStore
+	entries []CommittedEntry
+	ticket  uint64
+}
+
+// newPublication must be called with the latches of the keys held and after the entries are written, the
+// returned publication must be published once the latches are released.
+func (store *MVCCStore) newPublication(entries []CommittedEntry) publication {
+	if len(entries) == 0 {
+		return publication{}
+	}
+	subs := &store.subscriptions
+	subs.ticketMu.Lock()
+	subs.nextTicket++
+	ticket := subs.nextTicket
+	subs.ticketMu.Unlock()
+	return publication{store: store, entries: entries, ticket: ticket}
+}
+
+// publish waits for the publications of the earlier tickets and delivers the entries.
+func (p publication) publish() {
+	if p.store == nil {
+		return
+	}
+	subs := &p.store.subscriptions
+	subs.ticketMu.Lock()
+	for subs.doneTicket+1 != p.ticket {
+		subs.ticketCond.Wait()
+	}
+	subs.ticketMu.Unlock()
+	p.store.deliver(p.entries)
+	subs.ticketMu.Lock()
+	subs.doneTicket = p.ticket
+	subs.ticketMu.Unlock()
+	subs.ticketCond.Broadcast()
+}
+
+// deliver delivers the committed entries to the subscribers.
+func (store *MVCCStore) deliver(entries []CommittedEntry) {
+	subs := &store.subscriptions
+	if atomic.LoadInt32(&subs.cnt) == 0 {
+		return
+	}
+	subs.mu.RLock()
+	matched := make([]*Subscription, 0, len(subs.subs))
+	for sub := range subs.subs {
+		matched = append(matched, sub)
+	}
+	subs.mu.RUnlock()
+	for _, sub := range matched {
+		for _, entry := range entries {
+			if sub.contains(entry.Key) {
+				sub.deliver(entry)
+			}
+		}
+	}
+}
+
+func (store *MVCCStore) hasSubscriptions() bool {
+	return atomic.LoadInt32(&store.subscriptions.cnt) > 0
+}
@@ -0,0 +1,42 @@
+package tikv_test
+
+import (
+	"testing"
+
+	"github.com/ngaut/faketikv/tikv"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscribe(t *testing.T) {
+	c := newTestCluster(t)
+	sub := c.Store.Subscribe([]byte("t"), []byte("u"), 0, 4)
+	defer sub.Close()
+	slowSub := c.Store.Subscribe([]byte("t"), []byte("u"), 0, 2)
+	defer slowSub.Close()
+	var commitTSs []uint64
+	for i := 0; i < 4; i++ {
+		commitTS, err := c.Put([]byte("t1"), []byte{byte(i)})
+		require.NoError(t, err)
+		commitTSs = append(commitTSs, commitTS)
+	}
+	// The keys out of the range are not delivered.
+	_, err := c.Put([]byte("v1"), []byte("v"))
+	require.NoError(t, err)
+	checkEntries(t, sub, commitTSs)
+
+	// The commits don't wait for the slow subscriber, it's closed for the entries that don't fit in the buffer.
+	<-slowSub.Done()
+	require.Equal(t, tikv.ErrSubscriptionTooSlow, slowSub.Err())
+	checkEntries(t, slowSub, commitTSs[:2])
+}
+
+// checkEntries checks the subscription has delivered exactly the puts of t1 at the commit ts.
+func checkEntries(t *testing.T, sub *tikv.Subscription, commitTSs []uint64) {
+	for i, commitTS := range commitTSs {
+		entry := <-sub.Entries()
+		require.Equal(t, []byte("t1"), entry.Key)
+		require.Equal(t, []byte{byte(i)}, entry.Value)
+		require.Equal(t, commitTS, entry.CommitTS)
+	}
+	require.Len(t, sub.Entries(), 0)
+}
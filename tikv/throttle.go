@@ -0,0 +1,70 @@
+package tikv
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pingcap/kvproto/pkg/errorpb"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+)
+
+// tokenBucket limits the write bytes of a region, the zero value is a full bucket.
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// take takes n tokens from the bucket refilled at rate tokens per second up to burst, it returns false if
+// there are not enough tokens.
+func (b *tokenBucket) take(n int, rate, burst float64, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// checkWriteBudget returns a ServerIsBusy error if the region has written more than its budget. Only prewrite is
+// charged since its mutations carry the values written by commit.
+func (rm *RegionManager) checkWriteBudget(regCtx *regionCtx, size int) *errorpb.Error {
+	if rm.writeRateLimit <= 0 {
+		return nil
+	}
+	burst := rm.writeBurst
+	if burst < rm.writeRateLimit {
+		burst = rm.writeRateLimit
+	}
+	if size > int(burst) {
+		// A request larger than the burst can never get enough tokens, let it drain the bucket instead.
+		size = int(burst)
+	}
+	if regCtx.writeBucket.take(size, float64(rm.writeRateLimit), float64(burst), clock.Now()) {
+		return nil
+	}
+	return &errorpb.Error{
+		Message: "region write rate limit exceeded",
+		ServerIsBusy: &errorpb.ServerIsBusy{
+			Reason: "region write rate limit exceeded",
+		},
+	}
+}
+
+func mutationsSize(mutations []*kvrpcpb.Mutation) int {
+	var size int
+	for _, m := range mutations {
+		size += len(m.Key) + len(m.Value)
+	}
+	return size
+}
@@ -0,0 +1,109 @@
+package tikv_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ngaut/faketikv/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	fuzzTxnSlots = 4
+	fuzzKeys     = 8
+)
+
+type fuzzTxnState int
+
+const (
+	fuzzTxnBuilding fuzzTxnState = iota
+	fuzzTxnPrewritten
+	fuzzTxnAborted
+)
+
+type fuzzTxn struct {
+	txn    *testutil.Txn
+	state  fuzzTxnState
+	writes map[byte][]byte
+}
+
+// FuzzTxnInterleaving runs the interleaving of Prewrite, Commit and Rollback decoded from the input on a store of 4
+// regions, and checks the committed values are read afterwards. The ts are allocated sequentially, so a crash is
+// reproduced by its input.
+func FuzzTxnInterleaving(f *testing.F) {
+	f.Add([]byte{0, 0, 1, 0, 0, 6, 1, 0, 0, 2, 0, 0})
+	f.Add([]byte{0, 0, 1, 0, 1, 1, 1, 0, 0, 1, 1, 1, 3, 0, 0, 2, 1, 0})
+	f.Add([]byte{4, 2, 3, 0, 3, 3, 1, 2, 0, 1, 3, 0, 2, 3, 0, 2, 2, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		c, err := testutil.NewCluster(testutil.Options{Regions: 4})
+		require.NoError(t, err)
+		defer c.Close()
+		committed := make(map[byte][]byte)
+		var txns [fuzzTxnSlots]*fuzzTxn
+		for i := 0; i+2 < len(data); i += 3 {
+			op, slot, k := data[i]%5, data[i+1]%fuzzTxnSlots, data[i+2]%fuzzKeys
+			key := fuzzKey(k)
+			ft := txns[slot]
+			if ft == nil || ft.state == fuzzTxnAborted {
+				ft = &fuzzTxn{txn: c.Begin(), writes: make(map[byte][]byte)}
+				txns[slot] = ft
+			}
+			switch op {
+			case 0, 4:
+				if ft.state != fuzzTxnBuilding {
+					continue
+				}
+				if op == 0 {
+					val := []byte{byte(i), data[i+2]}
+					ft.txn.Set(key, val)
+					ft.writes[k] = val
+				} else {
+					ft.txn.Delete(key)
+					ft.writes[k] = nil
+				}
+			case 1:
+				if ft.state != fuzzTxnBuilding || len(ft.writes) == 0 {
+					continue
+				}
+				if err = ft.txn.Prewrite(); err != nil {
+					// The locks prewritten in the other regions are left, they are rolled back.
+					require.NoError(t, ft.txn.Rollback())
+					ft.state = fuzzTxnAborted
+					continue
+				}
+				ft.state = fuzzTxnPrewritten
+			case 2:
+				if ft.state != fuzzTxnPrewritten {
+					continue
+				}
+				require.NoError(t, ft.txn.CommitAt(c.AllocTS()))
+				for k, val := range ft.writes {
+					committed[k] = val
+				}
+				ft.state = fuzzTxnAborted
+			case 3:
+				if ft.state != fuzzTxnPrewritten {
+					continue
+				}
+				require.NoError(t, ft.txn.Rollback())
+				ft.state = fuzzTxnAborted
+			}
+		}
+		for _, ft := range txns {
+			if ft != nil && ft.state == fuzzTxnPrewritten {
+				require.NoError(t, ft.txn.Rollback())
+			}
+		}
+		readTS := c.AllocTS()
+		for k := byte(0); k < fuzzKeys; k++ {
+			val, err := c.Get(fuzzKey(k), readTS)
+			require.NoError(t, err)
+			require.True(t, bytes.Equal(committed[k], val), "key %d read %x, expected %x", k, val, committed[k])
+		}
+	})
+}
+
+// fuzzKey spreads the keys over the regions split by testutil.EvenSplitKeys.
+func fuzzKey(k byte) []byte {
+	return []byte{k * (256 / fuzzKeys), 'k'}
+}
@@ -0,0 +1,226 @@
+package tikv_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ngaut/faketikv/testutil"
+	"github.com/ngaut/faketikv/tikv"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+var (
+	primaryKey   = []byte{0x10, 'p'}
+	secondaryKey = []byte{0xf0, 's'}
+)
+
+func TestPushMinCommitTS(t *testing.T) {
+	c := newTestCluster(t)
+	startTS := c.AllocTS()
+	prewrite(t, c, startTS, primaryKey, primaryKey, secondaryKey)
+	commitTS := c.AllocTS()
+	readTS := c.AllocTS()
+	// The read of the secondary doesn't push its lock.
+	checkLocked(t, get(t, c, secondaryKey, readTS), startTS)
+
+	// The reader pushes the alive primary, the transaction must commit after the reader.
+	status := checkTxnStatus(t, c, startTS, readTS)
+	require.Equal(t, kvrpcpb.Action_MinCommitTSPushed, status.Action)
+	require.Equal(t, readTS+1, status.LockInfo.MinCommitTs)
+	keyErr := commit(t, c, primaryKey, startTS, commitTS)
+	require.NotNil(t, keyErr)
+	require.NotNil(t, keyErr.CommitTsExpired)
+	commitTS = c.AllocTS()
+	require.Nil(t, commit(t, c, primaryKey, startTS, commitTS))
+	require.Nil(t, commit(t, c, secondaryKey, startTS, commitTS))
+	require.Empty(t, get(t, c, secondaryKey, readTS).Value)
+	require.Equal(t, secondaryKey, get(t, c, secondaryKey, commitTS).Value)
+}
+
+func TestReadPushesPrimary(t *testing.T) {
+	c := newTestCluster(t)
+	startTS := c.AllocTS()
+	prewrite(t, c, startTS, primaryKey, primaryKey, secondaryKey)
+	commitTS, readTS := c.AllocTS(), c.AllocTS()
+	// The reader pushes the alive primary lock under its latch and reads the version before it.
+	resp := get(t, c, primaryKey, readTS)
+	require.Nil(t, resp.Error)
+	require.Empty(t, resp.Value)
+	keyErr := commit(t, c, primaryKey, startTS, commitTS)
+	require.NotNil(t, keyErr)
+	require.NotNil(t, keyErr.CommitTsExpired)
+	require.Equal(t, readTS+1, keyErr.CommitTsExpired.MinCommitTs)
+
+	// A later batch get pushes the primary again, the transaction commits after both readers.
+	batchTS := c.AllocTS()
+	require.Empty(t, batchGet(t, c, [][]byte{primaryKey}, batchTS))
+	keyErr = commit(t, c, primaryKey, startTS, batchTS)
+	require.NotNil(t, keyErr)
+	require.Equal(t, batchTS+1, keyErr.CommitTsExpired.MinCommitTs)
+	commitTS = c.AllocTS()
+	require.Nil(t, commit(t, c, primaryKey, startTS, commitTS))
+	require.Nil(t, commit(t, c, secondaryKey, startTS, commitTS))
+	require.Empty(t, get(t, c, primaryKey, batchTS).Value)
+	require.Equal(t, primaryKey, get(t, c, primaryKey, commitTS).Value)
+}
+
+func TestCheckCommittedPrimary(t *testing.T) {
+	c := newTestCluster(t)
+	startTS := c.AllocTS()
+	prewrite(t, c, startTS, primaryKey, primaryKey, secondaryKey)
+	commitTS := c.AllocTS()
+	require.Nil(t, commit(t, c, primaryKey, startTS, commitTS))
+	readTS := c.AllocTS()
+	checkLocked(t, get(t, c, secondaryKey, readTS), startTS)
+
+	// The committed primary is not pushed, the secondary is committed at the commit ts of the primary.
+	status := checkTxnStatus(t, c, startTS, readTS)
+	require.Equal(t, kvrpcpb.Action_NoAction, status.Action)
+	require.Equal(t, commitTS, status.CommitVersion)
+	require.Nil(t, commit(t, c, secondaryKey, startTS, commitTS))
+	resp := get(t, c, secondaryKey, readTS)
+	require.Nil(t, resp.Error)
+	require.Equal(t, secondaryKey, resp.Value)
+}
+
+// physicalTS returns the ts at the physical time d after the test's epoch.
+func physicalTS(d time.Duration) uint64 {
+	return uint64((time.Hour+d)/time.Millisecond) << 18
+}
+
+func TestPrewriteAfterRollbackGC(t *testing.T) {
+	c := newTestCluster(t)
+	c.Store.RollbackRetention = time.Second
+	c.Store.ProtectedRollbackRetention = time.Second
+	liveTS, rolledBackTS := physicalTS(0), physicalTS(time.Millisecond)
+	rollback(t, c, secondaryKey, rolledBackTS)
+	// Move the latest ts over the retention of the rollback record.
+	rollback(t, c, []byte{0x20}, physicalTS(10*time.Minute))
+
+	// The rollback records after the GC safe point are kept, the alive transactions can prewrite.
+	require.NoError(t, c.Store.UpdateGCSafePoint(rolledBackTS))
+	require.NoError(t, c.Store.CollectRollbacks())
+	require.NotEmpty(t, tryPrewrite(t, c, rolledBackTS, secondaryKey, secondaryKey))
+	require.Empty(t, tryPrewrite(t, c, liveTS, primaryKey, primaryKey))
+
+	// The records before the safe point are collected, the transactions before it are too old.
+	require.NoError(t, c.Store.UpdateGCSafePoint(physicalTS(5*time.Minute)))
+	require.NoError(t, c.Store.CollectRollbacks())
+	require.NotEmpty(t, tryPrewrite(t, c, rolledBackTS, secondaryKey, secondaryKey))
+	require.NotEmpty(t, tryPrewrite(t, c, liveTS, primaryKey, []byte{0x30}))
+}
+
+func TestRollbackGCWithoutSafePoint(t *testing.T) {
+	c := newTestCluster(t)
+	c.Store.RollbackRetention = time.Second
+	c.Store.ProtectedRollbackRetention = time.Second
+	rolledBackTS := physicalTS(time.Millisecond)
+	rollback(t, c, secondaryKey, rolledBackTS)
+	rollback(t, c, []byte{0x20}, physicalTS(10*time.Minute))
+	// Without a GC safe point the records are collected after the retention.
+	require.NoError(t, c.Store.CollectRollbacks())
+	errs := tryPrewrite(t, c, rolledBackTS, secondaryKey, secondaryKey)
+	require.Len(t, errs, 1)
+	require.Contains(t, errs[0].Retryable, "too old")
+	// The records within the retention are kept.
+	recentTS := physicalTS(10*time.Minute - time.Millisecond)
+	rollback(t, c, primaryKey, recentTS)
+	require.NoError(t, c.Store.CollectRollbacks())
+	errs = tryPrewrite(t, c, recentTS, primaryKey, primaryKey)
+	require.Len(t, errs, 1)
+	require.Contains(t, errs[0].Retryable, "already rollback")
+}
+
+func TestPipelinedPessimisticLockAcrossSplit(t *testing.T) {
+	c := newTestCluster(t)
+	c.Store.PipelinedPessimisticLock = true
+	require.NoError(t, c.Store.SetWriteStall(tikv.WriteStall{WriteDelay: 100 * time.Millisecond, Probability: 1}))
+	startTS := c.AllocTS()
+	require.Empty(t, pessimisticLock(t, c, primaryKey, startTS))
+	require.NoError(t, c.RegionManager.SplitRegion(regionCtx(t, c, primaryKey).RegionId, []byte{primaryKey[0]}))
+	// The request on the split region waits for the lock to be applied.
+	errs := pessimisticLock(t, c, primaryKey, c.AllocTS())
+	require.Len(t, errs, 1)
+	require.NotNil(t, errs[0].Locked)
+	require.Equal(t, startTS, errs[0].Locked.LockVersion)
+}
+
+func TestResolveLockKeepsOldVersion(t *testing.T) {
+	c := newTestCluster(t)
+	oldTS, err := c.Put(secondaryKey, []byte("v0"))
+	require.NoError(t, err)
+	startTS := c.AllocTS()
+	prewrite(t, c, startTS, primaryKey, secondaryKey)
+	resp, err := c.Server.KvResolveLock(context.Background(), &kvrpcpb.ResolveLockRequest{
+		Context:       regionCtx(t, c, secondaryKey),
+		StartVersion:  startTS,
+		CommitVersion: c.AllocTS(),
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp.RegionError)
+	require.Nil(t, resp.Error)
+
+	val, err := c.Get(secondaryKey, c.AllocTS())
+	require.NoError(t, err)
+	require.Equal(t, secondaryKey, val)
+	// The overwritten version is still readable at its ts.
+	val, err = c.Get(secondaryKey, oldTS)
+	require.NoError(t, err)
+	require.Equal(t, []byte("v0"), val)
+}
+
+func checkLocked(t *testing.T, resp *kvrpcpb.GetResponse, startTS uint64) {
+	require.NotNil(t, resp.Error)
+	require.NotNil(t, resp.Error.Locked)
+	require.Equal(t, startTS, resp.Error.Locked.LockVersion)
+}
+
+func rollback(t *testing.T, c *testutil.Cluster, key []byte, startTS uint64) {
+	resp, err := c.Server.KvBatchRollback(context.Background(), &kvrpcpb.BatchRollbackRequest{
+		Context:      regionCtx(t, c, key),
+		Keys:         [][]byte{key},
+		StartVersion: startTS,
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp.RegionError)
+	require.Nil(t, resp.Error)
+}
+
+func commit(t *testing.T, c *testutil.Cluster, key []byte, startTS, commitTS uint64) *kvrpcpb.KeyError {
+	resp, err := c.Server.KvCommit(context.Background(), &kvrpcpb.CommitRequest{
+		Context:       regionCtx(t, c, key),
+		Keys:          [][]byte{key},
+		StartVersion:  startTS,
+		CommitVersion: commitTS,
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp.RegionError)
+	return resp.Error
+}
+
+func get(t *testing.T, c *testutil.Cluster, key []byte, ts uint64) *kvrpcpb.GetResponse {
+	resp, err := c.Server.KvGet(context.Background(), &kvrpcpb.GetRequest{
+		Context: regionCtx(t, c, key),
+		Key:     key,
+		Version: ts,
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp.RegionError)
+	return resp
+}
+
+func checkTxnStatus(t *testing.T, c *testutil.Cluster, startTS, callerStartTS uint64) *kvrpcpb.CheckTxnStatusResponse {
+	resp, err := c.Server.KvCheckTxnStatus(context.Background(), &kvrpcpb.CheckTxnStatusRequest{
+		Context:       regionCtx(t, c, primaryKey),
+		PrimaryKey:    primaryKey,
+		LockTs:        startTS,
+		CallerStartTs: callerStartTS,
+		CurrentTs:     callerStartTS,
+	})
+	require.NoError(t, err)
+	require.Nil(t, resp.RegionError)
+	require.Nil(t, resp.Error)
+	return resp
+}
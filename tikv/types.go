@@ -1,6 +1,7 @@
 package tikv
 
 import (
+	"encoding/binary"
 	"unsafe"
 
 	"github.com/coocood/badger"
@@ -34,20 +35,51 @@ func decodeValue(item *badger.Item) (v mvccValue, err error) {
 	if err != nil {
 		return v, errors.Trace(err)
 	}
-	v.mvccValueHdr = *(*mvccValueHdr)(unsafe.Pointer(&val[0]))
-	if len(val) > mvccValueHdrSize {
-		v.value = append(v.value[:0], val[mvccValueHdrSize:]...)
+	return parseValue(val)
+}
+
+// parseValue decodes data to value and checks the length, the value is copied.
+func parseValue(data []byte) (v mvccValue, err error) {
+	if len(data) < mvccValueHdrSize {
+		return v, errors.Errorf("invalid value length %d", len(data))
+	}
+	v.mvccValueHdr = *(*mvccValueHdr)(unsafe.Pointer(&data[0]))
+	if len(data) > mvccValueHdrSize {
+		v.value = append(v.value[:0], data[mvccValueHdrSize:]...)
 	}
 	return v, nil
 }
 
 // decodeLock decodes data to lock, the primary and value is copied.
 func decodeLock(data []byte) (l mvccLock) {
-	l.mvccLockHdr = *(*mvccLockHdr)(unsafe.Pointer(&data[0]))
-	buf := append([]byte{}, data[mvccLockHdrSize:]...)
+	l, err := parseLock(data)
+	if err != nil {
+		panic(err)
+	}
+	return l
+}
+
+// parseLock is decodeLock with the length checked, for the data not written by the lock store.
+func parseLock(data []byte) (l mvccLock, err error) {
+	if len(data) < mvccLockHdrV0Size {
+		return l, errors.Errorf("invalid lock length %d", len(data))
+	}
+	hdrSize := mvccLockHdrV0Size
+	if data[lockOpOffset]&lockHdrV1Flag != 0 {
+		hdrSize = mvccLockHdrSize
+		if len(data) < hdrSize {
+			return l, errors.Errorf("invalid lock length %d", len(data))
+		}
+	}
+	copy((*[mvccLockHdrSize]byte)(unsafe.Pointer(&l.mvccLockHdr))[:], data[:hdrSize])
+	l.op &^= lockHdrV1Flag
+	buf := append([]byte{}, data[hdrSize:]...)
+	if int(l.primaryLen) > len(buf) {
+		return l, errors.Errorf("invalid lock primary length %d", l.primaryLen)
+	}
 	l.primary = buf[:l.primaryLen]
 	l.value = buf[l.primaryLen:]
-	return
+	return l, nil
 }
 
 // UnmarshalBinary implements encoding.BinaryUnmarshaler interface.
@@ -64,10 +96,22 @@ type mvccLockHdr struct {
 	op         uint8
 	hasOldVer  bool
 	primaryLen uint16
+	// forUpdateTS is the for update ts of a pessimistic transaction's lock.
+	forUpdateTS uint64
+	// minCommitTS is the min commit ts of the transaction, the lock can be pushed by readers if it is not zero.
+	minCommitTS uint64
 }
 
 const mvccLockHdrSize = int(unsafe.Sizeof(mvccLockHdr{}))
 
+// mvccLockHdrV0Size is the size of the header before forUpdateTS and minCommitTS, the locks dumped by the old
+// versions have it. The header with them is the v1 header, lockHdrV1Flag is set in its op byte.
+const (
+	mvccLockHdrV0Size       = 16
+	lockOpOffset            = 12
+	lockHdrV1Flag     uint8 = 0x80
+)
+
 type mvccLock struct {
 	mvccLockHdr
 	primary []byte
@@ -79,6 +123,7 @@ func (l *mvccLock) MarshalBinary() []byte {
 	buf := make([]byte, mvccLockHdrSize+len(l.primary)+len(l.value))
 	hdr := (*mvccLockHdr)(unsafe.Pointer(&buf[0]))
 	*hdr = l.mvccLockHdr
+	hdr.op |= lockHdrV1Flag
 	copy(buf[mvccLockHdrSize:], l.primary)
 	copy(buf[mvccLockHdrSize+int(l.primaryLen):], l.value)
 	return buf
@@ -96,6 +141,10 @@ const (
 	userMetaRollback   byte = 1
 	userMetaDelete     byte = 2
 	userMetaRollbackGC byte = 3
+	// userMetaDestroy deletes a lock that may have been deleted already.
+	userMetaDestroy byte = 4
+	// userMetaRawTTL marks the raw values stored after their expire time.
+	userMetaRawTTL byte = 5
 )
 
 func encodeOldKey(key []byte, ts uint64) []byte {
@@ -112,12 +161,13 @@ func encodeRollbackKey(buf, key []byte, ts uint64) []byte {
 }
 
 func decodeRollbackTS(buf []byte) uint64 {
-	tsBin := buf[len(buf)-8:]
-	_, ts, err := codec.DecodeUintDesc(tsBin)
-	if err != nil {
-		panic(err)
-	}
-	return ts
+	return decodeKeyTS(buf)
+}
+
+// decodeKeyTS decodes the ts suffix of an old key or a rollback key, the ts is encoded by codec.EncodeUintDesc which
+// is the bitwise not of the big endian bytes, so it is decoded inline without the error checking.
+func decodeKeyTS(key []byte) uint64 {
+	return ^binary.BigEndian.Uint64(key[len(key)-8:])
 }
 
 // Pair is a KV pair read from MvccStore or an error if any occurs.
@@ -125,4 +175,7 @@ type Pair struct {
 	Key   []byte
 	Value []byte
 	Err   error
+	// StartTS and CommitTS are the ts of the version read, they are only set by BatchGet.
+	StartTS  uint64
+	CommitTS uint64
 }
@@ -0,0 +1,116 @@
+package tikv
+
+import (
+	"bytes"
+	"testing"
+	"unsafe"
+
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/tidb/util/codec"
+	"github.com/stretchr/testify/require"
+)
+
+func FuzzDecodeLock(f *testing.F) {
+	lock := mvccLock{
+		mvccLockHdr: mvccLockHdr{startTS: 100, ttl: 3000, op: uint8(kvrpcpb.Op_Put), primaryLen: 3, minCommitTS: 101},
+		primary:     []byte("pri"),
+		value:       []byte("value"),
+	}
+	f.Add(lock.MarshalBinary())
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		l, err := parseLock(data)
+		if err != nil {
+			return
+		}
+		if data[lockOpOffset]&lockHdrV1Flag == 0 {
+			// The v0 lock is encoded to the v1 header.
+			l1, err := parseLock(l.MarshalBinary())
+			require.NoError(t, err)
+			require.Equal(t, l, l1)
+			return
+		}
+		buf := l.MarshalBinary()
+		require.True(t, bytes.Equal(buf, data), "lock %v is encoded to %x, expected %x", l, buf, data)
+	})
+}
+
+func FuzzLockMarshal(f *testing.F) {
+	f.Add(uint64(100), uint32(3000), uint8(kvrpcpb.Op_Put), uint64(0), uint64(101), []byte("pri"), []byte("value"))
+	f.Add(uint64(1), uint32(0), uint8(kvrpcpb.Op_PessimisticLock), uint64(2), uint64(0), []byte{}, []byte{})
+	f.Fuzz(func(t *testing.T, startTS uint64, ttl uint32, op uint8, forUpdateTS, minCommitTS uint64, primary, value []byte) {
+		if len(primary) > 0xffff || op&lockHdrV1Flag != 0 {
+			return
+		}
+		lock := mvccLock{
+			mvccLockHdr: mvccLockHdr{
+				startTS:     startTS,
+				ttl:         ttl,
+				op:          op,
+				primaryLen:  uint16(len(primary)),
+				forUpdateTS: forUpdateTS,
+				minCommitTS: minCommitTS,
+			},
+			primary: primary,
+			value:   value,
+		}
+		l, err := parseLock(lock.MarshalBinary())
+		require.NoError(t, err)
+		require.Equal(t, lock.mvccLockHdr, l.mvccLockHdr)
+		require.True(t, bytes.Equal(primary, l.primary))
+		require.True(t, bytes.Equal(value, l.value))
+	})
+}
+
+func TestParseV0Lock(t *testing.T) {
+	// The v0 header: startTS, ttl, op, hasOldVer and primaryLen in native byte order.
+	data := make([]byte, mvccLockHdrV0Size, mvccLockHdrV0Size+len("pri")+len("value"))
+	*(*uint64)(unsafe.Pointer(&data[0])) = 100
+	*(*uint32)(unsafe.Pointer(&data[8])) = 3000
+	data[lockOpOffset] = uint8(kvrpcpb.Op_Put)
+	data[13] = 1
+	*(*uint16)(unsafe.Pointer(&data[14])) = 3
+	data = append(data, "privalue"...)
+	l, err := parseLock(data)
+	require.NoError(t, err)
+	require.Equal(t, mvccLockHdr{startTS: 100, ttl: 3000, op: uint8(kvrpcpb.Op_Put), hasOldVer: true, primaryLen: 3},
+		l.mvccLockHdr)
+	require.Equal(t, []byte("pri"), l.primary)
+	require.Equal(t, []byte("value"), l.value)
+}
+
+func FuzzDecodeValue(f *testing.F) {
+	f.Add(mvccValue{mvccValueHdr: mvccValueHdr{startTS: 100, commitTS: 101}, value: []byte("value")}.MarshalBinary())
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		v, err := parseValue(data)
+		if err != nil {
+			return
+		}
+		buf := v.MarshalBinary()
+		require.True(t, bytes.Equal(buf, data), "value %v is encoded to %x, expected %x", v, buf, data)
+	})
+}
+
+// BenchmarkDecodeKeyTS compares decodeKeyTS with codec.DecodeUintDesc on the old key of a row.
+func BenchmarkDecodeKeyTS(b *testing.B) {
+	key := encodeOldKey([]byte("t\x80\x00\x00\x00\x00\x00\x00\x01_r\x80\x00\x00\x00\x00\x00\x00\x01"), 400000000000000000)
+	b.Run("inline", func(b *testing.B) {
+		var sum uint64
+		for i := 0; i < b.N; i++ {
+			sum += decodeKeyTS(key)
+		}
+		require.NotZero(b, sum)
+	})
+	b.Run("DecodeUintDesc", func(b *testing.B) {
+		var sum uint64
+		for i := 0; i < b.N; i++ {
+			_, ts, err := codec.DecodeUintDesc(key[len(key)-8:])
+			if err != nil {
+				b.Fatal(err)
+			}
+			sum += ts
+		}
+		require.NotZero(b, sum)
+	})
+}
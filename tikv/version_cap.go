@@ -0,0 +1,108 @@
+package tikv
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/coocood/badger"
+	"github.com/dgryski/go-farm"
+	"github.com/juju/errors"
+)
+
+const (
+	// maxVersionCounterKeys is the max number of keys counted, the counts are reset when it's exceeded.
+	maxVersionCounterKeys = 1 << 20
+	versionPruneQueueSize = 256
+)
+
+// versionCounter counts the old versions written for the keys since they were last pruned.
+type versionCounter struct {
+	mu      sync.Mutex
+	counts  map[uint64]int
+	pruneCh chan []byte
+}
+
+// countOldVersions is called after the latest versions of the keys are moved to old, the keys with more than
+// MaxKeyVersions old versions are queued to be pruned.
+func (store *MVCCStore) countOldVersions(keys [][]byte) {
+	limit := store.MaxKeyVersions
+	if limit <= 0 || len(keys) == 0 {
+		return
+	}
+	vc := &store.versionCounter
+	var full [][]byte
+	vc.mu.Lock()
+	if vc.counts == nil || len(vc.counts) >= maxVersionCounterKeys {
+		vc.counts = make(map[uint64]int)
+	}
+	for _, key := range keys {
+		h := farm.Fingerprint64(key)
+		vc.counts[h]++
+		if vc.counts[h] > limit {
+			delete(vc.counts, h)
+			full = append(full, key)
+		}
+	}
+	vc.mu.Unlock()
+	for _, key := range full {
+		select {
+		case vc.pruneCh <- key:
+		default:
+		}
+	}
+}
+
+// versionPruner deletes the old versions of the keys exceeding MaxKeyVersions that are invisible at the GC safe
+// point, so hot keys don't accumulate versions until GC reaches them.
+type versionPruner struct {
+	store *MVCCStore
+}
+
+func (p *versionPruner) run() {
+	store := p.store
+	defer store.wg.Done()
+	for {
+		select {
+		case <-store.closeCh:
+			return
+		case key := <-store.versionCounter.pruneCh:
+			safePoint := store.GCSafePoint()
+			if safePoint == 0 || store.IsGCPaused() {
+				continue
+			}
+			if err := p.prune(key, safePoint); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+}
+
+func (p *versionPruner) prune(key []byte, safePoint uint64) error {
+	store := p.store
+	dbBatch := newWriteDBBatch(new(requestCtx))
+	err := store.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return errors.Trace(err)
+		}
+		mvVal, err := decodeValue(item)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		oldIt := newIterator(txn, false)
+		defer oldIt.Close()
+		return collectOldVersions(oldIt, key, mvVal.commitTS, store.gcSafePoint(key, safePoint), 0, dbBatch)
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	store.waitGCQuota(len(dbBatch.entries))
+	if err = store.writeDB(dbBatch); err != nil {
+		return errors.Trace(err)
+	}
+	atomic.AddInt64(&store.gcStats.DeletedVersions, int64(len(dbBatch.entries)))
+	return nil
+}
@@ -3,8 +3,11 @@ package tikv
 import (
 	"bufio"
 	"io"
+	"math"
 	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
@@ -18,6 +21,8 @@ type writeDBBatch struct {
 	err     error
 	wg      sync.WaitGroup
 	reqCtx  *requestCtx
+	// commitTS is the max commit ts of the committed values in the batch.
+	commitTS uint64
 }
 
 func newWriteDBBatch(reqCtx *requestCtx) *writeDBBatch {
@@ -31,6 +36,14 @@ func (batch *writeDBBatch) set(key, val []byte) {
 	})
 }
 
+// commit sets the committed value of the key.
+func (batch *writeDBBatch) commit(key []byte, val mvccValue) {
+	batch.set(key, val.MarshalBinary())
+	if val.commitTS > batch.commitTS {
+		batch.commitTS = val.commitTS
+	}
+}
+
 func (batch *writeDBBatch) delete(key []byte) {
 	batch.entries = append(batch.entries, &badger.Entry{
 		Key:      key,
@@ -52,6 +65,8 @@ type writeLockBatch struct {
 	err     error
 	wg      sync.WaitGroup
 	reqCtx  *requestCtx
+	// onDone is called by the writeLockWorker after the batch is applied if it is submitted asynchronously.
+	onDone func()
 }
 
 func newWriteLockBatch(reqCtx *requestCtx) *writeLockBatch {
@@ -65,9 +80,14 @@ func (batch *writeLockBatch) set(key, val []byte) {
 	})
 }
 
-func (batch *writeLockBatch) rollback(key []byte) {
+func (batch *writeLockBatch) rollback(key []byte, protected bool) {
+	val := rollbackValUnprotected
+	if protected {
+		val = rollbackValProtected
+	}
 	batch.entries = append(batch.entries, &badger.Entry{
 		Key:      key,
+		Value:    val,
 		UserMeta: userMetaRollback,
 	})
 }
@@ -79,6 +99,13 @@ func (batch *writeLockBatch) rollbackGC(key []byte) {
 	})
 }
 
+func (batch *writeLockBatch) destroy(key []byte) {
+	batch.entries = append(batch.entries, &badger.Entry{
+		Key:      key,
+		UserMeta: userMetaDestroy,
+	})
+}
+
 func (batch *writeLockBatch) delete(key []byte) {
 	batch.entries = append(batch.entries, &badger.Entry{
 		Key:      key,
@@ -100,6 +127,8 @@ func (store *MVCCStore) writeDB(batch *writeDBBatch) error {
 	default:
 	}
 	batch.wg.Wait()
+	store.updateMaxCommitTS(batch.reqCtx, batch.commitTS)
+	store.bumpDataVersion(batch.reqCtx)
 	return batch.err
 }
 
@@ -107,6 +136,21 @@ func (store *MVCCStore) writeLocks(batch *writeLockBatch) error {
 	if len(batch.entries) == 0 {
 		return nil
 	}
+	store.submitLockBatch(batch)
+	batch.wg.Wait()
+	store.bumpDataVersion(batch.reqCtx)
+	return batch.err
+}
+
+// writeLocksAsync submits the batch without waiting for it to be applied, onDone is called after that.
+func (store *MVCCStore) writeLocksAsync(batch *writeLockBatch, onDone func()) {
+	// The request may finish before the batch is applied, so the worker must not trace on it.
+	batch.reqCtx = &requestCtx{priority: batch.reqCtx.priority}
+	batch.onDone = onDone
+	store.submitLockBatch(batch)
+}
+
+func (store *MVCCStore) submitLockBatch(batch *writeLockBatch) {
 	batch.wg.Add(1)
 	w := store.writeLockWorker
 	w.mu.Lock()
@@ -116,8 +160,6 @@ func (store *MVCCStore) writeLocks(batch *writeLockBatch) error {
 	case w.wakeUp <- struct{}{}:
 	default:
 	}
-	batch.wg.Wait()
-	return batch.err
 }
 
 type writeDBWorker struct {
@@ -128,6 +170,8 @@ type writeDBWorker struct {
 	wakeUp  chan struct{}
 	closeCh <-chan struct{}
 	store   *MVCCStore
+	// batchCount is the number of batches written, used to tell if the store is idle.
+	batchCount int64
 }
 
 func (w *writeDBWorker) run() {
@@ -143,6 +187,10 @@ func (w *writeDBWorker) run() {
 		w.mu.Lock()
 		batches, w.mu.batches = w.mu.batches, batches
 		w.mu.Unlock()
+		atomic.AddInt64(&w.batchCount, int64(len(batches)))
+		sort.SliceStable(batches, func(i, j int) bool {
+			return batches[i].reqCtx.isHighPriority() && !batches[j].reqCtx.isHighPriority()
+		})
 		batchesGroups := w.splitBatches(batches)
 		for _, batchGroup := range batchesGroups {
 			w.updateBatchGroup(batchGroup)
@@ -150,26 +198,54 @@ func (w *writeDBWorker) run() {
 	}
 }
 
+// maxBatchGroupEntries is the max number of entries of the batches merged into a badger transaction.
+const maxBatchGroupEntries = 4 << 10
+
+// splitBatches splits the batches of different transactions into groups, each is written in a badger transaction to
+// amortize the commit overhead. A batch starts a new group if the group is full or any of its keys is written by the
+// group, so the batches in a group are disjoint and the order of the writes to a key is kept.
 func (w *writeDBWorker) splitBatches(batches []*writeDBBatch) [][]*writeDBBatch {
-	splitOffsets := []int{0}
-	var batchGroupEntries int
+	var batchGroups [][]*writeDBBatch
+	var start, batchGroupEntries int
+	groupKeys := make(map[uint64]struct{})
 	for i, batch := range batches {
+		hashVals := batch.keyHashVals()
+		if i > start && (batchGroupEntries+len(batch.entries) > maxBatchGroupEntries || overlapHashVals(groupKeys, hashVals)) {
+			batchGroups = append(batchGroups, batches[start:i])
+			start, batchGroupEntries = i, 0
+			groupKeys = make(map[uint64]struct{})
+		}
 		batchGroupEntries += len(batch.entries)
-		if batchGroupEntries > 4<<10 || i == len(batches)-1 {
-			batchGroupEntries = 0
-			splitOffsets = append(splitOffsets, i+1)
+		for _, h := range hashVals {
+			groupKeys[h] = struct{}{}
 		}
 	}
-
-	batchGroups := make([][]*writeDBBatch, len(splitOffsets))
-	for i := 1; i < len(splitOffsets); i++ {
-		batchGroups[i] = batches[splitOffsets[i-1]:splitOffsets[i]]
+	if start < len(batches) {
+		batchGroups = append(batchGroups, batches[start:])
 	}
 	return batchGroups
 }
 
+func (batch *writeDBBatch) keyHashVals() []uint64 {
+	keys := make([][]byte, len(batch.entries))
+	for i, entry := range batch.entries {
+		keys[i] = entry.Key
+	}
+	return keysToHashVals(keys...)
+}
+
+func overlapHashVals(set map[uint64]struct{}, hashVals []uint64) bool {
+	for _, h := range hashVals {
+		if _, ok := set[h]; ok {
+			return true
+		}
+	}
+	return false
+}
+
 func (w *writeDBWorker) updateBatchGroup(batchGroup []*writeDBBatch) {
 	begin := time.Now()
+	w.store.stallWrite()
 	var in time.Time
 	err := w.store.db.Update(func(txn *badger.Txn) error {
 		for _, batch := range batchGroup {
@@ -183,6 +259,14 @@ func (w *writeDBWorker) updateBatchGroup(batchGroup []*writeDBBatch) {
 		in = time.Now()
 		return nil
 	})
+	w.store.stallSync()
+	if err != nil && len(batchGroup) > 1 {
+		// The batches of different transactions must not fail together, retry them one by one.
+		for _, batch := range batchGroup {
+			w.updateBatchGroup([]*writeDBBatch{batch})
+		}
+		return
+	}
 	end := time.Now()
 	for _, batch := range batchGroup {
 		batch.reqCtx.traceAt(eventBeginWriteDB, begin)
@@ -218,16 +302,20 @@ func (w *writeLockWorker) run() {
 		w.mu.Lock()
 		batches, w.mu.batches = w.mu.batches, batches
 		w.mu.Unlock()
+		sort.SliceStable(batches, func(i, j int) bool {
+			return batches[i].reqCtx.isHighPriority() && !batches[j].reqCtx.isHighPriority()
+		})
 		begin := time.Now()
 		for _, batch := range batches {
 			batch.reqCtx.traceAt(eventBeginWriteLock, begin)
 		}
+		w.store.stallLockWrite()
 		var delCnt, insertCnt int
 		for _, batch := range batches {
 			for _, entry := range batch.entries {
 				switch entry.UserMeta {
 				case userMetaRollback:
-					w.store.rollbackStore.Insert(entry.Key, []byte{0})
+					w.store.rollbackStore.Insert(entry.Key, entry.Value)
 				case userMetaDelete:
 					delCnt++
 					if !ls.Delete(entry.Key) {
@@ -235,51 +323,127 @@ func (w *writeLockWorker) run() {
 					}
 				case userMetaRollbackGC:
 					rollbackStore.Delete(entry.Key)
+				case userMetaDestroy:
+					ls.Delete(entry.Key)
 				default:
 					insertCnt++
 					if !ls.Insert(entry.Key, entry.Value) {
 						panic("failed to insert key")
 					}
+					w.store.lockObserver.observe(entry.Key, entry.Value)
 				}
 			}
 			batch.wg.Done()
+			if batch.onDone != nil {
+				batch.onDone()
+			}
 		}
 	}
 }
 
-// rollbackGCWorker delete all rollback keys after one minute to recycle memory.
+var (
+	rollbackValUnprotected = []byte{0}
+	rollbackValProtected   = []byte{1}
+)
+
+const (
+	rollbackGCInterval = time.Minute
+	// DefaultRollbackRetention is the default time to keep the unprotected rollback records.
+	DefaultRollbackRetention = time.Minute
+	// DefaultProtectedRollbackRetention is the default time to keep the protected rollback records.
+	DefaultProtectedRollbackRetention = 10 * time.Minute
+)
+
+// rollbackGCWorker deletes the rollback records after the retention to recycle memory, the protected ones are kept
+// longer. If the records in memory exceed RollbackMemLimit, the oldest ones are spilled to badger.
+// If the GC safe point is set, only the records before it are collected, the prewrite before the max collected start
+// ts fails with ErrTxnTooOld, and the transactions before the safe point can't be alive.
 type rollbackGCWorker struct {
 	store *MVCCStore
 }
 
-func (w *rollbackGCWorker) run() {
+func (w *rollbackGCWorker) collect() error {
 	store := w.store
-	defer store.wg.Done()
-	ticker := time.Tick(time.Minute)
-	for {
-		select {
-		case <-store.closeCh:
-			return
-		case <-ticker:
+	var gcKeys, spilledGCKeys [][]byte
+	var kept []rollbackRecord
+	var maxGCTS uint64
+	var stats RollbackStats
+	latestTS := store.getLatestTS()
+	safePoint := store.GCSafePoint()
+	oldestTS := uint64(math.MaxUint64)
+	expired := func(rollbackKey, val []byte) bool {
+		ts := decodeRollbackTS(rollbackKey)
+		retention := store.RollbackRetention
+		if isProtectedRollback(val) {
+			retention = store.ProtectedRollbackRetention
 		}
-		lockBatch := newWriteLockBatch(new(requestCtx))
-		it := store.rollbackStore.NewIterator()
-		latestTS := store.getLatestTS()
-		for it.SeekToFirst(); it.Valid(); it.Next() {
-			ts := decodeRollbackTS(it.Key())
-			if tsSub(latestTS, ts) > time.Minute {
-				lockBatch.rollbackGC(safeCopy(it.Key()))
+		if tsSub(latestTS, ts) > retention && (safePoint == 0 || ts < safePoint) {
+			if ts > maxGCTS {
+				maxGCTS = ts
 			}
+			return true
+		}
+		if ts < oldestTS {
+			oldestTS = ts
+		}
+		return false
+	}
+	it := store.rollbackStore.NewIterator()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if expired(it.Key(), it.Value()) {
+			gcKeys = append(gcKeys, safeCopy(it.Key()))
+			continue
+		}
+		stats.MemCount++
+		stats.MemBytes += int64(len(it.Key()) + len(it.Value()))
+		if store.RollbackMemLimit > 0 {
+			kept = append(kept, rollbackRecord{key: safeCopy(it.Key()), val: safeCopy(it.Value()),
+				ts: decodeRollbackTS(it.Key())})
+		}
+	}
+	err := store.scanSpilledRollbacks(func(key, rollbackKey, val []byte) error {
+		if expired(rollbackKey, val) {
+			spilledGCKeys = append(spilledGCKeys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if oldestTS != math.MaxUint64 {
+		stats.OldestAgeMs = int64(tsSub(latestTS, oldestTS) / time.Millisecond)
+	}
+	if len(gcKeys) > 0 || len(spilledGCKeys) > 0 {
+		// The watermark must be persisted before any rollback key is deleted.
+		if err = store.saveRollbackGCTS(maxGCTS); err != nil {
+			return errors.Trace(err)
+		}
+		if err = store.collectSpilledRollbacks(spilledGCKeys); err != nil {
+			return errors.Trace(err)
+		}
+		lockBatch := newWriteLockBatch(new(requestCtx))
+		for _, key := range gcKeys {
+			lockBatch.rollbackGC(key)
 			if len(lockBatch.entries) >= 1000 {
 				store.writeLocks(lockBatch)
 				lockBatch.entries = lockBatch.entries[:0]
 			}
 		}
-		if len(lockBatch.entries) == 0 {
-			continue
-		}
 		store.writeLocks(lockBatch)
 	}
+	if store.RollbackMemLimit > 0 && stats.MemBytes > store.RollbackMemLimit {
+		n, err := store.spillRollbacks(kept, stats.MemBytes)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		log.Infof("spilled %d rollback records to badger", n)
+	}
+	store.rollbackStats.Store(stats)
+	return nil
+}
+
+func isProtectedRollback(val []byte) bool {
+	return len(val) > 0 && val[0] == rollbackValProtected[0]
 }
 
 type lockEntryHdr struct {
@@ -310,6 +474,7 @@ func (store *MVCCStore) dumpMemLocks() error {
 	if err != nil {
 		return errors.Trace(err)
 	}
+	store.stallSync()
 	err = f.Sync()
 	if err != nil {
 		return errors.Trace(err)
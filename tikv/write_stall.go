@@ -0,0 +1,115 @@
+package tikv
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// The distributions of the delays of WriteStall.
+const (
+	StallFixed       = "fixed"
+	StallUniform     = "uniform"
+	StallExponential = "exponential"
+)
+
+// WriteStall delays the writes to badger to simulate a slow disk, it's used to observe how the write workers, the
+// latches and the clients behave under degraded IO.
+type WriteStall struct {
+	// Distribution is the distribution of the delays, StallFixed by default.
+	Distribution string `json:"distribution"`
+	// WriteDelay is delayed before a badger write and before the lock worker applies its batches. It's the fixed
+	// delay, the max delay of StallUniform and the mean delay of StallExponential.
+	WriteDelay time.Duration `json:"write_delay_ns"`
+	// SyncDelay is delayed after a badger write like a slow fsync, and before the lock store is synced to disk.
+	SyncDelay time.Duration `json:"sync_delay_ns"`
+	// Probability is the chance a write is delayed, 0 means no write is delayed and 1 means every write is.
+	Probability float64 `json:"probability"`
+}
+
+// WriteStallStats is the delays injected by the WriteStall.
+type WriteStallStats struct {
+	WriteStall
+	StalledWrites     int64 `json:"stalled_writes"`
+	StalledLockWrites int64 `json:"stalled_lock_writes"`
+	StalledSyncs      int64 `json:"stalled_syncs"`
+	StalledMs         int64 `json:"stalled_ms"`
+}
+
+type writeStallState struct {
+	config            atomic.Value
+	stalledWrites     int64
+	stalledLockWrites int64
+	stalledSyncs      int64
+	stalledNanos      int64
+}
+
+// SetWriteStall replaces the WriteStall of the store, a zero WriteStall disables the stall.
+func (store *MVCCStore) SetWriteStall(stall WriteStall) error {
+	switch stall.Distribution {
+	case "":
+		stall.Distribution = StallFixed
+	case StallFixed, StallUniform, StallExponential:
+	default:
+		return errors.Errorf("unknown write stall distribution %q", stall.Distribution)
+	}
+	if stall.WriteDelay < 0 || stall.SyncDelay < 0 || stall.Probability < 0 || stall.Probability > 1 {
+		return errors.New("invalid write stall")
+	}
+	store.writeStall.config.Store(stall)
+	return nil
+}
+
+// WriteStallStats returns the current WriteStall and the delays injected.
+func (store *MVCCStore) WriteStallStats() WriteStallStats {
+	s := &store.writeStall
+	stats := WriteStallStats{
+		StalledWrites:     atomic.LoadInt64(&s.stalledWrites),
+		StalledLockWrites: atomic.LoadInt64(&s.stalledLockWrites),
+		StalledSyncs:      atomic.LoadInt64(&s.stalledSyncs),
+		StalledMs:         atomic.LoadInt64(&s.stalledNanos) / int64(time.Millisecond),
+	}
+	stats.WriteStall, _ = s.config.Load().(WriteStall)
+	return stats
+}
+
+// stallWrite is called before a badger write.
+func (store *MVCCStore) stallWrite() {
+	stall, _ := store.writeStall.config.Load().(WriteStall)
+	if store.writeStall.sleep(stall, stall.WriteDelay) {
+		atomic.AddInt64(&store.writeStall.stalledWrites, 1)
+	}
+}
+
+// stallLockWrite is called before the lock worker applies its batches.
+func (store *MVCCStore) stallLockWrite() {
+	stall, _ := store.writeStall.config.Load().(WriteStall)
+	if store.writeStall.sleep(stall, stall.WriteDelay) {
+		atomic.AddInt64(&store.writeStall.stalledLockWrites, 1)
+	}
+}
+
+// stallSync is called after a badger write or before a file sync.
+func (store *MVCCStore) stallSync() {
+	stall, _ := store.writeStall.config.Load().(WriteStall)
+	if store.writeStall.sleep(stall, stall.SyncDelay) {
+		atomic.AddInt64(&store.writeStall.stalledSyncs, 1)
+	}
+}
+
+func (s *writeStallState) sleep(stall WriteStall, delay time.Duration) bool {
+	if delay <= 0 || rand.Float64() >= stall.Probability {
+		return false
+	}
+	switch stall.Distribution {
+	case StallUniform:
+		delay = time.Duration(rand.Int63n(int64(delay) + 1))
+	case StallExponential:
+		delay = time.Duration(rand.ExpFloat64() * float64(delay))
+	}
+	<-clock.After(delay)
+	atomic.AddInt64(&s.stalledNanos, int64(delay))
+	return true
+}
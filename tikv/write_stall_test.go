@@ -0,0 +1,41 @@
+package tikv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteStall(t *testing.T) {
+	store := &MVCCStore{}
+	require.Error(t, store.SetWriteStall(WriteStall{Distribution: "normal"}))
+	require.Error(t, store.SetWriteStall(WriteStall{Probability: 2}))
+	require.Error(t, store.SetWriteStall(WriteStall{SyncDelay: -time.Millisecond}))
+
+	// A zero probability delays no write.
+	require.NoError(t, store.SetWriteStall(WriteStall{WriteDelay: time.Millisecond}))
+	store.stallWrite()
+	store.stallLockWrite()
+	stats := store.WriteStallStats()
+	require.Equal(t, StallFixed, stats.Distribution)
+	require.Zero(t, stats.StalledWrites)
+	require.Zero(t, stats.StalledLockWrites)
+
+	// The write delay also delays the lock worker.
+	require.NoError(t, store.SetWriteStall(WriteStall{WriteDelay: time.Millisecond, Probability: 1}))
+	store.stallWrite()
+	store.stallLockWrite()
+	store.stallSync()
+	stats = store.WriteStallStats()
+	require.Equal(t, int64(1), stats.StalledWrites)
+	require.Equal(t, int64(1), stats.StalledLockWrites)
+	require.Zero(t, stats.StalledSyncs)
+
+	require.NoError(t, store.SetWriteStall(WriteStall{Distribution: StallUniform, SyncDelay: time.Millisecond, Probability: 1}))
+	store.stallWrite()
+	store.stallSync()
+	stats = store.WriteStallStats()
+	require.Equal(t, int64(1), stats.StalledWrites)
+	require.Equal(t, int64(1), stats.StalledSyncs)
+}